@@ -2,27 +2,58 @@
 package accounts
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"path"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/go-etcd/etcd"
+
+	"github.com/mimoto-xxxxxx/dockerns/metrics"
+)
+
+// reloads はルーティング情報の再作成を行った回数を、きっかけとなった変更の種類ごとに数える。
+var reloads = metrics.Default.Counter(
+	"dockerns_reloads_total",
+	"Number of routing table reloads by trigger.",
+	"trigger",
+)
+
+// accountReloads は変更のあったアカウントのみルーティング情報を再作成した回数。
+var accountReloads = metrics.Default.Counter(
+	"dockerns_account_reloads_total",
+	"Number of incremental reloads of a single account.",
+)
+
+// containerNotFound は存在しないコンテナを接続先とするルーティング情報を見つけた回数。
+// デプロイ順序の誤りなどで接続先のコンテナが起動していない状態を監視するために使用する。
+var containerNotFound = metrics.Default.Counter(
+	"dockerns_route_container_not_found_total",
+	"Number of times a route referenced a container that does not exist.",
+	"account", "container",
 )
 
 // Container は docker のコンテナを表す。コンテナ名にはリンクされた時の名前ではなく必ず独立した名前が割り当てられる。
 type Container struct {
-	Name      string //コンテナ名。
-	IPAddress string //"172.17.0.2" のような形式。
+	ID          string            //コンテナの ID。
+	Name        string            //コンテナ名。
+	IPAddress   string            //"172.17.0.2" のような形式。
+	IPv6Address string            //"2001:db8::2" のような形式。IPv6 が無効な場合は空。
+	Labels      map[string]string //コンテナに設定されたラベル。
 }
 
 // String はコンテナ情報を人間が読みやすい文字列として出力する。
@@ -32,18 +63,198 @@ func (c *Container) String() string {
 
 // Route はコンテナへのルーティング情報を表す。
 // Name にはルーティングに対する任意の名称を保存することができる。
-// Regexp に割り当てられた正規表現にホスト名が一致する場合はホスト名が Host に差し替えられる。
+// Matcher にホスト名が一致する場合はホスト名が Host に差し替えられる。
+// Host が 172.17.0.2:8080 のようにポート番号付きの場合は、接続先のポート番号もそれに差し替えられる(SplitTarget を参照)。
+// Regexp は Matcher が正規表現の場合のその正規表現で、それ以外の場合は nil になる。Matcher が nil の場合は Regexp が使用される。
 // Priority の値が大きいデータほど正規表現が優先的に評価される。
+// ALPN と Port は DNS サーバーが SVCB/HTTPS レコードで通知する接続ヒントで、空の場合は通知しない。
+// StripPrefix と AddPrefix はリバースプロキシーで転送する際にパスから取り除く／付け加える接頭辞。
+// Backup を指定した場合は Host をヘルスチェックの対象とし、HealthPort への接続に失敗している間だけ Backup へ接続する。
+// HealthCheck はヘルスチェックの方法で、HealthCheckTCP か HealthCheckHTTP を指定すると Backup が無くても接続先をヘルスチェックの対象とする。
+// HealthPath は HealthCheckHTTP で要求するパスで、空の場合は "/" を使用する。
+// Subnets は DNS サーバーがクライアントのアドレスに応じて Host の代わりに返す接続先の一覧で、最初に一致したものが使用される。
+// TTL は DNS サーバーがこのルーティング情報から作成する応答に設定する TTL(秒)で、0 の場合は DNS サーバー全体の設定を使用する。
+// Container は Host が "foobar.container" の形式やラベルで指定されたコンテナのアドレスの場合、そのコンテナの名前。
+// MaxConns はプロキシーでこの接続先へ同時に中継する接続数の上限で、どのアカウントからの接続かを問わずに数える。0 の場合は制限しない。
+// HTTP リクエストの転送では接続先への接続を再利用するため、リクエストではなく接続先との接続の数を数える。
+// Scheme は HTTP プロキシーでこの接続先へ中継できる方式で、"https" の場合は CONNECT のみ、"http" の場合は CONNECT 以外のリクエストのみを許可する。
+// 空の場合は制限しない(AllowsScheme を参照)。
+// Hosts はプライオリティと正規表現が同じ複数の接続先を一つにまとめた場合の全ての接続先で、Host はその最初の要素になる。
+// 接続先が一つの場合は nil で、Target は Host を返す。複数の場合は呼び出しの度に順に一つずつ返す(ラウンドロビン)。
+// Weight は複数の接続先をまとめた場合にこの接続先を選ぶ割合の重みで、0 の場合は選ばれない。
+// 接続先が一つの場合も 0 であれば選ばれず、Target は空文字列を返す。
+// Weights はまとめた場合の Hosts のそれぞれの重みで、Target は重みに比例した回数ずつ偏りなく混ぜて返す(smooth weighted round-robin)。
+//
+// Regexp は同じパターンを持つ他の Route (他のアカウントのものを含む) と共有されることがあるが、
+// 一致回数などの可変な状態は Route ごとに保持される。この状態は再構築の際に同じアカウント、プライオリティ、
+// パターン、接続先を持つ新しい Route へ引き継がれる(inheritStats を参照)。
 type Route struct {
-	Name     string
-	Priority int
-	Host     string
-	Regexp   *regexp.Regexp
+	Name        string
+	Priority    int
+	Host        string
+	Hosts       []string
+	Weight      int
+	Weights     []int
+	Matcher     Matcher
+	Regexp      *regexp.Regexp
+	ALPN        []string
+	Port        uint16
+	StripPrefix string
+	AddPrefix   string
+	Backup      string
+	HealthPort  uint16
+	HealthCheck string
+	HealthPath  string
+	MaxConns    int
+	Scheme      string
+	Subnets     []SubnetTarget
+	TTL         uint32
+	Container   string
+	stats       *routeStats
+	next        uint32
+	schedule    []int
+	health      *health
+}
+
+// Matches はこのルーティング情報がホスト名に一致した回数を返す。
+func (r *Route) Matches() uint64 {
+	if r.stats == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&r.stats.matches)
+}
+
+// LastMatch はこのルーティング情報が最後にホスト名に一致した時刻を返す。一度も一致していない場合はゼロ値を返す。
+func (r *Route) LastMatch() time.Time {
+	if r.stats == nil {
+		return time.Time{}
+	}
+	n := atomic.LoadInt64(&r.stats.lastMatch)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// AllowsScheme は HTTP プロキシーでこの接続先へ scheme の方式で中継できれば true を返す。
+// scheme には CONNECT の場合は "https" を、それ以外のリクエストの場合は "http" を渡す。
+func (r *Route) AllowsScheme(scheme string) bool {
+	return r.Scheme == "" || r.Scheme == scheme
+}
+
+// setOption は etcd 上で接続先の下に "_" から始まるキーとして保存されたオプションを r に設定する。
+// key には先頭の "_" を除いた名前を渡す。
+func (r *Route) setOption(key, value string) error {
+	switch key {
+	case "alpn":
+		r.ALPN = nil
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				r.ALPN = append(r.ALPN, v)
+			}
+		}
+	case "port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port value: %v", err)
+		}
+		r.Port = uint16(port)
+	case "backup":
+		r.Backup = value
+	case "health_port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid health_port value: %v", err)
+		}
+		r.HealthPort = uint16(port)
+	case "weight":
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 0 || weight > maxWeight {
+			return fmt.Errorf("invalid weight value: %q", value)
+		}
+		r.Weight = weight
+	case "scheme":
+		switch value {
+		case "http", "https", "":
+			r.Scheme = value
+		default:
+			return fmt.Errorf("invalid scheme value: %q", value)
+		}
+	case "health_check":
+		switch value {
+		case HealthCheckTCP, HealthCheckHTTP, "":
+			r.HealthCheck = value
+		default:
+			return fmt.Errorf("invalid health_check value: %q", value)
+		}
+	case "health_path":
+		if !strings.HasPrefix(value, "/") {
+			return fmt.Errorf("invalid health_path value: %q", value)
+		}
+		r.HealthPath = value
+		if r.HealthCheck == "" {
+			r.HealthCheck = HealthCheckHTTP
+		}
+	case "subnets":
+		r.Subnets = nil
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			kv := strings.SplitN(v, "=", 2)
+			if len(kv) != 2 || kv[1] == "" {
+				return fmt.Errorf("invalid subnets value: %q", v)
+			}
+			_, n, err := net.ParseCIDR(kv[0])
+			if err != nil {
+				return fmt.Errorf("invalid subnets value: %v", err)
+			}
+			r.Subnets = append(r.Subnets, SubnetTarget{Net: n, Host: kv[1]})
+		}
+	case "max_conns":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid max_conns value: %q", value)
+		}
+		r.MaxConns = n
+	case "ttl":
+		ttl, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return fmt.Errorf("invalid ttl value: %v", err)
+		}
+		r.TTL = uint32(ttl)
+	case "strip_prefix":
+		r.StripPrefix = "/" + strings.Trim(value, "/")
+	case "add_prefix":
+		r.AddPrefix = "/" + strings.Trim(value, "/")
+	default:
+		return fmt.Errorf("unknown option: _%s", key)
+	}
+	return nil
+}
+
+// SubnetTarget はクライアントのアドレスが Net に含まれる場合に使用する接続先 Host。
+type SubnetTarget struct {
+	Net  *net.IPNet
+	Host string
+}
+
+// TargetFor はクライアントのアドレス ip に応じた接続先を返す。
+// Subnets に ip を含むものがなければ Target と同じ値を返す。
+func (r *Route) TargetFor(ip net.IP) string {
+	if ip != nil {
+		for _, s := range r.Subnets {
+			if s.Net.Contains(ip) {
+				return s.Host
+			}
+		}
+	}
+	return r.Target()
 }
 
 // String はルーティング設定を人間が読みやすい文字列として出力する。
 func (r *Route) String() string {
-	return fmt.Sprintf("%v pr:%d -> %v", r.Regexp, r.Priority, r.Host)
+	return fmt.Sprintf("%v pr:%d -> %v", r.Pattern(), r.Priority, r.Host)
 }
 
 // Routes は優先順位に応じて並び替えされた状態の Route の配列。
@@ -65,57 +276,346 @@ func (r Routes) Swap(i, j int) {
 	r[i], r[j] = r[j], r[i]
 }
 
-// ReplaceHost は host を該当するルーティング情報があれば差し替える。
-// host に example.com:8080 のようなポート番号付きのものを渡した場合は分解した上で検索される。
-func (r Routes) ReplaceHost(host string) string {
-	parts := strings.SplitN(host, ":", 2)
-	hostname := parts[0]
-	hasPort := len(parts) == 2 && parts[1] != ""
+// Find は hostname に一致するルーティング情報を優先順位に従って検索する。
+// 該当するものが存在しない場合は nil を返す。
+func (r Routes) Find(hostname string) *Route {
 	for _, route := range r {
-		if route.Regexp.MatchString(hostname) {
-			if hasPort {
-				return route.Host + ":" + parts[1]
+		if route.matcher().Match(hostname) {
+			if route.stats != nil {
+				route.stats.record()
 			}
-			return route.Host
+			return route
 		}
 	}
-	return host
+	return nil
+}
+
+// Match は host に一致するルーティング情報と、それに従って差し替えた後のホストを返す。
+// 該当するルーティング情報が存在しない場合は nil と host をそのまま返す。
+// host に example.com:8080 のようなポート番号付きのものを渡した場合は分解した上で検索される。
+func (r Routes) Match(host string) (*Route, string) {
+	return r.match(host, false)
+}
+
+// match は Match と同様にルーティング情報を検索する。
+// withPort が true の場合はポート番号を取り除かずに example.com:8080 のまま正規表現と照合する。
+// いずれの場合も差し替えた後のホストには host のポート番号が引き継がれる。
+// ただし接続先が 172.17.0.2:8080 のようにポート番号付きの場合は、host のポート番号に関わらずそのポート番号を使用する。
+func (r Routes) match(host string, withPort bool) (*Route, string) {
+	parts := strings.SplitN(host, ":", 2)
+	hasPort := len(parts) == 2 && parts[1] != ""
+	key := parts[0]
+	if withPort {
+		key = host
+	}
+	route := r.Find(key)
+	if route == nil {
+		return nil, host
+	}
+	target := route.Target()
+	if target == "" {
+		// 全ての接続先がヘルスチェックに失敗している場合は差し替えない。
+		return route, host
+	}
+	if h, port := SplitTarget(target); port != "" {
+		// 接続先にポート番号が指定されている場合は host のポート番号の代わりにそれを使用する。
+		return route, net.JoinHostPort(h, port)
+	}
+	if hasPort {
+		return route, net.JoinHostPort(target, parts[1])
+	}
+	if strings.Contains(target, ":") {
+		// IPv6 アドレスは URL のホスト部分としてそのまま使えるよう括弧で囲む。
+		return route, "[" + target + "]"
+	}
+	return route, target
+}
+
+// SplitTarget は接続先 target を 172.17.0.2:8080 のようにポート番号付きで指定されている場合にホストとポート番号に分ける。
+// ポート番号が無い場合は target と空文字列を返す。"::1" のような括弧の無い IPv6 アドレスはポート番号の無いものとして扱う。
+func SplitTarget(target string) (host, port string) {
+	if h, p, err := net.SplitHostPort(target); err == nil {
+		return h, p
+	}
+	return target, ""
+}
+
+// ReplaceHost は host を該当するルーティング情報があれば差し替える。
+// host に example.com:8080 のようなポート番号付きのものを渡した場合は分解した上で検索される。
+func (r Routes) ReplaceHost(host string) string {
+	_, newHost := r.Match(host)
+	return newHost
 }
 
 // Account は案件ごとの設定を格納した構造体。
 // Routes は Priority の降順で並び替えられた状態で格納されている。
+// MaxHeaderBytes と MaxHeaders は HTTP プロキシーで許容するヘッダーの合計サイズと個数で、0 の場合はサーバーの設定に従う。
+// RateLimit と RateBurst は HTTP プロキシーでの 1 秒あたりのリクエスト数と連続して受け付けるリクエスト数の上限で、0 の場合はサーバーの設定に従う。
+// Password はプロキシーでこのアカウントを使用する際のパスワードで、空の場合はサーバー全体のパスワードを使用する(CheckPassword を参照)。
+// MatchPort が true の場合、プロキシーではポート番号を取り除かずに example.com:8080 のような接続先全体を正規表現と照合する。
+// containerRefs は etcd 上で "foobar.container" の形式で参照されているコンテナ名で、Docker のイベントで再構築するアカウントを決めるために使用する。
+// containerAddrs はルーティング情報の接続先になっているコンテナのアドレスからコンテナ名を引く逆引き用の対応表(LookupAddr を参照)。
 type Account struct {
-	Name   string
-	Routes Routes
+	Name           string
+	Routes         Routes
+	MaxHeaderBytes int
+	MaxHeaders     int
+	RateLimit      float64
+	RateBurst      int
+	Password       Secret
+	MatchPort      bool
+	containerRefs  map[string]bool
+	containerAddrs map[string]string
+}
+
+// Secret はログなどに出力する際に値を伏せる文字列。
+type Secret string
+
+// String は値が設定されている場合は伏せた文字列を返す。
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "********"
+}
+
+// CheckPassword は password がアカウントのパスワードと一致するかを返す。
+// アカウントにパスワードが設定されていない場合は fallback と比較し、fallback も空の場合は常に true を返す。
+func (a *Account) CheckPassword(password, fallback string) bool {
+	want := a.EffectivePassword(fallback)
+	return want == "" || subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
+
+// EffectivePassword はプロキシーでこのアカウントを使用する際のパスワードを返す。
+// アカウントにパスワードが設定されていない場合は fallback を返す。空の場合はパスワードを確認しないことを表す。
+// Digest 認証のように、パスワードそのものを比較せずに確認する場合に使用する。
+func (a *Account) EffectivePassword(fallback string) string {
+	if a.Password != "" {
+		return string(a.Password)
+	}
+	return fallback
+}
+
+// containerOf は接続先 host が "foobar.container" の形式であれば、containers からそのコンテナを返す。
+// コンテナが見つからない場合や、それ以外の形式の場合は nil を返す。
+func containerOf(host string, containers map[string]*Container) *Container {
+	const SUFFIX = ".container"
+	host, _ = SplitTarget(host)
+	if len(host) <= len(SUFFIX) || !strings.HasSuffix(host, SUFFIX) {
+		return nil
+	}
+	return containers[host[:len(host)-len(SUFFIX)]]
+}
+
+// refer は接続先 host が "foobar.container" の形式であれば、参照しているコンテナ名として記録する。
+func (a *Account) refer(host string) {
+	const SUFFIX = ".container"
+	host, _ = SplitTarget(host)
+	if len(host) <= len(SUFFIX) || !strings.HasSuffix(host, SUFFIX) {
+		return
+	}
+	if a.containerRefs == nil {
+		a.containerRefs = make(map[string]bool)
+	}
+	a.containerRefs[host[:len(host)-len(SUFFIX)]] = true
+}
+
+// indexAddrs は Routes の接続先になっているコンテナのアドレスからコンテナ名を引けるよう containerAddrs を作り直す。
+// 同じアドレスに複数のコンテナ名が対応する場合は Routes の順で先に現れたものを使用する。
+func (a *Account) indexAddrs() {
+	a.containerAddrs = nil
+	for _, route := range a.Routes {
+		host, _ := SplitTarget(route.Host)
+		ip := net.ParseIP(host)
+		if route.Container == "" || ip == nil {
+			continue
+		}
+		if a.containerAddrs == nil {
+			a.containerAddrs = make(map[string]string)
+		}
+		if _, ok := a.containerAddrs[ip.String()]; !ok {
+			a.containerAddrs[ip.String()] = route.Container
+		}
+	}
+}
+
+// LookupAddr はルーティング情報の接続先になっているコンテナのうち、アドレスが ip のもののコンテナ名を返す。
+func (a *Account) LookupAddr(ip net.IP) (string, bool) {
+	name, ok := a.containerAddrs[ip.String()]
+	return name, ok
+}
+
+// Match は host に一致するルーティング情報と、それに従って差し替えた後のホストを返す。
+// MatchPort に従ってポート番号を含めるかどうかを切り替える以外は Routes.Match と同じ。
+func (a *Account) Match(host string) (*Route, string) {
+	return a.Routes.match(host, a.MatchPort)
+}
+
+// setOption は etcd 上でアカウントの下に "_" から始まるキーとして保存されたオプションを a に設定する。
+// key には先頭の "_" を除いた名前を渡す。
+func (a *Account) setOption(key, value string) error {
+	switch key {
+	case "max_header_bytes", "max_headers":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid %s value: %q", key, value)
+		}
+		if key == "max_header_bytes" {
+			a.MaxHeaderBytes = n
+		} else {
+			a.MaxHeaders = n
+		}
+	case "rate_limit":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+			return fmt.Errorf("invalid %s value: %q", key, value)
+		}
+		a.RateLimit = f
+	case "rate_burst":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid %s value: %q", key, value)
+		}
+		a.RateBurst = n
+	case "password":
+		a.Password = Secret(value)
+	case "match_port":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s value: %q", key, value)
+		}
+		a.MatchPort = b
+	default:
+		return fmt.Errorf("unknown option: _%s", key)
+	}
+	return nil
 }
 
 // Accounts はアカウント情報の集合。
 // accounts の string には Account.Name と同じ物を使用する。
+// LabelSelector を指定した場合は、それに一致するコンテナのラベルのみをルーティング情報の作成に使用する。
+// AddressFamily はコンテナへ接続する際に IPv4 と IPv6 のどちらのアドレスを使用するかを指定する。
+// AllowedAccounts を指定した場合は、etcd 上に存在していてもそこに含まれないアカウントは Get で取得できない。
+// AllowedTargets はルーティング情報の接続先として許可するアドレスの範囲で、空の場合は制限しない。
+// 接続先がホスト名の場合は Reload の時点で名前解決したアドレスで判断し、範囲外の接続先へのルーティング情報はメッセージを出力して除外する。
+// NoMatchLogInterval はプロキシーや DNS サーバーでルーティング情報に一致しなかったホスト名をログに出力する最小間隔で、
+// 0 の場合は出力しない(RecordNoMatch を参照)。
+// DockerNetwork を指定した場合はコンテナのアドレスとしてその名前の Docker ネットワーク上のアドレスを使用する。
+// 指定しない場合はデフォルトのブリッジネットワーク、無ければユーザー定義ネットワークのアドレスを使用する。
+// EtcdTLS を指定した場合は etcd へ TLS で接続する。
+// EtcdUsername と EtcdPassword を指定した場合は etcd へのアクセスにその認証情報を使用する。
+// EtcdAPIVersion は etcd へのアクセスに使用する API のバージョンで、2 (既定値) か 3 を指定する。
+// 3 の場合も "/proxy/アカウント名/接続先/0.正規表現の名前" のキーの階層構造は v2 と同様に扱われる。
+// MaxContainerAliases は一つのコンテナに対して登録するリンク時の名前の上限で、0 の場合は制限しない。
+// DockerConcurrency は Reload でコンテナの詳細を同時に問い合わせる数の上限で、0 以下の場合は 1 として扱う。
+// DockerEventsTimeout は Watch で Docker Remote API のイベントストリームを開く際に、応答のヘッダーを受け取るまで待つ最大時間で、
+// 0 の場合は無制限に待つ。ヘッダーを受け取った後のストリームの読み取りには適用されない。
+// EtcdAddr が空の場合は etcd を使用せず、StaticRoutes と Docker のラベルのみからルーティング情報を作成する。
+// StaticRoutes は etcd 上のルーティング情報に加える静的なルーティング情報(StaticRouteEnvPrefix を参照)。
+// VerboseAccounts に含まれるアカウントについては、Verbose が false でもプロキシーや DNS サーバーで詳細なログを出力する(VerboseFor を参照)。
+// ResyncInterval は Watch でイベントの有無に関わらずルーティング情報全体を再構築する間隔で、0 の場合は行わない。
+// MaxRoutingBytes はルーティング情報が使用するメモリの推定値の上限で、0 の場合は制限しない。
+// 上限を超えてルーティング情報が大きくなる場合は Reload でエラーを返し、それまでのルーティング情報を使い続ける。
+// HealthCheckInterval と HealthCheckTimeout は CheckHealth でヘルスチェックを行う間隔と一回の確認を待つ最大時間で、
+// HealthCheckInterval が 0 の場合はヘルスチェックを行わない。
 type Accounts struct {
-	accounts   map[string]Account
-	m          sync.Mutex
-	DockerAddr string
-	EtcdAddr   string
-	EtcdRoot   string
-	Verbose    bool
+	accounts            map[string]Account
+	m                   sync.Mutex
+	reload              sync.Mutex
+	DockerAddr          string
+	DockerNetwork       string
+	EtcdAddr            string
+	EtcdRoot            string
+	EtcdTLS             TLSFiles
+	EtcdUsername        string
+	EtcdPassword        string
+	EtcdAPIVersion      int
+	StaticRoutes        []string
+	LabelSelector       Selector
+	AddressFamily       AddressFamily
+	AllowedAccounts     []string
+	AllowedTargets      []*net.IPNet
+	MaxRoutingBytes     int64
+	ResyncInterval      time.Duration
+	MaxContainerAliases int
+	DockerConcurrency   int
+	DockerEventsTimeout time.Duration
+	NoMatchLogInterval  time.Duration
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	Verbose             bool
+	VerboseAccounts     []string
+	containers          map[string]*Container
+	size                int64
+	lastReload          time.Time
+	lastSuccess         time.Time
+	reloadErr           error
+	etcdWatching        bool
+	dockerWatching      bool
+	etcdIndex           uint64
+	health              *health
+	stats               map[routeStatsKey]*routeStats
+	noMatchLog          noMatchLog
 }
 
 // New は Accounts のインスタンスを新規作成する。
 func New(dockerAddr, etcdAddr, etcdRoot string) *Accounts {
 	return &Accounts{
-		DockerAddr: dockerAddr,
-		EtcdAddr:   etcdAddr,
-		EtcdRoot:   etcdRoot,
-		accounts:   make(map[string]Account),
+		DockerAddr:          dockerAddr,
+		EtcdAddr:            etcdAddr,
+		EtcdRoot:            etcdRoot,
+		EtcdAPIVersion:      2,
+		AddressFamily:       PreferIPv4,
+		DockerConcurrency:   8,
+		DockerEventsTimeout: 10 * time.Second,
+		HealthCheckInterval: 10 * time.Second,
+		HealthCheckTimeout:  2 * time.Second,
+		accounts:            make(map[string]Account),
+		health:              newHealth(),
+	}
+}
+
+// unixClients は UNIX ドメインソケットのパスごとの http.Client。
+// 一度の Reload で多数のコンテナの詳細を問い合わせるため、接続を使い回せるようソケットごとに共有する。
+var unixClients = struct {
+	sync.Mutex
+	m map[string]*http.Client
+}{m: make(map[string]*http.Client)}
+
+// unixClient は UNIX ドメインソケット socket へ接続する http.Client を返す。
+func unixClient(socket string) *http.Client {
+	unixClients.Lock()
+	defer unixClients.Unlock()
+	c, ok := unixClients.m[socket]
+	if !ok {
+		var d net.Dialer
+		c = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		}
+		unixClients.m[socket] = c
 	}
+	return c
 }
 
 // httpGet は s の接頭辞が "unix:" の場合は UNIX ドメインソケットで HTTP リクエストを、
 // そうでなければ http.Get(url) の結果を返す。
 // UNIX ドメインソケットでのリクエストの場合は unix:///path/to/unix.sock:/request/path?param=value のような形式で渡す。
 func httpGet(s string) (*http.Response, error) {
+	return httpGetContext(context.Background(), s)
+}
+
+// httpGetContext は ctx が終了した場合にリクエストを中断する httpGet。
+func httpGetContext(ctx context.Context, s string) (*http.Response, error) {
 	if len(s) < 5 || (s[:5] != "unix:") {
-		return http.Get(s)
+		req, err := http.NewRequestWithContext(ctx, "GET", s, nil)
+		if err != nil {
+			return nil, err
+		}
+		return http.DefaultClient.Do(req)
 	}
 
 	u, err := url.Parse(s)
@@ -126,22 +626,17 @@ func httpGet(s string) (*http.Response, error) {
 	if len(parts) < 2 {
 		return nil, fmt.Errorf("invalid UNIX domain socket url format: %s", s)
 	}
-	host, path := parts[0], parts[1]
+	socket, path := parts[0], parts[1]
 
 	if u.RawQuery != "" {
 		path += "?" + u.RawQuery
 	}
-	req, err := http.NewRequest("GET", path, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	conn, err := net.Dial("unix", host)
+	// ホスト名は接続先の決定には使われないが、Host ヘッダーとして送られる。
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://docker"+path, nil)
 	if err != nil {
 		return nil, err
 	}
-
-	return httputil.NewClientConn(conn, nil).Do(req)
+	return unixClient(socket).Do(req)
 }
 
 // httpGetJson は url で指定されたリソースを取得し、それが JSON であると仮定した上で v へ展開する。
@@ -151,7 +646,11 @@ func httpGetJson(url string, v interface{}) error {
 		return err
 	}
 
-	defer res.Body.Close()
+	// 接続を使い回せるよう、JSON の後に残ったデータも読み捨ててから閉じる。
+	defer func() {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
 
 	if err = json.NewDecoder(res.Body).Decode(v); err != nil {
 		return err
@@ -160,7 +659,10 @@ func httpGetJson(url string, v interface{}) error {
 	return nil
 }
 
-func getContainers(dockerAddr string) (map[string]*Container, error) {
+// getContainers は Docker Remote API からコンテナの一覧を取得し、名前からコンテナを引ける形で返す。
+// network と maxAliases については inspectContainer と Accounts.MaxContainerAliases を参照。
+// 個々のコンテナの詳細は最大 concurrency 個まで並行して問い合わせ、問い合わせに失敗したコンテナはログに出力して除外する。
+func getContainers(dockerAddr, network string, maxAliases, concurrency int) (map[string]*Container, error) {
 	containers := make(map[string]*Container)
 
 	// docker のコンテナ一覧を取得し、名前と IP の対応付けを行う。
@@ -173,36 +675,222 @@ func getContainers(dockerAddr string) (map[string]*Container, error) {
 		return nil, err
 	}
 
-	for _, containerItem := range containerList {
-		// Name と IPAddress の値を得るため個々の詳細を問い合わせる。
-		var container struct {
-			Name            string `json:"Name"`
-			NetworkSettings struct {
-				IPAddress string `json:"IPAddress"`
-			} `json:"NetworkSettings"`
-		}
-		err = httpGetJson(dockerAddr+"/containers/"+containerItem.ID+"/json", &container)
-		if err != nil {
-			return nil, err
+	// 結果はコンテナ一覧と同じ位置に格納し、名前の登録は全ての問い合わせが終わってから一覧の順に行う。
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	details := make([]*Container, len(containerList))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, containerItem := range containerList {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			c, err := inspectContainer(dockerAddr, network, id)
+			if err != nil {
+				log.Println("failed to inspect container:", id, "Error:", err)
+				return
+			}
+			details[i] = c
+		}(i, containerItem.ID)
+	}
+	wg.Wait()
+
+	for i, containerItem := range containerList {
+		c := details[i]
+		if c == nil {
+			continue
 		}
 
 		// 名前は /hoge/mysql のようなリンク時の名前と
 		// そのコンテナ本来の / が含まれていない名前の両方を登録しておく。
-		c := &Container{
-			IPAddress: container.NetworkSettings.IPAddress,
-			Name:      container.Name[1:],
-		}
+		// リンクを多用している場合は同じ名前が重複していたり大量の別名を持っていることがあるため、
+		// 重複を除いた上で maxAliases 個までに制限する。本来の名前は常に登録する。
 		containers[c.Name] = c
+		seen := map[string]bool{c.Name: true, "/" + c.Name: true}
+		aliases, dropped := 0, 0
 		for _, n := range containerItem.Names {
+			if seen[n] {
+				continue
+			}
+			seen[n] = true
+			if maxAliases > 0 && aliases >= maxAliases {
+				dropped++
+				continue
+			}
 			containers[n] = c
+			aliases++
+		}
+		if dropped > 0 {
+			log.Println(
+				"too many container aliases, truncated:", c.Name,
+				"Dropped:", dropped,
+				"Limit:", maxAliases,
+			)
 		}
 	}
 
 	return containers, nil
 }
 
+// containerAddress は Docker Remote API が返すコンテナのネットワーク上のアドレス。
+type containerAddress struct {
+	IPAddress         string `json:"IPAddress"`
+	GlobalIPv6Address string `json:"GlobalIPv6Address"`
+}
+
+// inspectContainer は ID もしくは名前が id のコンテナの詳細を問い合わせる。
+// コンテナが存在しない場合は nil を返す。
+// network を指定した場合はそのネットワーク上のアドレスを使用し、接続されていなければアドレスは空になる。
+// 指定しない場合はデフォルトのブリッジネットワークのアドレスを使用し、それが無ければ
+// ユーザー定義ネットワークのうち名前順で最初にアドレスを持つもののアドレスを使用する。
+func inspectContainer(dockerAddr, network, id string) (*Container, error) {
+	// Name と IPAddress の値を得るため個々の詳細を問い合わせる。
+	var container struct {
+		ID     string `json:"Id"`
+		Name   string `json:"Name"`
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+		NetworkSettings struct {
+			containerAddress
+			Networks map[string]containerAddress `json:"Networks"`
+		} `json:"NetworkSettings"`
+	}
+	err := httpGetJson(dockerAddr+"/containers/"+id+"/json", &container)
+	if err != nil {
+		return nil, err
+	}
+	// 存在しない場合は {"message": "..."} が返されるため Name が空になる。
+	if container.Name == "" {
+		return nil, nil
+	}
+
+	addr := container.NetworkSettings.containerAddress
+	if network != "" {
+		addr = container.NetworkSettings.Networks[network]
+	} else if addr.IPAddress == "" && addr.GlobalIPv6Address == "" {
+		names := make([]string, 0, len(container.NetworkSettings.Networks))
+		for name := range container.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if a := container.NetworkSettings.Networks[name]; a.IPAddress != "" || a.GlobalIPv6Address != "" {
+				addr = a
+				break
+			}
+		}
+	}
+
+	c := &Container{
+		ID:          container.ID,
+		IPAddress:   addr.IPAddress,
+		IPv6Address: addr.GlobalIPv6Address,
+		Name:        container.Name[1:],
+		Labels:      container.Config.Labels,
+	}
+	if addr, ok := c.Labels[AddressLabel]; ok {
+		if ip := net.ParseIP(addr); ip == nil {
+			log.Println("invalid address label:", addr, "Container:", c.Name)
+		} else if ip.To4() != nil {
+			c.IPAddress, c.IPv6Address = ip.String(), ""
+		} else {
+			c.IPAddress, c.IPv6Address = "", ip.String()
+		}
+	}
+	return c, nil
+}
+
+// newRoute は "0.正規表現の名前" 形式の key と正規表現 pattern から host へのルーティング情報を作成する。
+// 名前に "0.glob:名前" のように接頭辞を付けた場合は、pattern をその種類のパターンとして扱う(Matcher を参照)。
+// コンパイル済みの正規表現は compiled に保存され、同じパターンに対しては使い回される。
+func newRoute(key, pattern, host string, compiled map[string]*regexp.Regexp) (*Route, error) {
+	s := strings.SplitN(key, ".", 2)
+	var priority int
+	if len(s) == 2 {
+		var err error
+		priority, err = strconv.Atoi(s[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority value: %v", err)
+		}
+	}
+
+	// 空の正規表現は全てのホスト名に一致してしまうため、意図しない設定として扱う。
+	if strings.TrimSpace(pattern) == "" {
+		return nil, fmt.Errorf("empty regexp pattern")
+	}
+
+	kind, name := splitMatchType(s[len(s)-1])
+	m, re, err := newMatcher(kind, pattern, compiled)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Route{
+		Name:     name,
+		Priority: priority,
+		Host:     host,
+		Weight:   defaultWeight,
+		Matcher:  m,
+		Regexp:   re,
+	}, nil
+}
+
+// resolveHost は etcd 上の接続先の名前 host を実際に接続するアドレスに変換する。
+// "foobar.container" の場合は Docker のコンテナへの接続とし、AddressFamily に従ってコンテナのアドレスを返す。
+// "foobar.container:8080" のようにポート番号が付いている場合は、コンテナのアドレスに同じポート番号を付けて返す。
+// コンテナが見つからないなどの理由で変換できなかった場合や、変換後の接続先が AllowedTargets に含まれない場合は
+// メッセージを出力して false を返す。
+func (a *Accounts) resolveHost(host string, account Account, containers map[string]*Container) (string, bool) {
+	const SUFFIX = ".container"
+	if name, port := SplitTarget(host); port != "" && strings.HasSuffix(name, SUFFIX) {
+		// "foobar.container:8080" の場合はコンテナのアドレスにポート番号を付ける。
+		addr, ok := a.resolveHost(name, account, containers)
+		if !ok {
+			return "", false
+		}
+		return net.JoinHostPort(addr, port), true
+	}
+	if len(host) <= len(SUFFIX) || host[len(host)-len(SUFFIX):] != SUFFIX {
+		return host, a.allowTarget(host, account.Name)
+	}
+
+	containerName := host[:len(host)-len(SUFFIX)]
+	if a.DockerAddr == "" {
+		log.Println(
+			"Docker Remote API not available:", containerName,
+			"Account:", account,
+		)
+		return "", false
+	}
+
+	container, ok := containers[containerName]
+	if !ok {
+		log.Println(
+			"Container not found:", containerName,
+			"Account:", account,
+		)
+		containerNotFound.Inc(account.Name, containerName)
+		return "", false
+	}
+	host = a.AddressFamily.Select(container)
+	if host == "" {
+		log.Println(
+			"Container has no address for family:", containerName,
+			"Family:", a.AddressFamily,
+			"Account:", account,
+		)
+		return "", false
+	}
+	return host, a.allowTarget(host, account.Name)
+}
+
 // Reload は Docker Remote API と etcd にアクセスしてルーティング情報を組み立てる。
 // 設定された名前のコンテナが実際には存在しなかったり正規表現が不正な場合はメッセージを出力しつつもそれを除外した上で処理を続行する。
+// 正規表現が空文字列や空白のみの場合も、全てのホスト名に一致するルーティング情報にならないよう同様に除外する。
 //
 // etcd に対しては、例えば以下のような形式で設定を書き込んでおく。
 //
@@ -211,12 +899,111 @@ func getContainers(dockerAddr string) (map[string]*Container, error) {
 //  # 例2: 全ての道は Google に通ず
 //  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/www.google.com/600613.goog -X PUT -d value='.'
 //
+// 接続先の下に "_" から始まるキーを置いた場合はルーティング情報ではなく、その接続先へのルーティング全てに適用されるオプションとして扱われる。
+//
+//  # 例3: DNS サーバーの SVCB/HTTPS レコードで HTTP/2 と 8443 番ポートを通知する
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/my_container_name.container/_alpn -X PUT -d value='h2,http/1.1'
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/my_container_name.container/_port -X PUT -d value='8443'
+//
+//  # 例4: リバースプロキシーで /api/v1/... へのリクエストを /... としてコンテナへ転送する
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/my_container_name.container/_strip_prefix -X PUT -d value='/api/v1'
+//
+//  # 例5: my_container_name の 8080 番ポートに接続できない間は my_backup_name へ接続する (Accounts.CheckHealth を参照)
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/my_container_name.container/_backup -X PUT -d value='my_backup_name.container'
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/my_container_name.container/_health_port -X PUT -d value='8080'
+//
+//  # 例6: my_container_name へはプロキシー全体で同時に 10 接続までしか中継しない
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/my_container_name.container/_max_conns -X PUT -d value='10'
+//
+//  # 例7: 10.1.0.0/16 からの DNS の問い合わせには 10.1.0.5 を、192.168.0.0/16 からは 192.168.0.5 を返す
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/www.example.com/_subnets -X PUT -d value='10.1.0.0/16=10.1.0.5,192.168.0.0/16=192.168.0.5'
+//
+//  # 例8: フェイルオーバーを速やかに反映させるため、my_container_name を指す DNS の応答の TTL を 5 秒にする
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/my_container_name.container/_ttl -X PUT -d value='5'
+//
+// アカウントの直下に "_" から始まるキーを置いた場合は、そのアカウント全体に適用されるオプションとして扱われる。
+//
+//  # 例9: master アカウントの HTTP プロキシーで受け付けるヘッダーを合計 16KiB、100 個までに制限する
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/_max_header_bytes -X PUT -d value='16384'
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/_max_headers -X PUT -d value='100'
+//
+//  # 例10: master アカウントのプロキシーのパスワードを -password で指定したものとは別に設定する
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/_password -X PUT -d value='s3cret'
+//
+// プロキシーでは通常、接続先 example.com:8080 のポート番号を取り除いた example.com を正規表現と照合する。
+// _match_port を true にした場合はポート番号を含めた example.com:8080 を照合するため、ポート番号ごとに接続先を振り分けられる。
+// この場合、ポート番号の無い接続先にも一致させたい正規表現は '^example\.com(:\d+)?$' のように書く必要がある。
+//
+//  # 例11: master アカウントで example.com の 8443 番ポートへの接続のみを my_container_name へ振り分ける
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/_match_port -X PUT -d value='true'
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/my_container_name.container/0.tls -X PUT -d value='^example\.com:8443$'
+//
+// プライオリティと正規表現が同じルーティング情報が複数ある場合は一つにまとめられ、接続の度に順に振り分けられる(ラウンドロビン)。
+// "web-*.container" のようにコンテナ名に path.Match 形式のパターンを使用すると、一致する全てのコンテナへ振り分けられる。
+// まとめた場合、接続先以外のオプションは接続先の名前が最も小さいもののものが使用される。
+//
+//  # 例12: master アカウントで www.example.com への接続を web-1, web-2, ... の全てのコンテナへ順に振り分ける
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/web-*.container/0.web -X PUT -d value='^www\.example\.com$'
+//
+// _health_check に tcp か http を指定した接続先は、_backup が無くてもヘルスチェックの対象になり、失敗している接続先には振り分けない。
+// http の場合は _health_path (省略時は "/")へ GET で要求し、2xx / 3xx 以外の応答や接続の失敗を失敗として扱う。
+// _health_path を指定した場合は _health_check を省略すると http として扱う。
+// 全ての接続先が失敗している場合、_backup があればそこへ接続し、無ければホスト名を差し替えずにそのまま接続する。
+//
+//  # 例13: web-1, web-2, ... のうち 8080 番ポートの /healthz が正常な応答を返すコンテナのみへ振り分ける
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/web-*.container/_health_path -X PUT -d value='/healthz'
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/web-*.container/_health_port -X PUT -d value='8080'
+//
+//  # 例14: HTTP プロキシーで my_container_name へは CONNECT での接続のみを許可し、平文の HTTP のリクエストは 403 で拒否する
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/my_container_name.container/_scheme -X PUT -d value='https'
+//
+// まとめた接続先には _weight で 0 から 1000 までの重み(省略時は 1)を指定でき、重みに比例した割合で振り分けられる。
+// 重みが 0 の接続先は設定に残したまま振り分けの対象から外れ、_weight を書き換えるとその場で振り分けられるようになる。
+// 全ての接続先の重みが 0 の場合はホスト名を差し替えない。
+//
+//  # 例15: www.example.com への接続を stable に 9 割、canary に 1 割の割合で振り分ける
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/stable.container/0.web -X PUT -d value='^www\.example\.com$'
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/stable.container/_weight -X PUT -d value='9'
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/canary.container/0.web -X PUT -d value='^www\.example\.com$'
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/canary.container/_weight -X PUT -d value='1'
+//
+// 正規表現の名前に "glob:" や "exact:" の接頭辞を付けると、値を正規表現の代わりに path.Match 形式のパターンや
+// ホスト名そのものとして扱う。いずれも大文字と小文字は区別せず、glob の "*" は "." を含む任意の文字列に一致する。
+// 接頭辞を省略した場合は従来通り正規表現として扱い、未知の接頭辞の場合はエラーを出力してそのルーティング情報を無視する。
+//
+//  # 例16: *.my-service.com と my-service.com を my_container_name へ振り分ける
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/my_container_name.container/0.glob:sub -X PUT -d value='*.my-service.com'
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/my_container_name.container/0.exact:apex -X PUT -d value='my-service.com'
+//
+// 接続先に "my_container_name.container:8080" や "172.17.0.2:8080" のようにポート番号を付けると、
+// 接続先のポート番号も差し替える。付けない場合は元の接続先のポート番号をそのまま使用する。
+// _health_port を省略した場合のヘルスチェックもこのポート番号に対して行う。DNS サーバーの応答ではポート番号は使用されない。
+//
+//  # 例17: api.my-service.com へは何番ポートへの接続でも my_container_name の 8080 番ポートへ接続する
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/my_container_name.container:8080/0.api -X PUT -d value='^api\.my-service\.com$'
+//
+// _rate_limit と _rate_burst を設定すると、HTTP プロキシーの -http-rate-limit と -http-rate-burst をアカウントごとに上書きできる。
+//
+//  # 例18: master アカウントの HTTP プロキシーへのリクエストを 1 秒あたり 5 回、連続 20 回までに制限する
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/_rate_limit -X PUT -d value='5'
+//  curl -L http://172.17.42.1:4001/v2/keys/proxy/master/_rate_burst -X PUT -d value='20'
+//
 // `proxy` の部分はコマンドライン引数、`master` の部分はプロクシのユーザー名が使用される。
-func (a *Accounts) Reload() error {
+//
+// Docker Remote API が利用できる場合は、コンテナのラベルからもルーティング情報が作成される(LabelPrefix を参照)。
+// EtcdAddr が空の場合は etcd にはアクセスせず、StaticRoutes とコンテナのラベルのみからルーティング情報を作成する。
+//
+// Reload、ReloadAccount とコンテナのイベントの反映は、読み込みを始めてから採用するまでを排他して順に行う。
+// 並行して行うと、先に読み込みを始めた古いルーティング情報が後から採用されて新しいものを上書きすることがあるため。
+func (a *Accounts) Reload() (err error) {
+	a.reload.Lock()
+	defer a.reload.Unlock()
+	defer func() { a.recordReload(err) }()
+
 	var containers map[string]*Container
 	if a.DockerAddr != "" {
 		var err error
-		containers, err = getContainers(a.DockerAddr)
+		containers, err = getContainers(a.DockerAddr, a.DockerNetwork, a.MaxContainerAliases, a.DockerConcurrency)
 		if err != nil {
 			return err
 		}
@@ -225,101 +1012,259 @@ func (a *Accounts) Reload() error {
 	// etcd への登録情報を元に実際のルーティングを組み立てる。
 	// "/proxy/アカウント名/接続先/0.正規表現の名前" で値部分が正規表現文字列。
 	// 0 はプライオリティ。"0." を省略した場合はプライオリティ 0 として処理される。
-	etcdClient := etcd.NewClient([]string{a.EtcdAddr})
-	r, err := etcdClient.Get(a.EtcdRoot, false, true)
+	var nodes etcd.Nodes
+	root, index, err := a.loadNodes(a.EtcdRoot)
 	if err != nil {
-		if etcderr, ok := err.(etcd.EtcdError); ok && etcderr.ErrorCode == 100 {
-			// routing information not found
-			a.m.Lock()
-			a.accounts = make(map[string]Account)
-			a.m.Unlock()
-			return nil
-		}
 		return err
 	}
+	// ルーティング情報が一つも登録されていない場合は root が nil になる。
+	if root != nil {
+		nodes = root.Nodes
+	}
+
+	// 同じパターンの正規表現はアカウントをまたいで使い回す。
+	compiled := make(map[string]*regexp.Regexp)
 
 	accounts := make(map[string]Account)
-	for _, aNode := range r.Node.Nodes {
-		account := Account{
-			Name: aNode.Key[strings.LastIndex(aNode.Key, "/")+1:],
-		}
-		for _, toNode := range aNode.Nodes {
-			// 接続先を探す。
-			host := toNode.Key[strings.LastIndex(toNode.Key, "/")+1:]
-
-			// "foobar.container" の場合は Docker のコンテナへの接続とする。
-			const SUFFIX = ".container"
-			if len(host) > len(SUFFIX) && host[len(host)-len(SUFFIX):] == SUFFIX {
-				containerName := host[:len(host)-len(SUFFIX)]
-				if a.DockerAddr == "" {
-					log.Println(
-						"Docker Remote API not available:", containerName,
-						"Account:", account,
-					)
-					continue
-				}
+	for _, aNode := range nodes {
+		account := a.buildAccount(aNode, containers, compiled)
+		accounts[account.Name] = account
+	}
 
-				container, ok := containers[containerName]
-				if !ok {
-					log.Println(
-						"Container not found:", containerName,
-						"Account:", account,
-					)
-					continue
-				}
-				host = container.IPAddress
-			}
+	a.addLabelRoutes(accounts, containers, compiled, "")
 
-			// コンテナに導くための正規表現をコンパイルする。
-			for _, reNode := range toNode.Nodes {
-				s := strings.SplitN(reNode.Key[strings.LastIndex(reNode.Key, "/")+1:], ".", 2)
-				var priority int
-				if len(s) < 2 {
-					priority = 0
-				} else {
-					priority, err = strconv.Atoi(s[0])
-					if err != nil {
-						log.Println(
-							"invalid priority value:", err,
-							"Account:", account,
-							"ConnectTo:", host,
-							"RegExp:", reNode.Value,
-						)
-						continue
-					}
-				}
+	for name, account := range accounts {
+		sort.Sort(sort.Reverse(account.Routes))
+		account.indexAddrs()
+		account.Routes = mergeRoutes(account.Routes)
+		accounts[name] = account
+	}
 
-				re, err := regexp.Compile(reNode.Value)
-				if err != nil {
-					log.Println(
-						"error at regexp.Compile:", err,
-						"Account:", account,
-						"ConnectTo:", host,
-						"RegExp:", reNode.Value,
-						"Priority:", priority,
-					)
-					continue
-				}
-				account.Routes = append(account.Routes, &Route{
-					Name:     s[len(s)-1],
-					Priority: priority,
-					Host:     host,
-					Regexp:   re,
-				})
+	if a.Verbose {
+		log.Println("new accounts:", accounts)
+	}
+
+	if err := a.commit(accounts, containers); err != nil {
+		return err
+	}
+	a.setEtcdIndex(index)
+	return nil
+}
+
+// ReloadAccount は accountName のアカウントのルーティング情報のみを etcd から読み込み直し、現在のルーティング情報に反映する。
+// etcd 上からアカウントが削除されている場合はラベルによるルーティング情報のみが残る。
+// コンテナの情報は直前の Reload で取得したものを使い、そこに含まれないコンテナのみを Docker Remote API に問い合わせる。
+// Reload と同様に、他の再構築とは排他して行う。
+func (a *Accounts) ReloadAccount(accountName string) error {
+	a.reload.Lock()
+	defer a.reload.Unlock()
+
+	a.m.Lock()
+	current, containers := a.accounts, a.containers
+	a.m.Unlock()
+
+	aNode, _, err := a.loadNodes(path.Join(a.EtcdRoot, accountName))
+	if err != nil {
+		return err
+	}
+
+	if a.DockerAddr != "" && aNode != nil {
+		if containers, err = a.inspectReferenced(aNode, containers); err != nil {
+			return err
+		}
+	}
+
+	// 他のアカウントと正規表現を共有できるよう、現在のルーティング情報からコンパイル済みの正規表現を集めておく。
+	compiled := make(map[string]*regexp.Regexp)
+	accounts := make(map[string]Account, len(current)+1)
+	for name, account := range current {
+		for _, route := range account.Routes {
+			if route.Regexp != nil {
+				compiled[route.Regexp.String()] = route.Regexp
 			}
 		}
+		if name != accountName {
+			accounts[name] = account
+		}
+	}
 
+	if aNode != nil {
+		accounts[accountName] = a.buildAccount(aNode, containers, compiled)
+	}
+	a.addLabelRoutes(accounts, containers, compiled, accountName)
+	if account, ok := accounts[accountName]; ok {
 		sort.Sort(sort.Reverse(account.Routes))
-		accounts[account.Name] = account
+		account.indexAddrs()
+		account.Routes = mergeRoutes(account.Routes)
+		accounts[accountName] = account
 	}
 
 	if a.Verbose {
-		log.Println("new accounts:", accounts)
+		log.Println("new account:", accounts[accountName])
+	}
+
+	return a.commit(accounts, containers)
+}
+
+// inspectReferenced は aNode 以下で "foobar.container" の形式で参照されているコンテナのうち、
+// containers に含まれていないものを Docker Remote API に問い合わせ、それらを加えた新しい一覧を返す。
+// containers 自体は変更しない。
+func (a *Accounts) inspectReferenced(aNode *etcd.Node, containers map[string]*Container) (map[string]*Container, error) {
+	const SUFFIX = ".container"
+	var missing []string
+	for _, toNode := range aNode.Nodes {
+		names := []string{toNode.Key[strings.LastIndex(toNode.Key, "/")+1:]}
+		for _, reNode := range toNode.Nodes {
+			if strings.HasSuffix(reNode.Key, "/_backup") {
+				names = append(names, reNode.Value)
+			}
+		}
+		for _, name := range names {
+			if name, _ = SplitTarget(name); !strings.HasSuffix(name, SUFFIX) || len(name) <= len(SUFFIX) {
+				continue
+			}
+			// パターンの場合は既に取得済みのコンテナのみを対象にする。
+			if name = name[:len(name)-len(SUFFIX)]; containers[name] == nil && !isContainerPattern(name) {
+				missing = append(missing, name)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return containers, nil
+	}
+
+	ret := make(map[string]*Container, len(containers)+len(missing))
+	for name, c := range containers {
+		ret[name] = c
+	}
+	for _, name := range missing {
+		c, err := inspectContainer(a.DockerAddr, a.DockerNetwork, name)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			ret[name] = c
+			ret[c.Name] = c
+		}
+	}
+	return ret, nil
+}
+
+// buildAccount は etcd 上のアカウントのノード aNode からアカウント情報を組み立てる。
+// 組み立てたルーティング情報は Priority の順に並び替えられていない。
+func (a *Accounts) buildAccount(aNode *etcd.Node, containers map[string]*Container, compiled map[string]*regexp.Regexp) Account {
+	account := Account{
+		Name: aNode.Key[strings.LastIndex(aNode.Key, "/")+1:],
+	}
+	for _, toNode := range aNode.Nodes {
+		// 接続先を探す。
+		host := toNode.Key[strings.LastIndex(toNode.Key, "/")+1:]
+
+		// "_" から始まるキーはアカウントに対するオプションとして扱う。
+		if strings.HasPrefix(host, "_") && !toNode.Dir {
+			if err := account.setOption(host[1:], toNode.Value); err != nil {
+				log.Println(
+					"invalid option:", err,
+					"Account:", account.Name,
+				)
+			}
+			continue
+		}
+
+		account.refer(host)
+		for _, host := range a.expandHost(host, account, containers) {
+			a.addRoutes(&account, toNode, host, containers, compiled)
+		}
+	}
+	return account
+}
+
+// addRoutes は etcd 上の接続先 toNode 以下のルーティング情報を、接続先を host として account に追加する。
+// host は toNode の名前か、それがパターンの場合は expandHost で展開した名前の一つ。
+func (a *Accounts) addRoutes(account *Account, toNode *etcd.Node, host string, containers map[string]*Container, compiled map[string]*regexp.Regexp) {
+	container := containerOf(host, containers)
+	host, ok := a.resolveHost(host, *account, containers)
+	if !ok {
+		return
+	}
+
+	// "_" から始まるキーは接続先に対するオプションとして扱う。
+	options := make(map[string]string)
+	for _, reNode := range toNode.Nodes {
+		if key := reNode.Key[strings.LastIndex(reNode.Key, "/")+1:]; strings.HasPrefix(key, "_") {
+			options[key[1:]] = reNode.Value
+		}
+	}
+	// 予備の接続先も接続先と同様に "foobar.container" でコンテナを指定できる。
+	if backup, ok := options["backup"]; ok {
+		account.refer(backup)
+		if options["backup"], ok = a.resolveHost(backup, *account, containers); !ok {
+			delete(options, "backup")
+		}
+	}
+
+	// コンテナに導くための正規表現をコンパイルする。
+	for _, reNode := range toNode.Nodes {
+		key := reNode.Key[strings.LastIndex(reNode.Key, "/")+1:]
+		if strings.HasPrefix(key, "_") {
+			continue
+		}
+
+		route, err := newRoute(key, reNode.Value, host, compiled)
+		if err != nil {
+			log.Println(
+				err,
+				"Account:", account,
+				"ConnectTo:", host,
+				"RegExp:", reNode.Value,
+			)
+			continue
+		}
+		route.health = a.health
+		if container != nil {
+			route.Container = container.Name
+		}
+		for k, v := range options {
+			if err := route.setOption(k, v); err != nil {
+				log.Println(
+					"invalid option:", err,
+					"Account:", account,
+					"ConnectTo:", host,
+				)
+			}
+		}
+		account.Routes = append(account.Routes, route)
 	}
+}
+
+// commit は accounts を新しいルーティング情報として採用し、作成に使用した containers を次回の ReloadAccount のために保存する。
+// MaxRoutingBytes を超えてルーティング情報が大きくなる場合はエラーを返し、それまでのルーティング情報を使い続ける。
+//
+// 採用した accounts とそこに含まれる Account、Routes、Route は以降変更せず、再構築の際は常に新しいものを作成して丸ごと差し替える。
+// これにより Get で取得済みのアカウント情報は、ロックを取らずに参照し続けても再構築の影響を受けない。
+// 例外は Route のマッチ数などの統計情報と、CheckHealth による接続先の状態で、これらは atomic な操作やロックで更新される。
+// 統計情報は採用する際に以前のルーティング情報から引き継ぐ(inheritStats を参照)。
+func (a *Accounts) commit(accounts map[string]Account, containers map[string]*Container) error {
+	size := estimateSize(accounts, containers)
 
 	a.m.Lock()
+	defer a.m.Unlock()
+	if a.MaxRoutingBytes > 0 && size > a.MaxRoutingBytes {
+		// 初回は使い続けるルーティング情報が無いため、警告のみ出力して採用する。
+		if a.size > 0 && size > a.size {
+			routingTableRejected.Inc()
+			return fmt.Errorf("routing table size %d bytes exceeds limit %d bytes, keeping previous routing table", size, a.MaxRoutingBytes)
+		}
+		log.Println(
+			"warning: routing table exceeds memory limit:", size, "bytes",
+			"Limit:", a.MaxRoutingBytes, "bytes",
+		)
+	}
+	a.inheritStats(accounts)
 	a.accounts = accounts
-	a.m.Unlock()
+	a.containers = containers
+	a.size = size
+	routingTableBytes.Set(size)
 
 	return nil
 }
@@ -334,18 +1279,90 @@ func (a *Accounts) get() map[string]Account {
 }
 
 // Get は accountName に対応するアカウント情報を取得する。
-// 該当するアカウントが存在しない場合は nil を返す。
+// 該当するアカウントが存在しない場合や AllowedAccounts に含まれていない場合は nil を返す。
+//
+// 返されるアカウント情報は呼び出した時点のルーティング情報のスナップショットで、
+// その後に Reload や ReloadAccount が行われても内容は変化しない(commit を参照)。
+// 一つのリクエストの処理中は同じ *Account を使い続けることで、途中で再構築が行われても一貫したルーティング情報で処理できる。
+// Routes の要素は現在のルーティング情報と共有されているため並び替えなどの変更は行わないこと。変更する場合は Snapshot を使用する。
+// Routes の容量は長さと同じに制限してあるため、append した場合は共有されていない新しいスライスになる。
 func (a *Accounts) Get(accountName string) *Account {
+	if !a.allowed(accountName) {
+		return nil
+	}
 	if account, ok := a.get()[accountName]; ok {
+		account.Routes = account.Routes[:len(account.Routes):len(account.Routes)]
 		return &account
 	}
 	return nil
 }
 
+// List は Get で取得できる全てのアカウントの名前を順に並べて返す。
+func (a *Accounts) List() []string {
+	var ret []string
+	for name := range a.get() {
+		if a.allowed(name) {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Snapshot は Get で取得できる全てのアカウント情報の複製を返す。
+// Routes のスライスは複製されるため、呼び出し元で並び替えなどを行っても現在のルーティング情報には影響しない。
+// 個々の Route は共有されるため、参照のみに使用すること。
+func (a *Accounts) Snapshot() map[string]Account {
+	accounts := a.get()
+	ret := make(map[string]Account, len(accounts))
+	for name, account := range accounts {
+		if !a.allowed(name) {
+			continue
+		}
+		account.Routes = append(Routes(nil), account.Routes...)
+		ret[name] = account
+	}
+	return ret
+}
+
+// VerboseFor は accountName のアカウントについて詳細なログを出力するかを返す。
+// Verbose が true の場合は全てのアカウントについて true を返す。
+func (a *Accounts) VerboseFor(accountName string) bool {
+	if a.Verbose {
+		return true
+	}
+	for _, name := range a.VerboseAccounts {
+		if name == accountName {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed は accountName が AllowedAccounts に含まれているかを返す。
+// AllowedAccounts が空の場合は常に true を返す。
+func (a *Accounts) allowed(accountName string) bool {
+	if len(a.AllowedAccounts) == 0 {
+		return true
+	}
+	for _, name := range a.AllowedAccounts {
+		if name == accountName {
+			return true
+		}
+	}
+	return false
+}
+
 // Watch は etcd や docker を監視し、変更が見つかる度に自動的にルーティング情報を再構築する。
+// etcd の変更が特定のアカウント以下に限られる場合は、そのアカウントのみを ReloadAccount で再構築する。
+// コンテナの起動や終了の場合も、そのコンテナの情報のみを更新し、コンテナを参照しているアカウントのみを再構築する。
+// ResyncInterval が指定されている場合は、監視でイベントを取りこぼした場合に備えてその間隔で全体を再構築する。
+// 直前の Reload で読み込んだ時点までに行われた etcd の変更の通知では再構築しない。
 func (a *Accounts) Watch() error {
 	recvEtcd := make(chan *etcd.Response)
-	go a.watchEtcdEvent(recvEtcd)
+	if a.EtcdAddr != "" {
+		go a.watchEtcdEvent(recvEtcd)
+	}
 
 	recvDocker := make(chan *dockerEvent)
 	if a.DockerAddr != "" {
@@ -356,19 +1373,108 @@ func (a *Accounts) Watch() error {
 	// 既にスケジューリングされている場合は t が入れ替わるため、結局一番最後のもののみが使用される。
 	var t <-chan time.Time
 
+	// 再作成のきっかけとなった変更の種類と内容。
+	triggers := make(map[string]bool)
+	var causes []string
+
+	// 変更のあったアカウント。Docker の変化などで全体の再作成が必要な場合は full を true にする。
+	changed := make(map[string]bool)
+	full := false
+
+	// コンテナの起動や終了など、コンテナ情報の更新と関係するアカウントの再作成のみで反映できる Docker のイベント。
+	var events []*dockerEvent
+
+	var resync <-chan time.Time
+	if a.ResyncInterval > 0 {
+		ticker := time.NewTicker(a.ResyncInterval)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
 	for {
 		select {
 		case r := <-recvEtcd:
 			if a.Verbose {
 				log.Println("etcd notify:", r)
 			}
+			if a.alreadyLoaded(r) {
+				// 起動時の Reload で読み込み済みの変更では作り直さない。
+				continue
+			}
+			triggers["etcd"] = true
+			if r != nil && r.Node != nil {
+				causes = append(causes, "etcd "+r.Action+" of "+r.Node.Key)
+			}
+			if name := a.eventAccount(r); name != "" {
+				changed[name] = true
+			} else {
+				full = true
+			}
 			t = time.After(time.Second)
 		case r := <-recvDocker:
 			if a.Verbose {
 				log.Println("docker notify:", r)
 			}
+			triggers[r.trigger()] = true
+			causes = append(causes, r.cause())
+			if r.incremental() {
+				events = append(events, r)
+			} else {
+				full = true
+			}
 			t = time.After(time.Second)
+		case <-resync:
+			// 他の変更による再作成と重ならないよう、通常の変更と同様にスケジューリングする。
+			// 既にスケジューリングされている場合は延期しない。間隔が再作成までの待ち時間より短いと、延期され続けて実行されないため。
+			triggers["resync"] = true
+			causes = append(causes, "periodic resync")
+			full = true
+			if t == nil {
+				t = time.After(time.Second)
+			}
 		case <-t:
+			t = nil
+			log.Println("reload triggered by:", strings.Join(causes, ", "))
+			for trigger := range triggers {
+				reloads.Inc(trigger)
+			}
+			triggers = make(map[string]bool)
+			causes = nil
+
+			pending := changed
+			changed = make(map[string]bool)
+			pendingEvents := events
+			events = nil
+			for _, e := range pendingEvents {
+				if full {
+					break
+				}
+				names, ok := a.applyContainerEvent(e)
+				if !ok {
+					full = true
+					break
+				}
+				for name := range names {
+					pending[name] = true
+				}
+			}
+			if !full {
+				for name := range pending {
+					log.Println("incremental reload of account:", name)
+					accountReloads.Inc()
+					if err := a.ReloadAccount(name); err != nil {
+						// 古いルーティング情報が残らないよう全体を作り直す。失敗した場合は Reload によって記録される。
+						log.Println("watch:", err, "falling back to full reload")
+						full = true
+						break
+					}
+				}
+				if !full {
+					break
+				}
+			}
+			full = false
+
 			if err := a.Reload(); err != nil {
 				log.Println("watch:", err)
 				break
@@ -377,36 +1483,101 @@ func (a *Accounts) Watch() error {
 	}
 }
 
-// watchEtcdEvent は etcd のイベントを検出する度に recv にイベント内容を投げる。
-func (a *Accounts) watchEtcdEvent(recv chan *etcd.Response) error {
-	etcdClient := etcd.NewClient([]string{a.EtcdAddr})
-	for {
-		_, err := etcdClient.Watch(a.EtcdRoot, 0, true, recv, nil)
-		if err != nil {
-			log.Println("watchEtcdEvent:", err)
-			continue
-		}
+// eventAccount は etcd のイベント r が特定のアカウント以下への変更であればそのアカウント名を返す。
+// EtcdRoot 自体への変更などアカウントを特定できない場合は空文字列を返す。
+func (a *Accounts) eventAccount(r *etcd.Response) string {
+	if r == nil || r.Node == nil {
+		return ""
+	}
+	root := strings.TrimSuffix(a.EtcdRoot, "/") + "/"
+	if !strings.HasPrefix(r.Node.Key, root) {
+		return ""
+	}
+	name := strings.SplitN(r.Node.Key[len(root):], "/", 2)[0]
+	if name == "" {
+		return ""
 	}
+	return name
 }
 
 // dockerEvent は docker のイベントストリーミングAPIで受信したデータを表現する構造体。
+// Type, Action, Actor は Docker Remote API v1.22 以降で追加された項目で、それより前では空になる。
 type dockerEvent struct {
 	Status string `json:"status"`
 	ID     string `json:"id"`
 	From   string `json:"from"`
 	Time   int64  `json:"time"`
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// action はイベントの種類と動作を返す。
+// 古い API で Type が無い場合はコンテナのイベントとして扱う。
+func (e *dockerEvent) action() (string, string) {
+	typ, action := e.Type, e.Action
+	if typ == "" {
+		typ = "container"
+	}
+	if action == "" {
+		action = e.Status
+	}
+	// "exec_start: /bin/sh" のように詳細が付加されている場合は取り除く。
+	if i := strings.Index(action, ":"); i >= 0 {
+		action = action[:i]
+	}
+	return typ, action
+}
+
+// trigger はメトリクスに記録する再作成のきっかけを "docker_container_start" のような形式で返す。
+func (e *dockerEvent) trigger() string {
+	typ, action := e.action()
+	return "docker_" + typ + "_" + action
+}
+
+// cause はログに出力する再作成のきっかけを "container start of web" のような形式で返す。
+func (e *dockerEvent) cause() string {
+	typ, action := e.action()
+	name := e.Actor.Attributes["name"]
+	if name == "" {
+		name = e.ID
+		if name == "" {
+			name = e.Actor.ID
+		}
+	}
+	return typ + " " + action + " of " + name
 }
 
 // watchDockerEvent は docker のイベントを検出する度に recv にイベント内容を投げる。
+// 接続が途切れた場合は watchEtcdEvent と同様に待ち時間を指数的に増やしながら再接続する。
 func (a *Accounts) watchDockerEvent(recv chan<- *dockerEvent) error {
+	b := newBackoff(watchBackoffMin, watchBackoffMax)
 	for {
 		func() {
-			resp, err := httpGet(a.DockerAddr + "/events")
+			// 接続できてもヘッダーが返ってこない場合に待ち続けないよう、ヘッダーを受け取るまでの時間を制限する。
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var timer *time.Timer
+			if a.DockerEventsTimeout > 0 {
+				timer = time.AfterFunc(a.DockerEventsTimeout, cancel)
+			}
+			resp, err := httpGetContext(ctx, a.DockerAddr+"/events")
+			if timer != nil {
+				timer.Stop()
+			}
 			if err != nil {
+				if ctx.Err() != nil {
+					err = fmt.Errorf("no response within %v: %v", a.DockerEventsTimeout, err)
+				}
 				log.Println("watchDockerEvent:", err)
 				return
 			}
 			defer resp.Body.Close()
+			a.setWatching(&a.dockerWatching, true)
+			defer a.setWatching(&a.dockerWatching, false)
 
 			// ストリームが途切れるまで JSON を読み取り随時 recv に流す。
 			d := json.NewDecoder(resp.Body)
@@ -417,9 +1588,10 @@ func (a *Accounts) watchDockerEvent(recv chan<- *dockerEvent) error {
 					log.Println("watchDockerEvent:", err)
 					break
 				}
+				b.reset()
 				recv <- de
 			}
 		}()
-		time.Sleep(time.Second)
+		b.wait()
 	}
 }
@@ -0,0 +1,374 @@
+package accounts
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStaticAccounts は routes を静的なルーティング情報(StaticRouteEnvPrefix を参照)として読み込んだ Accounts を返す。
+func newStaticAccounts(t *testing.T, routes ...string) *Accounts {
+	t.Helper()
+	a := New("", "", "/proxy")
+	a.StaticRoutes = routes
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// routeHosts は account の全てのルーティング情報の接続先を並べ替えてカンマ区切りで返す。
+func routeHosts(account *Account) string {
+	var hosts []string
+	for _, r := range account.Routes {
+		if r.Hosts != nil {
+			hosts = append(hosts, r.Hosts...)
+		} else {
+			hosts = append(hosts, r.Host)
+		}
+	}
+	sort.Strings(hosts)
+	return strings.Join(hosts, ",")
+}
+
+func TestMatchCounters(t *testing.T) {
+	a := newStaticAccounts(t,
+		`alice/192.0.2.1/0.www=^www\.example\.com$`,
+		`bob/192.0.2.2/0.www=^www\.example\.com$`,
+	)
+	alice, bob := a.Get("alice"), a.Get("bob")
+	if alice.Routes[0].Regexp != bob.Routes[0].Regexp {
+		t.Error("the same pattern is compiled twice")
+	}
+
+	tests := []struct {
+		account    *Account
+		host       string
+		alice, bob uint64
+	}{
+		{account: alice, host: "www.example.com", alice: 1, bob: 0},
+		{account: alice, host: "www.example.com", alice: 2, bob: 0},
+		{account: bob, host: "www.example.com", alice: 2, bob: 1},
+		{account: bob, host: "api.example.com", alice: 2, bob: 1},
+	}
+	for i, tt := range tests {
+		tt.account.Match(tt.host)
+		if got := alice.Routes[0].Matches(); got != tt.alice {
+			t.Errorf("%d: alice Matches = %d, want %d", i, got, tt.alice)
+		}
+		if got := bob.Routes[0].Matches(); got != tt.bob {
+			t.Errorf("%d: bob Matches = %d, want %d", i, got, tt.bob)
+		}
+	}
+}
+
+func TestEmptyPattern(t *testing.T) {
+	// etcd の値、静的なルーティング情報、コンテナのラベルのそれぞれで、空の正規表現のルーティング情報は作成されない。
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"action":"get","node":{"key":"/proxy","dir":true,"nodes":[
+			{"key":"/proxy/etcd","dir":true,"nodes":[
+				{"key":"/proxy/etcd/192.0.2.1","dir":true,"nodes":[
+					{"key":"/proxy/etcd/192.0.2.1/0.empty","value":""},
+					{"key":"/proxy/etcd/192.0.2.1/1.blank","value":"  "},
+					{"key":"/proxy/etcd/192.0.2.1/2.www","value":"^www\\.example\\.com$"}
+				]}
+			]}
+		]}}`)
+	}))
+	defer ts.Close()
+	docker := newDockerStub(t, testContainer{ID: "1", Name: "web", IP: "172.17.0.2", Labels: map[string]string{
+		LabelPrefix + "labels.0.empty": "",
+		LabelPrefix + "labels.1.blank": " ",
+		LabelPrefix + "labels.2.www":   `^www\.example\.com$`,
+	}})
+
+	a := New(docker.URL, ts.URL, "/proxy")
+	a.StaticRoutes = []string{
+		`static/192.0.2.3/0.empty=`,
+		`static/192.0.2.3/1.blank= `,
+		`static/192.0.2.3/2.www=^www\.example\.com$`,
+	}
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		account string
+		host    string
+	}{
+		{account: "etcd", host: "192.0.2.1"},
+		{account: "static", host: "192.0.2.3"},
+		{account: "labels", host: "172.17.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.account, func(t *testing.T) {
+			account := a.Get(tt.account)
+			if account == nil {
+				t.Fatal("account not found")
+			}
+			if len(account.Routes) != 1 || account.Routes[0].Name != "www" {
+				t.Fatalf("routes = %v, want only www", account.Routes)
+			}
+			if _, newHost := account.Match("other.example.com"); newHost != "other.example.com" {
+				t.Errorf("other.example.com is routed to %q", newHost)
+			}
+			if _, newHost := account.Match("www.example.com"); newHost != tt.host {
+				t.Errorf("www.example.com is routed to %q, want %q", newHost, tt.host)
+			}
+		})
+	}
+}
+
+func TestContainerNotFound(t *testing.T) {
+	docker := newDockerStub(t,
+		testContainer{ID: "1", Name: "web", IP: "172.17.0.2"},
+		testContainer{ID: "2", Name: "api-1", IP: "172.17.0.3"},
+	)
+
+	tests := []struct {
+		name      string
+		target    string
+		container string
+		found     bool
+	}{
+		{name: "present", target: "web.container", container: "web", found: true},
+		{name: "present with port", target: "web.container:8080", container: "web", found: true},
+		{name: "missing", target: "db.container", container: "db"},
+		{name: "missing with port", target: "db.container:5432", container: "db"},
+		{name: "pool", target: "api-*.container", container: "api-*", found: true},
+		{name: "empty pool", target: "worker-*.container", container: "worker-*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// カウンターは全体で共有されるため、テストごとに異なるアカウント名を使用する。
+			account := "notfound-" + strings.ReplaceAll(tt.name, " ", "-")
+			before := containerNotFound.Get(account, tt.container)
+
+			a := New(docker.URL, "", "/proxy")
+			a.StaticRoutes = []string{account + `/` + tt.target + `/0.www=^www\.example\.com$`}
+			if err := a.Reload(); err != nil {
+				t.Fatal(err)
+			}
+
+			want := before + 1
+			if tt.found {
+				want = before
+			}
+			if got := containerNotFound.Get(account, tt.container); got != want {
+				t.Errorf("counter = %d, want %d", got, want)
+			}
+			if routed := a.Get(account) != nil && len(a.Get(account).Routes) > 0; routed != tt.found {
+				t.Errorf("routed = %v, want %v", routed, tt.found)
+			}
+		})
+	}
+}
+
+func TestAllowedAccounts(t *testing.T) {
+	routes := []string{
+		`alpha/192.0.2.1/0.www=^www\.example\.com$`,
+		`beta/192.0.2.2/0.www=^www\.example\.com$`,
+	}
+	tests := []struct {
+		name    string
+		allowed []string
+		want    []string
+	}{
+		{name: "no allowlist", want: []string{"alpha", "beta"}},
+		{name: "allowlisted", allowed: []string{"alpha"}, want: []string{"alpha"}},
+		{name: "not present", allowed: []string{"alpha", "gamma"}, want: []string{"alpha"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newStaticAccounts(t, routes...)
+			a.AllowedAccounts = tt.allowed
+
+			if got := a.List(); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("List = %v, want %v", got, tt.want)
+			}
+			if got := len(a.Snapshot()); got != len(tt.want) {
+				t.Errorf("len(Snapshot) = %d, want %d", got, len(tt.want))
+			}
+			for _, name := range []string{"alpha", "beta", "gamma"} {
+				want := false
+				for _, w := range tt.want {
+					want = want || w == name
+				}
+				if got := a.Get(name) != nil; got != want {
+					t.Errorf("Get(%q) != nil = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLastMatch(t *testing.T) {
+	a := newStaticAccounts(t,
+		`lastmatch/192.0.2.1/0.www=^www\.example\.com$`,
+		`lastmatch/192.0.2.2/0.api=^api\.example\.com$`,
+	)
+	account := a.Get("lastmatch")
+	route := func(host string) *Route {
+		for _, r := range account.Routes {
+			if r.Host == host {
+				return r
+			}
+		}
+		t.Fatalf("no route to %s", host)
+		return nil
+	}
+	www, api := route("192.0.2.1"), route("192.0.2.2")
+	if !www.LastMatch().IsZero() || !api.LastMatch().IsZero() {
+		t.Fatal("LastMatch is set before any match")
+	}
+
+	tests := []struct {
+		host string
+		// updated は一致したことで LastMatch が更新されるルーティング情報。
+		updated *Route
+	}{
+		{host: "www.example.com", updated: www},
+		{host: "api.example.com", updated: api},
+		{host: "www.example.com", updated: www},
+		{host: "other.example.com"},
+	}
+	for _, tt := range tests {
+		before := map[*Route]time.Time{www: www.LastMatch(), api: api.LastMatch()}
+		start := time.Now()
+		account.Match(tt.host)
+		for _, r := range []*Route{www, api} {
+			got := r.LastMatch()
+			if r != tt.updated {
+				if !got.Equal(before[r]) {
+					t.Errorf("%s: LastMatch of %s changed to %v", tt.host, r.Host, got)
+				}
+				continue
+			}
+			if got.Before(start) || got.After(time.Now()) {
+				t.Errorf("%s: LastMatch of %s = %v, want after %v", tt.host, r.Host, got, start)
+			}
+		}
+	}
+}
+
+func TestMatchPort(t *testing.T) {
+	a := newStaticAccounts(t,
+		`portless/192.0.2.1/0.www=^www\.example\.com$`,
+		`ported/_match_port=true`,
+		`ported/192.0.2.2/0.alt=^www\.example\.com:8080$`,
+		`ported/192.0.2.3/0.www=^www\.example\.com(:443)?$`,
+	)
+
+	tests := []struct {
+		account string
+		host    string
+		want    string
+		matched bool
+	}{
+		// 既定ではポート番号を取り除いて照合し、接続先にはポート番号を付け直す。
+		{account: "portless", host: "www.example.com:8080", want: "192.0.2.1:8080", matched: true},
+		{account: "portless", host: "www.example.com", want: "192.0.2.1", matched: true},
+		{account: "portless", host: "api.example.com:8080", want: "api.example.com:8080"},
+		// _match_port が true の場合はポート番号を含めて照合する。
+		{account: "ported", host: "www.example.com:8080", want: "192.0.2.2:8080", matched: true},
+		{account: "ported", host: "www.example.com:443", want: "192.0.2.3:443", matched: true},
+		{account: "ported", host: "www.example.com", want: "192.0.2.3", matched: true},
+		{account: "ported", host: "www.example.com:9090", want: "www.example.com:9090"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.account+"/"+tt.host, func(t *testing.T) {
+			account := a.Get(tt.account)
+			if account.MatchPort != (tt.account == "ported") {
+				t.Fatalf("MatchPort = %v", account.MatchPort)
+			}
+			route, newHost := account.Match(tt.host)
+			if (route != nil) != tt.matched {
+				t.Errorf("matched = %v, want %v", route != nil, tt.matched)
+			}
+			if newHost != tt.want {
+				t.Errorf("newHost = %q, want %q", newHost, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplaceHostPort(t *testing.T) {
+	a := newStaticAccounts(t,
+		`master/192.0.2.1/0.www=^www\.example\.com$`,
+		`master/192.0.2.2:8080/0.api=^api\.example\.com$`,
+		`master/2001:db8::1/0.v6=^v6\.example\.com$`,
+		`master/[2001:db8::2]:8080/0.v6port=^v6port\.example\.com$`,
+	)
+	routes := a.Get("master").Routes
+	tests := []struct {
+		host string
+		want string
+	}{
+		// 接続先にポート番号が無い場合は元のポート番号を引き継ぐ。
+		{host: "www.example.com", want: "192.0.2.1"},
+		{host: "www.example.com:443", want: "192.0.2.1:443"},
+		{host: "v6.example.com", want: "[2001:db8::1]"},
+		{host: "v6.example.com:443", want: "[2001:db8::1]:443"},
+		// 接続先にポート番号がある場合は元のポート番号に関わらずそれを使用する。
+		{host: "api.example.com", want: "192.0.2.2:8080"},
+		{host: "api.example.com:443", want: "192.0.2.2:8080"},
+		{host: "v6port.example.com", want: "[2001:db8::2]:8080"},
+		{host: "v6port.example.com:443", want: "[2001:db8::2]:8080"},
+		// 一致しない場合はそのまま返す。
+		{host: "other.example.com:443", want: "other.example.com:443"},
+	}
+	for _, tt := range tests {
+		if got := routes.ReplaceHost(tt.host); got != tt.want {
+			t.Errorf("ReplaceHost(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestStatsAfterReload(t *testing.T) {
+	a := newStaticAccounts(t,
+		`reloadstats/192.0.2.1/0.www=^www\.example\.com$`,
+		`reloadstats/192.0.2.2/0.api=^api\.example\.com$`,
+	)
+	start := time.Now()
+	a.Get("reloadstats").Match("www.example.com")
+	a.Get("reloadstats").Match("api.example.com")
+
+	// 再構築後も同じアカウント、プライオリティ、パターン、接続先のルーティング情報は統計情報を引き継ぐ。
+	// 接続先が変わったものは別のルーティング情報として扱う。
+	a.StaticRoutes = []string{
+		`reloadstats/192.0.2.1/0.www=^www\.example\.com$`,
+		`reloadstats/192.0.2.3/0.api=^api\.example\.com$`,
+	}
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host    string
+		matches uint64
+	}{
+		{host: "192.0.2.1", matches: 1},
+		{host: "192.0.2.3", matches: 0},
+	}
+	for _, tt := range tests {
+		var route *Route
+		for _, r := range a.Get("reloadstats").Routes {
+			if r.Host == tt.host {
+				route = r
+			}
+		}
+		if route == nil {
+			t.Fatalf("no route to %s", tt.host)
+		}
+		if got := route.Matches(); got != tt.matches {
+			t.Errorf("%s: Matches = %d, want %d", tt.host, got, tt.matches)
+		}
+		if got := route.LastMatch(); got.IsZero() != (tt.matches == 0) || (!got.IsZero() && got.Before(start)) {
+			t.Errorf("%s: LastMatch = %v after reload", tt.host, got)
+		}
+	}
+}
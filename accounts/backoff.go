@@ -0,0 +1,42 @@
+package accounts
+
+import (
+	"math/rand"
+	"time"
+)
+
+// 監視が失敗した場合に再接続するまでの待ち時間の初期値と上限。
+const (
+	watchBackoffMin = time.Second
+	watchBackoffMax = 30 * time.Second
+)
+
+// backoff は失敗が続く度に待ち時間を倍に増やす指数バックオフ。
+// 多数のプロセスが同時に再接続しないよう、実際に待つ時間は待ち時間の半分から全体までの間でランダムに決める。
+type backoff struct {
+	min      time.Duration
+	max      time.Duration
+	next     time.Duration
+	failures int
+}
+
+// newBackoff は min から始まり max まで増える backoff を作成する。
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{min: min, max: max, next: min}
+}
+
+// wait は連続して失敗した回数を数えた上で、現在の待ち時間だけ待機し、次の待ち時間を倍にする。
+func (b *backoff) wait() {
+	b.failures++
+	d := b.next/2 + time.Duration(rand.Int63n(int64(b.next/2)+1))
+	if b.next *= 2; b.next > b.max {
+		b.next = b.max
+	}
+	time.Sleep(d)
+}
+
+// reset は成功した場合に呼び出し、待ち時間と失敗した回数を初期状態に戻す。
+func (b *backoff) reset() {
+	b.next = b.min
+	b.failures = 0
+}
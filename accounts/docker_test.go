@@ -0,0 +1,270 @@
+package accounts
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testContainer は dockerStub が返すコンテナ。
+// Names は一覧で返す名前で、省略した場合は "/" + Name のみを返す。
+type testContainer struct {
+	ID       string
+	Name     string
+	Names    []string
+	IP       string
+	IPv6     string
+	Networks map[string]containerAddress
+	Labels   map[string]string
+}
+
+// dockerStub は Docker Remote API のうち、コンテナの一覧と詳細、イベントのストリームに応答するサーバー。
+// inspectDelay を指定した場合はコンテナの詳細を返す前に待機し、同時に処理していた問い合わせの最大数を maxInspects に記録する。
+// events に送った文字列はイベントのストリームにそのまま書き込まれる。
+type dockerStub struct {
+	*httptest.Server
+	m            sync.Mutex
+	containers   []testContainer
+	inspectDelay time.Duration
+	inspects     int32
+	active       int32
+	maxInspects  int32
+	events       chan string
+}
+
+// newDockerStub は containers を返す dockerStub を起動する。
+func newDockerStub(t *testing.T, containers ...testContainer) *dockerStub {
+	t.Helper()
+	d := &dockerStub{containers: containers, events: make(chan string, 16)}
+	d.Server = httptest.NewServer(http.HandlerFunc(d.serve))
+	t.Cleanup(d.Close)
+	return d
+}
+
+// set は返すコンテナを containers に差し替える。
+func (d *dockerStub) set(containers ...testContainer) {
+	d.m.Lock()
+	d.containers = containers
+	d.m.Unlock()
+}
+
+func (d *dockerStub) serve(w http.ResponseWriter, r *http.Request) {
+	d.m.Lock()
+	containers := d.containers
+	d.m.Unlock()
+
+	switch {
+	case r.URL.Path == "/containers/json":
+		list := []map[string]interface{}{}
+		for _, c := range containers {
+			names := c.Names
+			if names == nil {
+				names = []string{"/" + c.Name}
+			}
+			list = append(list, map[string]interface{}{"Id": c.ID, "Names": names})
+		}
+		json.NewEncoder(w).Encode(list)
+
+	case strings.HasPrefix(r.URL.Path, "/containers/") && strings.HasSuffix(r.URL.Path, "/json"):
+		atomic.AddInt32(&d.inspects, 1)
+		n := atomic.AddInt32(&d.active, 1)
+		defer atomic.AddInt32(&d.active, -1)
+		for {
+			max := atomic.LoadInt32(&d.maxInspects)
+			if n <= max || atomic.CompareAndSwapInt32(&d.maxInspects, max, n) {
+				break
+			}
+		}
+		time.Sleep(d.inspectDelay)
+
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")
+		for _, c := range containers {
+			if c.ID != id && c.Name != id {
+				continue
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Id":     c.ID,
+				"Name":   "/" + c.Name,
+				"Config": map[string]interface{}{"Labels": c.Labels},
+				"NetworkSettings": map[string]interface{}{
+					"IPAddress":         c.IP,
+					"GlobalIPv6Address": c.IPv6,
+					"Networks":          c.Networks,
+				},
+			})
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "No such container: " + id})
+
+	case r.URL.Path == "/events":
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case e := <-d.events:
+				w.Write([]byte(e))
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestContainerAliases(t *testing.T) {
+	names := []string{"/web", "/web", "/app/web", "/app/web", "/api/backend", "/worker/web", "/app/web"}
+	for i := 0; i < 100; i++ {
+		names = append(names, "/app/web")
+	}
+	docker := newDockerStub(t, testContainer{ID: "1", Name: "web", Names: names, IP: "172.17.0.2"})
+
+	tests := []struct {
+		name       string
+		maxAliases int
+		want       []string
+	}{
+		{name: "unlimited", want: []string{"/api/backend", "/app/web", "/worker/web", "web"}},
+		{name: "limited", maxAliases: 2, want: []string{"/api/backend", "/app/web", "web"}},
+		// 本来の名前("/web" を含む)は上限に数えずに登録する。
+		{name: "one alias", maxAliases: 1, want: []string{"/app/web", "web"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			containers, err := getContainers(docker.URL, "", tt.maxAliases, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for name, c := range containers {
+				got = append(got, name)
+				if c != containers["web"] {
+					t.Errorf("%s is registered as a different container", name)
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("names = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	containers := []testContainer{
+		{ID: "1", Name: "web-1", IP: "172.17.0.2", Labels: map[string]string{LabelPrefix + "unix.10.web": `^www\.example\.com$`}},
+		{ID: "2", Name: "web-2", IP: "172.17.0.3", Labels: map[string]string{LabelPrefix + "unix.10.web": `^www\.example\.com$`}},
+		{ID: "3", Name: "api", IP: "172.17.0.4", Labels: map[string]string{LabelPrefix + "unix.10.api": `^api\.example\.com$`}},
+	}
+
+	tests := []struct {
+		name    string
+		reloads int
+	}{
+		{name: "single reload", reloads: 1},
+		{name: "repeated reloads", reloads: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 接続の使い回しはソケットのパスごとに共有されるため、テストごとに別のソケットを使用する。
+			socket := filepath.Join(t.TempDir(), "docker.sock")
+			ln, err := net.Listen("unix", socket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := &dockerStub{containers: containers, events: make(chan string, 16)}
+			d.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Host != "docker" || r.ProtoMajor != 1 || r.ProtoMinor != 1 {
+					t.Errorf("request %s %s, Host = %q", r.Proto, r.URL, r.Host)
+				}
+				d.serve(w, r)
+			}))
+			d.Listener = ln
+			var conns int32
+			d.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt32(&conns, 1)
+				}
+			}
+			d.Start()
+			t.Cleanup(d.Close)
+
+			a := New("unix://"+socket+":", "", "/proxy")
+			a.DockerConcurrency = 1
+			for i := 0; i < tt.reloads; i++ {
+				if err := a.Reload(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := routeHosts(a.Get("unix")); got != "172.17.0.2,172.17.0.3,172.17.0.4" {
+				t.Errorf("targets = %q", got)
+			}
+			if got := atomic.LoadInt32(&d.inspects); got != int32(3*tt.reloads) {
+				t.Errorf("inspects = %d, want %d", got, 3*tt.reloads)
+			}
+			// 一覧と全てのコンテナの詳細の問い合わせが一つの接続で行われる。
+			if got := atomic.LoadInt32(&conns); got != 1 {
+				t.Errorf("connections = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestDockerConcurrency(t *testing.T) {
+	var containers []testContainer
+	var routes, hosts []string
+	for i := 0; i < 12; i++ {
+		name := "web-" + strconv.Itoa(i)
+		ip := "172.17.0." + strconv.Itoa(i+2)
+		containers = append(containers, testContainer{ID: strconv.Itoa(i), Name: name, IP: ip})
+		routes = append(routes, `concurrency/`+name+`.container/0.`+name+`=^`+name+`\.example\.com$`)
+		hosts = append(hosts, ip)
+	}
+	sort.Strings(hosts)
+
+	tests := []struct {
+		concurrency int
+		// max は同時に問い合わせてよい数。
+		max int32
+	}{
+		{concurrency: 0, max: 1},
+		{concurrency: 1, max: 1},
+		{concurrency: 4, max: 4},
+		{concurrency: 100, max: 12},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.concurrency), func(t *testing.T) {
+			docker := newDockerStub(t, containers...)
+			docker.inspectDelay = 50 * time.Millisecond
+
+			a := New(docker.URL, "", "/proxy")
+			a.StaticRoutes = routes
+			a.DockerConcurrency = tt.concurrency
+			if err := a.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			if got := routeHosts(a.Get("concurrency")); got != strings.Join(hosts, ",") {
+				t.Errorf("targets = %q", got)
+			}
+			got := atomic.LoadInt32(&docker.maxInspects)
+			if got > tt.max {
+				t.Errorf("concurrent inspects = %d, want at most %d", got, tt.max)
+			}
+			if tt.max > 1 && got < 2 {
+				t.Errorf("concurrent inspects = %d, want inspects in parallel", got)
+			}
+		})
+	}
+}
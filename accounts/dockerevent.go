@@ -0,0 +1,107 @@
+package accounts
+
+import (
+	"log"
+	"strings"
+)
+
+// incremental はイベントが applyContainerEvent で全体を再構築せずに反映できる種類であれば true を返す。
+func (e *dockerEvent) incremental() bool {
+	typ, action := e.action()
+	if typ != "container" {
+		return false
+	}
+	switch action {
+	case "start", "die", "destroy":
+		return true
+	}
+	return false
+}
+
+// containerID はイベントの対象のコンテナの ID を返す。
+func (e *dockerEvent) containerID() string {
+	if e.ID != "" {
+		return e.ID
+	}
+	return e.Actor.ID
+}
+
+// applyContainerEvent はコンテナの起動や終了のイベント e を、保持しているコンテナ情報にのみ反映する。
+// 起動した場合はそのコンテナの詳細を Docker Remote API に問い合わせて差し替え、終了や削除の場合は取り除く。
+// 戻り値はそのコンテナを参照しているためにルーティング情報を再構築する必要があるアカウントの名前。
+// コンテナの問い合わせに失敗した場合など、全体を再構築する必要がある場合は false を返す。
+// Reload と同様に、他の再構築とは排他して行う。
+func (a *Accounts) applyContainerEvent(e *dockerEvent) (map[string]bool, bool) {
+	id := e.containerID()
+	if id == "" {
+		return nil, false
+	}
+	_, action := e.action()
+
+	a.reload.Lock()
+	defer a.reload.Unlock()
+
+	a.m.Lock()
+	current, containers := a.accounts, a.containers
+	a.m.Unlock()
+
+	// 現在の一覧から対象のコンテナを取り除いた新しい一覧を作る。
+	var old *Container
+	var oldNames []string
+	updated := make(map[string]*Container, len(containers)+1)
+	for name, c := range containers {
+		if c.ID == id {
+			old = c
+			oldNames = append(oldNames, name)
+			continue
+		}
+		updated[name] = c
+	}
+
+	var c *Container
+	if action == "start" {
+		var err error
+		if c, err = inspectContainer(a.DockerAddr, a.DockerNetwork, id); err != nil || c == nil {
+			log.Println("failed to inspect started container:", id, "Error:", err)
+			return nil, false
+		}
+		// 再起動した場合はリンク時の名前も引き継ぐ。
+		// 新しく起動したコンテナのリンク時の名前は次に全体を再構築するまで登録されない。
+		updated[c.Name] = c
+		for _, name := range oldNames {
+			updated[name] = c
+		}
+	}
+
+	affected := make(map[string]bool)
+	for _, x := range []*Container{old, c} {
+		if x == nil {
+			continue
+		}
+		names := map[string]bool{x.Name: true}
+		for _, name := range oldNames {
+			names[name] = true
+		}
+		for name, account := range current {
+			for ref := range account.containerRefs {
+				if matchRef(ref, names) {
+					affected[name] = true
+				}
+			}
+		}
+		for label := range x.Labels {
+			if strings.HasPrefix(label, LabelPrefix) {
+				affected[strings.SplitN(label[len(LabelPrefix):], ".", 2)[0]] = true
+			}
+		}
+	}
+
+	if old == nil && c == nil {
+		return affected, true
+	}
+	if err := a.commit(current, updated); err != nil {
+		log.Println("applyContainerEvent:", err)
+		return nil, false
+	}
+	return affected, true
+}
@@ -0,0 +1,300 @@
+package accounts
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdV3Timeout は etcd v3 API への接続と問い合わせを待つ最大時間。
+const etcdV3Timeout = 5 * time.Second
+
+// etcdGet は EtcdAPIVersion に従って etcd から key 以下のノードを再帰的に取得する。
+// key が存在しない場合は nil を返す。
+// 取得した時点の etcd のインデックス(v3 API の場合はリビジョン)も返す。取得したノードはこの時点までの変更を反映している。
+func (a *Accounts) etcdGet(key string) (*etcd.Node, uint64, error) {
+	switch a.EtcdAPIVersion {
+	case 0, 2:
+		return a.etcdGetV2(key)
+	case 3:
+		return a.etcdGetV3(key)
+	}
+	return nil, 0, fmt.Errorf("unsupported etcd API version: %d", a.EtcdAPIVersion)
+}
+
+// TLSFiles は TLS で接続する際に使用する証明書のファイル。
+// CACert は接続先のサーバー証明書を検証する CA 証明書で、省略した場合はシステムの CA 証明書を使用する。
+// Cert と Key はクライアント証明書とその秘密鍵で、クライアント証明書による認証が必要な場合に両方を指定する。
+type TLSFiles struct {
+	CACert string
+	Cert   string
+	Key    string
+}
+
+// Enabled はいずれかのファイルが指定されているかを返す。
+func (f TLSFiles) Enabled() bool {
+	return f.CACert != "" || f.Cert != "" || f.Key != ""
+}
+
+// Config はファイルを読み込んで tls.Config を作成する。
+// ファイルが読み込めない場合や、Cert と Key の一方しか指定されていない場合はエラーを返す。
+func (f TLSFiles) Config() (*tls.Config, error) {
+	if (f.Cert == "") != (f.Key == "") {
+		return nil, errors.New("client certificate and key must be specified together")
+	}
+	config := &tls.Config{}
+	if f.CACert != "" {
+		pem, err := os.ReadFile(f.CACert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", f.CACert)
+		}
+	}
+	if f.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// etcdClient は etcd v2 API のクライアントを作成する。
+// EtcdTLS が指定されている場合は TLS で接続し、EtcdUsername が指定されている場合は認証情報を設定する。
+// etcd.NewTLSClient はクライアント証明書を必須とし、サーバー証明書も検証しないため、
+// v3 API と同じく TLSFiles.Config で作成した設定を使用する Transport に差し替える。
+func (a *Accounts) etcdClient() (*etcd.Client, error) {
+	c := etcd.NewClient([]string{a.EtcdAddr})
+	if a.EtcdTLS.Enabled() {
+		config, err := a.EtcdTLS.Config()
+		if err != nil {
+			return nil, err
+		}
+		// go-etcd の既定の接続と同様に、接続先の停止を検知できるよう短い間隔で TCP のキープアライブを行う。
+		d := &net.Dialer{Timeout: time.Second, KeepAlive: time.Second}
+		c.SetTransport(&http.Transport{DialContext: d.DialContext, TLSClientConfig: config})
+	}
+	if a.EtcdUsername != "" {
+		c.SetCredentials(a.EtcdUsername, a.EtcdPassword)
+	}
+	return c, nil
+}
+
+// etcdClientV3 は etcd v3 API のクライアントを作成する。
+// EtcdTLS が指定されている場合は TLS で接続し、EtcdUsername が指定されている場合は認証情報を設定する。
+func (a *Accounts) etcdClientV3() (*clientv3.Client, error) {
+	config := clientv3.Config{
+		Endpoints:   []string{a.EtcdAddr},
+		DialTimeout: etcdV3Timeout,
+		Username:    a.EtcdUsername,
+		Password:    a.EtcdPassword,
+	}
+	if a.EtcdTLS.Enabled() {
+		var err error
+		if config.TLS, err = a.EtcdTLS.Config(); err != nil {
+			return nil, err
+		}
+	}
+	return clientv3.New(config)
+}
+
+// etcdGetV2 は etcd v2 API で key 以下のノードを取得する。
+func (a *Accounts) etcdGetV2(key string) (*etcd.Node, uint64, error) {
+	etcdClient, err := a.etcdClient()
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err := etcdClient.Get(key, false, true)
+	if err != nil {
+		// key not found
+		etcderr, ok := err.(etcd.EtcdError)
+		if !ok || etcderr.ErrorCode != 100 {
+			return nil, 0, err
+		}
+		return nil, etcderr.Index, nil
+	}
+	return r.Node, r.EtcdIndex, nil
+}
+
+// etcdGetV3 は etcd v3 API で key 以下のキーを取得し、v2 API と同じ階層構造のノードとして組み立てる。
+// v3 API にはディレクトリが無いため、"/" で区切られたキーの途中までをディレクトリとして扱う。
+func (a *Accounts) etcdGetV3(key string) (*etcd.Node, uint64, error) {
+	cli, err := a.etcdClientV3()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdV3Timeout)
+	defer cancel()
+	key = strings.TrimSuffix(key, "/")
+	r, err := cli.Get(ctx, key+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	revision := uint64(r.Header.Revision)
+	if len(r.Kvs) == 0 {
+		return nil, revision, nil
+	}
+
+	root := &etcd.Node{Key: key, Dir: true}
+	dirs := map[string]*etcd.Node{key: root}
+	for _, kv := range r.Kvs {
+		addNode(root, dirs, string(kv.Key)[len(key):], string(kv.Value))
+	}
+	sortNodes(root)
+	return root, revision, nil
+}
+
+// addNode は root 以下の相対的なキー rel に値 value のノードを追加し、途中のディレクトリが無ければ作成する。
+// dirs には root 以下のディレクトリのノードをキーから引けるよう保持しておき、作成したディレクトリも追加する。
+func addNode(root *etcd.Node, dirs map[string]*etcd.Node, rel, value string) {
+	parent := root
+	parts := strings.Split(strings.Trim(rel, "/"), "/")
+	for i, part := range parts {
+		k := parent.Key + "/" + part
+		if i == len(parts)-1 {
+			parent.Nodes = append(parent.Nodes, &etcd.Node{Key: k, Value: value})
+			return
+		}
+		dir, ok := dirs[k]
+		if !ok {
+			dir = &etcd.Node{Key: k, Dir: true}
+			dirs[k] = dir
+			parent.Nodes = append(parent.Nodes, dir)
+		}
+		parent = dir
+	}
+}
+
+// sortNodes は n 以下のノードをキーの順に並び替える。
+func sortNodes(n *etcd.Node) {
+	sort.Slice(n.Nodes, func(i, j int) bool { return n.Nodes[i].Key < n.Nodes[j].Key })
+	for _, c := range n.Nodes {
+		sortNodes(c)
+	}
+}
+
+// etcdRecreateAfter は監視がこの回数続けて失敗した場合に etcd v2 API のクライアントを作り直す回数。
+const etcdRecreateAfter = 3
+
+// watchEtcdEvent は etcd のイベントを検出する度に recv にイベント内容を投げる。
+// v3 API の場合もイベントは v2 API の形式に変換して投げる。
+// 監視が途切れた場合は待ち時間を指数的に増やしながら再接続し、イベントを受信できた時点で待ち時間を元に戻す。
+func (a *Accounts) watchEtcdEvent(recv chan *etcd.Response) error {
+	if a.EtcdAPIVersion == 3 {
+		return a.watchEtcdEventV3(recv)
+	}
+
+	b := newBackoff(watchBackoffMin, watchBackoffMax)
+	var etcdClient *etcd.Client
+	for {
+		// 接続に問題が残っている可能性があるため、失敗が続いた場合はクライアントを作り直す。
+		if etcdClient == nil || b.failures >= etcdRecreateAfter {
+			c, err := a.etcdClient()
+			if err != nil {
+				log.Println("watchEtcdEvent:", err)
+				b.wait()
+				continue
+			}
+			etcdClient = c
+		}
+
+		// Watch は終了時に受信用のチャンネルを閉じるため、監視の度に新しいチャンネルを渡す。
+		ch := make(chan *etcd.Response)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := etcdClient.Watch(a.EtcdRoot, 0, true, ch, nil)
+			errc <- err
+		}()
+		a.setWatching(&a.etcdWatching, true)
+		received := false
+		for r := range ch {
+			received = true
+			recv <- r
+		}
+		a.setWatching(&a.etcdWatching, false)
+		if received {
+			b.reset()
+		}
+		if err := <-errc; err != nil {
+			log.Println("watchEtcdEvent:", err)
+		}
+		b.wait()
+	}
+}
+
+// watchEtcdEventV3 は etcd v3 API の Watch で EtcdRoot 以下の変更を監視する。
+// 監視が途切れる度にクライアントを作り直す。
+func (a *Accounts) watchEtcdEventV3(recv chan *etcd.Response) error {
+	b := newBackoff(watchBackoffMin, watchBackoffMax)
+	for {
+		cli, err := a.etcdClientV3()
+		if err != nil {
+			log.Println("watchEtcdEvent:", err)
+			b.wait()
+			continue
+		}
+
+		a.setWatching(&a.etcdWatching, true)
+		for wr := range cli.Watch(context.Background(), strings.TrimSuffix(a.EtcdRoot, "/")+"/", clientv3.WithPrefix()) {
+			if err := wr.Err(); err != nil {
+				log.Println("watchEtcdEvent:", err)
+				break
+			}
+			b.reset()
+			for _, ev := range wr.Events {
+				action := "set"
+				if ev.Type == clientv3.EventTypeDelete {
+					action = "delete"
+				}
+				recv <- &etcd.Response{
+					Action: action,
+					Node: &etcd.Node{
+						Key:           string(ev.Kv.Key),
+						Value:         string(ev.Kv.Value),
+						ModifiedIndex: uint64(ev.Kv.ModRevision),
+					},
+				}
+			}
+		}
+		a.setWatching(&a.etcdWatching, false)
+		cli.Close()
+		b.wait()
+	}
+}
+
+// setEtcdIndex は Reload で読み込んだルーティング情報が反映している etcd のインデックス index を記録する。
+func (a *Accounts) setEtcdIndex(index uint64) {
+	a.m.Lock()
+	a.etcdIndex = index
+	a.m.Unlock()
+}
+
+// alreadyLoaded は etcd のイベント r が、直前の Reload で読み込んだ時点までに行われた変更であれば true を返す。
+// Watch の開始直後に通知される読み込み済みの変更で、ルーティング情報を作り直さないために使用する。
+// インデックスが分からない場合は false を返す。
+func (a *Accounts) alreadyLoaded(r *etcd.Response) bool {
+	if r == nil || r.Node == nil || r.Node.ModifiedIndex == 0 {
+		return false
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	return r.Node.ModifiedIndex <= a.etcdIndex
+}
@@ -0,0 +1,121 @@
+package accounts
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// etcdV2Tree は master アカウントの www.example.com を host へ差し替えるルーティング情報を、
+// etcd v2 API の GET /v2/keys/proxy?recursive=true に対する応答の形式で返す。
+func etcdV2Tree(host string) string {
+	return `{"action":"get","node":{"key":"/proxy","dir":true,"nodes":[` + etcdV2Account(host) + `]}}`
+}
+
+// etcdV2Account は etcdV2Tree の master アカウントのノードを返す。
+func etcdV2Account(host string) string {
+	return `{"key":"/proxy/master","dir":true,"nodes":[
+		{"key":"/proxy/master/` + host + `","dir":true,"nodes":[
+			{"key":"/proxy/master/` + host + `/0.www","value":"^www\\.example\\.com$"}
+		]}
+	]}`
+}
+
+// writePEM は block を PEM 形式で dir 以下の name に書き込み、そのパスを返す。
+func writePEM(t *testing.T, dir, name string, block *pem.Block) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// writeSelfSigned は自己署名証明書とその秘密鍵を dir 以下に書き込み、それぞれのパスを返す。
+func writeSelfSigned(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, dir, name+".crt", &pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		writePEM(t, dir, name+".key", &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestEtcdV2TLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Etcd-Index", "7")
+		io.WriteString(w, etcdV2Tree("192.0.2.1"))
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	serverCA := writePEM(t, dir, "server.crt", &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	otherCA, _ := writeSelfSigned(t, dir, "other")
+	clientCert, clientKey := writeSelfSigned(t, dir, "client")
+
+	tests := []struct {
+		name    string
+		tls     TLSFiles
+		wantErr bool
+	}{
+		// クライアント証明書を使用せずに CA 証明書のみを指定できること。
+		{name: "CA only", tls: TLSFiles{CACert: serverCA}},
+		{name: "CA and client certificate", tls: TLSFiles{CACert: serverCA, Cert: clientCert, Key: clientKey}},
+		// サーバー証明書を検証すること。
+		{name: "untrusted server", tls: TLSFiles{CACert: otherCA}, wantErr: true},
+		{name: "certificate without key", tls: TLSFiles{CACert: serverCA, Cert: clientCert}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New("", ts.URL, "/proxy")
+			a.EtcdTLS = tt.tls
+			err := a.Reload()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			account := a.Get("master")
+			if account == nil {
+				t.Fatal("account master not loaded")
+			}
+			if route, newHost := account.Match("www.example.com"); route == nil || newHost != "192.0.2.1" {
+				t.Errorf("Match = %v, %q, want 192.0.2.1", route, newHost)
+			}
+		})
+	}
+}
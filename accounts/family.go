@@ -0,0 +1,50 @@
+package accounts
+
+import "fmt"
+
+// AddressFamily はコンテナが IPv4 と IPv6 の両方のアドレスを持つ場合に、どちらを接続先として使用するかを表す。
+type AddressFamily string
+
+const (
+	// PreferIPv4 は IPv4 アドレスを優先し、存在しない場合は IPv6 アドレスを使用する。
+	PreferIPv4 AddressFamily = "prefer-ipv4"
+	// PreferIPv6 は IPv6 アドレスを優先し、存在しない場合は IPv4 アドレスを使用する。
+	PreferIPv6 AddressFamily = "prefer-ipv6"
+	// IPv4Only は IPv4 アドレスのみを使用する。
+	IPv4Only AddressFamily = "ipv4-only"
+	// IPv6Only は IPv6 アドレスのみを使用する。
+	IPv6Only AddressFamily = "ipv6-only"
+)
+
+// ParseAddressFamily は s を AddressFamily として解釈する。
+// s が空文字列の場合は PreferIPv4 を返す。
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch f := AddressFamily(s); f {
+	case "":
+		return PreferIPv4, nil
+	case PreferIPv4, PreferIPv6, IPv4Only, IPv6Only:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown address family: %q", s)
+}
+
+// Select は f に従って c の接続先として使用するアドレスを返す。
+// 該当するアドレスが存在しない場合は空文字列を返す。
+// f が空文字列の場合は PreferIPv4 として扱う。
+func (f AddressFamily) Select(c *Container) string {
+	switch f {
+	case PreferIPv6:
+		if c.IPv6Address != "" {
+			return c.IPv6Address
+		}
+		return c.IPAddress
+	case IPv4Only:
+		return c.IPAddress
+	case IPv6Only:
+		return c.IPv6Address
+	}
+	if c.IPAddress != "" {
+		return c.IPAddress
+	}
+	return c.IPv6Address
+}
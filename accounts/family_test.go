@@ -0,0 +1,75 @@
+package accounts
+
+import "testing"
+
+func TestAddressFamily(t *testing.T) {
+	docker := newDockerStub(t,
+		testContainer{ID: "1", Name: "dual", IP: "172.17.0.2", IPv6: "2001:db8::2"},
+		testContainer{ID: "2", Name: "v4", IP: "172.17.0.3"},
+		testContainer{ID: "3", Name: "v6", IPv6: "2001:db8::4"},
+	)
+
+	tests := []struct {
+		family    AddressFamily
+		container string
+		port      string
+		want      string
+	}{
+		{family: PreferIPv4, container: "dual", want: "172.17.0.2"},
+		{family: PreferIPv6, container: "dual", want: "2001:db8::2"},
+		{family: IPv4Only, container: "dual", want: "172.17.0.2"},
+		{family: IPv6Only, container: "dual", want: "2001:db8::2"},
+		{family: PreferIPv4, container: "v6", want: "2001:db8::4"},
+		{family: PreferIPv6, container: "v4", want: "172.17.0.3"},
+		{family: IPv4Only, container: "v6", want: ""},
+		{family: IPv6Only, container: "v4", want: ""},
+		{family: PreferIPv6, container: "dual", port: "8080", want: "[2001:db8::2]:8080"},
+		{family: PreferIPv4, container: "dual", port: "8080", want: "172.17.0.2:8080"},
+	}
+	for _, tt := range tests {
+		target := tt.container + ".container"
+		if tt.port != "" {
+			target += ":" + tt.port
+		}
+		t.Run(string(tt.family)+"/"+target, func(t *testing.T) {
+			a := New(docker.URL, "", "/proxy")
+			a.AddressFamily = tt.family
+			a.StaticRoutes = []string{`family/` + target + `/0.www=^www\.example\.com$`}
+			if err := a.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if account := a.Get("family"); account != nil {
+				got = routeHosts(account)
+			}
+			if got != tt.want {
+				t.Errorf("host = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAddressFamily(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    AddressFamily
+		wantErr bool
+	}{
+		{in: "", want: PreferIPv4},
+		{in: "prefer-ipv4", want: PreferIPv4},
+		{in: "prefer-ipv6", want: PreferIPv6},
+		{in: "ipv4-only", want: IPv4Only},
+		{in: "ipv6-only", want: IPv6Only},
+		{in: "ipv6", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAddressFamily(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAddressFamily(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseAddressFamily(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
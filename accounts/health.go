@@ -0,0 +1,223 @@
+package accounts
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultHealthPort は Route.HealthPort が指定されていない場合にヘルスチェックで接続するポート。
+const defaultHealthPort = 80
+
+// health はヘルスチェックの結果を保持する。
+// ルーティング情報は Reload の度に作り直されるため、結果は接続先のアドレスをキーとして Accounts 側で保持する。
+type health struct {
+	m    sync.Mutex
+	down map[string]bool
+}
+
+// newHealth は health を新規作成する。
+func newHealth() *health {
+	return &health{down: make(map[string]bool)}
+}
+
+// isDown は addr がヘルスチェックに失敗している場合に true を返す。
+func (h *health) isDown(addr string) bool {
+	if h == nil {
+		return false
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.down[addr]
+}
+
+// ヘルスチェックの方法(Route.HealthCheck を参照)。
+const (
+	// HealthCheckTCP は HealthPort へ TCP で接続できるかを確認する。
+	HealthCheckTCP = "tcp"
+	// HealthCheckHTTP は HealthPort の HealthPath へ GET で要求し、2xx か 3xx の応答が返るかを確認する。
+	HealthCheckHTTP = "http"
+)
+
+// checked はこのルーティング情報の接続先がヘルスチェックの対象であれば true を返す。
+func (r *Route) checked() bool {
+	return r.Backup != "" || r.HealthCheck != ""
+}
+
+// targets はこのルーティング情報の全ての接続先を返す。
+func (r *Route) targets() []string {
+	if len(r.Hosts) > 0 {
+		return r.Hosts
+	}
+	return []string{r.Host}
+}
+
+// healthAddr はヘルスチェックで接続するアドレスを返す。
+func (r *Route) healthAddr() string {
+	return r.healthAddrOf(r.Host)
+}
+
+// healthAddrOf は接続先 host のヘルスチェックで接続するアドレスを返す。
+// HealthPort が指定されていない場合は host のポート番号を、それも無い場合は defaultHealthPort を使用する。
+func (r *Route) healthAddrOf(host string) string {
+	host, port := SplitTarget(host)
+	if r.HealthPort != 0 || port == "" {
+		p := r.HealthPort
+		if p == 0 {
+			p = defaultHealthPort
+		}
+		port = strconv.Itoa(int(p))
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// healthKey は接続先 host のヘルスチェックの結果を保持する際のキーを返す。
+// HealthCheckHTTP の場合は要求する URL、それ以外の場合は接続するアドレスになる。
+func (r *Route) healthKey(host string) string {
+	if r.HealthCheck != HealthCheckHTTP {
+		return r.healthAddrOf(host)
+	}
+	path := r.HealthPath
+	if path == "" {
+		path = "/"
+	}
+	return "http://" + r.healthAddrOf(host) + path
+}
+
+// Target は実際に接続する先を返す。
+// Hosts が複数ある場合は呼び出しの度に重みに従って順に返し、それ以外の場合は Host を返す。
+// 全ての接続先の重みが 0 の場合は、接続先が一つの場合も含めて空文字列を返す。
+// ヘルスチェックの対象の場合は失敗している接続先を飛ばし、全ての接続先が失敗している場合は Backup を返す。
+// Backup も指定されていない場合は空文字列を返す。
+func (r *Route) Target() string {
+	if !r.checked() {
+		return r.nextHost()
+	}
+	for i, n := 0, r.rotation(); i < n; i++ {
+		if host := r.nextHost(); host != "" && !r.health.isDown(r.healthKey(host)) {
+			return host
+		}
+	}
+	return r.Backup
+}
+
+// CheckHealth は HealthCheckInterval ごとにヘルスチェックの対象の全ての接続先を確認し、
+// 失敗した接続先を振り分けの対象から外す。確認に成功するようになった時点で振り分けの対象に戻す。
+// HealthCheckInterval が 0 以下の場合は何もせずに戻る。
+func (a *Accounts) CheckHealth() {
+	if a.HealthCheckInterval <= 0 {
+		return
+	}
+	for {
+		a.checkHealth(a.HealthCheckTimeout)
+		time.Sleep(a.HealthCheckInterval)
+	}
+}
+
+// probe はヘルスチェックのキー key (Route.healthKey を参照)が表す接続先を一度確認する。
+func probe(client *http.Client, key string, timeout time.Duration) error {
+	if !strings.HasPrefix(key, "http://") {
+		c, err := net.DialTimeout("tcp", key, timeout)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+	res, err := client.Get(key)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	return nil
+}
+
+// checkHealth は全ての対象に対して一度ずつヘルスチェックを行う。
+func (a *Accounts) checkHealth(timeout time.Duration) {
+	type checkedRoute struct {
+		account string
+		route   *Route
+	}
+	var routes []checkedRoute
+	targets := make(map[string]bool)
+	for _, account := range a.get() {
+		for _, route := range account.Routes {
+			if !route.checked() {
+				continue
+			}
+			routes = append(routes, checkedRoute{account.Name, route})
+			for _, host := range route.targets() {
+				targets[route.healthKey(host)] = true
+			}
+		}
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		// 毎回新たに接続して確認するため、接続を使い回さない。環境変数のプロキシーの設定も使用しない。
+		Transport: &http.Transport{DisableKeepAlives: true},
+		// リダイレクトの応答自体を成功として扱うため、リダイレクト先へは要求しない。
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var m sync.Mutex
+	down := make(map[string]bool)
+	var wg sync.WaitGroup
+	for key := range targets {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			if err := probe(client, key, timeout); err != nil {
+				m.Lock()
+				down[key] = true
+				m.Unlock()
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	a.health.m.Lock()
+	old := a.health.down
+	for key := range targets {
+		if down[key] != old[key] {
+			if down[key] {
+				log.Println("health check failed:", key)
+			} else {
+				log.Println("health check recovered:", key)
+			}
+		}
+	}
+	a.health.down = down
+	a.health.m.Unlock()
+
+	// 全ての接続先が失敗しているルーティング情報は、状態が変わった時点で記録する。
+	for _, c := range routes {
+		wasDown, isDown := true, true
+		for _, host := range c.route.targets() {
+			key := c.route.healthKey(host)
+			wasDown = wasDown && old[key]
+			isDown = isDown && down[key]
+		}
+		if isDown == wasDown {
+			continue
+		}
+		switch {
+		case !isDown:
+			log.Println("route targets recovered:", c.route.Pattern(), "Account:", c.account)
+		case c.route.Backup != "":
+			log.Println("all route targets are down, failing over to backup:", c.route.Pattern(), "Backup:", c.route.Backup, "Account:", c.account)
+		default:
+			log.Println("all route targets are down, passing the original host through:", c.route.Pattern(), "Account:", c.account)
+		}
+	}
+}
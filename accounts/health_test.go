@@ -0,0 +1,127 @@
+package accounts
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFailover(t *testing.T) {
+	// healthy が 0 の間はヘルスチェックに 503 を返す。
+	var healthy int32 = 1
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer primary.Close()
+	addr := primary.Listener.Addr().String()
+
+	a := newStaticAccounts(t,
+		`failover/`+addr+`/0.app=^app\.test$`,
+		`failover/`+addr+`/_backup=192.0.2.10:8080`,
+		`failover/`+addr+`/_health_check=http`,
+		`nobackup/`+addr+`/0.app=^app\.test$`,
+		`nobackup/`+addr+`/_health_check=http`,
+	)
+
+	// 各段階は順に実行し、前の段階のヘルスチェックの結果を引き継ぐ。
+	tests := []struct {
+		name     string
+		healthy  bool
+		want     string
+		noBackup string
+	}{
+		{name: "primary healthy", healthy: true, want: addr, noBackup: addr},
+		{name: "primary down", healthy: false, want: "192.0.2.10:8080", noBackup: ""},
+		{name: "still down", healthy: false, want: "192.0.2.10:8080", noBackup: ""},
+		{name: "primary recovered", healthy: true, want: addr, noBackup: addr},
+	}
+	for _, tt := range tests {
+		if tt.healthy {
+			atomic.StoreInt32(&healthy, 1)
+		} else {
+			atomic.StoreInt32(&healthy, 0)
+		}
+		a.checkHealth(time.Second)
+		if got := a.Get("failover").Routes[0].Target(); got != tt.want {
+			t.Errorf("%s: Target = %q, want %q", tt.name, got, tt.want)
+		}
+		if got := a.Get("nobackup").Routes[0].Target(); got != tt.noBackup {
+			t.Errorf("%s: Target without backup = %q, want %q", tt.name, got, tt.noBackup)
+		}
+	}
+}
+
+func TestTCPHealthCheck(t *testing.T) {
+	// listen は addr で Listen し、閉じるまでの間は TCP のヘルスチェックに成功する。
+	listen := func(addr string) net.Listener {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		return ln
+	}
+	lnA, lnB := listen("127.0.0.1:0"), listen("127.0.0.1:0")
+	a1, b1 := lnA.Addr().String(), lnB.Addr().String()
+
+	// 同じプライオリティとパターンのルーティング情報は一つにまとめられ、接続先へ順に振り分けられる。
+	a := newStaticAccounts(t,
+		`health/`+a1+`/0.app=^app\.test$`,
+		`health/`+a1+`/_health_check=tcp`,
+		`health/`+b1+`/0.app=^app\.test$`,
+		`health/`+b1+`/_health_check=tcp`,
+	)
+	all := []string{a1, b1}
+	sort.Strings(all)
+
+	// 各段階は順に実行し、前の段階で閉じた接続先は再び Listen するまで閉じたままになる。
+	tests := []struct {
+		name  string
+		close []net.Listener
+		open  []string
+		// want は 4 回照合した際に振り分けられる接続先の集合で、nil の場合は元のホスト名のまま差し替えない。
+		want []string
+	}{
+		{name: "all healthy", want: all},
+		{name: "one down", close: []net.Listener{lnB}, want: []string{a1}},
+		{name: "all down", close: []net.Listener{lnA}},
+		{name: "recovered", open: []string{a1, b1}, want: all},
+	}
+	for _, tt := range tests {
+		for _, ln := range tt.close {
+			ln.Close()
+		}
+		for _, addr := range tt.open {
+			listen(addr)
+		}
+		a.checkHealth(time.Second)
+
+		seen := make(map[string]bool)
+		for i := 0; i < 4; i++ {
+			route, newHost := a.Get("health").Match("app.test")
+			if route == nil {
+				t.Fatalf("%s: app.test does not match", tt.name)
+			}
+			seen[newHost] = true
+		}
+		var got []string
+		for host := range seen {
+			got = append(got, host)
+		}
+		sort.Strings(got)
+		want := tt.want
+		if want == nil {
+			want = []string{"app.test"}
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: targets = %v, want %v", tt.name, got, want)
+		}
+	}
+}
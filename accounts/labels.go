@@ -0,0 +1,236 @@
+package accounts
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// LabelPrefix は Docker コンテナのラベルからルーティング情報を作成する際に使用するラベル名の接頭辞。
+//
+// "dockerns.route.アカウント名.0.正規表現の名前" というラベルの値に正規表現を設定しておくと、
+// そのアカウントに「正規表現に一致したらこのコンテナへ接続する」というルーティング情報が追加される。
+// etcd の場合と同様に "0." のプライオリティは省略でき、名前も省略した場合はコンテナ名が使用される。
+// 同じラベルを付けた複数のコンテナを起動した場合は、それらのコンテナへ順に振り分けられる。
+//
+//  docker run -l 'dockerns.route.master.10.web=^www\.my-service\.com$' my_image
+const LabelPrefix = "dockerns.route."
+
+// AddressLabel はコンテナへ接続する際のアドレスを明示的に指定するためのラベル名。
+//
+// ブリッジネットワークのコンテナ内部のアドレスに dockerns から到達できない場合などに、
+// ホスト側で公開されているアドレスを指定しておくと、Docker から取得したアドレスの代わりに使用される。
+// 指定したアドレスのみが使用され、Docker から取得した IPv4 / IPv6 のアドレスはどちらも使用されなくなる。
+//
+//  docker run -l 'dockerns.address=10.0.0.5' my_image
+const AddressLabel = "dockerns.address"
+
+// requirement は Selector を構成する個々の条件。
+type requirement struct {
+	key    string
+	op     string // "exists", "!exists", "=", "!=", "in", "notin"
+	values []string
+}
+
+// matches は labels が条件を満たしていれば true を返す。
+func (r requirement) matches(labels map[string]string) bool {
+	v, ok := labels[r.key]
+	switch r.op {
+	case "exists":
+		return ok
+	case "!exists":
+		return !ok
+	case "=", "in":
+		if !ok {
+			return false
+		}
+		for _, s := range r.values {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	case "!=", "notin":
+		if !ok {
+			return true
+		}
+		for _, s := range r.values {
+			if v == s {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// String は条件を人間が読みやすい文字列として出力する。
+func (r requirement) String() string {
+	switch r.op {
+	case "exists":
+		return r.key
+	case "!exists":
+		return "!" + r.key
+	case "=", "!=":
+		return r.key + r.op + r.values[0]
+	}
+	return fmt.Sprintf("%s %s (%s)", r.key, r.op, strings.Join(r.values, ","))
+}
+
+// Selector はコンテナのラベルに対する条件の集合で、全ての条件を満たすコンテナに一致する。
+// 空の Selector は全てのコンテナに一致する。
+type Selector []requirement
+
+// ParseSelector はカンマ区切りで記述された条件を Selector として解釈する。
+// 以下の形式の条件に対応している。
+//
+//  key            ラベルが存在する
+//  !key           ラベルが存在しない
+//  key=value      ラベルの値が value と等しい("==" も可)
+//  key!=value     ラベルが存在しないか、値が value と異なる
+//  key in (a,b)   ラベルの値が a か b のいずれか
+//  key notin (a,b) ラベルが存在しないか、値が a と b のいずれでもない
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, term := range splitSelector(s) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		r, err := parseRequirement(term)
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+// splitSelector は括弧の中を除いて s をカンマで分割する。
+func splitSelector(s string) []string {
+	var terms []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, s[start:])
+}
+
+// parseRequirement は単一の条件を解釈する。
+func parseRequirement(term string) (requirement, error) {
+	if strings.HasPrefix(term, "!") {
+		return requirement{key: strings.TrimSpace(term[1:]), op: "!exists"}, nil
+	}
+	if i := strings.Index(term, "!="); i >= 0 {
+		return requirement{key: strings.TrimSpace(term[:i]), op: "!=", values: []string{strings.TrimSpace(term[i+2:])}}, nil
+	}
+	if i := strings.Index(term, "="); i >= 0 {
+		v := strings.TrimPrefix(term[i+1:], "=")
+		return requirement{key: strings.TrimSpace(term[:i]), op: "=", values: []string{strings.TrimSpace(v)}}, nil
+	}
+
+	fields := strings.Fields(term)
+	if len(fields) == 1 {
+		return requirement{key: fields[0], op: "exists"}, nil
+	}
+	if len(fields) < 2 || (fields[1] != "in" && fields[1] != "notin") {
+		return requirement{}, fmt.Errorf("invalid label selector: %q", term)
+	}
+	set := strings.TrimSpace(strings.Join(fields[2:], " "))
+	if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+		return requirement{}, fmt.Errorf("invalid label selector: %q", term)
+	}
+	r := requirement{key: fields[0], op: fields[1]}
+	for _, v := range strings.Split(set[1:len(set)-1], ",") {
+		r.values = append(r.values, strings.TrimSpace(v))
+	}
+	return r, nil
+}
+
+// Matches は labels が全ての条件を満たしていれば true を返す。
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// String は Selector を ParseSelector で解釈できる形式の文字列として出力する。
+func (s Selector) String() string {
+	terms := make([]string, len(s))
+	for i, r := range s {
+		terms[i] = r.String()
+	}
+	return strings.Join(terms, ",")
+}
+
+// addLabelRoutes は LabelSelector に一致するコンテナのラベルからルーティング情報を作成し、accounts に追加する。
+// only を指定した場合はそのアカウントに対するルーティング情報のみを追加する。
+func (a *Accounts) addLabelRoutes(accounts map[string]Account, containers map[string]*Container, compiled map[string]*regexp.Regexp, only string) {
+	// containers には同じコンテナが別名でも登録されているため、重複を除いて処理する。
+	seen := make(map[*Container]bool)
+	for _, c := range containers {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+
+		if !a.LabelSelector.Matches(c.Labels) {
+			continue
+		}
+		host := a.AddressFamily.Select(c)
+
+		for label, pattern := range c.Labels {
+			if !strings.HasPrefix(label, LabelPrefix) {
+				continue
+			}
+			parts := strings.SplitN(label[len(LabelPrefix):], ".", 2)
+			accountName := parts[0]
+			if only != "" && accountName != only {
+				continue
+			}
+			if host == "" {
+				log.Println(
+					"Container has no address for family:", c,
+					"Family:", a.AddressFamily,
+				)
+				break
+			}
+			if !a.allowTarget(host, accountName) {
+				continue
+			}
+			key := "0." + c.Name
+			if len(parts) == 2 {
+				key = parts[1]
+			}
+
+			route, err := newRoute(key, pattern, host, compiled)
+			if err != nil {
+				log.Println(
+					"invalid label route:", err,
+					"Container:", c,
+					"Label:", label,
+				)
+				continue
+			}
+			route.Container = c.Name
+			account := accounts[accountName]
+			account.Name = accountName
+			account.Routes = append(account.Routes, route)
+			accounts[accountName] = account
+		}
+	}
+}
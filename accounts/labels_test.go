@@ -0,0 +1,155 @@
+package accounts
+
+import (
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	labels := map[string]string{"env": "prod", "team": "web"}
+	tests := []struct {
+		selector string
+		str      string
+		match    bool
+		err      bool
+	}{
+		{selector: "", str: "", match: true},
+		{selector: "env", str: "env", match: true},
+		{selector: "!env", str: "!env", match: false},
+		{selector: "!tier", str: "!tier", match: true},
+		{selector: "env=prod", str: "env=prod", match: true},
+		{selector: "env==prod", str: "env=prod", match: true},
+		{selector: "env=dev", str: "env=dev", match: false},
+		{selector: "env!=dev", str: "env!=dev", match: true},
+		{selector: "tier!=db", str: "tier!=db", match: true},
+		{selector: "env in (dev, prod)", str: "env in (dev,prod)", match: true},
+		{selector: "env notin (dev,prod)", str: "env notin (dev,prod)", match: false},
+		{selector: "env=prod, team=web", str: "env=prod,team=web", match: true},
+		{selector: "env=prod,team=db", str: "env=prod,team=db", match: false},
+		{selector: "env in dev", err: true},
+		{selector: "env maybe (dev)", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			s, err := ParseSelector(tt.selector)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("ParseSelector = %v, want error", s)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.String() != tt.str {
+				t.Errorf("String = %q, want %q", s.String(), tt.str)
+			}
+			if got := s.Matches(labels); got != tt.match {
+				t.Errorf("Matches = %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestLabelRoutes(t *testing.T) {
+	docker := newDockerStub(t,
+		testContainer{ID: "1", Name: "web-prod", IP: "172.17.0.2", Labels: map[string]string{
+			"env": "prod", LabelPrefix + "master.10.web": `^www\.example\.com$`,
+		}},
+		testContainer{ID: "2", Name: "web-dev", IP: "172.17.0.3", Labels: map[string]string{
+			"env": "dev", LabelPrefix + "master.10.web": `^www\.example\.com$`,
+		}},
+		testContainer{ID: "3", Name: "api", IP: "172.17.0.4", Labels: map[string]string{
+			LabelPrefix + "other": `^api\.example\.com$`,
+		}},
+		testContainer{ID: "4", Name: "db", IP: "172.17.0.5", Labels: map[string]string{"env": "prod"}},
+	)
+
+	tests := []struct {
+		selector string
+		// want はアカウントごとのルーティング情報の接続先。
+		want map[string]string
+	}{
+		{selector: "", want: map[string]string{"master": "172.17.0.2,172.17.0.3", "other": "172.17.0.4"}},
+		{selector: "env=prod", want: map[string]string{"master": "172.17.0.2"}},
+		{selector: "env!=prod", want: map[string]string{"master": "172.17.0.3", "other": "172.17.0.4"}},
+		{selector: "env", want: map[string]string{"master": "172.17.0.2,172.17.0.3"}},
+		{selector: "env=staging", want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			a := New(docker.URL, "", "/proxy")
+			var err error
+			if a.LabelSelector, err = ParseSelector(tt.selector); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Reload(); err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]string)
+			for _, name := range a.List() {
+				got[name] = routeHosts(a.Get(name))
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("routes = %v, want %v", got, tt.want)
+			}
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("%s: targets = %q, want %q", name, got[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestAddressLabel(t *testing.T) {
+	docker := newDockerStub(t,
+		testContainer{ID: "1", Name: "plain", IP: "172.17.0.2", IPv6: "2001:db8::2"},
+		testContainer{ID: "2", Name: "v4", IP: "172.17.0.3", IPv6: "2001:db8::3", Labels: map[string]string{AddressLabel: "10.0.0.5"}},
+		testContainer{ID: "3", Name: "v6", IP: "172.17.0.4", Labels: map[string]string{AddressLabel: "2001:db8:1::5"}},
+		testContainer{ID: "4", Name: "invalid", IP: "172.17.0.6", Labels: map[string]string{AddressLabel: "host.example"}},
+		testContainer{ID: "5", Name: "labeled", IP: "172.17.0.7", Labels: map[string]string{
+			AddressLabel: "10.0.0.7", LabelPrefix + "labeled.10.web": `^www\.example\.com$`,
+		}},
+	)
+
+	tests := []struct {
+		container string
+		family    AddressFamily
+		want      string
+	}{
+		{container: "plain", family: PreferIPv4, want: "172.17.0.2"},
+		{container: "v4", family: PreferIPv4, want: "10.0.0.5"},
+		// 明示したアドレスのみを使用するため、Docker から取得した IPv6 アドレスは使用しない。
+		{container: "v4", family: PreferIPv6, want: "10.0.0.5"},
+		{container: "v4", family: IPv6Only, want: ""},
+		{container: "v6", family: PreferIPv4, want: "2001:db8:1::5"},
+		{container: "invalid", family: PreferIPv4, want: "172.17.0.6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.container+"/"+string(tt.family), func(t *testing.T) {
+			a := New(docker.URL, "", "/proxy")
+			a.AddressFamily = tt.family
+			a.StaticRoutes = []string{`address/` + tt.container + `.container/0.www=^www\.example\.com$`}
+			if err := a.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if account := a.Get("address"); account != nil {
+				got = routeHosts(account)
+			}
+			if got != tt.want {
+				t.Errorf("host = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// ラベルで設定したルーティング情報にも反映される。
+	a := New(docker.URL, "", "/proxy")
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if account := a.Get("labeled"); account == nil || routeHosts(account) != "10.0.0.7" {
+		t.Errorf("labeled route = %v, want 10.0.0.7", account)
+	}
+}
@@ -0,0 +1,118 @@
+package accounts
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Matcher はホスト名がルーティング情報に一致するかを判定する。
+// String は設定されたパターンを返し、表示や同じパターンのルーティング情報をまとめる際に使用する。
+type Matcher interface {
+	Match(host string) bool
+	String() string
+}
+
+// ルーティング情報のパターンの種類。etcd のキーの名前に "0.glob:web" のように接頭辞として指定する。
+const (
+	// MatchRegexp は正規表現(regexp パッケージの形式)。接頭辞を省略した場合もこれになる。
+	MatchRegexp = "regexp"
+	// MatchGlob は path.Match の形式のパターン。"*" は "." を含む任意の文字列に一致する。大文字と小文字は区別しない。
+	MatchGlob = "glob"
+	// MatchExact はホスト名との完全一致。大文字と小文字は区別しない。
+	MatchExact = "exact"
+)
+
+// regexpMatcher は正規表現による Matcher。
+type regexpMatcher struct {
+	re *regexp.Regexp
+}
+
+// Match は host が正規表現に一致すれば true を返す。
+func (m regexpMatcher) Match(host string) bool {
+	return m.re.MatchString(host)
+}
+
+// String は正規表現のパターンを返す。
+func (m regexpMatcher) String() string {
+	return m.re.String()
+}
+
+// globMatcher は path.Match の形式のパターンによる Matcher。パターンは小文字で保持する。
+type globMatcher string
+
+// Match は host がパターンに一致すれば true を返す。
+func (m globMatcher) Match(host string) bool {
+	ok, _ := path.Match(string(m), strings.ToLower(host))
+	return ok
+}
+
+// String は "glob:" に続けてパターンを返す。
+func (m globMatcher) String() string {
+	return MatchGlob + ":" + string(m)
+}
+
+// exactMatcher はホスト名との完全一致による Matcher。
+type exactMatcher string
+
+// Match は host がホスト名と一致すれば true を返す。
+func (m exactMatcher) Match(host string) bool {
+	return strings.EqualFold(host, string(m))
+}
+
+// String は "exact:" に続けてホスト名を返す。
+func (m exactMatcher) String() string {
+	return MatchExact + ":" + string(m)
+}
+
+// splitMatchType は etcd のキーの名前 name から "glob:" のような種類の接頭辞を分離する。
+// 接頭辞が無い場合は MatchRegexp を返す。"api:8080" のように既知の種類ではない ":" を含む名前はそのまま名前として扱う。
+func splitMatchType(name string) (kind, rest string) {
+	for _, kind := range []string{MatchRegexp, MatchGlob, MatchExact} {
+		if rest, ok := strings.CutPrefix(name, kind+":"); ok {
+			return kind, rest
+		}
+	}
+	return MatchRegexp, name
+}
+
+// newMatcher は種類 kind のパターン pattern の Matcher を作成する。
+// 正規表現の場合はコンパイルした正規表現も返す。同じパターンの正規表現は compiled で共有する。
+func newMatcher(kind, pattern string, compiled map[string]*regexp.Regexp) (Matcher, *regexp.Regexp, error) {
+	switch kind {
+	case MatchRegexp:
+		re, ok := compiled[pattern]
+		if !ok {
+			var err error
+			re, err = regexp.Compile(pattern)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error at regexp.Compile: %v", err)
+			}
+			compiled[pattern] = re
+		}
+		return regexpMatcher{re}, re, nil
+	case MatchGlob:
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, nil, fmt.Errorf("invalid glob pattern: %v", err)
+		}
+		return globMatcher(pattern), nil, nil
+	case MatchExact:
+		return exactMatcher(pattern), nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown match type: %q", kind)
+}
+
+// matcher は r の Matcher を返す。Matcher が設定されていない場合は Regexp を使用する。
+func (r *Route) matcher() Matcher {
+	if r.Matcher != nil {
+		return r.Matcher
+	}
+	return regexpMatcher{r.Regexp}
+}
+
+// Pattern は r のパターンを文字列で返す。正規表現以外の場合は "glob:" のような種類の接頭辞が付く。
+func (r *Route) Pattern() string {
+	return r.matcher().String()
+}
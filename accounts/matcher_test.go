@@ -0,0 +1,81 @@
+package accounts
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestNewRoute(t *testing.T) {
+	tests := []struct {
+		key, pattern string
+		name         string
+		priority     int
+		str          string
+		match        []string
+		noMatch      []string
+		err          bool
+	}{
+		{
+			key: "0.api", pattern: `^api\.example\.com$`,
+			name: "api", str: `^api\.example\.com$`,
+			match: []string{"api.example.com"}, noMatch: []string{"www.example.com"},
+		},
+		{
+			key: "1.regexp:api", pattern: `^api\.`,
+			name: "api", priority: 1, str: `^api\.`,
+			match: []string{"api.example.com"}, noMatch: []string{"www.example.com"},
+		},
+		{
+			key: "0.glob:web", pattern: "*.Example.com",
+			name: "web", str: "glob:*.example.com",
+			match: []string{"www.example.com", "a.b.EXAMPLE.com"}, noMatch: []string{"example.com", "example.org"},
+		},
+		{
+			key: "0.exact:www", pattern: "www.example.com",
+			name: "www", str: "exact:www.example.com",
+			match: []string{"WWW.example.com"}, noMatch: []string{"www.example.com.evil"},
+		},
+		{
+			// 既知の種類ではない ":" を含む名前は、接頭辞ではなく名前の一部として扱う。
+			key: "0.api:8080", pattern: `^api\.`,
+			name: "api:8080", str: `^api\.`,
+			match: []string{"api.example.com"},
+		},
+		{
+			key: "0.glob:api:8080", pattern: "api.*",
+			name: "api:8080", str: "glob:api.*",
+			match: []string{"api.example.com"},
+		},
+		{key: "0.api", pattern: "(", err: true},
+		{key: "0.glob:api", pattern: "[", err: true},
+		{key: "0.api", pattern: " ", err: true},
+		{key: "x.api", pattern: "api", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.pattern, func(t *testing.T) {
+			r, err := newRoute(tt.key, tt.pattern, "192.0.2.1", make(map[string]*regexp.Regexp))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("newRoute = %+v, want error", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Name != tt.name || r.Priority != tt.priority || r.Pattern() != tt.str {
+				t.Errorf("Name, Priority, Pattern = %q, %d, %q, want %q, %d, %q", r.Name, r.Priority, r.Pattern(), tt.name, tt.priority, tt.str)
+			}
+			for _, host := range tt.match {
+				if !r.matcher().Match(host) {
+					t.Errorf("Match(%q) = false, want true", host)
+				}
+			}
+			for _, host := range tt.noMatch {
+				if r.matcher().Match(host) {
+					t.Errorf("Match(%q) = true, want false", host)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package accounts
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"unsafe"
+
+	"github.com/mimoto-xxxxxx/dockerns/metrics"
+)
+
+// routingTableBytes はルーティング情報とその作成に使用したデータが使用しているメモリの推定値。
+var routingTableBytes = metrics.Default.Gauge(
+	"dockerns_routing_table_bytes",
+	"Estimated memory used by the routing table, compiled regexps and containers.",
+)
+
+// routingTableRejected は MaxRoutingBytes を超えたために新しいルーティング情報を採用しなかった回数。
+var routingTableRejected = metrics.Default.Counter(
+	"dockerns_routing_table_rejected_total",
+	"Number of reloads rejected because the routing table exceeded the memory limit.",
+)
+
+// ポインターとマップの要素一つあたりのおおよそのサイズ。
+const (
+	pointerBytes  = int64(unsafe.Sizeof(uintptr(0)))
+	mapEntryBytes = 2*int64(unsafe.Sizeof("")) + pointerBytes
+)
+
+// estimateSize はルーティング情報 accounts と、その作成に使用したコンテナ情報 containers が使用しているメモリの量を推定する。
+// 正確な値ではなく、設定の規模の変化を監視したり上限を設けたりするための目安として使用する。
+func estimateSize(accounts map[string]Account, containers map[string]*Container) int64 {
+	var n int64
+	// 正規表現は Route 間で共有されるため、パターンごとに一度だけ数える。
+	patterns := make(map[string]bool)
+	for name, account := range accounts {
+		n += mapEntryBytes + int64(len(name)) + int64(unsafe.Sizeof(account)) + int64(len(account.Name))
+		for _, r := range account.Routes {
+			n += pointerBytes + routeBytes(r)
+			if r.Regexp != nil && !patterns[r.Regexp.String()] {
+				patterns[r.Regexp.String()] = true
+				n += regexpBytes(r.Regexp.String())
+			}
+		}
+	}
+
+	// containers には同じコンテナが別名でも登録されているため、コンテナ自体は一度だけ数える。
+	seen := make(map[*Container]bool)
+	for name, c := range containers {
+		n += mapEntryBytes + int64(len(name))
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		n += int64(unsafe.Sizeof(*c)) + int64(len(c.ID)+len(c.Name)+len(c.IPAddress)+len(c.IPv6Address))
+		for k, v := range c.Labels {
+			n += mapEntryBytes + int64(len(k)+len(v))
+		}
+	}
+	return n
+}
+
+// routeBytes は r が使用しているメモリの量を推定する。正規表現は共有されるため含めない。
+func routeBytes(r *Route) int64 {
+	n := int64(unsafe.Sizeof(*r))
+	n += int64(len(r.Name) + len(r.Host) + len(r.StripPrefix) + len(r.AddPrefix) + len(r.Backup) + len(r.HealthCheck) + len(r.HealthPath) + len(r.Scheme))
+	for _, s := range r.Hosts {
+		n += int64(unsafe.Sizeof(s)) + int64(len(s))
+	}
+	n += int64(len(r.Weights)+len(r.schedule)) * int64(unsafe.Sizeof(int(0)))
+	if r.Regexp == nil && r.Matcher != nil {
+		n += int64(len(r.Matcher.String()))
+	}
+	for _, s := range r.ALPN {
+		n += int64(unsafe.Sizeof(s)) + int64(len(s))
+	}
+	for _, s := range r.Subnets {
+		n += int64(unsafe.Sizeof(s)) + int64(len(s.Host))
+		if s.Net != nil {
+			n += int64(unsafe.Sizeof(*s.Net)) + int64(len(s.Net.IP)+len(s.Net.Mask))
+		}
+	}
+	return n
+}
+
+// regexpBytes は pattern をコンパイルした正規表現が使用しているメモリの量を、
+// コンパイル後の命令列の長さから推定する。
+func regexpBytes(pattern string) int64 {
+	n := int64(unsafe.Sizeof(regexp.Regexp{})) + 2*int64(len(pattern))
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return n
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return n
+	}
+	for _, inst := range prog.Inst {
+		n += int64(unsafe.Sizeof(inst)) + 4*int64(len(inst.Rune))
+	}
+	return n
+}
@@ -0,0 +1,61 @@
+package accounts
+
+import (
+	"fmt"
+	"testing"
+)
+
+// syntheticRoutes は n 個のルーティング情報を持つ静的な設定を作成する。
+func syntheticRoutes(n int) []string {
+	routes := make([]string, n)
+	for i := range routes {
+		routes[i] = fmt.Sprintf(`memory/192.0.2.%d/0.host%d=^host%d\.example\.com$`, i%250+1, i, i)
+	}
+	return routes
+}
+
+func TestMaxRoutingBytes(t *testing.T) {
+	// ルーティング情報の規模に応じた推定値がメトリクスに記録される。
+	smallSize := newStaticAccounts(t, syntheticRoutes(10)...).size
+	if got := routingTableBytes.Get(); smallSize <= 0 || got != smallSize {
+		t.Fatalf("routing table bytes = %d, want %d", got, smallSize)
+	}
+	if largeSize := newStaticAccounts(t, syntheticRoutes(1000)...).size; largeSize <= smallSize*10 {
+		t.Fatalf("routing table bytes for 1000 routes = %d, for 10 routes = %d", largeSize, smallSize)
+	}
+
+	// 各段階は順に Reload し、前の段階で採用されたルーティング情報を引き継ぐ。
+	tests := []struct {
+		name     string
+		routes   int
+		err      bool
+		rejected uint64
+		// want は Reload 後のルーティング情報の数。
+		want int
+	}{
+		// 初回は使い続けるルーティング情報が無いため、上限を超えていても採用する。
+		{name: "initial over limit", routes: 1000, want: 1000},
+		{name: "shrink", routes: 10, want: 10},
+		{name: "grow within limit", routes: 20, want: 20},
+		{name: "grow over limit", routes: 1000, err: true, rejected: 1, want: 20},
+		{name: "shrink after rejection", routes: 15, want: 15},
+	}
+	a := New("", "", "/proxy")
+	a.MaxRoutingBytes = smallSize * 5
+	for _, tt := range tests {
+		before := routingTableRejected.Get()
+		a.StaticRoutes = syntheticRoutes(tt.routes)
+		if err := a.Reload(); (err != nil) != tt.err {
+			t.Fatalf("%s: Reload error = %v, want error %v", tt.name, err, tt.err)
+		}
+		if got := routingTableRejected.Get() - before; got != tt.rejected {
+			t.Errorf("%s: rejected = %d, want %d", tt.name, got, tt.rejected)
+		}
+		if got := len(a.Get("memory").Routes); got != tt.want {
+			t.Errorf("%s: routes = %d, want %d", tt.name, got, tt.want)
+		}
+		if got := routingTableBytes.Get(); got != a.size {
+			t.Errorf("%s: routing table bytes = %d, want %d", tt.name, got, a.size)
+		}
+	}
+}
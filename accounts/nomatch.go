@@ -0,0 +1,52 @@
+package accounts
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mimoto-xxxxxx/dockerns/metrics"
+)
+
+// noMatch はルーティング情報に一致せず、接続先を差し替えずにそのまま通過させた回数。
+// 設定漏れや意図的な素通しの量を把握するために使用する。
+var noMatch = metrics.Default.Counter(
+	"dockerns_route_no_match_total",
+	"Number of lookups that matched no route and passed through unchanged.",
+	"account", "service",
+)
+
+// noMatchLog はルーティング情報に一致しなかったホスト名のログ出力を間引く。
+type noMatchLog struct {
+	m          sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+// RecordNoMatch は service ("http", "socks", "dns" など)で account のルーティング情報に host が一致しなかったことを記録する。
+// NoMatchLogInterval が指定されている場合は、その間隔に一度だけホスト名をログに出力し、間引いた件数も併せて出力する。
+func (a *Accounts) RecordNoMatch(account, service, host string) {
+	noMatch.Inc(account, service)
+	if a.NoMatchLogInterval <= 0 {
+		return
+	}
+
+	l := &a.noMatchLog
+	now := time.Now()
+	l.m.Lock()
+	if now.Sub(l.last) < a.NoMatchLogInterval {
+		l.suppressed++
+		l.m.Unlock()
+		return
+	}
+	suppressed := l.suppressed
+	l.last, l.suppressed = now, 0
+	l.m.Unlock()
+
+	log.Println(
+		"no route matched:", host,
+		"Account:", account,
+		"Service:", service,
+		"Suppressed:", suppressed,
+	)
+}
@@ -0,0 +1,197 @@
+package accounts
+
+import (
+	"log"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// defaultWeight は _weight が指定されていない接続先の重み。
+const defaultWeight = 1
+
+// maxWeight は _weight に指定できる重みの上限。
+const maxWeight = 1000
+
+// isContainerPattern は "foobar.container" の形式のコンテナ名 name が、
+// "web-*" のように複数のコンテナに一致するパターン(path.Match の形式)であれば true を返す。
+func isContainerPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// matchRef は etcd 上で参照されているコンテナ名 ref が names のいずれかに一致すれば true を返す。
+// ref がパターンの場合は path.Match で照合する。
+func matchRef(ref string, names map[string]bool) bool {
+	if !isContainerPattern(ref) {
+		return names[ref]
+	}
+	for name := range names {
+		if ok, _ := path.Match(ref, strings.TrimPrefix(name, "/")); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// expandHost は etcd 上の接続先の名前 host がコンテナ名のパターンを含む "web-*.container" の形式の場合に、
+// 一致する全てのコンテナを名前順に "web-1.container" の形式で返す。それ以外の場合は host のみを返す。
+// 一致するコンテナが無い場合はメッセージを出力して nil を返す。
+func (a *Accounts) expandHost(host string, account Account, containers map[string]*Container) []string {
+	const SUFFIX = ".container"
+	target, port := SplitTarget(host)
+	name := strings.TrimSuffix(target, SUFFIX)
+	if a.DockerAddr == "" || name == target || !isContainerPattern(name) {
+		return []string{host}
+	}
+
+	// containers には同じコンテナが別名でも登録されているため、本来の名前のみで照合する。
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, c := range containers {
+		if seen[c.Name] {
+			continue
+		}
+		seen[c.Name] = true
+		if ok, _ := path.Match(name, c.Name); ok {
+			if port != "" {
+				hosts = append(hosts, net.JoinHostPort(c.Name+SUFFIX, port))
+			} else {
+				hosts = append(hosts, c.Name+SUFFIX)
+			}
+		}
+	}
+	if len(hosts) == 0 {
+		log.Println(
+			"No container matches:", name,
+			"Account:", account,
+		)
+		containerNotFound.Inc(account.Name, name)
+		return nil
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// mergeRoutes は Priority の降順に並んだ routes のうち、プライオリティとパターンが同じものを一つのルーティング情報にまとめる。
+// まとめたルーティング情報は Host が最も小さいものを代表とし、その Hosts に全ての接続先を名前順に、Weights にそれぞれの重みを格納する。
+// 同じ接続先が複数ある場合は重みを合計する。接続先以外のオプションは代表のものが使用される。
+func mergeRoutes(routes Routes) Routes {
+	type key struct {
+		priority int
+		pattern  string
+	}
+	groups := make(map[key][]*Route)
+	var order []key
+	for _, r := range routes {
+		k := key{r.Priority, r.Pattern()}
+		if _, ok := groups[k]; !ok {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], r)
+	}
+	if len(order) == len(routes) {
+		return routes
+	}
+
+	merged := make(Routes, 0, len(order))
+	for _, k := range order {
+		group := groups[k]
+		if len(group) == 1 {
+			merged = append(merged, group[0])
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool { return group[i].Host < group[j].Host })
+		primary := group[0]
+		index := make(map[string]int)
+		var hosts []string
+		var weights []int
+		for _, r := range group {
+			if i, ok := index[r.Host]; ok {
+				weights[i] += r.Weight
+				continue
+			}
+			index[r.Host] = len(hosts)
+			hosts = append(hosts, r.Host)
+			weights = append(weights, r.Weight)
+		}
+		if len(hosts) > 1 {
+			primary.Hosts, primary.Weights = hosts, weights
+			primary.schedule = smoothSchedule(weights)
+		}
+		merged = append(merged, primary)
+	}
+	return merged
+}
+
+// smoothSchedule は重み weights に比例した回数ずつ、偏りなく混ぜた接続先の番号の並びを返す(smooth weighted round-robin)。
+// 重みは最大公約数で割ってから使用するため、並びの長さは重みの合計以下になる。
+// 全ての重みが等しい場合は単純なラウンドロビンで済むため nil を、全ての重みが 0 の場合は空の並びを返す。
+func smoothSchedule(weights []int) []int {
+	g, total, equal := 0, 0, true
+	for _, w := range weights {
+		g, total = gcd(g, w), total+w
+		equal = equal && w == weights[0]
+	}
+	if total == 0 {
+		return []int{}
+	}
+	if equal {
+		return nil
+	}
+	total /= g
+
+	current := make([]int, len(weights))
+	schedule := make([]int, 0, total)
+	for len(schedule) < total {
+		best := 0
+		for i, w := range weights {
+			current[i] += w / g
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, best)
+	}
+	return schedule
+}
+
+// gcd は a と b の最大公約数を返す。
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// rotation は Target が一巡する間に nextHost を呼び出す回数を返す。
+func (r *Route) rotation() int {
+	switch {
+	case r.schedule != nil:
+		return len(r.schedule)
+	case len(r.Hosts) > 0:
+		return len(r.Hosts)
+	}
+	return 1
+}
+
+// nextHost は Hosts が複数ある場合は呼び出しの度に重みに従って順に一つずつ返し、それ以外の場合は Host を返す。
+// 全ての接続先の重みが 0 の場合は、接続先が一つの場合も含めて空文字列を返す。
+func (r *Route) nextHost() string {
+	if len(r.Hosts) <= 1 {
+		if r.Weight == 0 {
+			return ""
+		}
+		return r.Host
+	}
+	i := atomic.AddUint32(&r.next, 1) - 1
+	if r.schedule != nil {
+		if len(r.schedule) == 0 {
+			return ""
+		}
+		return r.Hosts[r.schedule[i%uint32(len(r.schedule))]]
+	}
+	return r.Hosts[i%uint32(len(r.Hosts))]
+}
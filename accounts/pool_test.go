@@ -0,0 +1,75 @@
+package accounts
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestZeroWeight(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []string
+		// want は 10 回 Target を呼び出した際に返された接続先を、重複を除いて名前順に並べたもの。
+		want []string
+	}{
+		{
+			name: "canary",
+			routes: []string{
+				`master/192.0.2.1/0.www=^www\.example\.com$`,
+				`master/192.0.2.1/_weight=9`,
+				`master/192.0.2.2/0.www=^www\.example\.com$`,
+				`master/192.0.2.2/_weight=0`,
+			},
+			want: []string{"192.0.2.1"},
+		},
+		// 重みが 0 の接続先のみが残った場合も選ばれない。
+		{
+			name: "lone zero weight",
+			routes: []string{
+				`master/192.0.2.2/0.www=^www\.example\.com$`,
+				`master/192.0.2.2/_weight=0`,
+			},
+			want: []string{""},
+		},
+		{
+			name: "lone weight",
+			routes: []string{
+				`master/192.0.2.2/0.www=^www\.example\.com$`,
+				`master/192.0.2.2/_weight=3`,
+			},
+			want: []string{"192.0.2.2"},
+		},
+		// 同じ接続先のみにまとめられた場合は重みの合計で判断する。
+		{
+			name: "collapsed zero weight",
+			routes: []string{
+				`master/192.0.2.2/0.www=^www\.example\.com$`,
+				`master/192.0.2.2/0.www2=^www\.example\.com$`,
+				`master/192.0.2.2/_weight=0`,
+			},
+			want: []string{""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newStaticAccounts(t, tt.routes...)
+			route := a.Get("master").Routes.Find("www.example.com")
+			if route == nil {
+				t.Fatal("no route")
+			}
+			seen := make(map[string]bool)
+			for i := 0; i < 10; i++ {
+				seen[route.Target()] = true
+			}
+			var got []string
+			for host := range seen {
+				got = append(got, host)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("targets = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
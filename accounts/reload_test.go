@@ -0,0 +1,164 @@
+package accounts
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReloadSerialized(t *testing.T) {
+	reload := func(a *Accounts) error { return a.Reload() }
+	reloadAccount := func(a *Accounts) error { return a.ReloadAccount("master") }
+
+	tests := []struct {
+		name          string
+		first, second func(a *Accounts) error
+	}{
+		{name: "Reload and Reload", first: reload, second: reload},
+		{name: "Reload and ReloadAccount", first: reload, second: reloadAccount},
+		{name: "ReloadAccount and Reload", first: reloadAccount, second: reload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// n 回目の問い合わせには 192.0.2.n を返す。1 回目の応答は 2 回目の問い合わせを受けてから更に遅らせ、
+			// 排他していなければ先に読み込みを始めた古いルーティング情報が後から採用される状況を作る。
+			// 排他していれば 2 回目の問い合わせは 1 回目の応答の後になるため、一定時間で諦めて応答する。
+			var n int32
+			started, second := make(chan struct{}), make(chan struct{})
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := atomic.AddInt32(&n, 1)
+				switch i {
+				case 1:
+					close(started)
+					select {
+					case <-second:
+						time.Sleep(100 * time.Millisecond)
+					case <-time.After(300 * time.Millisecond):
+					}
+				case 2:
+					close(second)
+				}
+				host := fmt.Sprintf("192.0.2.%d", i)
+				w.Header().Set("X-Etcd-Index", fmt.Sprint(i))
+				if r.URL.Path == "/v2/keys/proxy/master" {
+					io.WriteString(w, `{"action":"get","node":`+etcdV2Account(host)+`}`)
+					return
+				}
+				io.WriteString(w, etcdV2Tree(host))
+			}))
+			defer ts.Close()
+
+			a := New("", ts.URL, "/proxy")
+			done := make(chan error, 1)
+			go func() { done <- tt.first(a) }()
+			<-started
+			if err := tt.second(a); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+
+			if _, newHost := a.Get("master").Match("www.example.com"); newHost != "192.0.2.2" {
+				t.Errorf("newHost = %q, want the later 192.0.2.2", newHost)
+			}
+		})
+	}
+}
+
+func TestGetSnapshot(t *testing.T) {
+	tests := []struct {
+		name   string
+		reload func(a *Accounts) error
+	}{
+		{name: "Reload", reload: func(a *Accounts) error { return a.Reload() }},
+		{name: "ReloadAccount", reload: func(a *Accounts) error { return a.ReloadAccount("master") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// n 回目の読み込みでは全てのルーティング情報の接続先が 192.0.2.n になる。
+			// 取得したスナップショットの接続先が混在していれば、読み込みの途中の状態が見えている。
+			var n int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := atomic.AddInt32(&n, 1)
+				host := fmt.Sprintf("192.0.2.%d", i%250+1)
+				account := `{"key":"/proxy/master","dir":true,"nodes":[
+					{"key":"/proxy/master/` + host + `","dir":true,"nodes":[
+						{"key":"/proxy/master/` + host + `/0.www","value":"^www\\.example\\.com$"},
+						{"key":"/proxy/master/` + host + `/1.api","value":"^api\\.example\\.com$"},
+						{"key":"/proxy/master/` + host + `/2.web","value":"^web\\.example\\.com$"}
+					]}
+				]}`
+				w.Header().Set("X-Etcd-Index", fmt.Sprint(i))
+				if r.URL.Path == "/v2/keys/proxy/master" {
+					io.WriteString(w, `{"action":"get","node":`+account+`}`)
+					return
+				}
+				io.WriteString(w, `{"action":"get","node":{"key":"/proxy","dir":true,"nodes":[`+account+`]}}`)
+			}))
+			defer ts.Close()
+
+			a := New("", ts.URL, "/proxy")
+			if err := a.Reload(); err != nil {
+				t.Fatal(err)
+			}
+
+			stop, done := make(chan struct{}), make(chan struct{})
+			go func() {
+				defer close(done)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if err := tt.reload(a); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+
+			start := atomic.LoadInt32(&n)
+			for i := 0; i < 200; i++ {
+				account := a.Get("master")
+				if len(account.Routes) != 3 {
+					t.Fatalf("len(Routes) = %d, want 3", len(account.Routes))
+				}
+				hosts := make([]string, len(account.Routes))
+				for j, r := range account.Routes {
+					hosts[j] = r.Host
+				}
+				if hosts[0] != hosts[1] || hosts[0] != hosts[2] {
+					t.Fatalf("hosts = %v, want a single reload's routes", hosts)
+				}
+
+				// Routes に append しても現在のルーティング情報には影響しない。
+				_ = append(account.Routes, &Route{Host: "203.0.113.1"})
+				time.Sleep(time.Millisecond)
+
+				for j, r := range account.Routes {
+					if r.Host != hosts[j] {
+						t.Fatalf("Routes[%d].Host changed from %q to %q during reload", j, hosts[j], r.Host)
+					}
+				}
+				if _, newHost := account.Match("www.example.com"); newHost != hosts[0] {
+					t.Fatalf("newHost = %q, want %q from the snapshot", newHost, hosts[0])
+				}
+			}
+			close(stop)
+			<-done
+
+			if atomic.LoadInt32(&n)-start < 2 {
+				t.Fatalf("only %d reloads ran concurrently with Get", atomic.LoadInt32(&n)-start)
+			}
+			if got := len(a.Get("master").Routes); got != 3 {
+				t.Errorf("len(Routes) = %d after append to a snapshot, want 3", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package accounts
+
+import (
+	"log"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// StaticRouteEnvPrefix は静的なルーティング情報を設定する環境変数名の接頭辞。
+//
+// "DOCKERNS_ROUTE_" から始まる環境変数の値に "アカウント名/接続先/0.正規表現の名前=正規表現" の形式で設定しておくと、
+// etcd 上の "/proxy/アカウント名/接続先/0.正規表現の名前" に正規表現を登録した場合と同様に扱われる。
+// "_" から始まるオプションも同様に指定できる。etcd を使用せずに Docker のラベルと組み合わせて使用することを想定している。
+//
+//  DOCKERNS_ROUTE_WEB='master/my_container_name.container/10.web=^www\.my-service\.com$'
+//  DOCKERNS_ROUTE_WEB_PORT='master/my_container_name.container/_port=8080'
+const StaticRouteEnvPrefix = "DOCKERNS_ROUTE_"
+
+// loadNodes は key 以下のルーティング情報を etcd と StaticRoutes から読み込み、etcd のノードの形式で返す。
+// EtcdAddr が空の場合は etcd を使用しない。ルーティング情報が一つも無い場合は nil を返す。
+// etcd から読み込んだ時点の etcd のインデックスも返す(etcdGet を参照)。etcd を使用しない場合は 0 になる。
+func (a *Accounts) loadNodes(key string) (*etcd.Node, uint64, error) {
+	var root *etcd.Node
+	var index uint64
+	if a.EtcdAddr != "" {
+		var err error
+		if root, index, err = a.etcdGet(key); err != nil {
+			return nil, 0, err
+		}
+	}
+	return a.addStaticRoutes(root, key), index, nil
+}
+
+// addStaticRoutes は StaticRoutes のうち key 以下に該当するものを root 以下のノードとして追加する。
+// root が nil の場合は必要に応じて作成する。
+func (a *Accounts) addStaticRoutes(root *etcd.Node, key string) *etcd.Node {
+	key = strings.TrimSuffix(key, "/")
+	prefix := strings.TrimSuffix(a.EtcdRoot, "/") + "/"
+
+	var dirs map[string]*etcd.Node
+	for _, r := range a.StaticRoutes {
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 {
+			log.Println("invalid static route:", r)
+			continue
+		}
+		full := prefix + strings.Trim(parts[0], "/")
+		if !strings.HasPrefix(full, key+"/") {
+			continue
+		}
+
+		if root == nil {
+			root = &etcd.Node{Key: key, Dir: true}
+		}
+		if dirs == nil {
+			dirs = make(map[string]*etcd.Node)
+			indexDirs(root, dirs)
+		}
+		addNode(root, dirs, full[len(key):], parts[1])
+	}
+	return root
+}
+
+// indexDirs は n 以下のディレクトリのノードをキーから引けるよう dirs に登録する。
+func indexDirs(n *etcd.Node, dirs map[string]*etcd.Node) {
+	if !n.Dir {
+		return
+	}
+	dirs[n.Key] = n
+	for _, c := range n.Nodes {
+		indexDirs(c, dirs)
+	}
+}
@@ -0,0 +1,47 @@
+package accounts
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// routeStats はルーティング情報がホスト名に一致した回数と最後に一致した時刻。
+// ルーティング情報は Reload の度に作り直されるため、Accounts 側で routeStatsKey ごとに保持し、
+// commit で新しいルーティング情報に引き継ぐ。
+type routeStats struct {
+	matches   uint64
+	lastMatch int64
+}
+
+// record は一致したことを記録する。
+func (s *routeStats) record() {
+	atomic.AddUint64(&s.matches, 1)
+	atomic.StoreInt64(&s.lastMatch, time.Now().UnixNano())
+}
+
+// routeStatsKey は routeStats を引き継ぐ際に同じルーティング情報とみなすための、アカウント名とプライオリティ、パターン、接続先の組。
+type routeStatsKey struct {
+	account  string
+	priority int
+	pattern  string
+	host     string
+}
+
+// inheritStats は accounts の全てのルーティング情報に、同じ routeStatsKey を持つ以前のルーティング情報の routeStats を設定する。
+// ReloadAccount で現在のルーティング情報から引き継いだ Route には既に設定されているため、それをそのまま使う。
+// 新しいルーティング情報に含まれなくなった routeStats は破棄される。a.m のロックを取った状態で呼び出すこと。
+func (a *Accounts) inheritStats(accounts map[string]Account) {
+	stats := make(map[routeStatsKey]*routeStats)
+	for name, account := range accounts {
+		for _, r := range account.Routes {
+			key := routeStatsKey{name, r.Priority, r.Pattern(), r.Host}
+			if r.stats == nil {
+				if r.stats = a.stats[key]; r.stats == nil {
+					r.stats = &routeStats{}
+				}
+			}
+			stats[key] = r.stats
+		}
+	}
+	a.stats = stats
+}
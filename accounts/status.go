@@ -0,0 +1,66 @@
+package accounts
+
+import "time"
+
+// Status はルーティング情報の読み込みと変更の監視の状態。
+// LastReload と LastSuccess は最後に Reload を実行した時刻と最後に成功した時刻で、一度も実行、成功していない場合はゼロ値になる。
+// ReloadError は最後の Reload が失敗した場合のエラーの内容。
+// EtcdWatching と DockerWatching は Watch で etcd と Docker Remote API の変更を監視中かどうかで、
+// 使用しない設定の場合は nil になる。
+// Accounts は現在読み込まれているアカウントの数。
+type Status struct {
+	LastReload     time.Time
+	LastSuccess    time.Time
+	ReloadError    string
+	EtcdWatching   *bool
+	DockerWatching *bool
+	Accounts       int
+}
+
+// ReloadSucceeded は一度以上 Reload を実行し、最後の Reload が成功していれば true を返す。
+func (s *Status) ReloadSucceeded() bool {
+	return !s.LastReload.IsZero() && s.ReloadError == ""
+}
+
+// Status は現在の Status を返す。
+func (a *Accounts) Status() Status {
+	a.m.Lock()
+	defer a.m.Unlock()
+	s := Status{
+		LastReload:  a.lastReload,
+		LastSuccess: a.lastSuccess,
+		Accounts:    len(a.accounts),
+	}
+	if a.reloadErr != nil {
+		s.ReloadError = a.reloadErr.Error()
+	}
+	if a.EtcdAddr != "" {
+		watching := a.etcdWatching
+		s.EtcdWatching = &watching
+	}
+	if a.DockerAddr != "" {
+		watching := a.dockerWatching
+		s.DockerWatching = &watching
+	}
+	return s
+}
+
+// recordReload は Reload の結果 err を記録する。
+func (a *Accounts) recordReload(err error) {
+	now := time.Now()
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.lastReload = now
+	a.reloadErr = err
+	if err == nil {
+		a.lastSuccess = now
+	}
+}
+
+// setWatching は Watch による監視の状態 watching を記録する。
+// flag には a.etcdWatching か a.dockerWatching を渡す。
+func (a *Accounts) setWatching(flag *bool, watching bool) {
+	a.m.Lock()
+	*flag = watching
+	a.m.Unlock()
+}
@@ -0,0 +1,93 @@
+package accounts
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/mimoto-xxxxxx/dockerns/metrics"
+)
+
+// targetRejected は接続先が AllowedTargets に含まれないために除外したルーティング情報の接続先の数。
+var targetRejected = metrics.Default.Counter(
+	"dockerns_route_target_rejected_total",
+	"Number of route targets skipped because they resolve outside the allowed target ranges.",
+	"account",
+)
+
+// ParseAllowedTargets はカンマ区切りで並べた CIDR 形式のアドレスの範囲 s を解釈する。
+// "10.0.0.5" のように範囲を省略した場合はそのアドレスのみを表す。s が空文字列の場合は nil を返す。
+func ParseAllowedTargets(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// checkTarget は接続先 host が AllowedTargets に含まれるかを調べる。
+// host がホスト名の場合は名前解決した全てのアドレスが含まれている必要があり、名前解決に失敗した場合も含まれないものとして扱う。
+// AllowedTargets が空の場合は全ての接続先を許可する。
+func (a *Accounts) checkTarget(host string) error {
+	if len(a.AllowedTargets) == 0 {
+		return nil
+	}
+	host, _ = SplitTarget(host)
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return err
+		}
+	}
+	for _, ip := range ips {
+		if !a.targetAllowed(ip) {
+			return fmt.Errorf("%s is not in the allowed target ranges", ip)
+		}
+	}
+	return nil
+}
+
+// targetAllowed は ip が AllowedTargets のいずれかに含まれていれば true を返す。
+func (a *Accounts) targetAllowed(ip net.IP) bool {
+	for _, n := range a.AllowedTargets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowTarget は checkTarget で host を調べ、許可されない場合はメッセージを出力して false を返す。
+func (a *Accounts) allowTarget(host, accountName string) bool {
+	if err := a.checkTarget(host); err != nil {
+		log.Println(
+			"Target not allowed:", host,
+			"Error:", err,
+			"Account:", accountName,
+		)
+		targetRejected.Inc(accountName)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package accounts
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAllowedTargets(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+		err  bool
+	}{
+		{s: "", want: ""},
+		{s: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{s: "10.0.0.5", want: "10.0.0.5/32"},
+		{s: "10.0.0.0/8, 2001:db8::/32 ,192.0.2.1", want: "10.0.0.0/8,2001:db8::/32,192.0.2.1/32"},
+		{s: "2001:db8::1", want: "2001:db8::1/128"},
+		{s: "10.0.0.0/33", err: true},
+		{s: "host.example", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			nets, err := ParseAllowedTargets(tt.s)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("ParseAllowedTargets = %v, want error", nets)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, n := range nets {
+				got = append(got, n.String())
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("ParseAllowedTargets = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedTargets(t *testing.T) {
+	docker := newDockerStub(t,
+		testContainer{ID: "1", Name: "inside", IP: "172.17.0.2", Labels: map[string]string{LabelPrefix + "labeled.10.inside": `^inside\.example\.com$`}},
+		testContainer{ID: "2", Name: "outside", IP: "192.168.0.2", Labels: map[string]string{LabelPrefix + "labeled.10.outside": `^outside\.example\.com$`}},
+	)
+	allowed, err := ParseAllowedTargets("172.17.0.0/16, 10.0.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		allowed bool
+	}{
+		{name: "in range", target: "172.17.5.5", allowed: true},
+		{name: "single address", target: "10.0.0.5", allowed: true},
+		{name: "with port", target: "10.0.0.5:8080", allowed: true},
+		{name: "outside", target: "10.0.0.6"},
+		{name: "outside with port", target: "192.0.2.1:80"},
+		{name: "container", target: "inside.container", allowed: true},
+		{name: "container outside", target: "outside.container"},
+		{name: "unresolvable", target: "unresolvable.invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// カウンターは全体で共有されるため、テストごとに異なるアカウント名を使用する。
+			account := "targets-" + strings.ReplaceAll(tt.name, " ", "-")
+			before := targetRejected.Get(account)
+
+			a := New(docker.URL, "", "/proxy")
+			a.AllowedTargets = allowed
+			a.StaticRoutes = []string{account + `/` + tt.target + `/0.www=^www\.example\.com$`}
+			if err := a.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			route, _ := a.Get(account).Match("www.example.com")
+			if (route != nil) != tt.allowed {
+				t.Errorf("route kept = %v, want %v", route != nil, tt.allowed)
+			}
+			want := before
+			if !tt.allowed {
+				want++
+			}
+			if got := targetRejected.Get(account); got != want {
+				t.Errorf("rejected = %d, want %d", got, want)
+			}
+		})
+	}
+
+	// コンテナのラベルから作成したルーティング情報にも適用される。
+	a := New(docker.URL, "", "/proxy")
+	a.AllowedTargets = allowed
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := routeHosts(a.Get("labeled")); got != "172.17.0.2" {
+		t.Errorf("label route targets = %q, want 172.17.0.2", got)
+	}
+}
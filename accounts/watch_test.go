@@ -0,0 +1,439 @@
+package accounts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDockerEventTrigger(t *testing.T) {
+	tests := []struct {
+		event   string
+		trigger string
+		cause   string
+	}{
+		{
+			event:   `{"Type":"container","Action":"start","Actor":{"ID":"1","Attributes":{"name":"web"}}}`,
+			trigger: "docker_container_start",
+			cause:   "container start of web",
+		},
+		{
+			event:   `{"Type":"container","Action":"die","Actor":{"ID":"1","Attributes":{"name":"web"}}}`,
+			trigger: "docker_container_die",
+			cause:   "container die of web",
+		},
+		{
+			event:   `{"Type":"network","Action":"connect","Actor":{"ID":"n1","Attributes":{"name":"bridge"}}}`,
+			trigger: "docker_network_connect",
+			cause:   "network connect of bridge",
+		},
+		// Type と Action が無い古い API のイベント。
+		{
+			event:   `{"status":"die","id":"abc"}`,
+			trigger: "docker_container_die",
+			cause:   "container die of abc",
+		},
+		{
+			event:   `{"Type":"container","Action":"exec_start: /bin/sh","Actor":{"ID":"1","Attributes":{"name":"web"}}}`,
+			trigger: "docker_container_exec_start",
+			cause:   "container exec_start of web",
+		},
+	}
+	for _, tt := range tests {
+		var e dockerEvent
+		if err := json.Unmarshal([]byte(tt.event), &e); err != nil {
+			t.Fatal(err)
+		}
+		if got := e.trigger(); got != tt.trigger {
+			t.Errorf("%s: trigger = %q, want %q", tt.event, got, tt.trigger)
+		}
+		if got := e.cause(); got != tt.cause {
+			t.Errorf("%s: cause = %q, want %q", tt.event, got, tt.cause)
+		}
+	}
+}
+
+func TestWatchReloadTrigger(t *testing.T) {
+	docker := newDockerStub(t, testContainer{ID: "1", Name: "web", IP: "172.17.0.2"})
+	// Watch は終了しないため、イベントのストリームを切断してから停止する。
+	t.Cleanup(docker.CloseClientConnections)
+
+	a := New(docker.URL, "", "/proxy")
+	a.StaticRoutes = []string{`watch/web.container/0.www=^www\.example\.com$`}
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	go a.Watch()
+
+	tests := []struct {
+		event   string
+		trigger string
+	}{
+		{event: `{"Type":"container","Action":"start","Actor":{"ID":"1","Attributes":{"name":"web"}}}`, trigger: "docker_container_start"},
+		{event: `{"Type":"container","Action":"die","Actor":{"ID":"1","Attributes":{"name":"web"}}}`, trigger: "docker_container_die"},
+	}
+	for _, tt := range tests {
+		before := reloads.Get(tt.trigger)
+		docker.events <- tt.event + "\n"
+		deadline := time.Now().Add(5 * time.Second)
+		for reloads.Get(tt.trigger) == before {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: reload not recorded", tt.trigger)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+func TestWatchIncremental(t *testing.T) {
+	docker := newDockerStub(t,
+		testContainer{ID: "1", Name: "web", IP: "172.17.0.2"},
+		testContainer{ID: "2", Name: "api", IP: "172.17.0.3"},
+	)
+	t.Cleanup(docker.CloseClientConnections)
+
+	// etcd v2 API の代わりに、全体とアカウントごとのルーティング情報を返し、events に送ったキーの変更を監視の応答として返す。
+	const tree = `{"action":"get","node":{"key":"/proxy","dir":true,"nodes":[
+		{"key":"/proxy/master","dir":true,"nodes":[{"key":"/proxy/master/web.container","dir":true,"nodes":[
+			{"key":"/proxy/master/web.container/0.www","value":"^www\\.example\\.com$"}]}]},
+		{"key":"/proxy/other","dir":true,"nodes":[{"key":"/proxy/other/api.container","dir":true,"nodes":[
+			{"key":"/proxy/other/api.container/0.api","value":"^api\\.example\\.com$"}]}]}
+	]}}`
+	var fullGets, accountGets int32
+	events := make(chan string)
+	etcdStub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Etcd-Index", "10")
+		switch {
+		case r.URL.Query().Get("wait") == "true":
+			select {
+			case key := <-events:
+				fmt.Fprintf(w, `{"action":"set","node":{"key":%q,"value":"x","modifiedIndex":11,"createdIndex":11}}`, key)
+			case <-r.Context().Done():
+			}
+		case r.URL.Path == "/v2/keys/proxy":
+			atomic.AddInt32(&fullGets, 1)
+			io.WriteString(w, tree)
+		default:
+			atomic.AddInt32(&accountGets, 1)
+			name := strings.TrimPrefix(r.URL.Path, "/v2/keys/proxy/")
+			var node struct {
+				Node struct {
+					Nodes []json.RawMessage `json:"nodes"`
+				} `json:"node"`
+			}
+			json.Unmarshal([]byte(tree), &node)
+			for _, n := range node.Node.Nodes {
+				if strings.Contains(string(n), `"key":"/proxy/`+name+`"`) {
+					fmt.Fprintf(w, `{"action":"get","node":%s}`, n)
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"errorCode":100,"message":"Key not found"}`)
+		}
+	}))
+	t.Cleanup(etcdStub.Close)
+	t.Cleanup(etcdStub.CloseClientConnections)
+
+	a := New(docker.URL, etcdStub.URL, "/proxy")
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	go a.Watch()
+
+	// 各段階は順に変更を通知し、全体とアカウントのどちらを読み込み直したかを確認する。
+	tests := []struct {
+		key  string
+		full bool
+	}{
+		{key: "/proxy/master/web.container/0.www"},
+		{key: "/proxy/other/api.container/0.api"},
+		{key: "/proxy", full: true},
+	}
+	for _, tt := range tests {
+		full, account := atomic.LoadInt32(&fullGets), atomic.LoadInt32(&accountGets)
+		inspects := atomic.LoadInt32(&docker.inspects)
+		incremental := accountReloads.Get()
+		events <- tt.key
+
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt32(&fullGets) == full && atomic.LoadInt32(&accountGets) == account {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: not reloaded", tt.key)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		// 再構築が終わるのを待つ。
+		time.Sleep(100 * time.Millisecond)
+
+		gotFull := atomic.LoadInt32(&fullGets) - full
+		gotAccount := atomic.LoadInt32(&accountGets) - account
+		gotIncremental := accountReloads.Get() - incremental
+		if tt.full {
+			if gotFull != 1 || gotAccount != 0 || gotIncremental != 0 {
+				t.Errorf("%s: full = %d, account = %d, incremental = %d, want a full reload", tt.key, gotFull, gotAccount, gotIncremental)
+			}
+			continue
+		}
+		if gotFull != 0 || gotAccount != 1 || gotIncremental != 1 {
+			t.Errorf("%s: full = %d, account = %d, incremental = %d, want an incremental reload", tt.key, gotFull, gotAccount, gotIncremental)
+		}
+		// 参照しているコンテナは直前の読み込みで取得済みのため、問い合わせ直さない。
+		if got := atomic.LoadInt32(&docker.inspects) - inspects; got != 0 {
+			t.Errorf("%s: inspects = %d, want 0", tt.key, got)
+		}
+	}
+	if account := a.Get("master"); account == nil || routeHosts(account) != "172.17.0.2" {
+		t.Errorf("master = %v", account)
+	}
+}
+
+func TestWatchResync(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		// want は監視のイベントが無い状態で待った後の接続先。
+		want string
+	}{
+		{name: "disabled", want: "172.17.0.2"},
+		{name: "enabled", interval: time.Second, want: "172.17.0.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := newDockerStub(t, testContainer{ID: "1", Name: "web", IP: "172.17.0.2"})
+			t.Cleanup(docker.CloseClientConnections)
+
+			a := New(docker.URL, "", "/proxy")
+			a.StaticRoutes = []string{`resync/web.container/0.www=^www\.example\.com$`}
+			a.ResyncInterval = tt.interval
+			if err := a.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			go a.Watch()
+
+			// イベントを送らずにコンテナのアドレスを変更し、定期的な再構築でのみ反映されるようにする。
+			before := reloads.Get("resync")
+			docker.set(testContainer{ID: "1", Name: "web", IP: "172.17.0.9"})
+			// 再構築は間隔の経過後、更に 1 秒待ってから行われる。
+			deadline := time.Now().Add(tt.interval + 3*time.Second)
+			for time.Now().Before(deadline) && routeHosts(a.Get("resync")) != tt.want {
+				time.Sleep(50 * time.Millisecond)
+			}
+			if tt.interval == 0 {
+				time.Sleep(time.Until(deadline))
+			}
+
+			if got := routeHosts(a.Get("resync")); got != tt.want {
+				t.Errorf("target = %q, want %q", got, tt.want)
+			}
+			if got := reloads.Get("resync") > before; got != (tt.interval > 0) {
+				t.Errorf("resync recorded = %v, want %v", got, tt.interval > 0)
+			}
+		})
+	}
+}
+
+func TestDockerEventsTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// retried は応答しないイベントストリームの問い合わせをやめて再接続するか。
+		retried bool
+	}{
+		{name: "timeout", timeout: 200 * time.Millisecond, retried: true},
+		{name: "no timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 最初の問い合わせには接続を受け付けたままヘッダーを返さず、以降はイベントを一つ返す。
+			var attempts int32
+			docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&attempts, 1) == 1 {
+					<-r.Context().Done()
+					return
+				}
+				io.WriteString(w, `{"Type":"container","Action":"start","Actor":{"ID":"1","Attributes":{"name":"web"}}}`+"\n")
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			}))
+			t.Cleanup(docker.Close)
+			t.Cleanup(docker.CloseClientConnections)
+
+			a := New(docker.URL, "", "/proxy")
+			a.DockerEventsTimeout = tt.timeout
+			recv := make(chan *dockerEvent, 1)
+			go a.watchDockerEvent(recv)
+
+			// 再接続は watchBackoffMin だけ待ってから行われる。
+			select {
+			case e := <-recv:
+				if !tt.retried {
+					t.Fatalf("received %v, want no event", e.cause())
+				}
+				if e.cause() != "container start of web" {
+					t.Errorf("event = %q", e.cause())
+				}
+			case <-time.After(tt.timeout + watchBackoffMin + 2*time.Second):
+				if tt.retried {
+					t.Fatalf("no event after %d attempts", atomic.LoadInt32(&attempts))
+				}
+			}
+			want := int32(1)
+			if tt.retried {
+				want = 2
+			}
+			if got := atomic.LoadInt32(&attempts); got != want {
+				t.Errorf("attempts = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestWatchAlreadyLoaded(t *testing.T) {
+	// etcd v2 API の代わりに、インデックス 10 の時点のルーティング情報を返し、events に送ったインデックスの変更を監視の応答として返す。
+	var gets int32
+	events := make(chan int)
+	etcdStub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Etcd-Index", "10")
+		if r.URL.Query().Get("wait") == "true" {
+			select {
+			case index := <-events:
+				fmt.Fprintf(w, `{"action":"set","node":{"key":"/proxy/master/192.0.2.1/0.www","value":"x","modifiedIndex":%d,"createdIndex":%d}}`, index, index)
+			case <-r.Context().Done():
+			}
+			return
+		}
+		atomic.AddInt32(&gets, 1)
+		io.WriteString(w, etcdV2Tree("192.0.2.1"))
+	}))
+	t.Cleanup(etcdStub.Close)
+	t.Cleanup(etcdStub.CloseClientConnections)
+
+	a := New("", etcdStub.URL, "/proxy")
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	go a.Watch()
+
+	// 各段階は順に変更を通知する。
+	tests := []struct {
+		index  int
+		reload bool
+	}{
+		// Watch の開始直後に通知される読み込み済みの変更では読み込み直さない。
+		{index: 9},
+		{index: 10},
+		{index: 11, reload: true},
+	}
+	for _, tt := range tests {
+		before := atomic.LoadInt32(&gets)
+		events <- tt.index
+		// 再構築は通知から 1 秒後に行われる。
+		deadline := time.Now().Add(2 * time.Second)
+		for atomic.LoadInt32(&gets) == before && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if got := atomic.LoadInt32(&gets) > before; got != tt.reload {
+			t.Errorf("index %d: reloaded = %v, want %v", tt.index, got, tt.reload)
+		}
+	}
+}
+
+func TestWatchIncrementalFailure(t *testing.T) {
+	tests := []struct {
+		name        string
+		accountFail bool
+		fullFail    bool
+		// full は差分の読み込みの代わりに全体を読み込み直すかどうか。
+		full bool
+		// host は変更の通知後の master の接続先。
+		host    string
+		healthy bool
+	}{
+		{name: "incremental", host: "192.0.2.2", healthy: true},
+		// アカウントの読み込みに失敗した場合は古いルーティング情報を残さないよう全体を作り直す。
+		{name: "fallback", accountFail: true, full: true, host: "192.0.2.2", healthy: true},
+		// 全体の読み込みにも失敗した場合はそれまでのルーティング情報を使い続け、失敗を記録する。
+		{name: "fallback fails", accountFail: true, fullFail: true, full: true, host: "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// etcd v2 API の代わりに、最初の読み込みでは 192.0.2.1、それ以降は 192.0.2.2 を接続先として返す。
+			var fullGets int32
+			var loaded int32
+			events := make(chan struct{})
+			fail := func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusForbidden)
+				io.WriteString(w, `{"errorCode":110,"message":"The request requires user authentication"}`)
+			}
+			etcdStub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Etcd-Index", "10")
+				switch {
+				case r.URL.Query().Get("wait") == "true":
+					select {
+					case <-events:
+						io.WriteString(w, `{"action":"set","node":{"key":"/proxy/master/192.0.2.2/0.www","value":"x","modifiedIndex":11,"createdIndex":11}}`)
+					case <-r.Context().Done():
+					}
+				case r.URL.Path == "/v2/keys/proxy":
+					atomic.AddInt32(&fullGets, 1)
+					if atomic.LoadInt32(&loaded) == 0 {
+						io.WriteString(w, etcdV2Tree("192.0.2.1"))
+						return
+					}
+					if tt.fullFail {
+						fail(w)
+						return
+					}
+					io.WriteString(w, etcdV2Tree("192.0.2.2"))
+				default:
+					if tt.accountFail {
+						fail(w)
+						return
+					}
+					io.WriteString(w, `{"action":"get","node":`+etcdV2Account("192.0.2.2")+`}`)
+				}
+			}))
+			t.Cleanup(etcdStub.Close)
+			t.Cleanup(etcdStub.CloseClientConnections)
+
+			a := New("", etcdStub.URL, "/proxy")
+			if err := a.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			atomic.StoreInt32(&loaded, 1)
+			go a.Watch()
+
+			before := a.Status().LastReload
+			events <- struct{}{}
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				s := a.Status()
+				if tt.full && s.LastReload.After(before) || !tt.full && routeHosts(a.Get("master")) == tt.host {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("not reloaded")
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+
+			if got := atomic.LoadInt32(&fullGets) > 1; got != tt.full {
+				t.Errorf("full reload = %v, want %v", got, tt.full)
+			}
+			if got := routeHosts(a.Get("master")); got != tt.host {
+				t.Errorf("master = %s, want %s", got, tt.host)
+			}
+			s := a.Status()
+			if got := s.ReloadSucceeded(); got != tt.healthy {
+				t.Errorf("ReloadSucceeded = %v (%s), want %v", got, s.ReloadError, tt.healthy)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+// Package certs は TLS 証明書の読み込みと、再起動を伴わない差し替えを行う。
+package certs
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader は CertFile と KeyFile から証明書を読み込み、
+// ファイルが更新された場合は新しい証明書に差し替える。
+// GetCertificate を tls.Config に設定することで、待受を停止せずに新しい証明書でハンドシェイクできる。
+// Interval はファイルの更新を確認する間隔で、0 の場合はハンドシェイク毎に確認する。
+type Reloader struct {
+	CertFile string
+	KeyFile  string
+	Interval time.Duration
+	Logger   *log.Logger
+
+	m       sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+// NewReloader は certFile と keyFile を読み込み、Reloader を新規作成する。
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		Interval: 10 * time.Second,
+		Logger:   log.New(os.Stderr, "", log.LstdFlags),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload はファイルから証明書を読み直す。
+// 読み込みに失敗した場合は以前の証明書を維持したままエラーを返す。
+func (r *Reloader) Reload() error {
+	certMod, keyMod, err := r.modTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	r.cert = &cert
+	r.certMod, r.keyMod = certMod, keyMod
+	r.checked = time.Now()
+	r.m.Unlock()
+	return nil
+}
+
+// modTime は証明書ファイルと鍵ファイルの更新日時を返す。
+func (r *Reloader) modTime() (time.Time, time.Time, error) {
+	cfi, err := os.Stat(r.CertFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	kfi, err := os.Stat(r.KeyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return cfi.ModTime(), kfi.ModTime(), nil
+}
+
+// check は前回の確認から Interval 以上経過していればファイルの更新日時を確認し、
+// 更新されていれば証明書を読み直す。
+func (r *Reloader) check() {
+	r.m.Lock()
+	now := time.Now()
+	if now.Sub(r.checked) < r.Interval {
+		r.m.Unlock()
+		return
+	}
+	r.checked = now
+	certMod, keyMod := r.certMod, r.keyMod
+	r.m.Unlock()
+
+	cm, km, err := r.modTime()
+	if err != nil {
+		r.Logger.Println("certs: could not stat certificate:", err)
+		return
+	}
+	if cm.Equal(certMod) && km.Equal(keyMod) {
+		return
+	}
+	if err = r.Reload(); err != nil {
+		// 証明書と鍵の書き換えの途中である可能性があるため、次回の確認で再度読み込む。
+		r.Logger.Println("certs: could not reload certificate:", err)
+		return
+	}
+	r.Logger.Println("certs: reloaded certificate:", r.CertFile)
+}
+
+// GetCertificate は tls.Config.GetCertificate の実装。
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.check()
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.cert, nil
+}
+
+// TLSConfig は GetCertificate を設定した tls.Config を返す。
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: r.GetCertificate}
+}
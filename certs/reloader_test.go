@@ -0,0 +1,168 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert は commonName の自己署名証明書とその秘密鍵を certFile と keyFile に書き込む。
+// 更新日時は mod に設定する。
+func writeCert(t *testing.T, certFile, keyFile, commonName string, mod time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		path  string
+		block *pem.Block
+	}{
+		{certFile, &pem.Block{Type: "CERTIFICATE", Bytes: der}},
+		{keyFile, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}},
+	} {
+		if err := os.WriteFile(f.path, pem.EncodeToMemory(f.block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f.path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// handshake は addr に TLS で接続し、サーバーが提示した証明書の CommonName を返す。
+func handshake(t *testing.T, addr string) string {
+	t.Helper()
+	c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestReloader(t *testing.T) {
+	// 各手順の後のハンドシェイクで提示される証明書を確認する。
+	type step struct {
+		// write が空でなければ、その CommonName の証明書をファイルに書き込む。broken の場合は壊れた証明書を書き込む。
+		write  string
+		broken bool
+		want   string
+	}
+	tests := []struct {
+		name     string
+		interval time.Duration
+		steps    []step
+	}{
+		{
+			name: "replaced",
+			steps: []step{
+				{want: "first"},
+				{write: "second", want: "second"},
+				{write: "third", want: "third"},
+			},
+		},
+		{
+			name: "broken file keeps the previous certificate",
+			steps: []step{
+				{broken: true, want: "first"},
+				{write: "second", want: "second"},
+			},
+		},
+		{
+			name:     "not checked until the interval passes",
+			interval: time.Hour,
+			steps: []step{
+				{write: "second", want: "first"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+			mod := time.Now().Add(-time.Hour)
+			writeCert(t, certFile, keyFile, "first", mod)
+
+			r, err := NewReloader(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Interval = tt.interval
+			r.Logger = log.New(io.Discard, "", 0)
+
+			ln, err := tls.Listen("tcp", "127.0.0.1:0", r.TLSConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				for {
+					c, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					c.(*tls.Conn).Handshake()
+					c.Close()
+				}
+			}()
+
+			for i, s := range tt.steps {
+				// 更新日時の変化で書き換えを検出するため、書き込む度に進める。
+				mod = mod.Add(time.Minute)
+				switch {
+				case s.broken:
+					if err := os.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+						t.Fatal(err)
+					}
+					os.Chtimes(certFile, mod, mod)
+				case s.write != "":
+					writeCert(t, certFile, keyFile, s.write, mod)
+				}
+				if got := handshake(t, ln.Addr().String()); got != s.want {
+					t.Errorf("step %d: certificate = %q, want %q", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewReloaderError(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if _, err := NewReloader(certFile, keyFile); err == nil {
+		t.Error("NewReloader succeeded without certificate files")
+	}
+	writeCert(t, certFile, keyFile, "first", time.Now())
+	if err := os.WriteFile(keyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewReloader(certFile, keyFile); err == nil {
+		t.Error("NewReloader succeeded with a broken key")
+	}
+}
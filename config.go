@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config は -config で指定する設定ファイルの内容。
+// yaml と toml タグは設定ファイル上のキー、flag タグは対応するコマンドライン引数の名前で、省略した場合はキーと同じ名前になる。
+type Config struct {
+	Docker       string `yaml:"docker" toml:"docker"`
+	Etcd         string `yaml:"etcd" toml:"etcd"`
+	Routes       string `yaml:"routes" toml:"routes"`
+	HTTP         string `yaml:"http" toml:"http"`
+	SOCKS        string `yaml:"socks" toml:"socks"`
+	DNS          string `yaml:"dns" toml:"dns"`
+	NS           string `yaml:"ns" toml:"ns"`
+	FakeMX       string `yaml:"fakemx" toml:"fakemx"`
+	Account      string `yaml:"account" toml:"account"`
+	Realm        string `yaml:"realm" toml:"realm"`
+	Password     string `yaml:"password" toml:"password"`
+	PasswordFile string `yaml:"password_file" toml:"password_file" flag:"password-file"`
+	Reverse      bool   `yaml:"reverse" toml:"reverse"`
+	Debug        bool   `yaml:"debug" toml:"debug" flag:"d"`
+
+	// keys は設定ファイルに記述されていたキー。
+	keys map[string]bool
+}
+
+// loadConfig は path の設定ファイルを読み込む。
+// 拡張子が .toml の場合は TOML、それ以外の場合は YAML として読み込む。Config に無いキーが含まれている場合はエラーを返す。
+func loadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{keys: make(map[string]bool)}
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		md, err := toml.Decode(string(b), c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("%s: unknown key: %q", path, undecoded[0].String())
+		}
+		for _, key := range md.Keys() {
+			c.keys[key.String()] = true
+		}
+		return c, nil
+	}
+
+	// 記述されていたキーを知るため、構造体とは別に map としても読み込む。
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	if err := d.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for key := range m {
+		c.keys[key] = true
+	}
+	return c, nil
+}
+
+// apply は設定ファイルに記述されていた値を fs のフラグに設定する。
+// explicit に含まれる、コマンドライン引数で明示的に指定されたフラグは上書きしない。
+func (c *Config) apply(fs *flag.FlagSet, explicit map[string]bool) error {
+	t := reflect.TypeOf(*c)
+	for key, i := range configFields() {
+		if !c.keys[key] {
+			continue
+		}
+		name := t.Field(i).Tag.Get("flag")
+		if name == "" {
+			name = key
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, fmt.Sprint(reflect.ValueOf(*c).Field(i).Interface())); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// configFields は Config の設定ファイル上のキーからフィールドの番号を引くための対応表を返す。
+func configFields() map[string]int {
+	t := reflect.TypeOf(Config{})
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("yaml"); key != "" {
+			fields[key] = i
+		}
+	}
+	return fields
+}
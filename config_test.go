@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		args    []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "yaml",
+			file:    "dockerns.yaml",
+			content: "# comment\netcd: \"http://127.0.0.1:2379\"\nhttp: :80\npassword: 1234 # trailing comment\npassword_file: /run/secrets/password\ndebug: true\n",
+			want:    map[string]string{"etcd": "http://127.0.0.1:2379", "http": ":80", "socks": "", "password": "1234", "password-file": "/run/secrets/password", "d": "true"},
+		},
+		{
+			name:    "toml",
+			file:    "dockerns.toml",
+			content: "# comment\netcd = \"http://127.0.0.1:2379\"\nhttp = \":80\"\nreverse = true\n",
+			want:    map[string]string{"etcd": "http://127.0.0.1:2379", "http": ":80", "reverse": "true", "d": "false"},
+		},
+		{
+			name:    "flags take precedence",
+			file:    "dockerns.yaml",
+			content: "http: \":80\"\nsocks: \":1080\"\n",
+			args:    []string{"-http=:8080"},
+			want:    map[string]string{"http": ":8080", "socks": ":1080"},
+		},
+		{name: "empty yaml", file: "dockerns.yaml", want: map[string]string{"http": ""}},
+		{name: "unknown yaml key", file: "dockerns.yaml", content: "htp: \":80\"\n", wantErr: true},
+		{name: "unknown toml key", file: "dockerns.toml", content: "htp = \":80\"\n", wantErr: true},
+		{name: "invalid boolean", file: "dockerns.yaml", content: "debug: sometimes\n", wantErr: true},
+		{name: "nested yaml", file: "dockerns.yaml", content: "http:\n  addr: \":80\"\n", wantErr: true},
+		{name: "invalid toml", file: "dockerns.toml", content: "http = :80\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			c, err := loadConfig(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fs := flag.NewFlagSet("dockerns", flag.ContinueOnError)
+			for _, name := range []string{"etcd", "http", "socks", "password", "password-file"} {
+				fs.String(name, "", "")
+			}
+			fs.Bool("reverse", false, "")
+			fs.Bool("d", false, "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			explicit := make(map[string]bool)
+			fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+			if err := c.apply(fs, explicit); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				if got := fs.Lookup(name).Value.String(); got != want {
+					t.Errorf("-%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestANY(t *testing.T) {
+	ns := serveUDP(t, &upstream{rcode: dns.RcodeNameError})
+
+	tests := []struct {
+		name  string
+		mode  string
+		qname string
+		rcode int
+		types []uint16
+	}{
+		{name: "default", qname: "www.example.com", rcode: dns.RcodeSuccess, types: []uint16{dns.TypeHINFO}},
+		{name: "minimal", mode: AnyMinimal, qname: "www.example.com", rcode: dns.RcodeSuccess, types: []uint16{dns.TypeHINFO}},
+		// 一致しない名前にも転送せずに応答する。
+		{name: "minimal unmatched", mode: AnyMinimal, qname: "other.example.org", rcode: dns.RcodeSuccess, types: []uint16{dns.TypeHINFO}},
+		{name: "refuse", mode: AnyRefuse, qname: "www.example.com", rcode: dns.RcodeRefused},
+		{name: "full", mode: AnyFull, qname: "www.example.com", rcode: dns.RcodeSuccess, types: []uint16{dns.TypeA, dns.TypeTXT, dns.TypeMX}},
+		{name: "full ipv6", mode: AnyFull, qname: "v6.example.com", rcode: dns.RcodeSuccess, types: []uint16{dns.TypeAAAA, dns.TypeTXT, dns.TypeMX}},
+		{name: "full cname", mode: AnyFull, qname: "alias.example.com", rcode: dns.RcodeSuccess, types: []uint16{dns.TypeCNAME, dns.TypeTXT, dns.TypeMX}},
+		{name: "full unmatched", mode: AnyFull, qname: "other.example.org", rcode: dns.RcodeNameError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New(newTestAccounts(t,
+				`master/192.0.2.1/0.www=^www\.example\.com$`,
+				`master/2001:db8::1/0.v6=^v6\.example\.com$`,
+				`master/www.example.net/0.alias=^alias\.example\.com$`,
+			))
+			d.AccountName = "master"
+			d.NameServer = ns
+			if tt.mode != "" {
+				d.AnyMode = tt.mode
+			}
+
+			r := query(t, serveUDP(t, d), tt.qname, dns.TypeANY)
+			if r.Rcode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if len(r.Answer) != len(tt.types) {
+				t.Fatalf("answer = %v, want types %v", r.Answer, tt.types)
+			}
+			for i, rr := range r.Answer {
+				if rr.Header().Rrtype != tt.types[i] {
+					t.Errorf("answer[%d] = %v, want type %s", i, rr, dns.TypeToString[tt.types[i]])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// sockopt は c のソケットオプション opt の値を返す。
+func sockopt(t *testing.T, c syscall.Conn, opt int) int {
+	t.Helper()
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v
+}
+
+func TestBufferSize(t *testing.T) {
+	// Linux は設定した値の 2 倍をバッファサイズとして確保し、getsockopt でもその値を返す。
+	tests := []struct {
+		name                    string
+		readBuffer, writeBuffer int
+	}{
+		{name: "both", readBuffer: 32 << 10, writeBuffer: 48 << 10},
+		{name: "read only", readBuffer: 40 << 10},
+		{name: "write only", writeBuffer: 40 << 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New(nil)
+			d.ReadBuffer, d.WriteBuffer = tt.readBuffer, tt.writeBuffer
+
+			check := func(t *testing.T, c syscall.Conn, defaults [2]int) {
+				t.Helper()
+				want := defaults
+				if tt.readBuffer > 0 {
+					want[0] = tt.readBuffer * 2
+				}
+				if tt.writeBuffer > 0 {
+					want[1] = tt.writeBuffer * 2
+				}
+				got := [2]int{sockopt(t, c, syscall.SO_RCVBUF), sockopt(t, c, syscall.SO_SNDBUF)}
+				if got != want {
+					t.Errorf("SO_RCVBUF, SO_SNDBUF = %v, want %v", got, want)
+				}
+			}
+
+			t.Run("udp", func(t *testing.T) {
+				pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer pc.Close()
+				c := pc.(*net.UDPConn)
+				defaults := [2]int{sockopt(t, c, syscall.SO_RCVBUF), sockopt(t, c, syscall.SO_SNDBUF)}
+				if err := d.setBuffer(pc); err != nil {
+					t.Fatal(err)
+				}
+				check(t, c, defaults)
+			})
+
+			t.Run("tcp", func(t *testing.T) {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				bl := &bufferListener{Listener: ln, d: d}
+				defer bl.Close()
+				client, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer client.Close()
+				defaults := [2]int{sockopt(t, client.(*net.TCPConn), syscall.SO_RCVBUF), sockopt(t, client.(*net.TCPConn), syscall.SO_SNDBUF)}
+
+				c, err := bl.Accept()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				check(t, c.(*net.TCPConn), defaults)
+			})
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package dns
+
+import (
+	"container/list"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cacheKey は応答をキャッシュする際のキー。
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+// newCacheKey は q に対応するキャッシュのキーを返す。名前の大文字小文字は区別しない。
+func newCacheKey(q dns.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+}
+
+// cacheEntry はキャッシュされた応答。served は応答を返した回数で、CacheOrderRotate で並び順をずらすために使用する。
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+	served  uint32
+}
+
+// cacheSweepInterval は期限切れのエントリーをバックグラウンドで削除する間隔。
+const cacheSweepInterval = time.Minute
+
+// cache は上位のネームサーバーから得た応答を TTL に従って保持する。
+// 期限切れのエントリーも stale の間は古い応答として返せるように保持し続ける。
+// size 件を超える場合は最も長く参照されていないエントリーから削除する。
+// order は応答を返す際の回答セクションのレコードの並べ方で、CacheOrderRotate などを指定する。
+type cache struct {
+	m       sync.Mutex
+	size    int
+	stale   time.Duration
+	order   string
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+}
+
+// newCache は最大 size 件の応答を保持する cache を新規作成する。
+func newCache(size int, stale time.Duration, order string) *cache {
+	return &cache{
+		size:    size,
+		stale:   stale,
+		order:   order,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// minTTL は m に含まれるレコードの TTL の最小値を返す。レコードが含まれない場合は false を返す。
+func minTTL(m *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range rrs {
+			if t := rr.Header().Ttl; !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// store は m を key に対する応答としてキャッシュする。
+// 成功および NXDOMAIN 以外の応答と、TTL を決められない応答はキャッシュしない。
+func (c *cache) store(key cacheKey, m *dns.Msg, now time.Time) {
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return
+	}
+	ttl, ok := minTTL(m)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	e := &cacheEntry{
+		key:     key,
+		msg:     m.Copy(),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	for c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(e)
+}
+
+// remove は el のエントリーを削除する。c.m をロックした状態で呼び出す。
+func (c *cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// lookup は key のエントリーを最も最近参照されたものとして返す。
+func (c *cache) lookup(key cacheKey) (*cacheEntry, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry), true
+}
+
+// sweep は古い応答として返せる期間も過ぎたエントリーを削除し、削除した件数を返す。
+func (c *cache) sweep(now time.Time) int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	n := 0
+	for el := c.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if now.After(el.Value.(*cacheEntry).expires.Add(c.stale)) {
+			c.remove(el)
+			n++
+		}
+		el = prev
+	}
+	return n
+}
+
+// sweepEvery は stop が閉じられるまで interval ごとに sweep を呼び出す。
+func (c *cache) sweepEvery(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			c.sweep(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// get は key に対する有効期限内の応答を返す。
+// 応答に含まれるレコードの TTL は残り時間に合わせて減算される。
+func (c *cache) get(key cacheKey, now time.Time) (*dns.Msg, bool) {
+	e, ok := c.lookup(key)
+	if !ok || !now.Before(e.expires) {
+		return nil, false
+	}
+
+	m := e.msg.Copy()
+	c.reorder(m.Answer, atomic.AddUint32(&e.served, 1)-1)
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				if h.Ttl > elapsed {
+					h.Ttl -= elapsed
+				} else {
+					h.Ttl = 0
+				}
+			}
+		}
+	}
+	return m, true
+}
+
+// getStale は key に対する期限切れの応答を古い応答として返せる期間内であれば返す。
+// 応答に含まれるレコードの TTL は ttl に置き換えられる。
+func (c *cache) getStale(key cacheKey, now time.Time, ttl uint32) (*dns.Msg, bool) {
+	e, ok := c.lookup(key)
+	if !ok || now.After(e.expires.Add(c.stale)) {
+		return nil, false
+	}
+
+	m := e.msg.Copy()
+	c.reorder(m.Answer, atomic.AddUint32(&e.served, 1)-1)
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				h.Ttl = ttl
+			}
+		}
+	}
+	return m, true
+}
+
+// reorder は rrs のうち名前と種類が同じ連続したレコードの並び順を order に従って入れ替える。
+// CacheOrderRotate の場合は応答を返した回数 n だけ先頭をずらし、CacheOrderShuffle の場合は無作為に並べ替える。
+// CNAME などの異なるレコードの間の順序は変えない。
+func (c *cache) reorder(rrs []dns.RR, n uint32) {
+	if c.order == CacheOrderFixed {
+		return
+	}
+	for i := 0; i < len(rrs); {
+		j := i + 1
+		for j < len(rrs) && sameRRset(rrs[i], rrs[j]) {
+			j++
+		}
+		if set := rrs[i:j]; len(set) > 1 {
+			if c.order == CacheOrderShuffle {
+				rand.Shuffle(len(set), func(a, b int) { set[a], set[b] = set[b], set[a] })
+			} else {
+				k := int(n % uint32(len(set)))
+				rotated := append(append(make([]dns.RR, 0, len(set)), set[k:]...), set[:k]...)
+				copy(set, rotated)
+			}
+		}
+		i = j
+	}
+}
+
+// sameRRset は a と b が同じ名前、種類、クラスのレコードであれば true を返す。
+func sameRRset(a, b dns.RR) bool {
+	ha, hb := a.Header(), b.Header()
+	return ha.Rrtype == hb.Rrtype && ha.Class == hb.Class && strings.EqualFold(ha.Name, hb.Name)
+}
@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// closedAddr は応答しない(ポートが閉じられた) UDP のアドレスを返す。
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	return addr
+}
+
+func TestServeStale(t *testing.T) {
+	tests := []struct {
+		name       string
+		serveStale time.Duration
+		// expired はキャッシュの有効期限が切れてからの経過時間で、負の値の場合はまだ有効期限内。
+		expired time.Duration
+		cached  bool
+		rcode   int
+		ttl     uint32
+	}{
+		{name: "fresh", serveStale: time.Hour, expired: -30 * time.Second, cached: true, rcode: dns.RcodeSuccess, ttl: 30},
+		{name: "stale", serveStale: time.Hour, expired: time.Minute, cached: true, rcode: dns.RcodeSuccess, ttl: staleTTL},
+		{name: "too old", serveStale: time.Hour, expired: 2 * time.Hour, cached: true, rcode: dns.RcodeServerFailure},
+		{name: "disabled", expired: time.Minute, cached: true, rcode: dns.RcodeServerFailure},
+		{name: "not cached", serveStale: time.Hour, rcode: dns.RcodeServerFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New(newTestAccounts(t, `master/192.0.2.1/0.www=^www\.example\.net$`))
+			d.AccountName = "master"
+			d.NameServer = closedAddr(t)
+			d.CacheSize = 10
+			d.ServeStale = tt.serveStale
+
+			if tt.cached {
+				m := &dns.Msg{}
+				m.SetQuestion("www.example.com.", dns.TypeA)
+				m.Response = true
+				m.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP("192.0.2.80"),
+				}}
+				d.getCache().store(newCacheKey(m.Question[0]), m, time.Now().Add(-60*time.Second-tt.expired))
+			}
+
+			r := query(t, serveUDP(t, d), "www.example.com", dns.TypeA)
+			if r.Rcode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if tt.rcode != dns.RcodeSuccess {
+				return
+			}
+			if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.80" {
+				t.Fatalf("answer = %v", r.Answer)
+			}
+			if ttl := r.Answer[0].Header().Ttl; ttl != tt.ttl {
+				t.Errorf("ttl = %d, want %d", ttl, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestCacheOrder(t *testing.T) {
+	addrs := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	tests := []struct {
+		name  string
+		order string
+		// minOrders と maxOrders は 30 回問い合わせた際に現れるべき、異なる並び順の数の範囲。
+		minOrders, maxOrders int
+	}{
+		{name: "default", minOrders: 3, maxOrders: 3},
+		{name: "rotate", order: CacheOrderRotate, minOrders: 3, maxOrders: 3},
+		{name: "shuffle", order: CacheOrderShuffle, minOrders: 2, maxOrders: 6},
+		{name: "fixed", order: CacheOrderFixed, minOrders: 1, maxOrders: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New(newTestAccounts(t, `master/192.0.2.1/0.www=^www\.example\.net$`))
+			d.AccountName = "master"
+			d.NameServer = closedAddr(t)
+			d.CacheSize = 10
+			d.CacheOrder = tt.order
+
+			m := &dns.Msg{}
+			m.SetQuestion("www.example.com.", dns.TypeA)
+			m.Response = true
+			m.Answer = []dns.RR{&dns.CNAME{
+				Hdr:    dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: "web.example.com.",
+			}}
+			for _, a := range addrs {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: "web.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP(a),
+				})
+			}
+			d.getCache().store(newCacheKey(m.Question[0]), m, time.Now())
+
+			addr := serveUDP(t, d)
+			orders := make(map[string]bool)
+			for i := 0; i < 30; i++ {
+				r := query(t, addr, "www.example.com", dns.TypeA)
+				if len(r.Answer) != 1+len(addrs) {
+					t.Fatalf("answer = %v", r.Answer)
+				}
+				// CNAME は常に先頭のまま、A レコードの集合は変わらないこと。
+				if _, ok := r.Answer[0].(*dns.CNAME); !ok {
+					t.Fatalf("first record = %v, want CNAME", r.Answer[0])
+				}
+				var got []string
+				for _, rr := range r.Answer[1:] {
+					got = append(got, rr.(*dns.A).A.String())
+				}
+				orders[strings.Join(got, ",")] = true
+				sort.Strings(got)
+				if !reflect.DeepEqual(got, addrs) {
+					t.Fatalf("records = %v, want %v", got, addrs)
+				}
+			}
+			if n := len(orders); n < tt.minOrders || n > tt.maxOrders {
+				t.Errorf("%d distinct orders %v, want %d to %d", n, orders, tt.minOrders, tt.maxOrders)
+			}
+		})
+	}
+}
@@ -2,46 +2,307 @@
 package dns
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 
 	"github.com/mimoto-xxxxxx/dockerns/accounts"
+	"github.com/mimoto-xxxxxx/dockerns/metrics"
 )
 
+// queries はクエリーの種類と応答の出所ごとの問い合わせの件数。
+// 出所は Source から始まる定数と同じ値で、SERVFAIL を返した場合は OutcomeFailure になる。
+var queries = metrics.Default.Counter(
+	"dockerns_dns_queries_total",
+	"Number of DNS queries by query type and outcome.",
+	"qtype", "outcome",
+)
+
+// OutcomeFailure は SERVFAIL を返した問い合わせのメトリクス上の出所。
+const OutcomeFailure = "failure"
+
+// countedQtypes はメトリクスでクエリーの種類ごとに数える種類。それ以外は "other" として数える。
+var countedQtypes = map[uint16]bool{
+	dns.TypeA: true, dns.TypeAAAA: true, dns.TypeCNAME: true, dns.TypeMX: true, dns.TypeNS: true,
+	dns.TypePTR: true, dns.TypeSOA: true, dns.TypeSRV: true, dns.TypeTXT: true,
+	dns.TypeSVCB: true, dns.TypeHTTPS: true, dns.TypeANY: true,
+}
+
+// countQuery は m の問い合わせを応答の出所 outcome と共にメトリクスに記録する。
+func countQuery(m *dns.Msg, outcome string) {
+	qtype := "other"
+	if len(m.Question) > 0 && countedQtypes[m.Question[0].Qtype] {
+		qtype = dns.TypeToString[m.Question[0].Qtype]
+	}
+	queries.Inc(qtype, outcome)
+}
+
 // DNS は簡易的な DNS サーバ。
+// ShutdownTimeout は Shutdown 時に処理中の問い合わせの完了を待つ最大時間で、0 の場合は無制限に待つ。
+// ReadBuffer と WriteBuffer は UDP / TCP ソケットの受信・送信バッファサイズで、0 の場合は OS の既定値を使用する。
+// CacheSize は NameServer から得た応答をキャッシュする最大件数で、0 の場合はキャッシュしない。
+// キャッシュは応答の TTL に従って期限切れになり、上限を超える場合は最も長く参照されていないものから削除する。
+// ルーティング情報から作成した応答はコンテナのアドレスの変化を即座に反映させるためキャッシュしない。
+// 同じ問い合わせの NameServer への転送が同時に発生した場合は一度の転送にまとめ、応答を共有する。
+// ServeStale は NameServer に到達できない場合に期限切れのキャッシュを返す最大の経過時間(RFC 8767)で、0 の場合は返さない。
+// CacheOrder はキャッシュした応答に複数のレコードが含まれる場合の並べ方で、CacheOrderRotate, CacheOrderShuffle, CacheOrderFixed のいずれかを指定する。
+// 空の場合は CacheOrderRotate として扱う。
+// AnyMode は ANY クエリーへの応答方法で、AnyMinimal, AnyFull, AnyRefuse のいずれかを指定する。
+// Debug が true の場合は応答の追加情報セクションに、応答をどこから得たかを示す TXT レコード(SourceName)を付加する。
+// DebugRoute が true の場合はルーティング情報から作成した応答の追加情報セクションに、一致したルーティング情報の名前と
+// 正規表現を示す TXT レコード(RouteName)を付加する。ルーティング情報の内容が問い合わせ元に知られるため、問題の切り分け時のみ使用すること。
+// TTLJitter はルーティング情報から作成する応答の TTL を TTL ±TTLJitter % の範囲でばらつかせる割合で、0 の場合は TTL をそのまま使用する。
+// 多数のクライアントのキャッシュが同時に期限切れになり、問い合わせが集中するのを避けるために使用する。
+// Rand は TTLJitter で使用する乱数生成器で、nil の場合は現在時刻で初期化したものを使用する。
+// ForwardOnMissingAccount が true の場合は AccountName のアカウントが見つからない間、SERVFAIL を返す代わりに
+// 全ての問い合わせを NameServer へ転送する。初回の読み込み前や設定の誤りで一時的にアカウントが無い場合に、
+// DNS サーバー全体が停止したように見えるのを避けるために使用する。
+// ルーティング情報の接続先が IP アドレスではなくホスト名の場合は、A / AAAA / CNAME の問い合わせに対してそのホスト名を指す CNAME レコードを返す。
+// FollowCNAME が true の場合は更に NameServer へそのホスト名を問い合わせ、得られた A / AAAA レコードを応答に加える。
+// Unresolvable はその問い合わせに失敗した場合の応答方法で、UnresolvableServFail (既定値), UnresolvableNXDomain,
+// UnresolvableForward のいずれかを指定する。FollowCNAME が false の場合はホスト名を解決せずに CNAME レコードのみを返し、
+// 解決はクライアントに任せるため Unresolvable は使用しない。
+// 問い合わせの名前は末尾の "." を取り除いて小文字に揃えてからルーティング情報の正規表現と照合するため、
+// 正規表現は "www.example.com" のような末尾に "." の無い小文字の名前に一致するように書く。
+// ルートゾーン(".")への問い合わせなど照合できない名前はルーティング情報に関わらず NameServer へ転送する。
+// PTR の問い合わせはルーティング情報の接続先になっているコンテナのアドレスであればコンテナ名を返し、それ以外は NameServer へ転送する。
+// ClientSubnet が true の場合は EDNS Client Subnet で通知されたクライアントのアドレスを元に接続先を選択する(Route.Subnets を参照)。
 type DNS struct {
-	AccountName string
-	TTL         uint32
-	NameServer  string
-	FakeMX      string
-	Logger      *log.Logger
-	accounts    *accounts.Accounts
+	AccountName             string
+	TTL                     uint32
+	TTLJitter               int
+	Rand                    *rand.Rand
+	NameServer              string
+	FakeMX                  string
+	ShutdownTimeout         time.Duration
+	ReadBuffer              int
+	WriteBuffer             int
+	CacheSize               int
+	ServeStale              time.Duration
+	CacheOrder              string
+	AnyMode                 string
+	ClientSubnet            bool
+	ForwardOnMissingAccount bool
+	FollowCNAME             bool
+	Unresolvable            string
+	Debug                   bool
+	DebugRoute              bool
+	Logger                  *log.Logger
+	accounts                *accounts.Accounts
+	m                       sync.Mutex
+	servers                 []*dns.Server
+	stop                    chan struct{}
+	cacheOnce               sync.Once
+	cache                   *cache
+	randMu                  sync.Mutex
+	accountMissing          int32
+	flights                 flightGroup
 }
 
+// staleTTL は期限切れのキャッシュを返す際に設定する TTL (RFC 8767 の推奨値)。
+const staleTTL = 30
+
+// SourceName は Debug が true の場合に応答の出所を示す TXT レコードの名前。
+const SourceName = "source.dockerns."
+
+// RouteName は DebugRoute が true の場合に一致したルーティング情報を示す TXT レコードの名前。
+// レコードには "name=名前"、"priority=プライオリティ"、"pattern=正規表現" の文字列が含まれる。
+const RouteName = "route.dockerns."
+
+// 応答の出所。
+const (
+	// SourceLocal はルーティング情報から作成した応答。
+	SourceLocal = "local"
+	// SourceCache はキャッシュしていた NameServer の応答。
+	SourceCache = "cache"
+	// SourceStale は NameServer に到達できなかったため返した期限切れのキャッシュ。
+	SourceStale = "stale"
+	// SourceForward は NameServer へ転送して得た応答。
+	SourceForward = "forward"
+	// SourceANY は AnyMode に従って作成した ANY クエリーへの応答。
+	SourceANY = "any"
+)
+
+// FollowCNAME が true の場合に、CNAME レコードの参照先のホスト名を解決できなかった際の応答方法。
+const (
+	// UnresolvableServFail は SERVFAIL を返す。
+	UnresolvableServFail = "servfail"
+	// UnresolvableNXDomain は NXDOMAIN を返す。
+	UnresolvableNXDomain = "nxdomain"
+	// UnresolvableForward はルーティング情報に一致しなかった場合と同様に、元の問い合わせを NameServer へ転送する。
+	UnresolvableForward = "forward"
+)
+
+// キャッシュした応答に含まれる複数のレコードの並べ方。
+const (
+	// CacheOrderRotate は応答を返す度に先頭のレコードを一つずつずらす。
+	CacheOrderRotate = "rotate"
+	// CacheOrderShuffle は応答を返す度に無作為に並べ替える。
+	CacheOrderShuffle = "shuffle"
+	// CacheOrderFixed は上位のネームサーバーから得た順序のまま返す。
+	CacheOrderFixed = "fixed"
+)
+
+// ANY クエリーへの応答方法。
+const (
+	// AnyMinimal は RFC 8482 に従い、HINFO レコードのみを含む最小限の応答を返す。
+	AnyMinimal = "minimal"
+	// AnyFull は一致したルーティング情報から作成できる全てのレコードを返し、それ以外は上位のネームサーバーへ転送する。
+	AnyFull = "full"
+	// AnyRefuse は REFUSED を返す。
+	AnyRefuse = "refuse"
+)
+
 // New は DNS サーバー用のインスタンスを新規作成する。
 func New(accounts *accounts.Accounts) *DNS {
 	return &DNS{
-		TTL:        60,
-		NameServer: "8.8.8.8:53",
-		Logger:     log.New(os.Stderr, "", log.LstdFlags),
-		accounts:   accounts,
+		TTL:             60,
+		NameServer:      "8.8.8.8:53",
+		ShutdownTimeout: time.Second,
+		AnyMode:         AnyMinimal,
+		Unresolvable:    UnresolvableServFail,
+		Logger:          log.New(os.Stderr, "", log.LstdFlags),
+		accounts:        accounts,
 	}
 }
 
 // ListenAndServe は DNS サーバとして Listen を開始する。
 // addr に指定されたアドレスとポートを UDP と TCP の両方で待ち受ける。
 func (d *DNS) ListenAndServe(addr string) error {
-	go (&dns.Server{Addr: addr, Net: "tcp", Handler: d}).ListenAndServe()
-	return (&dns.Server{Addr: addr, Net: "udp", Handler: d}).ListenAndServe()
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	if err = d.setBuffer(pc); err != nil {
+		pc.Close()
+		return err
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	tcp := &dns.Server{Listener: &bufferListener{Listener: ln, d: d}, Handler: d}
+	udp := &dns.Server{PacketConn: pc, Handler: d}
+	d.m.Lock()
+	d.servers = append(d.servers, tcp, udp)
+	d.m.Unlock()
+
+	go tcp.ActivateAndServe()
+	return udp.ActivateAndServe()
+}
+
+// ListenAndServeTLS は DNS-over-TLS (RFC 7858) サーバとして Listen を開始する。
+// addr に指定されたアドレスとポートを TCP で待ち受け、config を使用して TLS 接続を受け付ける。
+func (d *DNS) ListenAndServeTLS(addr string, config *tls.Config) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s := &dns.Server{
+		Net:      "tcp-tls",
+		Listener: tls.NewListener(&bufferListener{Listener: ln, d: d}, config),
+		Handler:  d,
+	}
+	d.m.Lock()
+	d.servers = append(d.servers, s)
+	d.m.Unlock()
+
+	return s.ActivateAndServe()
+}
+
+// bufferSetter はバッファサイズを変更できる接続。
+// *net.UDPConn と *net.TCPConn が該当する。
+type bufferSetter interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// setBuffer は c のバッファサイズを ReadBuffer と WriteBuffer に従って設定する。
+func (d *DNS) setBuffer(c interface{}) error {
+	bs, ok := c.(bufferSetter)
+	if !ok {
+		return nil
+	}
+	if d.ReadBuffer > 0 {
+		if err := bs.SetReadBuffer(d.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if d.WriteBuffer > 0 {
+		if err := bs.SetWriteBuffer(d.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bufferListener は Accept した TCP 接続にバッファサイズを設定する net.Listener。
+type bufferListener struct {
+	net.Listener
+	d *DNS
+}
+
+// Accept は net.Listener の実装。
+func (l *bufferListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err = l.d.setBuffer(c); err != nil {
+		l.d.Logger.Println("dns: could not set buffer size:", err)
+	}
+	return c, nil
+}
+
+// Shutdown は全ての待受を停止し、処理中の問い合わせが終了するまで待機する。
+func (d *DNS) Shutdown(ctx context.Context) error {
+	if d.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.ShutdownTimeout)
+		defer cancel()
+	}
+
+	d.m.Lock()
+	servers := d.servers
+	d.servers = nil
+	if d.stop == nil {
+		d.stop = make(chan struct{})
+	}
+	select {
+	case <-d.stop:
+	default:
+		close(d.stop)
+	}
+	d.m.Unlock()
+
+	var err error
+	for _, s := range servers {
+		if err2 := s.ShutdownContext(ctx); err == nil {
+			err = err2
+		}
+	}
+	return err
 }
 
 // serveFilure は失敗時のレスポンスを返す。
 func (d *DNS) serveFailure(err error, w dns.ResponseWriter, req *dns.Msg) {
 	d.Logger.Println("dns:", err)
+	countQuery(req, OutcomeFailure)
 	ret := &dns.Msg{}
 	ret.SetReply(req)
 	ret.SetRcode(req, dns.RcodeServerFailure)
@@ -60,24 +321,65 @@ func (d *DNS) poisoning(r *dns.Msg) {
 	}
 }
 
+// getCache は CacheSize が設定されていればキャッシュを返す。
+// 初めてキャッシュを作成した際に、期限切れのエントリーを定期的に削除する処理をバックグラウンドで開始する。
+func (d *DNS) getCache() *cache {
+	d.cacheOnce.Do(func() {
+		if d.CacheSize > 0 {
+			d.cache = newCache(d.CacheSize, d.ServeStale, d.CacheOrder)
+			go d.cache.sweepEvery(cacheSweepInterval, d.stopped())
+		}
+	})
+	return d.cache
+}
+
+// stopped は Shutdown が呼び出された際に閉じられるチャネルを返す。
+func (d *DNS) stopped() <-chan struct{} {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.stop == nil {
+		d.stop = make(chan struct{})
+	}
+	return d.stop
+}
+
 // forward は予め指定されていたネームサーバーに req をリクエストし、そのレスポンスをそのまま返送する。
+// キャッシュが有効な場合は有効期限内のキャッシュがあればそれを返す。
 func (d *DNS) forward(w dns.ResponseWriter, req *dns.Msg) {
-	network := "udp"
-	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
-		network = "tcp"
+	c := d.getCache()
+	key := newCacheKey(req.Question[0])
+	if c != nil {
+		if r, ok := c.get(key, time.Now()); ok {
+			r.Id = req.Id
+			d.poisoning(r)
+			d.annotate(r, SourceCache)
+			w.WriteMsg(r)
+			return
+		}
 	}
 
-	c := &dns.Client{Net: network}
-	for i := 0; i < 3; i++ {
-		r, _, err := c.Exchange(req, d.NameServer)
-		if err == nil {
+	r, err := d.resolve(req, key, network(w))
+	if err == nil {
+		r = r.Copy()
+		r.Id = req.Id
+		d.poisoning(r)
+		d.annotate(r, SourceForward)
+		w.WriteMsg(r)
+		return
+	}
+
+	if c != nil && d.ServeStale > 0 {
+		if r, ok := c.getStale(key, time.Now(), staleTTL); ok {
+			d.Logger.Println("serving stale answer:", req.Question[0].Name)
+			r.Id = req.Id
 			d.poisoning(r)
+			d.annotate(r, SourceStale)
 			w.WriteMsg(r)
 			return
 		}
-		d.Logger.Println("failure to forward request:", err)
 	}
 	d.Logger.Println("gave up")
+	countQuery(req, OutcomeFailure)
 
 	m := &dns.Msg{}
 	m.SetReply(req)
@@ -85,13 +387,60 @@ func (d *DNS) forward(w dns.ResponseWriter, req *dns.Msg) {
 	w.WriteMsg(m)
 }
 
+// resolve は key の問い合わせ req を network で NameServer へ転送し、その応答をキャッシュに保存して返す。
+// 同じ問い合わせが同時に来た場合は上位のネームサーバーへの転送を一度にまとめ、応答を共有する。
+// 返される応答は呼び出し元の間で共有されるため、変更する場合は複製してから変更すること。
+func (d *DNS) resolve(req *dns.Msg, key cacheKey, network string) (*dns.Msg, error) {
+	return d.flights.do(flightKey{cacheKey: key, network: network}, func() (*dns.Msg, error) {
+		r, err := d.exchange(req, network)
+		if err == nil {
+			if c := d.getCache(); c != nil {
+				c.store(key, r, time.Now())
+			}
+		}
+		return r, err
+	})
+}
+
+// network は問い合わせを受けた w のネットワークの種類を返す。
+func network(w dns.ResponseWriter) string {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// exchange は req を network で NameServer へ転送し、その応答を返す。失敗した場合は 3 回まで試行する。
+func (d *DNS) exchange(req *dns.Msg, network string) (*dns.Msg, error) {
+	client := &dns.Client{Net: network}
+	var err error
+	for i := 0; i < 3; i++ {
+		var r *dns.Msg
+		if r, _, err = client.Exchange(req, d.NameServer); err == nil {
+			return r, nil
+		}
+		d.Logger.Println("failure to forward request:", err)
+	}
+	return nil, err
+}
+
 // ServeDNS は DNS サーバーにきたリクエストを処理する。
 func (d *DNS) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	ac := d.accounts.Get(d.AccountName)
 	if ac == nil {
+		if d.ForwardOnMissingAccount && len(req.Question) > 0 {
+			if atomic.CompareAndSwapInt32(&d.accountMissing, 0, 1) {
+				d.Logger.Println("account not found, forwarding all queries:", d.AccountName)
+			}
+			d.forward(w, req)
+			return
+		}
 		d.serveFailure(fmt.Errorf("account not found: %q", d.AccountName), w, req)
 		return
 	}
+	if atomic.CompareAndSwapInt32(&d.accountMissing, 1, 0) {
+		d.Logger.Println("account found, serving routes again:", d.AccountName)
+	}
 
 	if len(req.Question) == 0 {
 		d.serveFailure(fmt.Errorf("no query"), w, req)
@@ -104,34 +453,121 @@ func (d *DNS) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
-	domain := q.Name[:len(q.Name)-1]
-	h := ac.Routes.ReplaceHost(domain)
+	if q.Qtype == dns.TypeANY && d.AnyMode != AnyFull {
+		d.serveANY(w, req)
+		return
+	}
 
-	if h == domain {
+	if q.Qtype == dns.TypePTR {
+		// ルーティング情報の接続先になっているコンテナのアドレスであればコンテナ名を返し、それ以外は転送する。
+		if ip := parseReverseName(q.Name); ip != nil {
+			if name, ok := ac.LookupAddr(ip); ok {
+				d.servePTR(w, req, name)
+				return
+			}
+		}
 		d.forward(w, req)
 		return
 	}
 
+	domain, ok := matchName(q.Name)
+	if !ok {
+		// ルートゾーンなどルーティング情報と照合できない名前は上位のネームサーバーに任せる。
+		d.forward(w, req)
+		return
+	}
+	route := ac.Routes.Find(domain)
+	if route == nil {
+		d.accounts.RecordNoMatch(d.AccountName, "dns", domain)
+	}
+	if d.accounts.VerboseFor(ac.Name) {
+		host := ""
+		if route != nil {
+			host = route.Host
+		}
+		d.Logger.Println("account:", ac.Name, "query:", q.Name, dns.TypeToString[q.Qtype], "host:", host)
+	}
+	if route == nil || strings.EqualFold(strings.TrimSuffix(route.Host, "."), domain) {
+		d.forward(w, req)
+		return
+	}
+	clientIP, ecs := d.clientSubnet(w, req)
+	// DNS の応答にはポート番号を含められないため、接続先のホストのみを使用する。
+	h, _ := accounts.SplitTarget(route.TargetFor(clientIP))
+	if h == "" {
+		// 全ての接続先がヘルスチェックに失敗している場合は上位のネームサーバーに任せる。
+		d.forward(w, req)
+		return
+	}
+
+	if q.Qtype == dns.TypeHTTPS || q.Qtype == dns.TypeSVCB {
+		// 接続ヒントが設定されていない場合は上位のネームサーバーに任せる。
+		if len(route.ALPN) == 0 && route.Port == 0 {
+			d.forward(w, req)
+			return
+		}
+		d.serveSVCB(w, req, route, h)
+		return
+	}
+
+	// 同じ応答に含まれるレコードには同じ TTL を設定する。
+	ttl := d.ttl(route)
 	rr := []dns.RR{}
 
-	if q.Qtype == dns.TypeA {
-		ip := net.ParseIP(h)
-		if ip != nil {
-			ipaddr, err := net.ResolveIPAddr("ip", h)
-			if err != nil {
-				d.serveFailure(err, w, req)
-				return
+	if net.ParseIP(h) == nil {
+		// 接続先が IP アドレスではなくホスト名の場合は CNAME レコードを返す。
+		if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+			rr = append(rr, &dns.CNAME{
+				Hdr: dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypeCNAME,
+					Class:  dns.ClassINET,
+					Ttl:    ttl,
+				},
+				Target: dns.Fqdn(h),
+			})
+			if d.FollowCNAME && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+				answer, err := d.followCNAME(w, dns.Fqdn(h), q.Qtype)
+				if err != nil {
+					err = fmt.Errorf("failed to follow CNAME: %s: %v", h, err)
+					switch d.Unresolvable {
+					case UnresolvableNXDomain:
+						d.Logger.Println("dns:", err)
+						d.serveNXDomain(w, req)
+					case UnresolvableForward:
+						d.Logger.Println("dns:", err)
+						d.forward(w, req)
+					default:
+						d.serveFailure(err, w, req)
+					}
+					return
+				}
+				rr = append(rr, answer...)
 			}
-			ip = ipaddr.IP
 		}
+	}
+
+	if (q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY) && net.ParseIP(h) != nil && !isIPv6(h) {
 		rr = append(rr, &dns.A{
 			Hdr: dns.RR_Header{
 				Name:   q.Name,
 				Rrtype: dns.TypeA,
 				Class:  dns.ClassINET,
-				Ttl:    d.TTL,
+				Ttl:    ttl,
 			},
-			A: ip,
+			A: net.ParseIP(h),
+		})
+	}
+
+	if (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY) && isIPv6(h) {
+		rr = append(rr, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			AAAA: net.ParseIP(h),
 		})
 	}
 
@@ -141,7 +577,7 @@ func (d *DNS) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 				Name:   q.Name,
 				Rrtype: dns.TypeTXT,
 				Class:  dns.ClassINET,
-				Ttl:    d.TTL,
+				Ttl:    ttl,
 			},
 			Txt: []string{"v=spf1 mx -all"},
 		})
@@ -153,7 +589,7 @@ func (d *DNS) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 				Name:   q.Name,
 				Rrtype: dns.TypeMX,
 				Class:  dns.ClassINET,
-				Ttl:    d.TTL,
+				Ttl:    ttl,
 			},
 			Mx:         q.Name,
 			Preference: 1,
@@ -164,8 +600,287 @@ func (d *DNS) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	m.SetReply(req)
 	m.RecursionAvailable = true
 	m.Answer = rr
+	if ecs != nil {
+		// RFC 7871: 応答がクライアントのサブネットに依存することを通知する。
+		opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		reply := *ecs
+		reply.SourceScope = ecs.SourceNetmask
+		opt.Option = append(opt.Option, &reply)
+		m.Extra = append(m.Extra, opt)
+	}
+	d.annotate(m, SourceLocal)
+	d.annotateRoute(m, route)
 	if err := w.WriteMsg(m); err != nil {
 		d.serveFailure(err, w, req)
 		return
 	}
 }
+
+// matchName は問い合わせの名前 name からルーティング情報の正規表現と照合する名前を作る。
+// 名前は末尾の "." の有無に関わらず "." を含まない形にし、0x20 エンコーディングなどで大文字が混じっていても一致するよう小文字に揃える。
+// ルートゾーン(".")や空のラベルを含む名前、エスケープされた文字を含む名前は照合の対象にせず false を返す。
+func matchName(name string) (string, bool) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "..") || strings.Contains(name, `\`) {
+		return "", false
+	}
+	return strings.ToLower(name), true
+}
+
+// followCNAME は CNAME レコードの参照先 target の qtype のレコードを NameServer に問い合わせ、応答に含まれるレコードを返す。
+// キャッシュが有効な場合は forward と同じキャッシュを使用する。
+// 問い合わせに失敗した場合や、応答が NOERROR 以外の場合はエラーを返す。
+func (d *DNS) followCNAME(w dns.ResponseWriter, target string, qtype uint16) ([]dns.RR, error) {
+	req := &dns.Msg{}
+	req.SetQuestion(target, qtype)
+	req.RecursionDesired = true
+
+	key := newCacheKey(req.Question[0])
+	var r *dns.Msg
+	var ok bool
+	if c := d.getCache(); c != nil {
+		r, ok = c.get(key, time.Now())
+	}
+	if !ok {
+		var err error
+		if r, err = d.resolve(req, key, network(w)); err != nil {
+			return nil, err
+		}
+		r = r.Copy()
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("name server returned %s", dns.RcodeToString[r.Rcode])
+	}
+	return r.Answer, nil
+}
+
+// serveNXDomain は問い合わせたホスト名が存在しないことを示す NXDOMAIN を返す。
+func (d *DNS) serveNXDomain(w dns.ResponseWriter, req *dns.Msg) {
+	m := &dns.Msg{}
+	m.SetReply(req)
+	m.SetRcode(req, dns.RcodeNameError)
+	m.RecursionAvailable = true
+	d.annotate(m, SourceLocal)
+	w.WriteMsg(m)
+}
+
+// annotate は応答 m の出所 source をメトリクスに記録し、
+// Debug が true の場合は m の追加情報セクションへ source を示す TXT レコードを付加する。
+func (d *DNS) annotate(m *dns.Msg, source string) {
+	countQuery(m, source)
+	if !d.Debug {
+		return
+	}
+	m.Extra = append(m.Extra, &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   SourceName,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassCHAOS,
+			Ttl:    0,
+		},
+		Txt: []string{source},
+	})
+}
+
+// annotateRoute は DebugRoute が true の場合に、応答 m の追加情報セクションへ一致したルーティング情報 route を示す TXT レコードを付加する。
+// TXT レコードの一つの文字列は 255 バイトまでのため、長い正規表現は分割して格納する。
+// miekg/dns は TXT レコードの文字列中の "\" をエスケープとして扱うため、正規表現の "\" や '"' はエスケープしてから格納する。
+func (d *DNS) annotateRoute(m *dns.Msg, route *accounts.Route) {
+	if !d.DebugRoute {
+		return
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace
+	txt := []string{escape("name=" + route.Name), "priority=" + strconv.Itoa(route.Priority)}
+	for pattern := "pattern=" + route.Pattern(); pattern != ""; {
+		n := len(pattern)
+		if n > 255 {
+			n = 255
+		}
+		txt = append(txt, escape(pattern[:n]))
+		pattern = pattern[n:]
+	}
+	m.Extra = append(m.Extra, &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   RouteName,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassCHAOS,
+			Ttl:    0,
+		},
+		Txt: txt,
+	})
+}
+
+// ttl はルーティング情報 route から作成する応答に設定する TTL を返す。
+// route に TTL が設定されている場合はそれを、そうでなければ d.TTL を使用する。
+// TTLJitter が指定されている場合は TTL ±TTLJitter % の範囲で一様にばらつかせる。
+func (d *DNS) ttl(route *accounts.Route) uint32 {
+	base := d.TTL
+	if route != nil && route.TTL > 0 {
+		base = route.TTL
+	}
+	delta := int64(base) * int64(d.TTLJitter) / 100
+	if delta <= 0 {
+		return base
+	}
+
+	d.randMu.Lock()
+	if d.Rand == nil {
+		d.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	ttl := int64(base) + d.Rand.Int63n(2*delta+1) - delta
+	d.randMu.Unlock()
+
+	if ttl < 0 {
+		ttl = 0
+	}
+	return uint32(ttl)
+}
+
+// clientSubnet はルーティング情報の Subnets と照合するクライアントのアドレスを返す。
+// ClientSubnet が true で問い合わせに EDNS Client Subnet (RFC 7871) が含まれている場合はそのアドレスとオプションを、
+// それ以外は問い合わせの送信元のアドレスを返す。
+func (d *DNS) clientSubnet(w dns.ResponseWriter, req *dns.Msg) (net.IP, *dns.EDNS0_SUBNET) {
+	if d.ClientSubnet {
+		if opt := req.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+					return ecs.Address, ecs
+				}
+			}
+		}
+	}
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP, nil
+	case *net.TCPAddr:
+		return addr.IP, nil
+	}
+	return nil, nil
+}
+
+// isIPv6 は host が IPv6 アドレスであれば true を返す。
+func isIPv6(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// serveANY は AnyMode に従って ANY クエリーに応答する。
+func (d *DNS) serveANY(w dns.ResponseWriter, req *dns.Msg) {
+	m := &dns.Msg{}
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	if d.AnyMode == AnyRefuse {
+		m.SetRcode(req, dns.RcodeRefused)
+	} else {
+		m.Answer = []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeHINFO,
+				Class:  dns.ClassINET,
+				Ttl:    d.TTL,
+			},
+			Cpu: "RFC8482",
+		}}
+	}
+	d.annotate(m, SourceANY)
+	w.WriteMsg(m)
+}
+
+// servePTR は逆引きの問い合わせに対してコンテナ名 name を指す PTR レコードを返す。
+func (d *DNS) servePTR(w dns.ResponseWriter, req *dns.Msg, name string) {
+	m := &dns.Msg{}
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	m.Answer = []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    d.ttl(nil),
+		},
+		Ptr: dns.Fqdn(name),
+	}}
+	d.annotate(m, SourceLocal)
+	if err := w.WriteMsg(m); err != nil {
+		d.serveFailure(err, w, req)
+	}
+}
+
+// parseReverseName は "4.3.2.1.in-addr.arpa." や "....ip6.arpa." の形式の逆引き用の名前からアドレスを取り出す。
+// 形式が正しくない場合は nil を返す。
+func parseReverseName(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil
+		}
+		var b strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return nil
+			}
+			b.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				b.WriteByte(':')
+			}
+		}
+		return net.ParseIP(b.String())
+	}
+	return nil
+}
+
+// serveSVCB は route に設定された接続ヒントを SVCB/HTTPS レコードとして返す。
+// host は ServeDNS でクライアントに応じて選択した接続先のホストで、IP アドレスの場合はアドレスのヒントとして含める。
+func (d *DNS) serveSVCB(w dns.ResponseWriter, req *dns.Msg, route *accounts.Route, host string) {
+	q := req.Question[0]
+	svcb := dns.SVCB{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: q.Qtype,
+			Class:  dns.ClassINET,
+			Ttl:    d.ttl(route),
+		},
+		Priority: 1,
+		Target:   ".",
+	}
+	if len(route.ALPN) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBAlpn{Alpn: route.ALPN})
+	}
+	if route.Port != 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBPort{Port: route.Port})
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			svcb.Value = append(svcb.Value, &dns.SVCBIPv4Hint{Hint: []net.IP{ip}})
+		} else {
+			svcb.Value = append(svcb.Value, &dns.SVCBIPv6Hint{Hint: []net.IP{ip}})
+		}
+	}
+
+	var rr dns.RR = &svcb
+	if q.Qtype == dns.TypeHTTPS {
+		rr = &dns.HTTPS{SVCB: svcb}
+	}
+
+	m := &dns.Msg{}
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	m.Answer = []dns.RR{rr}
+	d.annotate(m, SourceLocal)
+	d.annotateRoute(m, route)
+	if err := w.WriteMsg(m); err != nil {
+		d.serveFailure(err, w, req)
+	}
+}
@@ -0,0 +1,505 @@
+package dns
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/mimoto-xxxxxx/dockerns/accounts"
+	"github.com/mimoto-xxxxxx/dockerns/metrics"
+)
+
+// newTestAccounts は routes を静的なルーティング情報(accounts.StaticRouteEnvPrefix を参照)として読み込んだ Accounts を返す。
+func newTestAccounts(t *testing.T, routes ...string) *accounts.Accounts {
+	t.Helper()
+	a := accounts.New("", "", "/proxy")
+	a.StaticRoutes = routes
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// serveUDP は h を 127.0.0.1 の空いているポートで UDP の DNS サーバーとして起動し、そのアドレスを返す。
+func serveUDP(t *testing.T, h dns.Handler) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	s := &dns.Server{PacketConn: pc, Handler: h, NotifyStartedFunc: func() { close(started) }}
+	go s.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { s.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// upstream は上位のネームサーバーの代わりに、answers に登録された名前には A レコードを、それ以外には rcode を返す。
+// queries には受け取った問い合わせの名前が順に記録される。
+type upstream struct {
+	answers map[string]string
+	rcode   int
+	queries chan string
+}
+
+// ServeDNS は dns.Handler の実装。
+func (u *upstream) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	if u.queries != nil {
+		u.queries <- q.Name
+	}
+	m := &dns.Msg{}
+	m.SetReply(req)
+	if ip, ok := u.answers[q.Name]; ok {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		})
+	} else {
+		m.SetRcode(req, u.rcode)
+	}
+	w.WriteMsg(m)
+}
+
+// lineWriter は書き込まれた行を lines に送る io.Writer。
+type lineWriter chan string
+
+// Write は io.Writer の実装。
+func (w lineWriter) Write(b []byte) (int, error) {
+	w <- strings.TrimSuffix(string(b), "\n")
+	return len(b), nil
+}
+
+// query は addr の DNS サーバーに name の qtype のレコードを UDP で問い合わせる。
+func query(t *testing.T, addr, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	r, err := dns.Exchange(req, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestUnresolvable(t *testing.T) {
+	ns := serveUDP(t, &upstream{
+		answers: map[string]string{"www.example.com.": "192.0.2.80", "ok.example.net.": "192.0.2.1"},
+		rcode:   dns.RcodeNameError,
+	})
+
+	tests := []struct {
+		name         string
+		route        string
+		followCNAME  bool
+		unresolvable string
+		rcode        int
+		answers      []uint16
+	}{
+		{name: "default", route: "broken.example.net", followCNAME: true, rcode: dns.RcodeServerFailure},
+		{name: "servfail", route: "broken.example.net", followCNAME: true, unresolvable: UnresolvableServFail, rcode: dns.RcodeServerFailure},
+		{name: "nxdomain", route: "broken.example.net", followCNAME: true, unresolvable: UnresolvableNXDomain, rcode: dns.RcodeNameError},
+		// 転送した場合は上位のネームサーバーの www.example.com の応答がそのまま返る。
+		{name: "forward", route: "broken.example.net", followCNAME: true, unresolvable: UnresolvableForward, rcode: dns.RcodeSuccess, answers: []uint16{dns.TypeA}},
+		{name: "resolvable", route: "ok.example.net", followCNAME: true, unresolvable: UnresolvableNXDomain, rcode: dns.RcodeSuccess, answers: []uint16{dns.TypeCNAME, dns.TypeA}},
+		// FollowCNAME が false の場合は参照先を解決しないため、Unresolvable に関わらず CNAME レコードのみを返す。
+		{name: "without follow", route: "broken.example.net", unresolvable: UnresolvableNXDomain, rcode: dns.RcodeSuccess, answers: []uint16{dns.TypeCNAME}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New(newTestAccounts(t, `master/`+tt.route+`/0.www=^www\.example\.com$`))
+			d.AccountName = "master"
+			d.NameServer = ns
+			d.FollowCNAME = tt.followCNAME
+			if tt.unresolvable != "" {
+				d.Unresolvable = tt.unresolvable
+			}
+
+			r := query(t, serveUDP(t, d), "www.example.com", dns.TypeA)
+			if r.Rcode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			var types []uint16
+			for _, rr := range r.Answer {
+				types = append(types, rr.Header().Rrtype)
+			}
+			if len(types) != len(tt.answers) {
+				t.Fatalf("answer = %v, want types %v", r.Answer, tt.answers)
+			}
+			for i := range types {
+				if types[i] != tt.answers[i] {
+					t.Fatalf("answer = %v, want types %v", r.Answer, tt.answers)
+				}
+			}
+		})
+	}
+}
+
+func TestNoMatchCounter(t *testing.T) {
+	ns := serveUDP(t, &upstream{
+		answers: map[string]string{"other.example.com.": "192.0.2.80"},
+		rcode:   dns.RcodeNameError,
+	})
+	// カウンターは全体で共有されるため、他のテストと重ならないアカウント名を使用する。
+	d := New(newTestAccounts(t, `nomatch-dns/192.0.2.1/0.www=^www\.example\.com$`))
+	d.AccountName = "nomatch-dns"
+	d.NameServer = ns
+	addr := serveUDP(t, d)
+	noMatch := metrics.Default.Counter("dockerns_route_no_match_total", "", "account", "service")
+
+	tests := []struct {
+		name string
+		want uint64
+	}{
+		{name: "www.example.com", want: 0},
+		// ルーティング情報に一致しない名前は上位のネームサーバーに転送される。
+		{name: "other.example.com", want: 1},
+		{name: "missing.example.com", want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := noMatch.Get("nomatch-dns", "dns")
+			query(t, addr, tt.name, dns.TypeA)
+			if got := noMatch.Get("nomatch-dns", "dns") - before; got != tt.want {
+				t.Errorf("no-match counter increased by %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	tests := []struct {
+		jitter   int
+		min, max uint32
+	}{
+		{jitter: 0, min: 100, max: 100},
+		{jitter: 10, min: 90, max: 110},
+		{jitter: 50, min: 50, max: 150},
+		// 0 未満にはならない。
+		{jitter: 200, min: 0, max: 300},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.jitter), func(t *testing.T) {
+			d := New(newTestAccounts(t, `master/192.0.2.1/0.www=^www\.example\.com$`))
+			d.AccountName = "master"
+			d.TTL = 100
+			d.TTLJitter = tt.jitter
+			d.Rand = rand.New(rand.NewSource(1))
+			addr := serveUDP(t, d)
+
+			seen := make(map[uint32]bool)
+			for i := 0; i < 50; i++ {
+				r := query(t, addr, "www.example.com", dns.TypeA)
+				if len(r.Answer) != 1 {
+					t.Fatalf("answer = %v, want one record", r.Answer)
+				}
+				ttl := r.Answer[0].Header().Ttl
+				if ttl < tt.min || ttl > tt.max {
+					t.Fatalf("TTL = %d, want in [%d, %d]", ttl, tt.min, tt.max)
+				}
+				seen[ttl] = true
+			}
+			if varies := len(seen) > 1; varies != (tt.jitter > 0) {
+				t.Errorf("distinct TTLs = %d", len(seen))
+			}
+		})
+	}
+
+	// 同じシードの乱数生成器を使用すると同じ TTL の列が得られる。
+	sequence := func() []uint32 {
+		d := New(nil)
+		d.TTL = 100
+		d.TTLJitter = 50
+		d.Rand = rand.New(rand.NewSource(42))
+		var ttls []uint32
+		for i := 0; i < 10; i++ {
+			ttls = append(ttls, d.ttl(nil))
+		}
+		return ttls
+	}
+	a, b := sequence(), sequence()
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("TTLs with the same seed differ: %v, %v", a, b)
+		}
+	}
+}
+
+func TestMissingAccount(t *testing.T) {
+	ns := serveUDP(t, &upstream{
+		answers: map[string]string{"www.example.com.": "192.0.2.80"},
+		rcode:   dns.RcodeNameError,
+	})
+
+	tests := []struct {
+		name    string
+		forward bool
+		rcode   int
+		answer  string
+		// logs は 3 回問い合わせた間に出力されるログ。
+		logs []string
+	}{
+		{
+			name:  "servfail",
+			rcode: dns.RcodeServerFailure,
+			logs: []string{
+				`dns: account not found: "missing"`,
+				`dns: account not found: "missing"`,
+				`dns: account not found: "missing"`,
+			},
+		},
+		{
+			name:    "forward",
+			forward: true,
+			rcode:   dns.RcodeSuccess,
+			answer:  "192.0.2.80",
+			// アカウントが見つからない状態になった時に一度だけ出力する。
+			logs: []string{"account not found, forwarding all queries: missing"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := make(lineWriter, 8)
+			d := New(newTestAccounts(t, `master/192.0.2.1/0.www=^www\.example\.com$`))
+			d.AccountName = "missing"
+			d.NameServer = ns
+			d.ForwardOnMissingAccount = tt.forward
+			d.Logger = log.New(lines, "", 0)
+			addr := serveUDP(t, d)
+
+			for i := 0; i < 3; i++ {
+				r := query(t, addr, "www.example.com", dns.TypeA)
+				if r.Rcode != tt.rcode {
+					t.Fatalf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+				}
+				var answer string
+				if len(r.Answer) > 0 {
+					answer = r.Answer[0].(*dns.A).A.String()
+				}
+				if answer != tt.answer {
+					t.Errorf("answer = %q, want %q", answer, tt.answer)
+				}
+			}
+
+			var logs []string
+			for len(lines) > 0 {
+				logs = append(logs, <-lines)
+			}
+			if strings.Join(logs, "\n") != strings.Join(tt.logs, "\n") {
+				t.Errorf("logs = %q, want %q", logs, tt.logs)
+			}
+		})
+	}
+}
+
+func TestVerboseAccounts(t *testing.T) {
+	a := newTestAccounts(t,
+		`loud/192.0.2.1/0.www=^www\.example\.com$`,
+		`quiet/192.0.2.2/0.www=^www\.example\.com$`,
+	)
+	a.VerboseAccounts = []string{"loud"}
+
+	tests := []struct {
+		account string
+		want    string
+	}{
+		{account: "loud", want: "account: loud query: www.example.com. A host: 192.0.2.1"},
+		{account: "quiet"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.account, func(t *testing.T) {
+			lines := make(lineWriter, 8)
+			d := New(a)
+			d.AccountName = tt.account
+			d.Logger = log.New(lines, "", 0)
+			query(t, serveUDP(t, d), "www.example.com", dns.TypeA)
+
+			var logs []string
+			for len(lines) > 0 {
+				logs = append(logs, <-lines)
+			}
+			if got := strings.Join(logs, "\n"); got != tt.want {
+				t.Errorf("logs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryTypeCounters(t *testing.T) {
+	ns := serveUDP(t, &upstream{rcode: dns.RcodeNameError})
+	d := New(newTestAccounts(t, `master/192.0.2.1/0.www=^www\.example\.com$`))
+	d.AccountName = "master"
+	d.NameServer = ns
+	addr := serveUDP(t, d)
+
+	outcomes := []string{SourceLocal, SourceCache, SourceStale, SourceForward, SourceANY, OutcomeFailure}
+	tests := []struct {
+		name    string
+		qtype   uint16
+		label   string
+		outcome string
+	}{
+		{name: "www.example.com", qtype: dns.TypeA, label: "A", outcome: SourceLocal},
+		{name: "www.example.com", qtype: dns.TypeAAAA, label: "AAAA", outcome: SourceLocal},
+		{name: "other.example.com", qtype: dns.TypeA, label: "A", outcome: SourceForward},
+		{name: "other.example.com", qtype: dns.TypeMX, label: "MX", outcome: SourceForward},
+		{name: "other.example.com", qtype: dns.TypeTXT, label: "TXT", outcome: SourceForward},
+		{name: "www.example.com", qtype: dns.TypeANY, label: "ANY", outcome: SourceANY},
+		// 個別に数えない種類は "other" として数える。
+		{name: "other.example.com", qtype: dns.TypeCAA, label: "other", outcome: SourceForward},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			before := make(map[string]uint64)
+			for _, o := range outcomes {
+				before[o] = queries.Get(tt.label, o)
+			}
+			query(t, addr, tt.name, tt.qtype)
+			for _, o := range outcomes {
+				want := uint64(0)
+				if o == tt.outcome {
+					want = 1
+				}
+				if got := queries.Get(tt.label, o) - before[o]; got != want {
+					t.Errorf("%s/%s increased by %d, want %d", tt.label, o, got, want)
+				}
+			}
+		})
+	}
+
+	// Prometheus の形式で出力した場合もクエリーの種類ごとのラベルが付く。
+	var b strings.Builder
+	metrics.Default.WriteTo(&b)
+	for _, series := range []string{
+		`dockerns_dns_queries_total{qtype="A",outcome="local"}`,
+		`dockerns_dns_queries_total{qtype="MX",outcome="forward"}`,
+		`dockerns_dns_queries_total{qtype="other",outcome="forward"}`,
+	} {
+		if !strings.Contains(b.String(), series) {
+			t.Errorf("exposition does not contain %s", series)
+		}
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{name: "www.example.com.", want: "www.example.com", ok: true},
+		{name: "www.example.com", want: "www.example.com", ok: true},
+		{name: "WwW.ExAmPlE.CoM.", want: "www.example.com", ok: true},
+		{name: "."},
+		{name: ""},
+		{name: ".."},
+		{name: ".example.com."},
+		{name: "www..example.com."},
+		{name: `www\.example.com.`},
+	}
+	for _, tt := range tests {
+		got, ok := matchName(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("matchName(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRootQuery(t *testing.T) {
+	queries := make(chan string, 4)
+	ns := serveUDP(t, &upstream{rcode: dns.RcodeSuccess, queries: queries})
+	// 全ての名前に一致するルーティング情報があっても、ルートゾーンへの問い合わせは転送する。
+	d := New(newTestAccounts(t, `master/192.0.2.1/0.any=.*`))
+	d.AccountName = "master"
+	d.NameServer = ns
+	addr := serveUDP(t, d)
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		forwarded bool
+	}{
+		{name: ".", qtype: dns.TypeNS, forwarded: true},
+		{name: ".", qtype: dns.TypeA, forwarded: true},
+		{name: "www.example.com.", qtype: dns.TypeA},
+		{name: "WWW.Example.com.", qtype: dns.TypeA},
+	}
+	for _, tt := range tests {
+		r := query(t, addr, tt.name, tt.qtype)
+		if r.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s %s: rcode = %s", tt.name, dns.TypeToString[tt.qtype], dns.RcodeToString[r.Rcode])
+		}
+		select {
+		case q := <-queries:
+			if !tt.forwarded {
+				t.Errorf("%s %s: forwarded as %q", tt.name, dns.TypeToString[tt.qtype], q)
+			}
+		default:
+			if tt.forwarded {
+				t.Errorf("%s %s: not forwarded", tt.name, dns.TypeToString[tt.qtype])
+			}
+			if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+				t.Errorf("%s: answer = %v", tt.name, r.Answer)
+			}
+		}
+	}
+}
+
+// counterBackend は通知されたカウンターの更新を "名前{ラベル}" の形式で keys に送る metrics.Backend。
+type counterBackend struct {
+	metrics.Backend
+	keys chan string
+}
+
+// AddCounter は metrics.Backend の実装。
+func (b counterBackend) AddCounter(name string, labels map[string]string, n uint64) {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	select {
+	case b.keys <- name + "{" + strings.Join(pairs, ",") + "}":
+	default:
+	}
+}
+
+func TestMetricsBackend(t *testing.T) {
+	ns := serveUDP(t, &upstream{answers: map[string]string{"other.example.com.": "192.0.2.80"}})
+	keys := make(chan string, 16)
+	metrics.Default.SetBackend(counterBackend{Backend: metrics.Nop, keys: keys})
+	t.Cleanup(func() { metrics.Default.SetBackend(nil) })
+
+	d := New(newTestAccounts(t, `backend/192.0.2.1/0.www=^www\.example\.com$`))
+	d.AccountName = "backend"
+	d.NameServer = ns
+	addr := serveUDP(t, d)
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{name: "www.example.com", want: []string{"dockerns_dns_queries_total{outcome=local,qtype=A}"}},
+		{name: "other.example.com", want: []string{
+			"dockerns_route_no_match_total{account=backend,service=dns}",
+			"dockerns_dns_queries_total{outcome=forward,qtype=A}",
+		}},
+	}
+	for _, tt := range tests {
+		query(t, addr, tt.name, dns.TypeA)
+		var got []string
+		for len(keys) > 0 {
+			got = append(got, <-keys)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: counters = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package dns
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// flightKey は同時に行われている転送をまとめる際のキー。
+// UDP では応答が切り詰められることがあるため、TCP の問い合わせとは区別する。
+type flightKey struct {
+	cacheKey
+	network string
+}
+
+// flight は実行中の上位のネームサーバーへの転送。
+type flight struct {
+	wg  sync.WaitGroup
+	r   *dns.Msg
+	err error
+}
+
+// flightGroup は同じ問い合わせの転送が同時に行われた場合に、上位のネームサーバーへの問い合わせを一度にまとめる。
+type flightGroup struct {
+	m       sync.Mutex
+	flights map[flightKey]*flight
+}
+
+// do は key の転送が実行中であればその結果を待って返し、そうでなければ fn を実行して結果を返す。
+// 返される応答は呼び出し元の間で共有されるため、変更する場合は複製してから変更すること。
+func (g *flightGroup) do(key flightKey, fn func() (*dns.Msg, error)) (*dns.Msg, error) {
+	g.m.Lock()
+	if g.flights == nil {
+		g.flights = make(map[flightKey]*flight)
+	}
+	if f, ok := g.flights[key]; ok {
+		g.m.Unlock()
+		f.wg.Wait()
+		return f.r, f.err
+	}
+	f := &flight{}
+	f.wg.Add(1)
+	g.flights[key] = f
+	g.m.Unlock()
+
+	f.r, f.err = fn()
+	f.wg.Done()
+
+	g.m.Lock()
+	delete(g.flights, key)
+	g.m.Unlock()
+	return f.r, f.err
+}
@@ -0,0 +1,64 @@
+package dns
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		name  string
+		names []string
+		// exchanges は上位のネームサーバーが受け取る問い合わせの数。
+		exchanges int32
+	}{
+		{name: "identical", names: []string{"www.example.com"}, exchanges: 1},
+		{name: "distinct", names: []string{"www.example.com", "api.example.com"}, exchanges: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var exchanges int32
+			u := &upstream{answers: map[string]string{"www.example.com.": "192.0.2.80", "api.example.com.": "192.0.2.81"}}
+			// 全ての問い合わせが転送を待つ状態になるまで、上位のネームサーバーの応答を遅らせる。
+			ns := serveUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+				atomic.AddInt32(&exchanges, 1)
+				time.Sleep(300 * time.Millisecond)
+				u.ServeDNS(w, req)
+			}))
+			d := New(newTestAccounts(t, `master/192.0.2.1/0.other=^other\.example\.com$`))
+			d.AccountName = "master"
+			d.NameServer = ns
+			addr := serveUDP(t, d)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				name := tt.names[i%len(tt.names)]
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req := &dns.Msg{}
+					req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+					r, err := dns.Exchange(req, addr)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if r.Id != req.Id {
+						t.Errorf("%s: id = %d, want %d", name, r.Id, req.Id)
+					}
+					if len(r.Answer) != 1 || r.Answer[0].Header().Name != dns.Fqdn(name) {
+						t.Errorf("%s: answer = %v", name, r.Answer)
+					}
+				}()
+			}
+			wg.Wait()
+			if got := atomic.LoadInt32(&exchanges); got != tt.exchanges {
+				t.Errorf("upstream exchanges = %d, want %d", got, tt.exchanges)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package dns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// source は応答 r の追加情報セクションにある SourceName の TXT レコードの値を返す。無い場合は空文字列を返す。
+func source(r *dns.Msg) string {
+	for _, rr := range r.Extra {
+		if txt, ok := rr.(*dns.TXT); ok && txt.Hdr.Name == SourceName {
+			return txt.Txt[0]
+		}
+	}
+	return ""
+}
+
+func TestDebugSource(t *testing.T) {
+	ns := serveUDP(t, &upstream{answers: map[string]string{"www.example.net.": "192.0.2.80"}})
+	a := newTestAccounts(t, `master/192.0.2.1/0.www=^www\.example\.com$`)
+
+	// 各段階は順に問い合わせ、前の段階でキャッシュした応答を引き継ぐ。
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "www.example.com", want: SourceLocal},
+		{query: "www.example.net", want: SourceForward},
+		{query: "www.example.net", want: SourceCache},
+	}
+	for _, debug := range []bool{true, false} {
+		d := New(a)
+		d.AccountName = "master"
+		d.NameServer = ns
+		d.CacheSize = 10
+		d.Debug = debug
+		addr := serveUDP(t, d)
+
+		for _, tt := range tests {
+			want := tt.want
+			if !debug {
+				want = ""
+			}
+			if got := source(query(t, addr, tt.query, dns.TypeA)); got != want {
+				t.Errorf("debug %v: %s: source = %q, want %q", debug, tt.query, got, want)
+			}
+		}
+	}
+}
+
+// routeTXT は応答 r の追加情報セクションにある RouteName の TXT レコードの値を返す。無い場合は nil を返す。
+func routeTXT(r *dns.Msg) []string {
+	for _, rr := range r.Extra {
+		if txt, ok := rr.(*dns.TXT); ok && txt.Hdr.Name == RouteName {
+			return txt.Txt
+		}
+	}
+	return nil
+}
+
+func TestDebugRoute(t *testing.T) {
+	ns := serveUDP(t, &upstream{answers: map[string]string{"www.example.net.": "192.0.2.80"}})
+	long := strings.Repeat("a", 300)
+	a := newTestAccounts(t,
+		`master/192.0.2.1/10.www=^www\.example\.com$`,
+		`master/192.0.2.2/0.long=^long\.example\.com$|^`+long+`$`,
+	)
+
+	tests := []struct {
+		debug bool
+		query string
+		want  []string
+	}{
+		// 受信した TXT レコードの文字列では "\" がエスケープされている。
+		{debug: true, query: "www.example.com", want: []string{"name=www", "priority=10", `pattern=^www\\.example\\.com$`}},
+		// 255 バイトを超える正規表現は複数の文字列に分割する。
+		{debug: true, query: "long.example.com", want: []string{"name=long", "priority=0", `pattern=^long\\.example\\.com$|^` + long[:225], long[225:] + "$"}},
+		{debug: true, query: "www.example.net"},
+		{debug: false, query: "www.example.com"},
+	}
+	for _, tt := range tests {
+		d := New(a)
+		d.AccountName = "master"
+		d.NameServer = ns
+		d.DebugRoute = tt.debug
+		got := routeTXT(query(t, serveUDP(t, d), tt.query, dns.TypeA))
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("debug %v: %s: route = %q, want %q", tt.debug, tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientSubnet(t *testing.T) {
+	a := newTestAccounts(t,
+		`master/192.0.2.1/0.www=^www\.example\.com$`,
+		`master/192.0.2.1/_subnets=10.1.0.0/16=198.51.100.1,10.2.0.0/16=198.51.100.2`,
+	)
+
+	tests := []struct {
+		name         string
+		clientSubnet bool
+		ecs          string
+		want         string
+		// scope は応答の EDNS Client Subnet の SourceScope で、-1 の場合は応答に含まれないことを確認する。
+		scope int
+	}{
+		{name: "first subnet", clientSubnet: true, ecs: "10.1.2.0", want: "198.51.100.1", scope: 24},
+		{name: "second subnet", clientSubnet: true, ecs: "10.2.3.0", want: "198.51.100.2", scope: 24},
+		{name: "no mapping", clientSubnet: true, ecs: "203.0.113.0", want: "192.0.2.1", scope: 24},
+		{name: "no option", clientSubnet: true, want: "192.0.2.1", scope: -1},
+		{name: "disabled", ecs: "10.1.2.0", want: "192.0.2.1", scope: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New(a)
+			d.AccountName = "master"
+			d.ClientSubnet = tt.clientSubnet
+			addr := serveUDP(t, d)
+
+			req := &dns.Msg{}
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			if tt.ecs != "" {
+				opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+				opt.SetUDPSize(dns.DefaultMsgSize)
+				opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+					Code:          dns.EDNS0SUBNET,
+					Family:        1,
+					SourceNetmask: 24,
+					Address:       net.ParseIP(tt.ecs).To4(),
+				})
+				req.Extra = append(req.Extra, opt)
+			}
+			r, err := dns.Exchange(req, addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.Answer) != 1 {
+				t.Fatalf("answers = %v", r.Answer)
+			}
+			a, ok := r.Answer[0].(*dns.A)
+			if !ok || a.A.String() != tt.want {
+				t.Errorf("answer = %v, want %s", r.Answer[0], tt.want)
+			}
+
+			scope := -1
+			if opt := r.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+						scope = int(ecs.SourceScope)
+					}
+				}
+			}
+			if scope != tt.scope {
+				t.Errorf("scope = %d, want %d", scope, tt.scope)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package dns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// svcbHint は応答に含まれる SVCB/HTTPS レコードのアドレスのヒントを返す。
+func svcbHint(t *testing.T, r *dns.Msg) string {
+	t.Helper()
+	if len(r.Answer) != 1 {
+		t.Fatalf("answer = %v", r.Answer)
+	}
+	var svcb dns.SVCB
+	switch rr := r.Answer[0].(type) {
+	case *dns.HTTPS:
+		svcb = rr.SVCB
+	case *dns.SVCB:
+		svcb = *rr
+	default:
+		t.Fatalf("answer = %v", r.Answer)
+	}
+	for _, v := range svcb.Value {
+		switch v := v.(type) {
+		case *dns.SVCBIPv4Hint:
+			return v.Hint[0].String()
+		case *dns.SVCBIPv6Hint:
+			return v.Hint[0].String()
+		}
+	}
+	return ""
+}
+
+func TestSVCBHint(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []string
+		qtype  uint16
+		rotate bool
+		want   []string
+	}{
+		{
+			name:   "single target",
+			routes: []string{`master/192.0.2.1/0.www=^www\.example\.com$`, `master/192.0.2.1/_alpn=h2`},
+			qtype:  dns.TypeHTTPS,
+			want:   []string{"192.0.2.1", "192.0.2.1"},
+		},
+		{
+			name:   "ipv6",
+			routes: []string{`master/2001:db8::1/0.www=^www\.example\.com$`, `master/2001:db8::1/_port=8443`},
+			qtype:  dns.TypeSVCB,
+			want:   []string{"2001:db8::1"},
+		},
+		// 同じパターンの接続先は問い合わせごとに一つずつ順に使用する。
+		{
+			name: "round robin",
+			routes: []string{
+				`master/192.0.2.1/0.www=^www\.example\.com$`, `master/192.0.2.1/_alpn=h2`,
+				`master/192.0.2.2/0.www=^www\.example\.com$`, `master/192.0.2.2/_alpn=h2`,
+			},
+			qtype:  dns.TypeHTTPS,
+			rotate: true,
+			want:   []string{"192.0.2.1", "192.0.2.2", "192.0.2.1", "192.0.2.2"},
+		},
+		// 問い合わせ元のサブネットに対応する接続先をヒントにする。
+		{
+			name: "subnet",
+			routes: []string{
+				`master/192.0.2.1/0.www=^www\.example\.com$`, `master/192.0.2.1/_alpn=h2`,
+				`master/192.0.2.1/_subnets=127.0.0.0/8=198.51.100.1`,
+			},
+			qtype: dns.TypeHTTPS,
+			want:  []string{"198.51.100.1", "198.51.100.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New(newTestAccounts(t, tt.routes...))
+			d.AccountName = "master"
+			addr := serveUDP(t, d)
+
+			var got []string
+			for range tt.want {
+				got = append(got, svcbHint(t, query(t, addr, "www.example.com", tt.qtype)))
+			}
+			// ラウンドロビンの開始位置は問わず、順に巡回していることを確認する。
+			if tt.rotate && got[0] != tt.want[0] {
+				got = append(got[1:], got[0])
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("hints = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSVCBParams(t *testing.T) {
+	tests := []struct {
+		name      string
+		routes    []string
+		qtype     uint16
+		alpn      []string
+		port      uint16
+		forwarded bool
+	}{
+		{
+			name:   "alpn and port",
+			routes: []string{`master/192.0.2.1/0.www=^www\.example\.com$`, `master/192.0.2.1/_alpn=h2,http/1.1`, `master/192.0.2.1/_port=8443`},
+			qtype:  dns.TypeHTTPS,
+			alpn:   []string{"h2", "http/1.1"},
+			port:   8443,
+		},
+		{
+			name:   "alpn only",
+			routes: []string{`master/192.0.2.1/0.www=^www\.example\.com$`, `master/192.0.2.1/_alpn=h3`},
+			qtype:  dns.TypeHTTPS,
+			alpn:   []string{"h3"},
+		},
+		{
+			name:   "svcb",
+			routes: []string{`master/192.0.2.1/0.www=^www\.example\.com$`, `master/192.0.2.1/_port=8443`},
+			qtype:  dns.TypeSVCB,
+			port:   8443,
+		},
+		// 接続ヒントが設定されていない場合は上位のネームサーバーに任せる。
+		{
+			name:      "no params",
+			routes:    []string{`master/192.0.2.1/0.www=^www\.example\.com$`},
+			qtype:     dns.TypeHTTPS,
+			forwarded: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries := make(chan string, 1)
+			d := New(newTestAccounts(t, tt.routes...))
+			d.AccountName = "master"
+			d.NameServer = serveUDP(t, &upstream{rcode: dns.RcodeNameError, queries: queries})
+			r := query(t, serveUDP(t, d), "www.example.com", tt.qtype)
+			if tt.forwarded {
+				if len(queries) != 1 || r.Rcode != dns.RcodeNameError {
+					t.Errorf("rcode = %s, forwarded %d queries, want the upstream's answer", dns.RcodeToString[r.Rcode], len(queries))
+				}
+				return
+			}
+			if len(queries) != 0 {
+				t.Errorf("forwarded %q, want a local answer", <-queries)
+			}
+			if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+				t.Fatalf("rcode = %s, answer = %v", dns.RcodeToString[r.Rcode], r.Answer)
+			}
+			if rrtype := r.Answer[0].Header().Rrtype; rrtype != tt.qtype {
+				t.Fatalf("type = %s, want %s", dns.TypeToString[rrtype], dns.TypeToString[tt.qtype])
+			}
+
+			var svcb dns.SVCB
+			if rr, ok := r.Answer[0].(*dns.HTTPS); ok {
+				svcb = rr.SVCB
+			} else {
+				svcb = *r.Answer[0].(*dns.SVCB)
+			}
+			if svcb.Priority != 1 || svcb.Target != "." {
+				t.Errorf("priority, target = %d, %q, want 1, \".\"", svcb.Priority, svcb.Target)
+			}
+			var alpn []string
+			var port uint16
+			for _, v := range svcb.Value {
+				switch v := v.(type) {
+				case *dns.SVCBAlpn:
+					alpn = v.Alpn
+				case *dns.SVCBPort:
+					port = v.Port
+				}
+			}
+			if strings.Join(alpn, ",") != strings.Join(tt.alpn, ",") || port != tt.port {
+				t.Errorf("alpn, port = %v, %d, want %v, %d", alpn, port, tt.alpn, tt.port)
+			}
+		})
+	}
+}
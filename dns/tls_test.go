@@ -0,0 +1,110 @@
+package dns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// selfSigned は自己署名証明書を使用する tls.Config を返す。
+func selfSigned(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	d := New(newTestAccounts(t,
+		`master/192.0.2.1/0.www=^www\.example\.com$`,
+		`master/2001:db8::1/0.v6=^v6\.example\.com$`,
+	))
+	d.AccountName = "master"
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	go d.ListenAndServeTLS(addr, selfSigned(t))
+	t.Cleanup(func() { d.Shutdown(context.Background()) })
+
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{ServerName: "dns.test", InsecureSkipVerify: true}}
+	exchange := func(name string, qtype uint16) (*dns.Msg, error) {
+		req := &dns.Msg{}
+		req.SetQuestion(dns.Fqdn(name), qtype)
+		r, _, err := client.Exchange(req, addr)
+		return r, err
+	}
+	// 待受を開始するまで待つ。
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := exchange("www.example.com", dns.TypeA); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  string
+	}{
+		{name: "www.example.com", qtype: dns.TypeA, want: "192.0.2.1"},
+		{name: "WWW.Example.COM", qtype: dns.TypeA, want: "192.0.2.1"},
+		{name: "v6.example.com", qtype: dns.TypeAAAA, want: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := exchange(tt.name, tt.qtype)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+				t.Fatalf("rcode = %s, answer = %v", dns.RcodeToString[r.Rcode], r.Answer)
+			}
+			var got net.IP
+			switch rr := r.Answer[0].(type) {
+			case *dns.A:
+				got = rr.A
+			case *dns.AAAA:
+				got = rr.AAAA
+			}
+			if got.String() != tt.want {
+				t.Errorf("answer = %v, want %s", r.Answer[0], tt.want)
+			}
+		})
+	}
+
+	// TLS を使用しない接続は受け付けない。
+	plain := &dns.Client{Net: "tcp", Timeout: time.Second}
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	if r, _, err := plain.Exchange(req, addr); err == nil {
+		t.Errorf("plain TCP query answered: %v", r)
+	}
+}
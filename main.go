@@ -28,46 +28,315 @@
 //
 //  -d
 //      デバッグモード。
+//  -config=""
+//      設定ファイルのパス。拡張子が .toml の場合は TOML、それ以外の場合は YAML として読み込む。
+//      トップレベルのキーとして docker, etcd, routes, http, socks, dns, ns, fakemx, account, realm, password,
+//      password_file (-password-file), reverse, debug (-d) を記述でき、それ以外のキーが含まれている場合は起動時にエラーとなる。
+//      コマンドライン引数で指定したオプションは設定ファイルの値より優先される。
+//      例 (YAML):
+//        etcd: "http://127.0.0.1:2379"
+//        http: ":80"
+//        dns: ":53"
+//        debug: true
+//      例 (TOML):
+//        etcd = "http://127.0.0.1:2379"
+//        http = ":80"
+//        dns = ":53"
+//        debug = true
 //  -reverse
 //      HTTP サーバーでリバースプロキシーモードを有効にする。
-//      有効にするためには -account オプションで有効なアカウント名を指定する必要がある。
+//      有効にするためには -account オプションで有効なアカウント名を指定するか、
+//      -reverse-account-hosts か -reverse-account-from-host でリクエストごとにアカウントを選ぶ必要がある。
+//  -verbose-accounts=""
+//      -d を指定しない場合でも、プロキシーや DNS サーバーで詳細なログを出力するアカウント名をカンマ区切りで指定する。
 //  -account=""
 //      アカウント名。
 //      常に特定のアカウントを使用する場合はここでアカウント名を指定するとユーザー認証が不要になる。
+//  -account-credentials="ignore"
+//      -account を指定した状態で HTTP プロキシーへ Proxy-Authorization ヘッダーが送られてきた場合の扱い。
+//      ignore はヘッダーを無視して -account のアカウントを使用し、prefer はヘッダーで認証したアカウントを使用する(認証に失敗した場合は 407 を返す)。
+//      reject は意図しないアカウントでの接続に気付けるよう、ヘッダーを送ってきた要求を 403 で拒否する。
+//  -allowed-accounts=""
+//      使用を許可するアカウント名をカンマ区切りで指定する。
+//      指定した場合は etcd 上に存在していても、ここに含まれないアカウント名では認証できない。
+//  -allowed-targets=""
+//      ルーティング情報の接続先として許可するアドレスの範囲を CIDR 形式のカンマ区切りで指定する(例: 10.0.0.0/8,172.17.0.0/16)。
+//      指定した場合は、接続先のアドレスやホスト名を名前解決したアドレスが範囲外のルーティング情報を除外する。
 //  -realm="Proxy"
 //      HTTP プロキシーで使用されるレルム。
+//  -realms=""
+//      接続先のホスト名ごとに HTTP プロキシーで使用するレルムを "ホスト名=レルム" のカンマ区切りで指定する。
+//      ホスト名を "*.example.com" とした場合はサブドメインに一致する。一致しない場合は -realm が使用される。
+//      例: -realms='a.example.com=Tenant A,*.b.example.com=Tenant B'
+//  -auth-scheme=basic
+//      HTTP プロキシーの認証方式を basic か digest で指定する。
+//      digest の場合は Digest 認証(MD5)を要求し、パスワードをそのまま送信する Basic 認証は受け付けない。
 //  -password=""
 //      HTTP / SOCKS v5 プロキシーで使用するパスワード。
 //      省略した場合は任意の文字列を入力すれば通過できる。
+//      コマンドライン引数はプロセスの一覧から見えてしまうため、-password-file か環境変数 DOCKERNS_PASSWORD の使用を推奨する。
+//      これらが指定されている場合は -password-file、DOCKERNS_PASSWORD、-password の順に優先される。
+//      etcd 上でアカウントの直下に _password が設定されている場合は、そのアカウントではそちらのパスワードを使用する。
+//  -password-file=""
+//      -password の代わりにパスワードを読み込むファイルのパス。末尾の改行は取り除かれる。
 //  -docker=""
 //      Docker Remote API にアクセスするためのアドレスを指定する。
 //      省略した場合は Docker Remote API は使用せずに起動する。
 //      例: 'http://172.17.42.1:4243', 'unix:///path/to/docker.sock:'
+//  -docker-network=""
+//      コンテナのアドレスとして使用する Docker ネットワークの名前を指定する。
+//      省略した場合はデフォルトのブリッジネットワークのアドレスを、無ければユーザー定義ネットワークのアドレスを使用する。
 //  -etcd="http://172.17.42.1:4001"
 //      etcd にアクセスするためのアドレスを指定する。
+//      空文字列を指定した場合は etcd を使用せず、Docker のラベルと環境変数 DOCKERNS_ROUTE_* で指定した
+//      静的なルーティング情報のみを使用する(accounts.StaticRouteEnvPrefix を参照)。
+//  -etcd-cacert=""
+//      etcd のサーバー証明書を検証する CA 証明書のファイル。
+//  -etcd-cert=""
+//  -etcd-key=""
+//      etcd へのクライアント証明書による認証に使用する証明書と秘密鍵のファイル。両方を指定する。
+//      -etcd-cacert, -etcd-cert, -etcd-key のいずれかを指定した場合は etcd へ TLS で接続する。
+//      ファイルが読み込めない場合は起動時にエラーとなる。
+//  -etcd-user=""
+//  -etcd-password=""
+//      etcd へのアクセスに使用するユーザー名とパスワード。認証が必要な場合は両方を指定する。
+//  -etcd-api=2
+//      etcd へのアクセスに使用する API のバージョンを 2 か 3 で指定する。
+//      3 の場合は v3 API (gRPC) を使用し、キーの階層構造は v2 と同様に "/proxy/アカウント名/接続先/0.正規表現の名前" として扱う。
+//      例: -etcd='http://127.0.0.1:2379' -etcd-api=3
 //  -routes="/proxy"
 //      プロキシールーティング情報が etcd 上のどこを基点に保存されているのかを指定する。
+//  -label-selector=""
+//      Docker コンテナのラベルからルーティング情報を作成する際に、対象とするコンテナをラベルの条件で絞り込む。
+//      例: 'dockerns.expose=true,env in (prod,staging),!deprecated'
+//  -address-family="prefer-ipv4"
+//      コンテナが IPv4 と IPv6 の両方のアドレスを持つ場合に、接続先や DNS の応答として使用するアドレスを選択する。
+//      prefer-ipv4, prefer-ipv6, ipv4-only, ipv6-only のいずれかを指定する。
+//  -health-interval=10s
+//      etcd 上で _backup か _health_check が指定された接続先へのヘルスチェックを行う間隔。0 の場合は行わない。
+//      接続先の _health_port (省略時は 80 番)に接続できない間はその接続先へ振り分けず、
+//      全ての接続先に接続できない場合は _backup で指定した接続先へ切り替える(_backup が無ければホスト名を差し替えない)。
+//  -health-timeout=2s
+//      ヘルスチェックで接続を待つ最大時間。
+//  -no-match-log=0
+//      HTTP / SOCKS v5 プロキシーや DNS サーバーでルーティング情報に一致しなかったホスト名を、
+//      指定した間隔(例: 10s)に一度だけログに出力する。0 の場合は出力しない。
+//      一致しなかった件数はアカウントごとにメトリクス dockerns_route_no_match_total で数えられる。
+//  -docker-concurrency=8
+//      ルーティング情報の再読み込みの際に、Docker Remote API へコンテナの詳細を同時に問い合わせる数の上限。
+//      コンテナ数が多い環境で再読み込みの度に Docker デーモンの負荷が高くなる場合は小さくする。
+//  -docker-events-timeout=10s
+//      Docker Remote API のイベントストリームを開く際に、応答のヘッダーを受け取るまで待つ最大時間。
+//      時間内に応答が無い場合は接続し直す。0 の場合は無制限に待つ。
+//  -max-container-aliases=0
+//      Docker のリンクによってコンテナに付けられた別名のうち、名前からコンテナを引くために登録する数の上限。
+//      0 の場合は制限しない。コンテナ本来の名前は常に登録される。
+//  -resync=0
+//      etcd や Docker の監視でイベントを取りこぼした場合に備えて、ルーティング情報全体を定期的に再構築する間隔(例: 5m)。
+//      0 の場合は変更を検出した時のみ再構築する。
+//  -max-routing-bytes=0
+//      ルーティング情報が使用するメモリの推定値の上限をバイト単位で指定する。0 の場合は制限しない。
+//      上限を超えてルーティング情報が大きくなる変更があった場合は警告を出力し、それまでのルーティング情報を使い続ける。
 //  -http=""
 //      HTTP プロキシーが待ち受けるアドレスを :80 のような形で指定する。省略した場合は待ち受けない。
 //  -socks=""
 //      SOCKS v5 プロキシーが待ち受けるアドレスを :1080 のような形で指定する。省略した場合は待ち受けない。
+//  -tls-passthrough=""
+//      TLS を終端せずに SNI に従って中継するリバースプロキシーが待ち受けるアドレスを :443 のような形で指定する。
+//      ClientHello の SNI と待ち受けているポート番号をルーティング情報に従って差し替え、暗号化されたままの通信を中継する。
+//      ルーティング情報に一致しない接続は切断される。有効にするためには -account オプションで有効なアカウント名を指定する必要がある。
+//  -tls-passthrough-log
+//      -tls-passthrough で中継を開始した接続ごとに、ClientHello の SNI と ALPN、クライアントが対応している最も新しい TLS のバージョン、
+//      選択した接続先をログに出力する。通信の暗号化は解かない。
 //  -dns=""
 //      DNS サーバが待ち受けるアドレスを :53 のような形で指定する。省略した場合は待ち受けない。
 //      使用するためには -account でアカウント名を適切に渡す必要がある。
+//  -dns-debug
+//      DNS サーバーの応答の追加情報セクションに、応答の出所(local / cache / stale / forward / any)を示す
+//      source.dockerns. の CH クラスの TXT レコードを付加する。問題の切り分け用。
+//  -dns-debug-route
+//      DNS サーバーがルーティング情報から作成した応答の追加情報セクションに、一致したルーティング情報の名前、プライオリティ、
+//      正規表現を示す route.dockerns. の CH クラスの TXT レコードを付加する。dig の応答でどのルーティング情報に一致したかを確認できる。
+//      ルーティング情報の内容が問い合わせ元に知られるため、問題の切り分け時のみ指定すること。
+//  -dns-forward-on-missing-account
+//      DNS サーバーで -account のアカウントが etcd 上に見つからない間、SERVFAIL を返す代わりに
+//      全ての問い合わせを -ns のネームサーバーへ転送する。省略した場合は SERVFAIL を返す。
+//  -dns-ttl-jitter=0
+//      DNS サーバーがルーティング情報から作成する応答の TTL を ±指定したパーセントの範囲でばらつかせる。
+//      クライアントのキャッシュが一斉に期限切れになるのを避けるために使用する。0 の場合はばらつかせない。
+//  -dns-follow-cname
+//      DNS サーバーでルーティング情報の接続先がホスト名の場合に返す CNAME レコードの参照先を -ns のネームサーバーへ問い合わせ、
+//      得られた A / AAAA レコードを応答に加える。省略した場合は CNAME レコードのみを返す。
+//  -dns-unresolvable="servfail"
+//      -dns-follow-cname 使用時に、CNAME レコードの参照先を解決できなかった場合の応答方法。
+//      servfail は SERVFAIL を、nxdomain は NXDOMAIN を返し、forward は元の問い合わせを -ns のネームサーバーへ転送する。
+//      -dns-follow-cname を省略した場合は参照先を解決せずに CNAME レコードのみを返すため、この指定は使用されない。
+//  -dns-ecs
+//      DNS サーバーで EDNS Client Subnet (RFC 7871) を解釈し、etcd 上の _subnets で指定された対応に従って
+//      クライアントのサブネットに応じた接続先を返す。省略した場合は問い合わせの送信元のアドレスで判定する。
+//  -dns-tls=""
+//      DNS-over-TLS (RFC 7858) で待ち受けるアドレスを :853 のような形で指定する。省略した場合は待ち受けない。
+//      使用するためには -tls-cert と -tls-key で証明書を指定する必要がある。
+//  -tls-cert=""
+//      TLS で使用する証明書ファイル(PEM)。
+//      ファイルが更新された場合は再起動せずに新しい証明書に切り替わる。
+//  -tls-key=""
+//      TLS で使用する秘密鍵ファイル(PEM)。
+//  -http-cert=""
+//      指定した場合は HTTP プロキシーを HTTPS で提供し、Proxy-Authorization の認証情報を平文で送らずに済むようにする。
+//      CONNECT によるトンネルや管理用 API も TLS 上で使用できる。-http-key と共に指定する必要があり、-reverse とは併用できない。
+//      ファイルが更新された場合は再起動せずに新しい証明書に切り替わる。
+//  -http-key=""
+//      -http-cert の証明書に対応する秘密鍵ファイル(PEM)。
 //  -ns="8.8.8.8:53"
 //      DNS サーバが自分自身で解決できなかったリクエストを転送する先のネームサーバー。
 //  -fakemx=""
 //      -ns で指定されたサーバーからの応答を返す前に MX レコードの内容を書き換える場合に指定する。
+//  -http-drain=10s
+//      終了時に HTTP サーバーが処理中のリクエストや CONNECT トンネルの完了を待つ最大時間。-reverse 使用時も適用される。
+//  -http-read-timeout=0
+//      HTTP サーバーがボディを含むリクエスト全体を読み込む最大時間。0 の場合は無制限。-reverse 使用時も適用される。
+//      ヘッダーを少しずつ送り続けて接続を占有するクライアントへの対策になるが、大きなアップロードが途中で切断されないよう注意すること。
+//  -http-write-timeout=0
+//      HTTP サーバーがリクエストのヘッダーを読み込み終えてからレスポンスを書き込み終えるまでの最大時間。0 の場合は無制限。
+//      -reverse 使用時も適用される。CONNECT トンネルには適用されない。
+//  -http-idle-timeout=2m
+//      HTTP サーバーが keep-alive の接続で次のリクエストを待つ最大時間。0 の場合は -http-read-timeout の値を使用する。
+//  -http-max-header-bytes=0
+//      HTTP プロキシーで受け付けるリクエストヘッダー及び接続先からのレスポンスヘッダーの合計サイズの上限(バイト)。
+//      超えた場合はリクエストに 431 を返す。0 の場合は Go の既定値(1MiB)を使用する。
+//      アカウントごとに etcd 上の _max_header_bytes で個別に指定することもできる。
+//  -http-max-headers=0
+//      HTTP プロキシーで受け付けるヘッダーの個数の上限。0 の場合は制限しない。
+//      アカウントごとに etcd 上の _max_headers で個別に指定することもできる。
+//  -http-rate-limit=0
+//      HTTP プロキシーでアカウントごとに受け付ける 1 秒あたりのリクエスト数の上限。CONNECT も一回として数える。
+//      超えた場合は 429 を返す。0 の場合は制限しない。アカウントごとに etcd 上の _rate_limit で個別に指定することもできる。
+//  -http-rate-burst=0
+//      HTTP プロキシーでアカウントごとに連続して受け付けるリクエスト数の上限。0 の場合は -http-rate-limit を切り上げた値を使用する。
+//      アカウントごとに etcd 上の _rate_burst で個別に指定することもできる。
+//  -healthz-staleness=0
+//      HTTP サーバーの GET /healthz で、最後にルーティング情報の再構築に成功してからこの時間以上経過している場合は 503 を返す。
+//      0 の場合は経過時間を問わない。変更が無い間は再構築されないため、指定する場合は -resync より長い時間にすること。
+//  -reverse-retries=0
+//      -reverse 使用時に GET / HEAD リクエストで接続先への接続に失敗した場合に再試行する回数。
+//      コンテナの再起動中などに一時的に接続できない場合でもエラーを返さずに済む。
+//  -reverse-retry-backoff=100ms
+//      -reverse-retries による最初の再試行までの待ち時間。以降は再試行の度に倍になる。
+//  -reverse-scheme="http"
+//      -reverse 使用時に接続先へ転送する際のスキームで、http か https を指定する。
+//  -reverse-rewrite-host
+//      -reverse 使用時に転送するリクエストの Host ヘッダーを差し替えた後の接続先に書き換え、元の値を X-Forwarded-Host に設定する。
+//      省略した場合はクライアントが送った Host ヘッダーをそのまま転送する。
+//  -reverse-account-hosts=""
+//      -reverse 使用時にリクエストのホスト名ごとに使用するアカウントを "ホスト名=アカウント名" のカンマ区切りで指定する。
+//      ホスト名を "*.example.com" とした場合はサブドメインに一致する。一致しない場合は -account のアカウントを使用する。
+//      例: -reverse-account-hosts='a.example.com=tenant1,*.b.example.com=tenant2'
+//  -reverse-account-from-host
+//      -reverse 使用時に -reverse-account-hosts に一致しなかったリクエストのホスト名の最初のラベルをアカウント名として使用する。
+//      例えば tenant1.example.com へのリクエストには tenant1 のルーティング情報を使用する。
+//      そのアカウントが存在しない場合は -account のアカウントを使用する。
+//  -socks-advertise=""
+//      SOCKS v5 プロキシーの応答で BND.ADDR として通知するアドレスを 203.0.113.5 や 203.0.113.5:1080 のような形で指定する。
+//      NAT の内側で動作している場合などに、クライアントから到達できるアドレスを通知するために使用する。
+//      ポート番号を省略した場合は接続先への接続に使用したポート番号を通知する。
+//  -socks-drain=30s
+//      終了時に SOCKS v5 プロキシーが中継中の接続の完了を待つ最大時間。-tls-passthrough 使用時も適用される。
+//  -socks4
+//      -socks で指定したアドレスで SOCKS v5 に加えて SOCKS4 / SOCKS4a の接続も受け付ける。
+//      SOCKS4 には認証が無いため -account を指定した場合のみ使用でき、指定していない場合や -socks4 を省略した場合は拒否する。
+//  -dns-drain=1s
+//      終了時に DNS サーバーが処理中の問い合わせの完了を待つ最大時間。
+//  -shutdown-order=""
+//      終了時にサーバーを止める順序を dns, http, socks, tls-passthrough の種類で指定する。
+//      "," で区切った段階ごとに、"+" で並べた種類のサーバーが新しい接続の受け付けを止めて処理中の接続の完了を待ち、
+//      全て完了してから次の段階に進む。指定しなかった種類は最後に止める。省略した場合は全てのサーバーを同時に止める。
+//      SIGINT と SIGTERM のどちらを受け取った場合もこの順序で終了する。
+//      例えば "dns,http+socks+tls-passthrough" とすると、クライアントが新しい接続先を名前解決しなくなってからプロキシーを止める。
+//  -dns-rcvbuf=0
+//      DNS サーバーの UDP / TCP ソケットの受信バッファサイズ(バイト)。0 の場合は OS の既定値を使用する。
+//  -dns-sndbuf=0
+//      DNS サーバーの UDP / TCP ソケットの送信バッファサイズ(バイト)。0 の場合は OS の既定値を使用する。
+//  -dns-cache=0
+//      DNS サーバーが -ns で指定されたサーバーから得た応答をキャッシュする最大件数。0 の場合はキャッシュしない。
+//      応答の TTL (-dns-serve-stale を指定した場合はその期間も)が過ぎたものは定期的に削除され、上限を超える場合は最も長く参照されていないものから削除される。
+//  -dns-cache-order="rotate"
+//      キャッシュした応答に同じ名前と種類のレコードが複数含まれる場合の並べ方。
+//      rotate は応答を返す度に先頭のレコードを一つずつずらし、shuffle は無作為に並べ替え、fixed は得た順序のまま返す。
+//      キャッシュを有効にしても、複数のアドレスへの負荷の分散が保たれるようにする。
+//  -dns-serve-stale=0
+//      -ns で指定されたサーバーに到達できない場合に、期限切れから指定時間以内のキャッシュを代わりに返す。0 の場合は返さない。
+//  -dns-any="minimal"
+//      DNS サーバーが ANY クエリーに応答する方法。
+//      minimal は RFC 8482 に従い HINFO レコードのみを返し、refuse は REFUSED を返す。
+//      full は以前と同様に一致したルーティング情報から作成できる全てのレコードを返し、それ以外は -ns で指定されたサーバーへ転送する。
+//  -proxy-protocol
+//      HTTP / SOCKS v5 プロキシーで接続の先頭に PROXY プロトコル(v1 / v2)のヘッダーを要求し、本来のクライアントのアドレスを使用する。
+//      ロードバランサーの背後で使用する場合に指定する。
+//  -proxy-tlv-header=""
+//      PROXY プロトコル v2 の TLV の値を HTTP プロキシーのリクエストヘッダーとして転送する。
+//      TLV の名前とヘッダー名を = で繋いだものをカンマ区切りで指定する。
+//      TLV の名前には alpn, authority, unique_id, aws_vpce_id が使用できる。
+//      例: 'aws_vpce_id=X-Amzn-Vpce-Id'
+//  -policy=""
+//      HTTP / SOCKS v5 プロキシーで接続の可否を問い合わせるポリシーサーバーの URL。省略した場合は問い合わせない。
+//      アカウント名、接続元、接続先を JSON で POST し、{"decision":"allow|deny|rewrite","host":"..."} 形式の応答で判定する。
+//  -policy-fail-open
+//      ポリシーサーバーに到達できなかった場合に接続を許可する。省略した場合は拒否する。
+//      到達できたものの 200 以外の応答や解釈できない応答が返った場合は、指定に関わらず拒否する。
+//  -audit-log=""
+//      HTTP / SOCKS v5 プロキシーでルーティング情報により接続先が差し替えられた記録を出力するファイル。
+//      "-" を指定した場合は標準エラー出力に出力する。省略した場合は出力しない。
+//      アカウント名、接続元、本来の接続先、差し替えた後の接続先を一行ずつ追記する。
+//  -audit-all
+//      -audit-log に接続先が変化しなかった接続も記録する。
+//  -access-log=""
+//      HTTP プロキシー(-reverse 使用時はリバースプロキシー)のアクセスログを出力するファイル。
+//      "-" を指定した場合は標準出力に出力する。省略した場合は出力しない。
+//      リクエストごとに時刻、アカウント名、接続元、メソッド、本来の接続先、差し替えた後の接続先、ステータスコード、
+//      転送したバイト数を JSON で一行ずつ追記する。CONNECT トンネルはトンネルが閉じられた時点で追記する。
+//      -proxy-protocol 使用時は PROXY プロトコル v2 の TLV の値も記録する。
+//  -admin-token=""
+//      HTTP サーバーの管理用 API にアクセスするためのトークン。"Authorization: Bearer <token>" ヘッダーで渡す。
+//      省略した場合は管理用 API は無効になる。
+//      GET /debug/config では実行時の設定内容をパスワードなどを伏せた上で JSON で返す。
+//      GET /debug/connections では中継中の CONNECT トンネル、WebSocket などの Upgrade 接続、SOCKS v5 の接続の一覧を JSON で返す。
+//      GET /debug/routes では全てのルーティング情報を、ホスト名に一致した回数と最後に一致した時刻と共に JSON で返す。
+//      GET /admin/routes?account=master では指定したアカウントのルーティング情報を評価される順に JSON で返す。
+//      アカウントが存在しない場合は 404 を返す。
+//      POST /admin/reload ではルーティング情報を直ちに再構築し、完了すると 200 を、失敗した場合はエラーの内容を 500 で返す。
+//      etcd の監視を待たずに変更を反映したい場合や、監視の接続が切れている場合に使用する。
+//      GET /debug/accounts では全てのアカウントについて、接続先への接続の成功・失敗回数と成功した割合を JSON で返す。
+//      接続の成功・失敗回数はメトリクス dockerns_proxy_dials_total でも数えられる。
+//      GET /metrics ではプロキシーや DNS サーバーのメトリクスを Prometheus のテキスト形式で返す。
+//      GET /healthz ではルーティング情報の再構築の成否と最後に成功してからの経過時間、etcd と Docker の変更の監視の状態、
+//      アカウントの数を JSON で返す。最後の再構築が失敗している場合や -healthz-staleness を超えている場合は 503 を返す。
+//      /healthz は死活監視に使用できるよう、-admin-token を省略した場合もトークン無しでアクセスできる。
+//      /metrics も同様に -admin-token を省略した場合はトークン無しでアクセスでき、指定した場合はトークンが必要になる。
+//      トークン無しで提供する場合は -admin で外部から到達できないアドレスに分離することを推奨する。
+//  -admin=""
+//      HTTP サーバーの管理用 API を 127.0.0.1:9090 のような形で指定したアドレスで、プロキシーとは別に待ち受ける。
+//      指定した場合は -http で指定したアドレスでは管理用 API を提供しない。省略した場合は -http と同じアドレスで提供する。
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mimoto-xxxxxx/dockerns/accounts"
+	"github.com/mimoto-xxxxxx/dockerns/certs"
 	"github.com/mimoto-xxxxxx/dockerns/dns"
 	"github.com/mimoto-xxxxxx/dockerns/proxy"
 )
@@ -75,29 +344,265 @@ import (
 func main() {
 	var (
 		debug         = flag.Bool("d", false, "debug mode")
+		configFile    = flag.String("config", "", "configuration file (YAML, or TOML if the extension is .toml)")
 		reverse       = flag.Bool("reverse", false, "enable reverse http proxy mode")
 		account       = flag.String("account", "", "account")
+		accountCreds  = flag.String("account-credentials", proxy.CredentialsIgnore, "handling of Proxy-Authorization sent while -account is set ('ignore', 'prefer' or 'reject')")
+		verboseAccts  = flag.String("verbose-accounts", "", "comma separated list of account names logged verbosely even without -d")
+		allowed       = flag.String("allowed-accounts", "", "comma separated list of allowed account names (empty = all)")
+		allowedTgts   = flag.String("allowed-targets", "", "comma separated list of CIDR ranges allowed as route targets (empty = all)")
 		realm         = flag.String("realm", "Proxy", "realm for proxy server")
+		authScheme    = flag.String("auth-scheme", proxy.AuthBasic, "authentication scheme for HTTP proxy (basic or digest)")
+		realms        = flag.String("realms", "", "per-host realms for proxy server (e.g., 'a.example.com=Tenant A,*.b.example.com=Tenant B')")
 		proxyPassword = flag.String("password", "", "password for proxy server")
+		passwordFile  = flag.String("password-file", "", "file containing the password for proxy server (overrides "+passwordEnv+" and -password)")
 		dockerAddress = flag.String("docker", "", "docker remote api address")
+		dockerNetwork = flag.String("docker-network", "", "docker network whose container addresses are used (empty = default bridge, then any)")
 		etcdAddress   = flag.String("etcd", "http://172.17.42.1:4001", "etcd address")
+		etcdCACert    = flag.String("etcd-cacert", "", "CA certificate file to verify etcd server")
+		etcdCert      = flag.String("etcd-cert", "", "client certificate file for etcd")
+		etcdKey       = flag.String("etcd-key", "", "client private key file for etcd")
+		etcdUser      = flag.String("etcd-user", "", "etcd username for authentication")
+		etcdPassword  = flag.String("etcd-password", "", "etcd password for authentication")
+		etcdAPI       = flag.Int("etcd-api", 2, "etcd API version (2 or 3)")
 		etcdRoot      = flag.String("routes", "/proxy", "etcd routes information root")
+		labelSelector = flag.String("label-selector", "", "docker label selector for label-based routes (e.g., 'dockerns.expose=true,env in (prod)')")
+		addrFamily    = flag.String("address-family", string(accounts.PreferIPv4), "container address family ('prefer-ipv4', 'prefer-ipv6', 'ipv4-only' or 'ipv6-only')")
+		healthIntv    = flag.Duration("health-interval", 10*time.Second, "interval of health checks for routes with a backup target or _health_check (0 = disabled)")
+		healthTimeout = flag.Duration("health-timeout", 2*time.Second, "timeout of health checks for routes with a backup target or _health_check")
+		noMatchLog    = flag.Duration("no-match-log", 0, "minimum interval between logs of hostnames that matched no route (0 = disabled)")
+		dockerConc    = flag.Int("docker-concurrency", 8, "maximum number of concurrent container inspections on reload")
+		dockerEvTmout = flag.Duration("docker-events-timeout", 10*time.Second, "timeout for receiving response headers when opening the Docker events stream (0 = unlimited)")
+		maxAliases    = flag.Int("max-container-aliases", 0, "maximum number of link aliases registered per container (0 = unlimited)")
+		resync        = flag.Duration("resync", 0, "interval of periodic full reloads regardless of events (0 = disabled)")
+		maxRouting    = flag.Int64("max-routing-bytes", 0, "soft limit of estimated routing table memory in bytes (0 = unlimited)")
 		httpService   = flag.String("http", "", "HTTP service address (e.g., ':80')")
 		socksService  = flag.String("socks", "", "SOCKSv5 service address (e.g., ':1080')")
+		tlsPassLog    = flag.Bool("tls-passthrough-log", false, "log SNI, ALPN, TLS version and target of each TLS passthrough connection")
+		tlsPassSvc    = flag.String("tls-passthrough", "", "TLS passthrough service address routed by SNI (e.g., ':443')")
 		dnsService    = flag.String("dns", "", "DNS service address (e.g., ':53')")
+		dnsDebug      = flag.Bool("dns-debug", false, "annotate DNS responses with a TXT record describing their source")
+		dnsDebugRoute = flag.Bool("dns-debug-route", false, "annotate locally answered DNS responses with a TXT record describing the matched route")
+		dnsFwdMissing = flag.Bool("dns-forward-on-missing-account", false, "forward all DNS queries to the name server while the account is missing")
+		dnsTTLJitter  = flag.Int("dns-ttl-jitter", 0, "randomize DNS answer TTLs by up to +/- this percentage (0 = disabled)")
+		dnsFollowCN   = flag.Bool("dns-follow-cname", false, "resolve CNAME answers for hostname targets via the name server and append the results")
+		dnsUnresolv   = flag.String("dns-unresolvable", dns.UnresolvableServFail, "response when a CNAME target cannot be resolved with -dns-follow-cname ('servfail', 'nxdomain' or 'forward')")
+		dnsECS        = flag.Bool("dns-ecs", false, "use EDNS Client Subnet to select subnet-specific targets")
+		dnsTLSService = flag.String("dns-tls", "", "DNS-over-TLS service address (e.g., ':853')")
+		tlsCert       = flag.String("tls-cert", "", "TLS certificate file")
+		tlsKey        = flag.String("tls-key", "", "TLS private key file")
+		httpCert      = flag.String("http-cert", "", "TLS certificate file for serving the HTTP proxy over HTTPS")
+		httpKey       = flag.String("http-key", "", "TLS private key file for serving the HTTP proxy over HTTPS")
 		nameServer    = flag.String("ns", "8.8.8.8:53", "secondary name server (e.g., '8.8.8.8:53')")
 		fakeMX        = flag.String("fakemx", "", "enable mx record poisoning(e.g., 'localhost.localdomain.')")
+		httpDrain     = flag.Duration("http-drain", 10*time.Second, "graceful shutdown timeout for HTTP service")
+		httpReadTO    = flag.Duration("http-read-timeout", 0, "maximum duration for reading an entire request including the body (0 = no limit)")
+		httpWriteTO   = flag.Duration("http-write-timeout", 0, "maximum duration before timing out writes of a response (0 = no limit)")
+		httpIdleTO    = flag.Duration("http-idle-timeout", 2*time.Minute, "maximum duration to wait for the next request on a keep-alive connection (0 = use -http-read-timeout)")
+		httpMaxHdrLen = flag.Int("http-max-header-bytes", 0, "maximum total size of HTTP headers (0 = default)")
+		httpMaxHdrs   = flag.Int("http-max-headers", 0, "maximum number of HTTP headers (0 = unlimited)")
+		httpRate      = flag.Float64("http-rate-limit", 0, "maximum HTTP proxy requests per second per account (0 = unlimited)")
+		httpBurst     = flag.Int("http-rate-burst", 0, "maximum burst of HTTP proxy requests per account (0 = rate rounded up)")
+		healthzStale  = flag.Duration("healthz-staleness", 0, "report unhealthy on /healthz when the last successful reload is older than this (0 = disabled)")
+		revRetries    = flag.Int("reverse-retries", 0, "number of retries for idempotent reverse proxy requests when the target cannot be reached")
+		revBackoff    = flag.Duration("reverse-retry-backoff", 100*time.Millisecond, "initial backoff between reverse proxy retries")
+		revScheme     = flag.String("reverse-scheme", "http", "scheme used to forward reverse proxy requests to backends (http or https)")
+		revRewriteHdr = flag.Bool("reverse-rewrite-host", false, "rewrite the Host header of reverse proxy requests to the backend address")
+		revAcctHosts  = flag.String("reverse-account-hosts", "", "comma-separated host=account mapping used to select the account in reverse proxy mode")
+		revAcctLabel  = flag.Bool("reverse-account-from-host", false, "use the first label of the Host header as the account in reverse proxy mode")
+		socksAdvAddr  = flag.String("socks-advertise", "", "address advertised as BND.ADDR in SOCKSv5 replies (e.g., '203.0.113.5' or '203.0.113.5:1080')")
+		socksDrain    = flag.Duration("socks-drain", 30*time.Second, "graceful shutdown timeout for SOCKSv5 service")
+		socks4        = flag.Bool("socks4", false, "also accept SOCKS4/4a connections on the SOCKS service (requires -account)")
+		dnsDrain      = flag.Duration("dns-drain", time.Second, "graceful shutdown timeout for DNS service")
+		shutdownOrder = flag.String("shutdown-order", "", "order of stopping services on shutdown (e.g., 'dns,http+socks+tls-passthrough'; empty = all at once)")
+		dnsRcvBuf     = flag.Int("dns-rcvbuf", 0, "socket receive buffer size for DNS service (0 = OS default)")
+		dnsSndBuf     = flag.Int("dns-sndbuf", 0, "socket send buffer size for DNS service (0 = OS default)")
+		dnsCache      = flag.Int("dns-cache", 0, "maximum number of cached DNS answers (0 = disabled)")
+		dnsAnyMode    = flag.String("dns-any", dns.AnyMinimal, "response to DNS ANY queries ('minimal', 'full' or 'refuse')")
+		dnsCacheOrder = flag.String("dns-cache-order", dns.CacheOrderRotate, "order of multiple records in cached DNS answers ('rotate', 'shuffle' or 'fixed')")
+		dnsServeStale = flag.Duration("dns-serve-stale", 0, "maximum staleness of cached answers served when the name server is unreachable (0 = disabled)")
+		proxyProtocol = flag.Bool("proxy-protocol", false, "require PROXY protocol header on HTTP and SOCKSv5 services")
+		proxyTLVHdr   = flag.String("proxy-tlv-header", "", "forward PROXY protocol v2 TLVs as HTTP headers (e.g., 'aws_vpce_id=X-Amzn-Vpce-Id')")
+		policyURL     = flag.String("policy", "", "external connection policy endpoint URL")
+		policyOpen    = flag.Bool("policy-fail-open", false, "allow connections when the policy endpoint is unreachable")
+		auditLog      = flag.String("audit-log", "", "audit log file for rewritten proxy targets ('-' = stderr)")
+		auditAll      = flag.Bool("audit-all", false, "also audit connections whose target was not rewritten")
+		accessLogFile = flag.String("access-log", "", "JSON access log file for the HTTP proxy and reverse proxy ('-' = stdout)")
+		adminToken    = flag.String("admin-token", "", "token required for management API")
+		adminService  = flag.String("admin", "", "separate listen address for management API")
 	)
 
 	flag.Parse()
+	if *configFile != "" {
+		config, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatalln("-config:", err)
+		}
+		explicit := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+		if err := config.apply(flag.CommandLine, explicit); err != nil {
+			log.Fatalln("-config:", err)
+		}
+	}
+	if *httpService == "" && *socksService == "" && *dnsService == "" && *dnsTLSService == "" && *tlsPassSvc == "" {
+		log.Fatalln("no service configured: specify at least one of -http, -socks, -dns, -dns-tls or -tls-passthrough")
+	}
 
 	ac := accounts.New(*dockerAddress, *etcdAddress, *etcdRoot)
 	ac.Verbose = *debug
+	for _, name := range strings.Split(*verboseAccts, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ac.VerboseAccounts = append(ac.VerboseAccounts, name)
+		}
+	}
+	ac.DockerNetwork = *dockerNetwork
+	if *etcdAPI != 2 && *etcdAPI != 3 {
+		log.Fatalln("-etcd-api: unsupported version:", *etcdAPI)
+	}
+	ac.EtcdAPIVersion = *etcdAPI
+	if (*etcdUser == "") != (*etcdPassword == "") {
+		log.Fatalln("-etcd-user and -etcd-password must be specified together")
+	}
+	ac.EtcdUsername = *etcdUser
+	ac.EtcdTLS = accounts.TLSFiles{CACert: *etcdCACert, Cert: *etcdCert, Key: *etcdKey}
+	if ac.EtcdTLS.Enabled() {
+		if _, err := ac.EtcdTLS.Config(); err != nil {
+			log.Fatalln("etcd TLS:", err)
+		}
+	}
+	ac.EtcdPassword = *etcdPassword
+	ac.MaxRoutingBytes = *maxRouting
+	ac.ResyncInterval = *resync
+	ac.StaticRoutes = staticRoutes(os.Environ())
+	ac.MaxContainerAliases = *maxAliases
+	ac.DockerConcurrency = *dockerConc
+	ac.DockerEventsTimeout = *dockerEvTmout
+	ac.NoMatchLogInterval = *noMatchLog
+	ac.HealthCheckInterval = *healthIntv
+	ac.HealthCheckTimeout = *healthTimeout
+	for _, name := range strings.Split(*allowed, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ac.AllowedAccounts = append(ac.AllowedAccounts, name)
+		}
+	}
+	selector, err := accounts.ParseSelector(*labelSelector)
+	if err != nil {
+		log.Fatalln("-label-selector:", err)
+	}
+	ac.AllowedTargets, err = accounts.ParseAllowedTargets(*allowedTgts)
+	if err != nil {
+		log.Fatalln("-allowed-targets:", err)
+	}
+	ac.LabelSelector = selector
+	ac.AddressFamily, err = accounts.ParseAddressFamily(*addrFamily)
+	if err != nil {
+		log.Fatalln("-address-family:", err)
+	}
+
+	var reloader *certs.Reloader
+	if *tlsCert != "" || *tlsKey != "" {
+		reloader, err = certs.NewReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalln("-tls-cert:", err)
+		}
+	}
+	if *dnsTLSService != "" && reloader == nil {
+		log.Fatalln("-dns-tls: -tls-cert and -tls-key are required")
+	}
+	if (*httpCert == "") != (*httpKey == "") {
+		log.Fatalln("-http-cert: -http-cert and -http-key must be specified together")
+	}
+	if *httpCert != "" && *reverse {
+		log.Fatalln("-http-cert: cannot be used with -reverse")
+	}
+
+	tlvHeaders, err := parseTLVHeaders(*proxyTLVHdr)
+	if err != nil {
+		log.Fatalln("-proxy-tlv-header:", err)
+	}
+	revAccountHosts, err := parseHostMap(*revAcctHosts)
+	if err != nil {
+		log.Fatalln("-reverse-account-hosts:", err)
+	}
+	hostRealms, err := parseHostMap(*realms)
+	if err != nil {
+		log.Fatalln("-realms:", err)
+	}
+	switch *dnsUnresolv {
+	case dns.UnresolvableServFail, dns.UnresolvableNXDomain, dns.UnresolvableForward:
+	default:
+		log.Fatalln("-dns-unresolvable: unknown behavior:", *dnsUnresolv)
+	}
+	switch *dnsCacheOrder {
+	case dns.CacheOrderRotate, dns.CacheOrderShuffle, dns.CacheOrderFixed:
+	default:
+		log.Fatalln("-dns-cache-order: unknown order:", *dnsCacheOrder)
+	}
+	switch *accountCreds {
+	case proxy.CredentialsIgnore, proxy.CredentialsPrefer, proxy.CredentialsReject:
+	default:
+		log.Fatalln("-account-credentials: unknown value:", *accountCreds)
+	}
+	switch *revScheme {
+	case "http", "https":
+	default:
+		log.Fatalln("-reverse-scheme: unknown scheme:", *revScheme)
+	}
+	switch *authScheme {
+	case proxy.AuthBasic, proxy.AuthDigest:
+	default:
+		log.Fatalln("-auth-scheme: unknown scheme:", *authScheme)
+	}
+	socksAdvertise, err := parseAdvertiseAddr(*socksAdvAddr)
+	if err != nil {
+		log.Fatalln("-socks-advertise:", err)
+	}
+	order, err := parseShutdownOrder(*shutdownOrder)
+	if err != nil {
+		log.Fatalln("-shutdown-order:", err)
+	}
+	password, err := loadPassword(*proxyPassword, *passwordFile, os.Getenv)
+	if err != nil {
+		log.Fatalln("-password-file:", err)
+	}
+
+	var policy proxy.Policy
+	if *policyURL != "" {
+		p := proxy.NewHTTPPolicy(*policyURL)
+		p.FailOpen = *policyOpen
+		policy = p
+	}
+
+	var audit *proxy.Audit
+	if *auditLog != "" {
+		w := os.Stderr
+		if *auditLog != "-" {
+			w, err = os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				log.Fatalln("-audit-log:", err)
+			}
+		}
+		audit = proxy.NewAudit(log.New(w, "audit: ", log.LstdFlags))
+		audit.All = *auditAll
+	}
+
+	var accessLog io.Writer
+	if *accessLogFile == "-" {
+		accessLog = os.Stdout
+	} else if *accessLogFile != "" {
+		f, err := os.OpenFile(*accessLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalln("-access-log:", err)
+		}
+		accessLog = f
+	}
 
 	end := make(chan struct{})
+	svcs := services{order: order}
 
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt)
+	c := make(chan os.Signal, 1)
+	// docker stop などで送られる SIGTERM でも処理中の接続の完了を待ってから終了する
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		for _ = range c {
 			end <- struct{}{}
@@ -116,20 +621,57 @@ func main() {
 		}
 
 		go ac.Watch()
+		go ac.CheckHealth()
 
 		if *httpService != "" {
 			go func() {
-				if *reverse && *account != "" {
+				if *reverse && (*account != "" || revAccountHosts != nil || *revAcctLabel) {
 					s := proxy.NewRevHTTP(ac, *account)
+					s.ShutdownTimeout = *httpDrain
+					s.ReadTimeout = *httpReadTO
+					s.WriteTimeout = *httpWriteTO
+					s.IdleTimeout = *httpIdleTO
+					s.Retries = *revRetries
+					s.RetryBackoff = *revBackoff
+					s.Scheme = *revScheme
+					s.RewriteHost = *revRewriteHdr
+					s.AccountHosts = revAccountHosts
+					s.AccountFromLabel = *revAcctLabel
+					s.AccessLog = accessLog
+					svcs.add(serviceHTTP, s)
 					if err := s.ListenAndServe(*httpService); err != nil {
 						log.Println("ListenAndServe(RevHTTP):", err)
 					}
 				} else {
 					s := proxy.NewHTTP(ac)
 					s.AccountName = *account
-					s.Password = *proxyPassword
+					s.Password = password
 					s.Realm = *realm
-					if err := s.ListenAndServe(*httpService); err != nil {
+					s.Realms = hostRealms
+					s.AuthScheme = *authScheme
+					s.AccountCredentials = *accountCreds
+					s.Policy = policy
+					s.Audit = audit
+					s.ProxyProtocol = *proxyProtocol
+					s.TLVHeaders = tlvHeaders
+					s.AdminToken = *adminToken
+					s.AdminAddr = *adminService
+					s.Config = effectiveConfig(flag.CommandLine)
+					s.ShutdownTimeout = *httpDrain
+					s.ReadTimeout = *httpReadTO
+					s.WriteTimeout = *httpWriteTO
+					s.IdleTimeout = *httpIdleTO
+					s.MaxHeaderBytes = *httpMaxHdrLen
+					s.MaxHeaders = *httpMaxHdrs
+					s.RateLimit = proxy.RateLimit{Rate: *httpRate, Burst: *httpBurst}
+					s.AccessLog = accessLog
+					s.HealthStaleness = *healthzStale
+					svcs.add(serviceHTTP, s)
+					if *httpCert != "" {
+						if err := s.ListenAndServeTLS(*httpService, *httpCert, *httpKey); err != nil {
+							log.Println("ListenAndServeTLS(HTTP):", err)
+						}
+					} else if err := s.ListenAndServe(*httpService); err != nil {
 						log.Println("ListenAndServe(HTTP):", err)
 					}
 				}
@@ -140,24 +682,308 @@ func main() {
 			go func() {
 				s := proxy.NewSOCKS(ac)
 				s.AccountName = *account
+				s.ShutdownTimeout = *socksDrain
+				s.AdvertiseAddr = socksAdvertise
+				s.AllowSOCKS4 = *socks4
+				s.Password = password
+				s.Policy = policy
+				s.Audit = audit
+				s.ProxyProtocol = *proxyProtocol
+				svcs.add(serviceSOCKS, s)
 				if err := s.ListenAndServe(*socksService); err != nil {
 					log.Println("ListenAndServe(SOCKS):", err)
 				}
 				end <- struct{}{}
 			}()
 		}
-		if *dnsService != "" {
+		if *tlsPassSvc != "" {
 			go func() {
-				s := dns.New(ac)
-				s.AccountName = *account
-				s.NameServer = *nameServer
-				s.FakeMX = *fakeMX
-				if err := s.ListenAndServe(*dnsService); err != nil {
-					log.Println("ListenAndServe(DNS):", err)
+				if *account == "" {
+					log.Println("ListenAndServe(TLSPassthrough): -account is required")
+				} else {
+					s := proxy.NewTLSPassthrough(ac, *account)
+					s.ShutdownTimeout = *socksDrain
+					s.Policy = policy
+					s.Audit = audit
+					s.ProxyProtocol = *proxyProtocol
+					s.LogHandshake = *tlsPassLog
+					svcs.add(serviceTLSPassthrough, s)
+					if err := s.ListenAndServe(*tlsPassSvc); err != nil {
+						log.Println("ListenAndServe(TLSPassthrough):", err)
+					}
 				}
 				end <- struct{}{}
 			}()
 		}
+		if *dnsService != "" || *dnsTLSService != "" {
+			s := dns.New(ac)
+			s.AccountName = *account
+			s.NameServer = *nameServer
+			s.FakeMX = *fakeMX
+			s.ShutdownTimeout = *dnsDrain
+			s.ReadBuffer = *dnsRcvBuf
+			s.WriteBuffer = *dnsSndBuf
+			s.CacheSize = *dnsCache
+			s.ServeStale = *dnsServeStale
+			s.CacheOrder = *dnsCacheOrder
+			s.AnyMode = *dnsAnyMode
+			s.ClientSubnet = *dnsECS
+			s.FollowCNAME = *dnsFollowCN
+			s.Unresolvable = *dnsUnresolv
+			s.TTLJitter = *dnsTTLJitter
+			s.ForwardOnMissingAccount = *dnsFwdMissing
+			s.Debug = *dnsDebug
+			s.DebugRoute = *dnsDebugRoute
+			svcs.add(serviceDNS, s)
+			if *dnsService != "" {
+				go func() {
+					if err := s.ListenAndServe(*dnsService); err != nil {
+						log.Println("ListenAndServe(DNS):", err)
+					}
+					end <- struct{}{}
+				}()
+			}
+			if *dnsTLSService != "" {
+				go func() {
+					if err := s.ListenAndServeTLS(*dnsTLSService, reloader.TLSConfig()); err != nil {
+						log.Println("ListenAndServeTLS(DNS):", err)
+					}
+					end <- struct{}{}
+				}()
+			}
+		}
 	}()
 	<-end
+	svcs.shutdown()
+}
+
+// parseHostMap は -realms のような "ホスト名=値" をカンマ区切りで並べた s を解釈する。ホスト名は小文字に揃える。
+func parseHostMap(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	m := make(map[string]string)
+	for _, v := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid format: %q", v)
+		}
+		m[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+	return m, nil
+}
+
+// passwordEnv は -password の代わりにプロキシーのパスワードを指定する環境変数名。
+const passwordEnv = "DOCKERNS_PASSWORD"
+
+// loadPassword はプロキシーのパスワードを file、環境変数 passwordEnv、flagValue の順に探して返す。
+// file の内容は末尾の改行を取り除いて使用する。getenv には環境変数を取得する関数を渡す。
+func loadPassword(flagValue, file string, getenv func(string) string) (string, error) {
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	if v := getenv(passwordEnv); v != "" {
+		return v, nil
+	}
+	return flagValue, nil
+}
+
+// parseAdvertiseAddr は "IP アドレス" もしくは "IP アドレス:ポート番号" の形式の s を解釈する。
+// ポート番号を省略した場合は 0 になる。s が空の場合は nil を返す。
+func parseAdvertiseAddr(s string) (*net.TCPAddr, error) {
+	if s == "" {
+		return nil, nil
+	}
+	host, port := s, "0"
+	if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil {
+		host = ip.String()
+	} else {
+		var err error
+		if host, port, err = net.SplitHostPort(s); err != nil {
+			return nil, err
+		}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %q", host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, fmt.Errorf("invalid port: %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+// parseTLVHeaders は "TLV の名前=ヘッダー名" をカンマ区切りで並べた s を解釈する。
+func parseTLVHeaders(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	headers := make(map[string]string)
+	for _, v := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid format: %q", v)
+		}
+		known := false
+		for _, name := range proxy.ProxyTLVNames {
+			if kv[0] == name {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown TLV name: %q", kv[0])
+		}
+		headers[kv[0]] = kv[1]
+	}
+	return headers, nil
+}
+
+// effectiveConfig は fs の全てのフラグの現在の値を返す。
+// パスワードやトークン、鍵などの秘密情報は値を伏せる。
+func effectiveConfig(fs *flag.FlagSet) map[string]string {
+	config := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if v != "" && isSecretFlag(f.Name) {
+			v = "[REDACTED]"
+		}
+		config[f.Name] = v
+	})
+	return config
+}
+
+// isSecretFlag はフラグ名 name が秘密情報を扱うものであれば true を返す。
+func isSecretFlag(name string) bool {
+	for _, s := range []string{"password", "token", "secret", "key"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// shutdowner は Shutdown による終了処理に対応したサーバー。
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// 終了時の順序を -shutdown-order で指定する際のサーバーの種類。
+const (
+	serviceDNS            = "dns"
+	serviceHTTP           = "http"
+	serviceSOCKS          = "socks"
+	serviceTLSPassthrough = "tls-passthrough"
+)
+
+// service は終了時に Shutdown を呼び出すサーバーとその種類。
+type service struct {
+	kind string
+	v    shutdowner
+}
+
+// services は起動したサーバーの一覧。
+type services struct {
+	m    sync.Mutex
+	list []service
+
+	// order は終了する順序。各段階に含まれる種類のサーバーを並行して終了し、全て完了してから次の段階に進む。
+	// どの段階にも含まれない種類のサーバーは最後にまとめて終了する。nil の場合は全てのサーバーを並行して終了する。
+	order [][]string
+}
+
+// add は終了時に Shutdown を呼び出す kind の種類のサーバーとして v を登録する。
+func (s *services) add(kind string, v shutdowner) {
+	s.m.Lock()
+	s.list = append(s.list, service{kind: kind, v: v})
+	s.m.Unlock()
+}
+
+// shutdown は登録されたサーバーの Shutdown を order の段階ごとに並行して呼び出し、全て完了するまで待機する。
+// 待機する時間はそれぞれのサーバーに設定された ShutdownTimeout に従う。
+// 各サーバーの Shutdown は新しい接続の受け付けを止めた上で処理中の接続の完了を待ち、時間切れになった接続を切断する。
+func (s *services) shutdown() {
+	s.m.Lock()
+	list := s.list
+	s.m.Unlock()
+
+	done := make(map[int]bool)
+	stages := append(append([][]string(nil), s.order...), nil)
+	for n, stage := range stages {
+		kinds := make(map[string]bool)
+		for _, kind := range stage {
+			kinds[kind] = true
+		}
+		var wg sync.WaitGroup
+		for i, svc := range list {
+			if done[i] || (n < len(stages)-1 && !kinds[svc.kind]) {
+				continue
+			}
+			done[i] = true
+			wg.Add(1)
+			go func(svc service) {
+				defer wg.Done()
+				if err := svc.v.Shutdown(context.Background()); err != nil {
+					log.Println("Shutdown("+svc.kind+"):", err)
+				}
+			}(svc)
+		}
+		wg.Wait()
+	}
+}
+
+// parseShutdownOrder は終了する順序を "," で区切った段階として並べた s を解釈する。
+// 同じ段階で並行して終了させるサーバーの種類は "+" で区切って並べる。s が空の場合は nil を返す。
+func parseShutdownOrder(s string) ([][]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var order [][]string
+	seen := make(map[string]bool)
+	for _, stage := range strings.Split(s, ",") {
+		var kinds []string
+		for _, kind := range strings.Split(stage, "+") {
+			kind = strings.TrimSpace(kind)
+			switch kind {
+			case serviceDNS, serviceHTTP, serviceSOCKS, serviceTLSPassthrough:
+			default:
+				return nil, fmt.Errorf("unknown service: %q", kind)
+			}
+			if seen[kind] {
+				return nil, fmt.Errorf("duplicate service: %q", kind)
+			}
+			seen[kind] = true
+			kinds = append(kinds, kind)
+		}
+		order = append(order, kinds)
+	}
+	return order, nil
+}
+
+// staticRoutes は環境変数 env のうち accounts.StaticRouteEnvPrefix から始まるものの値を、環境変数名の順に並べて返す。
+// 値が "アカウント名/接続先/キー=値" の形式になっていない場合は終了する。
+func staticRoutes(env []string) []string {
+	var names []string
+	values := make(map[string]string)
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], accounts.StaticRouteEnvPrefix) {
+			continue
+		}
+		if !strings.Contains(parts[1], "=") {
+			log.Fatalln("invalid static route:", parts[0])
+		}
+		names = append(names, parts[0])
+		values[parts[0]] = parts[1]
+	}
+	sort.Strings(names)
+	routes := make([]string, len(names))
+	for i, name := range names {
+		routes[i] = values[name]
+	}
+	return routes
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	fs := flag.NewFlagSet("dockerns", flag.ContinueOnError)
+	for _, name := range []string{"http", "password", "password-file", "etcd-password", "admin-token", "tls-key", "empty-password"} {
+		fs.String(name, "", "")
+	}
+	fs.Bool("reverse", false, "")
+	if err := fs.Parse([]string{
+		"-http=:8080", "-password=1234", "-password-file=/run/secrets/password", "-etcd-password=etcd",
+		"-admin-token=token", "-tls-key=/etc/dockerns/key.pem", "-reverse",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "http", want: ":8080"},
+		{name: "reverse", want: "true"},
+		{name: "password", want: "[REDACTED]"},
+		{name: "password-file", want: "[REDACTED]"},
+		{name: "etcd-password", want: "[REDACTED]"},
+		{name: "admin-token", want: "[REDACTED]"},
+		{name: "tls-key", want: "[REDACTED]"},
+		// 値が設定されていない秘密情報は、設定されていないことが分かるよう空のままにする。
+		{name: "empty-password", want: ""},
+	}
+	config := effectiveConfig(fs)
+	if len(config) != len(tests) {
+		t.Errorf("config = %v, want %d flags", config, len(tests))
+	}
+	for _, tt := range tests {
+		if got, ok := config[tt.name]; !ok || got != tt.want {
+			t.Errorf("config[%q] = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// recordShutdown は Shutdown の開始と完了を events に記録する shutdowner。
+type recordShutdown struct {
+	kind   string
+	m      *sync.Mutex
+	events *[]string
+}
+
+// Shutdown は shutdowner の実装。
+func (r recordShutdown) Shutdown(ctx context.Context) error {
+	r.record("start " + r.kind)
+	time.Sleep(20 * time.Millisecond)
+	r.record("end " + r.kind)
+	return nil
+}
+
+// record は events に e を追加する。
+func (r recordShutdown) record(e string) {
+	r.m.Lock()
+	*r.events = append(*r.events, e)
+	r.m.Unlock()
+}
+
+func TestShutdownOrder(t *testing.T) {
+	kinds := []string{serviceDNS, serviceHTTP, serviceSOCKS, serviceTLSPassthrough}
+	tests := []struct {
+		order string
+		// stages は終了する段階ごとのサーバーの種類。
+		stages [][]string
+		err    bool
+	}{
+		{order: "", stages: [][]string{kinds}},
+		{order: "dns", stages: [][]string{{serviceDNS}, {serviceHTTP, serviceSOCKS, serviceTLSPassthrough}}},
+		{order: "http+socks, dns", stages: [][]string{{serviceHTTP, serviceSOCKS}, {serviceDNS}, {serviceTLSPassthrough}}},
+		{order: "tls-passthrough,socks,http,dns", stages: [][]string{{serviceTLSPassthrough}, {serviceSOCKS}, {serviceHTTP}, {serviceDNS}}},
+		{order: "dns,smtp", err: true},
+		{order: "dns,http+dns", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			order, err := parseShutdownOrder(tt.order)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parseShutdownOrder = %v, want error", order)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var m sync.Mutex
+			var events []string
+			s := &services{order: order}
+			for _, kind := range kinds {
+				s.add(kind, recordShutdown{kind: kind, m: &m, events: &events})
+			}
+			s.shutdown()
+
+			// 各段階のサーバーは全て開始してから完了し、次の段階は前の段階が全て完了してから開始する。
+			stage := make(map[string]int)
+			for n, st := range tt.stages {
+				for _, kind := range st {
+					stage[kind] = n
+				}
+			}
+			if len(events) != 2*len(kinds) {
+				t.Fatalf("events = %v", events)
+			}
+			pos := 0
+			for _, st := range tt.stages {
+				got := map[string]bool{}
+				for _, e := range events[pos : pos+2*len(st)] {
+					kind := strings.Fields(e)[1]
+					if stage[kind] != stage[st[0]] {
+						t.Fatalf("events = %v, want stages %v", events, tt.stages)
+					}
+					got[e] = true
+				}
+				for _, kind := range st {
+					if !got["start "+kind] || !got["end "+kind] {
+						t.Fatalf("events = %v, want stages %v", events, tt.stages)
+					}
+				}
+				for _, e := range events[pos : pos+len(st)] {
+					if !strings.HasPrefix(e, "start ") {
+						t.Errorf("events = %v, stage %v is not shut down concurrently", events, st)
+					}
+				}
+				pos += 2 * len(st)
+			}
+		})
+	}
+}
+
+func TestLoadPassword(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "password")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	crlf := filepath.Join(dir, "password-crlf")
+	if err := os.WriteFile(crlf, []byte("from-file\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		flag string
+		file string
+		env  string
+		want string
+		err  bool
+	}{
+		{name: "flag", flag: "from-flag", want: "from-flag"},
+		{name: "env", flag: "from-flag", env: "from-env", want: "from-env"},
+		{name: "file", flag: "from-flag", file: file, env: "from-env", want: "from-file"},
+		{name: "file with crlf", file: crlf, want: "from-file"},
+		{name: "missing file", flag: "from-flag", file: filepath.Join(dir, "missing"), env: "from-env", err: true},
+		{name: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(key string) string {
+				if key == passwordEnv {
+					return tt.env
+				}
+				return ""
+			}
+			got, err := loadPassword(tt.flag, tt.file, getenv)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("loadPassword = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("loadPassword = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package metrics
+
+// Backend は Registry に登録されたメトリクスの更新を受け取る、statsd や OpenTelemetry などの外部の集計先。
+// labels はラベル名からラベルの値を引く対応表で、呼び出しの度に新しく作成されるため保持してもよい。
+// 各メソッドはメトリクスを更新した処理から同期的に呼び出されるため、時間のかかる処理は行わないこと。
+type Backend interface {
+	// AddCounter はカウンター name を n 増やしたことを通知する。
+	AddCounter(name string, labels map[string]string, n uint64)
+	// SetGauge はゲージ name の値が v になったことを通知する。
+	SetGauge(name string, labels map[string]string, v int64)
+	// Observe はヒストグラム name に観測値 v を加えたことを通知する。
+	Observe(name string, labels map[string]string, v float64)
+}
+
+// Nop は何もしない Backend。
+var Nop Backend = nop{}
+
+// nop は Nop の実装。
+type nop struct{}
+
+func (nop) AddCounter(name string, labels map[string]string, n uint64) {}
+func (nop) SetGauge(name string, labels map[string]string, v int64)    {}
+func (nop) Observe(name string, labels map[string]string, v float64)   {}
+
+// backendHolder は atomic.Value に nil を含む任意の Backend を格納するための入れ物。
+type backendHolder struct {
+	b Backend
+}
+
+// SetBackend は以降のメトリクスの更新を通知する Backend を設定する。
+// nil か Nop を指定した場合は通知しない。Prometheus のテキスト形式での出力は Backend に関わらず行われる。
+func (r *Registry) SetBackend(b Backend) {
+	if b == Nop {
+		b = nil
+	}
+	r.backend.Store(backendHolder{b})
+}
+
+// Backend は SetBackend で設定された Backend を返す。設定されていない場合は nil を返す。
+func (r *Registry) Backend() Backend {
+	h, _ := r.backend.Load().(backendHolder)
+	return h.b
+}
+
+// labelMap はラベル名 names とラベルの値 values から Backend に渡す対応表を作る。
+func labelMap(names, values []string) map[string]string {
+	m := make(map[string]string, len(names))
+	for i, name := range names {
+		m[name] = values[i]
+	}
+	return m
+}
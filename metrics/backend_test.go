@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// captureBackend は通知された更新を "種類 名前{ラベル} 値" の形式の文字列として記録する Backend。
+type captureBackend struct {
+	m       sync.Mutex
+	updates []string
+}
+
+// record は kind の種類のメトリクス name の更新を記録する。
+func (c *captureBackend) record(kind, name string, labels map[string]string, v interface{}) {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	c.m.Lock()
+	c.updates = append(c.updates, fmt.Sprintf("%s %s{%s} %v", kind, name, strings.Join(pairs, ","), v))
+	c.m.Unlock()
+}
+
+// AddCounter は Backend の実装。
+func (c *captureBackend) AddCounter(name string, labels map[string]string, n uint64) {
+	c.record("counter", name, labels, n)
+}
+
+// SetGauge は Backend の実装。
+func (c *captureBackend) SetGauge(name string, labels map[string]string, v int64) {
+	c.record("gauge", name, labels, v)
+}
+
+// Observe は Backend の実装。
+func (c *captureBackend) Observe(name string, labels map[string]string, v float64) {
+	c.record("histogram", name, labels, v)
+}
+
+func TestBackend(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend func(c *captureBackend) Backend
+		want    []string
+	}{
+		{
+			name:    "capture",
+			backend: func(c *captureBackend) Backend { return c },
+			want: []string{
+				"counter requests_total{kind=http} 1",
+				"counter requests_total{kind=socks} 3",
+				"gauge connections{} 5",
+				"gauge connections{} 3",
+				"histogram duration_seconds{} 0.25",
+			},
+		},
+		{name: "nop", backend: func(c *captureBackend) Backend { return Nop }},
+		{name: "nil", backend: func(c *captureBackend) Backend { return nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry()
+			c := &captureBackend{}
+			r.SetBackend(tt.backend(c))
+
+			r.Counter("requests_total", "", "kind").Inc("http")
+			r.Counter("requests_total", "", "kind").Add(3, "socks")
+			g := r.Gauge("connections", "")
+			g.Set(5)
+			g.Add(-2)
+			r.Histogram("duration_seconds", "", []float64{1}).Observe(0.25)
+
+			if got := strings.Join(c.updates, "\n"); got != strings.Join(tt.want, "\n") {
+				t.Errorf("updates = %q, want %q", c.updates, tt.want)
+			}
+			// Backend に関わらず Registry にも記録される。
+			if got := r.Counter("requests_total", "", "kind").Get("socks"); got != 3 {
+				t.Errorf("requests_total{kind=socks} = %d, want 3", got)
+			}
+		})
+	}
+}
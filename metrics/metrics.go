@@ -0,0 +1,370 @@
+// Package metrics は監視用のメトリクスを集計し、Prometheus のテキスト形式で出力する。
+// Registry.SetBackend で Backend を設定すると、statsd など Prometheus 以外の集計先にもメトリクスの更新を通知できる。
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default は既定のメトリクスの登録先。
+var Default = NewRegistry()
+
+// Registry はメトリクスの集合。
+// 登録されたメトリクスは Prometheus のテキスト形式で出力できるよう常に集計され、
+// SetBackend で Backend を設定した場合は全ての更新がその Backend にも通知される。
+type Registry struct {
+	m        sync.Mutex
+	families map[string]collector
+	backend  atomic.Value
+}
+
+// collector は Registry に登録されるメトリクス。
+type collector interface {
+	write(w io.Writer)
+}
+
+// NewRegistry は Registry を新規作成する。
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]collector),
+	}
+}
+
+// Counter は name という名前のカウンターを返す。
+// 既に同じ名前のカウンターが登録されている場合はそれを返す。
+// labels にはカウンターを分類するラベル名を指定する。
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if f, ok := r.families[name]; ok {
+		return f.(*Counter)
+	}
+	c := &Counter{newFamily(r, name, help, "counter", labels)}
+	r.families[name] = c
+	return c
+}
+
+// Gauge は name という名前のゲージを返す。
+// 既に同じ名前のゲージが登録されている場合はそれを返す。
+// labels にはゲージを分類するラベル名を指定する。
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if f, ok := r.families[name]; ok {
+		return f.(*Gauge)
+	}
+	g := &Gauge{newFamily(r, name, help, "gauge", labels)}
+	r.families[name] = g
+	return g
+}
+
+// Histogram は name という名前のヒストグラムを返す。
+// 既に同じ名前のヒストグラムが登録されている場合はそれを返す。
+// buckets には観測値を分類するバケットの上限を昇順で指定し、nil の場合は DefaultBuckets を使用する。
+// labels にはヒストグラムを分類するラベル名を指定する。
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if f, ok := r.families[name]; ok {
+		return f.(*Histogram)
+	}
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &Histogram{
+		r:       r,
+		name:    name,
+		help:    help,
+		buckets: append([]float64(nil), buckets...),
+		labels:  labels,
+		values:  make(map[string]*histogramSeries),
+	}
+	r.families[name] = h
+	return h
+}
+
+// ServeHTTP は登録された全てのメトリクスを Prometheus のテキスト形式で返す http.Handler の実装。
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// WriteTo は登録された全てのメトリクスを Prometheus のテキスト形式で w に書き込む。
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.m.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	families := make([]collector, 0, len(names))
+	for _, name := range names {
+		families = append(families, r.families[name])
+	}
+	r.m.Unlock()
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		f.write(cw)
+	}
+	if err := cw.w.Flush(); err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return cw.n, cw.err
+}
+
+// Counter はラベルの値ごとに集計される単調増加のカウンター。
+type Counter struct {
+	*family
+}
+
+// Inc はラベルの値が labels のカウンターを 1 増やす。
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add はラベルの値が labels のカウンターを n 増やす。
+func (c *Counter) Add(n uint64, labels ...string) {
+	atomic.AddUint64(&c.value(labels).n, n)
+	if b := c.r.Backend(); b != nil {
+		b.AddCounter(c.name, labelMap(c.labels, labels), n)
+	}
+}
+
+// Get はラベルの値が labels のカウンターの現在値を返す。
+func (c *Counter) Get(labels ...string) uint64 {
+	return c.get(labels)
+}
+
+// Gauge はラベルの値ごとに保持される、増減する値。
+type Gauge struct {
+	*family
+}
+
+// Set はラベルの値が labels のゲージを n にする。
+func (g *Gauge) Set(n int64, labels ...string) {
+	atomic.StoreUint64(&g.value(labels).n, uint64(n))
+	if b := g.r.Backend(); b != nil {
+		b.SetGauge(g.name, labelMap(g.labels, labels), n)
+	}
+}
+
+// Add はラベルの値が labels のゲージに n を加える。n には負の値も指定できる。
+// Backend には加えた後の値を通知する。
+func (g *Gauge) Add(n int64, labels ...string) {
+	v := atomic.AddUint64(&g.value(labels).n, uint64(n))
+	if b := g.r.Backend(); b != nil {
+		b.SetGauge(g.name, labelMap(g.labels, labels), int64(v))
+	}
+}
+
+// Get はラベルの値が labels のゲージの現在値を返す。
+func (g *Gauge) Get(labels ...string) int64 {
+	return int64(g.get(labels))
+}
+
+// DefaultBuckets は Histogram で buckets を省略した場合に使用する、秒単位の処理時間向けのバケット。
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram はラベルの値ごとに観測値をバケットに分類して数えるヒストグラム。
+type Histogram struct {
+	r       *Registry
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+	m       sync.Mutex
+	values  map[string]*histogramSeries
+}
+
+// histogramSeries はラベルの値の組み合わせ一つ分のヒストグラム。
+// counts[i] は buckets[i] 以下の観測値のうち、それより小さいバケットに含まれないものの数。
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe はラベルの値が labels のヒストグラムに観測値 v を加える。
+func (h *Histogram) Observe(v float64, labels ...string) {
+	if len(labels) != len(h.labels) {
+		panic(fmt.Sprintf("metrics: %s: expected %d label values, got %d", h.name, len(h.labels), len(labels)))
+	}
+	key := strings.Join(labels, "\xff")
+
+	h.m.Lock()
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogramSeries{
+			labels: append([]string(nil), labels...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+	h.m.Unlock()
+
+	if b := h.r.Backend(); b != nil {
+		b.Observe(h.name, labelMap(h.labels, labels), v)
+	}
+}
+
+// write はヒストグラムを Prometheus のテキスト形式で w に書き込む。バケットの数は累積値として出力する。
+func (h *Histogram) write(w io.Writer) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	names := append(append([]string(nil), h.labels...), "le")
+	for _, key := range keys {
+		s := h.values[key]
+		values := append(append([]string(nil), s.labels...), "")
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += s.counts[i]
+			values[len(values)-1] = strconv.FormatFloat(b, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, values), cumulative)
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels), s.count)
+	}
+}
+
+// family は同じ名前を持つメトリクスを、ラベルの値の組み合わせごとに保持する。
+// ゲージの値は 2 の補数として uint64 に格納する。
+type family struct {
+	r      *Registry
+	name   string
+	help   string
+	typ    string
+	labels []string
+	m      sync.Mutex
+	values map[string]*series
+}
+
+// series はラベルの値の組み合わせ一つ分の値。
+type series struct {
+	n      uint64 // 32 ビット環境でアトミックに操作できるよう先頭に置く。
+	labels []string
+}
+
+// newFamily は r に登録する family を新規作成する。typ には "counter" か "gauge" を指定する。
+func newFamily(r *Registry, name, help, typ string, labels []string) *family {
+	return &family{
+		r:      r,
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		values: make(map[string]*series),
+	}
+}
+
+// value は labels に対応する series を返す。存在しない場合は作成する。
+func (f *family) value(labels []string) *series {
+	if len(labels) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s: expected %d label values, got %d", f.name, len(f.labels), len(labels)))
+	}
+	key := strings.Join(labels, "\xff")
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	v, ok := f.values[key]
+	if !ok {
+		v = &series{labels: append([]string(nil), labels...)}
+		f.values[key] = v
+	}
+	return v
+}
+
+// get は labels に対応する値を返す。存在しない場合は 0 を返す。
+func (f *family) get(labels []string) uint64 {
+	f.m.Lock()
+	v, ok := f.values[strings.Join(labels, "\xff")]
+	f.m.Unlock()
+	if !ok {
+		return 0
+	}
+	return atomic.LoadUint64(&v.n)
+}
+
+// write はメトリクスを Prometheus のテキスト形式で w に書き込む。
+func (f *family) write(w io.Writer) {
+	f.m.Lock()
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, f.values[key])
+	}
+	f.m.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	for _, v := range values {
+		n := atomic.LoadUint64(&v.n)
+		if f.typ == "gauge" {
+			fmt.Fprintf(w, "%s%s %d\n", f.name, formatLabels(f.labels, v.labels), int64(n))
+		} else {
+			fmt.Fprintf(w, "%s%s %d\n", f.name, formatLabels(f.labels, v.labels), n)
+		}
+	}
+}
+
+// formatLabels は names と values を {name="value",...} の形式に整形する。
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// countWriter は書き込んだバイト数と最初に発生したエラーを記録する io.Writer。
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+// Write は io.Writer の実装。
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
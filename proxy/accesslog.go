@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessLogEntry はアクセスログに出力する一件分の内容で、JSON の一行として出力する。
+// Kind は "http"、"connect"、"upgrade" のいずれかで、RevHTTP の場合は "reverse" になる。
+// Host はクライアントが要求した接続先、Target はルーティング情報に従って差し替えた後の接続先。
+// Status はクライアントに返したステータスコードで、"upgrade" のように接続先からの応答をそのまま中継した場合は 0 になる。
+// BytesIn はクライアントから受け取ったリクエストのボディ(CONNECT などの中継では中継したデータ)のバイト数、
+// BytesOut はクライアントへ返したレスポンスのボディ(同)のバイト数。
+// Duration はリクエストを受け付けてからレスポンスを返し終える(中継の場合は接続が閉じられる)までの秒数。
+// TLVs は PROXY プロトコル v2 で受け付けた接続の場合に、ヘッダーに含まれていた TLV の名前(ProxyTLVNames を参照)と値。
+type accessLogEntry struct {
+	Time     time.Time         `json:"time"`
+	Kind     string            `json:"kind"`
+	Account  string            `json:"account"`
+	Client   string            `json:"client"`
+	Method   string            `json:"method"`
+	Host     string            `json:"host"`
+	Target   string            `json:"target"`
+	Status   int               `json:"status,omitempty"`
+	BytesIn  int64             `json:"bytesIn"`
+	BytesOut int64             `json:"bytesOut"`
+	Duration float64           `json:"duration"`
+	TLVs     map[string]string `json:"tlvs,omitempty"`
+}
+
+// accessLogKey は処理中のリクエストの accessLogEntry を context に保存する際のキー。
+type accessLogKey struct{}
+
+// accessLogFrom は ctx に保存された accessLogEntry を返す。アクセスログを出力しない場合は nil を返す。
+func accessLogFrom(ctx context.Context) *accessLogEntry {
+	e, _ := ctx.Value(accessLogKey{}).(*accessLogEntry)
+	return e
+}
+
+// route はアカウント名と差し替えた後の接続先を記録する。e が nil の場合は何もしない。
+func (e *accessLogEntry) route(account, target string) {
+	if e != nil {
+		e.Account, e.Target = account, target
+	}
+}
+
+// relayed はクライアントとの接続を中継した際のステータスコードと転送したバイト数を記録する。e が nil の場合は何もしない。
+func (e *accessLogEntry) relayed(status int, in, out int64) {
+	if e != nil {
+		e.Status, e.BytesIn, e.BytesOut = status, in, out
+	}
+}
+
+// accessLogMutex は複数のサーバーが同じ io.Writer にアクセスログを出力しても行が混ざらないようにする。
+var accessLogMutex sync.Mutex
+
+// beginAccessLog は w が nil でなければ req のアクセスログの記録を開始し、
+// ステータスコードとバイト数を数えるよう包んだ rw と req、リクエストの処理を終えた際に呼び出して w へ出力する関数を返す。
+// w が nil の場合は rw と req をそのまま返す。
+func beginAccessLog(w io.Writer, rw http.ResponseWriter, req *http.Request, kind, account string) (http.ResponseWriter, *http.Request, func()) {
+	if w == nil {
+		return rw, req, func() {}
+	}
+	e := &accessLogEntry{
+		Time:    time.Now(),
+		Kind:    kind,
+		Account: account,
+		Client:  req.RemoteAddr,
+		Method:  req.Method,
+		Host:    req.Host,
+	}
+	if req.URL.Host != "" {
+		e.Host = req.URL.Host
+	}
+	h := proxyHeaderFrom(req.Context())
+	for _, name := range ProxyTLVNames {
+		if v, ok := h.Value(name); ok {
+			if e.TLVs == nil {
+				e.TLVs = make(map[string]string)
+			}
+			e.TLVs[name] = v
+		}
+	}
+	sw := &statusWriter{ResponseWriter: rw}
+	req = req.WithContext(context.WithValue(req.Context(), accessLogKey{}, e))
+	var body *countReader
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &countReader{ReadCloser: req.Body}
+		req.Body = body
+	}
+
+	return sw, req, func() {
+		e.Duration = time.Since(e.Time).Seconds()
+		if !sw.hijacked {
+			e.Status = sw.status
+			if e.Status == 0 && sw.bytes > 0 {
+				e.Status = http.StatusOK
+			}
+			e.BytesOut = sw.bytes
+			if body != nil {
+				e.BytesIn = atomic.LoadInt64(&body.n)
+			}
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		accessLogMutex.Lock()
+		defer accessLogMutex.Unlock()
+		w.Write(append(b, '\n'))
+	}
+}
+
+// statusWriter はクライアントに返したステータスコードとボディのバイト数を記録する http.ResponseWriter。
+// ハイジャックされた場合はそれ以降の通信を数えないため、hijacked を true にする。
+type statusWriter struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+// WriteHeader は http.ResponseWriter の実装。
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= http.StatusOK {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write は http.ResponseWriter の実装。
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush は http.Flusher の実装。
+func (w *statusWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack は http.Hijacker の実装。
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c, buf, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return c, buf, err
+}
+
+// Unwrap は http.ResponseController が元の http.ResponseWriter を使用できるようにする。
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countReader は Read したバイト数を数える io.ReadCloser。
+// 転送先への送信は別の goroutine から行われることがあるため、n は atomic に操作する。
+type countReader struct {
+	io.ReadCloser
+	n int64
+}
+
+// Read は io.Reader の実装。
+func (r *countReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mimoto-xxxxxx/dockerns/accounts"
+)
+
+// registerAPI はプロキシーとして扱われないリクエストを処理する API のハンドラを登録する。
+func (s *HTTP) registerAPI() {
+	s.api.HandleFunc("/debug/accounts", s.admin(s.serveAccounts))
+	s.api.HandleFunc("/debug/config", s.admin(s.serveConfig))
+	s.api.HandleFunc("/debug/connections", s.admin(s.serveConnections))
+	s.api.HandleFunc("/debug/routes", s.admin(s.serveRoutes))
+	s.api.HandleFunc("/metrics", s.adminOptional(s.serveMetrics))
+	s.api.HandleFunc("/admin/routes", s.admin(s.serveAccountRoutes))
+	s.api.HandleFunc("/admin/reload", s.admin(s.serveReload))
+	s.api.HandleFunc("/healthz", s.serveHealthz)
+}
+
+// admin は AdminToken による認証を要求するハンドラを返す。
+// トークンは "Authorization: Bearer <token>" ヘッダーで渡す。
+// AdminToken が空の場合は管理用の API 自体を無効として 404 を返す。
+func (s *HTTP) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// adminOptional は AdminToken が設定されている場合のみトークンによる認証を要求するハンドラを返す。
+// 監視システムから取得する /metrics のように、AdminToken を設定しない構成でも提供する API に使用する。
+// その場合は AdminAddr で外部から到達できないアドレスに分離して公開範囲を制限する。
+func (s *HTTP) adminOptional(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminToken == "" {
+			h(w, r)
+			return
+		}
+		s.admin(h)(w, r)
+	}
+}
+
+// serveConfig は Config に設定された実行時の設定内容を JSON で返す。
+func (s *HTTP) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Config)
+}
+
+// serveConnections は中継中の CONNECT トンネルと SOCKS の接続の一覧を JSON で返す。
+func (s *HTTP) serveConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, activeConns.list())
+}
+
+// RouteInfo は /debug/routes と /admin/routes で返すルーティング情報。
+// LastMatch は最後にホスト名に一致した時刻で、Reload 以降一度も一致していない場合は省略される。
+type RouteInfo struct {
+	Account   string     `json:"account"`
+	Name      string     `json:"name"`
+	Priority  int        `json:"priority"`
+	Pattern   string     `json:"pattern"`
+	Host      string     `json:"host"`
+	Hosts     []string   `json:"hosts,omitempty"`
+	Weights   []int      `json:"weights,omitempty"`
+	Matches   uint64     `json:"matches"`
+	LastMatch *time.Time `json:"lastMatch,omitempty"`
+}
+
+// serveRoutes は全てのアカウントのルーティング情報を、一致した回数と最後に一致した時刻と共に JSON で返す。
+func (s *HTTP) serveRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	routes := []RouteInfo{}
+	for _, name := range s.accounts.List() {
+		if account := s.accounts.Get(name); account != nil {
+			routes = append(routes, routeInfos(account)...)
+		}
+	}
+	writeJSON(w, http.StatusOK, routes)
+}
+
+// serveAccountRoutes はクエリーパラメーター account で指定されたアカウントのルーティング情報を、評価される順に JSON で返す。
+// アカウントが存在しない場合は 404 を返す。
+func (s *HTTP) serveAccountRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("account")
+	if name == "" {
+		http.Error(w, "account is required", http.StatusBadRequest)
+		return
+	}
+	account := s.accounts.Get(name)
+	if account == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, routeInfos(account))
+}
+
+// serveReload はルーティング情報を直ちに再構築し、完了してから応答を返す。
+// 再構築に失敗した場合はエラーの内容を 500 で返し、それまでのルーティング情報を使い続ける。
+func (s *HTTP) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	log.Println("reload triggered by: admin API")
+	if err := s.accounts.Reload(); err != nil {
+		log.Println("admin reload:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Healthz は /healthz で返すルーティング情報の読み込みと変更の監視の状態。
+// LastSuccess と SinceLastSuccess は最後に Reload が成功した時刻とそこからの経過秒数で、一度も成功していない場合は省略される。
+// EtcdWatching と DockerWatching は etcd や Docker Remote API を使用しない設定の場合は省略される。
+type Healthz struct {
+	Healthy          bool       `json:"healthy"`
+	ReloadSucceeded  bool       `json:"reloadSucceeded"`
+	ReloadError      string     `json:"reloadError,omitempty"`
+	LastSuccess      *time.Time `json:"lastSuccess,omitempty"`
+	SinceLastSuccess *float64   `json:"sinceLastSuccess,omitempty"`
+	EtcdWatching     *bool      `json:"etcdWatching,omitempty"`
+	DockerWatching   *bool      `json:"dockerWatching,omitempty"`
+	Accounts         int        `json:"accounts"`
+}
+
+// serveHealthz はルーティング情報の読み込みと変更の監視の状態を JSON で返す。
+// 最後の Reload が失敗している場合や、最後に成功してから HealthStaleness 以上経過している場合は 503 を返す。
+// ロードバランサーなどからの死活監視に使用するため、AdminToken による認証は要求しない。
+func (s *HTTP) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st := s.accounts.Status()
+	h := Healthz{
+		ReloadSucceeded: st.ReloadSucceeded(),
+		ReloadError:     st.ReloadError,
+		EtcdWatching:    st.EtcdWatching,
+		DockerWatching:  st.DockerWatching,
+		Accounts:        st.Accounts,
+	}
+	h.Healthy = h.ReloadSucceeded
+	if !st.LastSuccess.IsZero() {
+		since := time.Since(st.LastSuccess)
+		sec := since.Seconds()
+		h.LastSuccess, h.SinceLastSuccess = &st.LastSuccess, &sec
+		if s.HealthStaleness > 0 && since >= s.HealthStaleness {
+			h.Healthy = false
+		}
+	}
+	status := http.StatusOK
+	if !h.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, h)
+}
+
+// routeInfos は account のルーティング情報を RouteInfo の一覧として返す。
+func routeInfos(account *accounts.Account) []RouteInfo {
+	routes := make([]RouteInfo, 0, len(account.Routes))
+	for _, route := range account.Routes {
+		info := RouteInfo{
+			Account:  account.Name,
+			Name:     route.Name,
+			Priority: route.Priority,
+			Pattern:  route.Pattern(),
+			Host:     route.Host,
+			Hosts:    route.Hosts,
+			Weights:  route.Weights,
+			Matches:  route.Matches(),
+		}
+		if t := route.LastMatch(); !t.IsZero() {
+			info.LastMatch = &t
+		}
+		routes = append(routes, info)
+	}
+	return routes
+}
+
+// serveAccounts は全てのアカウントについて、接続先への接続の成功・失敗回数と成功した割合を JSON で返す。
+func (s *HTTP) serveAccounts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := []DialStats{}
+	for _, name := range s.accounts.List() {
+		stats = append(stats, dialStats(name))
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// serveMetrics は Metrics に登録されたメトリクスを Prometheus のテキスト形式で返す。
+func (s *HTTP) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	s.Metrics.ServeHTTP(w, r)
+}
+
+// writeJSON は v を JSON として書き出す。
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
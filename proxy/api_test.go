@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		path   string
+		auth   string
+		status int
+	}{
+		{name: "metrics without token configured", path: "/metrics", status: http.StatusOK},
+		{name: "metrics with token", token: "secret", path: "/metrics", auth: "Bearer secret", status: http.StatusOK},
+		{name: "metrics with wrong token", token: "secret", path: "/metrics", auth: "Bearer wrong", status: http.StatusUnauthorized},
+		{name: "metrics without token", token: "secret", path: "/metrics", status: http.StatusUnauthorized},
+		{name: "healthz without token configured", path: "/healthz", status: http.StatusOK},
+		{name: "routes without token configured", path: "/debug/routes", status: http.StatusNotFound},
+		{name: "routes with token", token: "secret", path: "/debug/routes", auth: "Bearer secret", status: http.StatusOK},
+		{name: "routes without token", token: "secret", path: "/debug/routes", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewHTTP(newTestAccounts(t, `master/192.0.2.1/0.www=^www\.example\.com$`))
+			s.AdminToken = tt.token
+
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.path == "/metrics" && tt.status == http.StatusOK && !strings.Contains(rec.Body.String(), "# TYPE ") {
+				t.Errorf("metrics body = %q", rec.Body)
+			}
+		})
+	}
+}
+
+func TestDebugConfig(t *testing.T) {
+	s := NewHTTP(newTestAccounts(t))
+	s.AdminToken = "secret"
+	s.Config = map[string]string{"http": ":8080", "password": "[REDACTED]"}
+
+	tests := []struct {
+		method string
+		status int
+		body   string
+	}{
+		{method: "GET", status: http.StatusOK, body: `{"http":":8080","password":"[REDACTED]"}`},
+		{method: "POST", status: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/debug/config", nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.body != "" && strings.TrimSpace(rec.Body.String()) != tt.body {
+				t.Errorf("body = %s, want %s", rec.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestAdminAddr(t *testing.T) {
+	// freeAddr は空いているポートのアドレスを返す。
+	freeAddr := func() string {
+		ln := listenLocal(t)
+		defer ln.Close()
+		return ln.Addr().String()
+	}
+	proxyAddr, adminAddr := freeAddr(), freeAddr()
+
+	s := NewHTTP(newTestAccounts(t, `master/192.0.2.1/0.www=^www\.example\.com$`))
+	s.AdminToken = "secret"
+	s.AdminAddr = adminAddr
+	go s.ListenAndServe(proxyAddr)
+	defer s.Shutdown(context.Background())
+
+	// get は addr の path へ管理用のトークンを付けて要求し、ステータスコードを返す。
+	get := func(addr, path string) int {
+		req, _ := http.NewRequest("GET", "http://"+addr+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		var res *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if res, err = http.DefaultClient.Do(req); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	tests := []struct {
+		path  string
+		admin int
+		proxy int
+	}{
+		{path: "/healthz", admin: http.StatusOK, proxy: http.StatusNotFound},
+		{path: "/metrics", admin: http.StatusOK, proxy: http.StatusNotFound},
+		{path: "/debug/routes", admin: http.StatusOK, proxy: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if got := get(adminAddr, tt.path); got != tt.admin {
+			t.Errorf("admin %s: status = %d, want %d", tt.path, got, tt.admin)
+		}
+		if got := get(proxyAddr, tt.path); got != tt.proxy {
+			t.Errorf("proxy %s: status = %d, want %d", tt.path, got, tt.proxy)
+		}
+	}
+}
+
+func TestRoutesLastMatch(t *testing.T) {
+	s := NewHTTP(newTestAccounts(t,
+		`lastmatch/192.0.2.1/0.www=^www\.example\.com$`,
+		`lastmatch/192.0.2.2/0.api=^api\.example\.com$`,
+	))
+	s.AdminToken = "secret"
+
+	// routes は /debug/routes から lastmatch アカウントのルーティング情報を接続先ごとに取得する。
+	routes := func() map[string]RouteInfo {
+		req := httptest.NewRequest("GET", "/debug/routes", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		var all []RouteInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &all); err != nil {
+			t.Fatal(err)
+		}
+		ret := make(map[string]RouteInfo)
+		for _, info := range all {
+			if info.Account == "lastmatch" {
+				ret[info.Host] = info
+			}
+		}
+		return ret
+	}
+
+	before := routes()
+	if before["192.0.2.1"].LastMatch != nil || before["192.0.2.2"].LastMatch != nil {
+		t.Fatalf("lastMatch is reported before any match: %+v", before)
+	}
+	start := time.Now()
+	s.accounts.Get("lastmatch").Match("www.example.com")
+
+	after := routes()
+	www := after["192.0.2.1"]
+	if www.Matches != 1 || www.LastMatch == nil || www.LastMatch.Before(start) {
+		t.Errorf("www = %+v, want a lastMatch after %v", www, start)
+	}
+	if api := after["192.0.2.2"]; api.Matches != 0 || api.LastMatch != nil {
+		t.Errorf("api = %+v, want no lastMatch", api)
+	}
+}
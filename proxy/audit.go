@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"log"
+	"strconv"
+)
+
+// Audit はルーティング情報によって接続先が差し替えられた記録を残すための監査ログ。
+// アクセスログやデバッグログとは別に出力し、意図しないコンテナへの接続が起きていないかを後から調査するために使用する。
+// All が true の場合は接続先が変化しなかった接続も記録する。
+type Audit struct {
+	Logger *log.Logger
+	All    bool
+}
+
+// NewAudit は logger に出力する Audit を新規作成する。
+func NewAudit(logger *log.Logger) *Audit {
+	return &Audit{Logger: logger}
+}
+
+// record は kind の接続でクライアント client が要求した host が newHost に差し替えられたことを記録する。
+// a が nil の場合や、All が false で接続先が変化していない場合は何もしない。
+func (a *Audit) record(kind, account, client, host, newHost string) {
+	if a == nil || (!a.All && host == newHost) {
+		return
+	}
+	a.Logger.Println(
+		"kind="+kind,
+		"account="+strconv.Quote(account),
+		"client="+client,
+		"host="+strconv.Quote(host),
+		"target="+strconv.Quote(newHost),
+		"rewritten="+strconv.FormatBool(host != newHost),
+	)
+}
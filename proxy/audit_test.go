@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lineWriter は書き込まれた行を lines に送る io.Writer。
+type lineWriter chan string
+
+// Write は io.Writer の実装。
+func (w lineWriter) Write(b []byte) (int, error) {
+	w <- strings.TrimSuffix(string(b), "\n")
+	return len(b), nil
+}
+
+func TestAudit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	target := backend.Listener.Addr().String()
+
+	s := NewHTTP(newTestAccounts(t, `master/`+target+`/0.app=^app\.test(:\d+)?$`))
+	s.AccountName = "master"
+	addr := serveHTTP(t, s)
+
+	tests := []struct {
+		name string
+		all  bool
+		req  string
+		// want は監査ログに含まれるべき文字列で、空文字列の場合は何も記録されないことを確認する。
+		want []string
+	}{
+		{
+			name: "rewrite",
+			req:  "GET http://app.test/ HTTP/1.1\r\nHost: app.test\r\n\r\n",
+			want: []string{"kind=http", `account="master"`, `host="app.test"`, `target="` + target + `"`, "rewritten=true"},
+		},
+		{
+			name: "connect rewrite",
+			req:  "CONNECT app.test:443 HTTP/1.1\r\nHost: app.test:443\r\n\r\n",
+			want: []string{"kind=connect", `host="app.test:443"`, `target="` + target + `"`, "rewritten=true"},
+		},
+		{
+			name: "pass-through",
+			req:  "GET http://" + target + "/ HTTP/1.1\r\nHost: " + target + "\r\n\r\n",
+		},
+		{
+			name: "pass-through with all",
+			all:  true,
+			req:  "GET http://" + target + "/ HTTP/1.1\r\nHost: " + target + "\r\n\r\n",
+			want: []string{"kind=http", `host="` + target + `"`, `target="` + target + `"`, "rewritten=false"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := make(lineWriter, 4)
+			s.Audit = NewAudit(log.New(lines, "", 0))
+			s.Audit.All = tt.all
+			defer func() { s.Audit = nil }()
+
+			_, res := sendProxy(t, addr, tt.req)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", res.StatusCode)
+			}
+
+			select {
+			case line := <-lines:
+				if tt.want == nil {
+					t.Fatalf("unexpected audit: %s", line)
+				}
+				for _, w := range tt.want {
+					if !strings.Contains(line, w) {
+						t.Errorf("audit %q does not contain %q", line, w)
+					}
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.want != nil {
+					t.Fatal("not audited")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/mimoto-xxxxxx/dockerns/accounts"
+	"github.com/mimoto-xxxxxx/dockerns/metrics"
+)
+
+// dials はプロキシーの種類とアカウント、結果ごとの接続先への接続の試行回数。
+// 種類は dialKinds のいずれかで、リバースプロキシー("reverse")では接続先への接続を使い回すため、接続ではなく転送したリクエストごとに数える。
+var dials = metrics.Default.Counter(
+	"dockerns_proxy_dials_total",
+	"Number of upstream connection attempts by kind, account and outcome.",
+	"kind", "account", "outcome",
+)
+
+// dialKinds は接続先へ接続するプロキシーの種類。
+// "http" は HTTP プロキシーでのリクエストの転送で、それ以外は Connection.Kind と同じ。
+var dialKinds = []string{"http", "connect", "upgrade", "socks", "tls", "reverse"}
+
+// dials の結果のラベル。
+const (
+	dialSuccess = "success"
+	dialFailure = "failure"
+)
+
+// recordDial は kind のプロキシーでの account の接続先への接続の試行結果 err をメトリクスに記録する。
+func recordDial(kind, account string, err error) {
+	if err != nil {
+		dials.Inc(kind, account, dialFailure)
+	} else {
+		dials.Inc(kind, account, dialSuccess)
+	}
+}
+
+// DialStats はアカウントごとの接続先への接続の成功・失敗回数。
+// SuccessRatio は試行回数に対する成功回数の割合で、一度も試行していない場合は省略される。
+type DialStats struct {
+	Account      string   `json:"account"`
+	Successes    uint64   `json:"successes"`
+	Failures     uint64   `json:"failures"`
+	SuccessRatio *float64 `json:"successRatio,omitempty"`
+}
+
+// dialStats は account の接続先への接続の成功・失敗回数を、全ての種類のプロキシーについて合計して返す。
+func dialStats(account string) DialStats {
+	st := DialStats{Account: account}
+	for _, kind := range dialKinds {
+		st.Successes += dials.Get(kind, account, dialSuccess)
+		st.Failures += dials.Get(kind, account, dialFailure)
+	}
+	if total := st.Successes + st.Failures; total > 0 {
+		ratio := float64(st.Successes) / float64(total)
+		st.SuccessRatio = &ratio
+	}
+	return st
+}
+
+// PreDialFunc は接続先へ接続する直前に呼び出されるフック。
+// account はアカウント名、host は本来の接続先、newHost はルーティング情報やポリシーによって差し替えられた後の接続先。
+// 戻り値を実際の接続先として使用する。d の LocalAddr などを書き換えることで接続元のインターフェースなども変更できる。
+// エラーを返した場合は接続しない。
+// HTTP リクエストの転送では同じ接続先への接続が再利用されるため、リクエストごとに呼び出されるとは限らない。
+type PreDialFunc func(account, host, newHost string, d *net.Dialer) (string, error)
+
+// dialInfoKey は HTTP リクエストを転送する際の接続で PreDialFunc に渡す情報を context に保存する際のキー。
+type dialInfoKey struct{}
+
+// dialInfo は PreDialFunc に渡すアカウント名と本来の接続先、同時接続数の上限を確認するための一致したルーティング情報。
+type dialInfo struct {
+	account string
+	host    string
+	route   *accounts.Route
+}
+
+// dial は hook が指定されていればそれを適用した上で、newHost へ TCP で接続する。
+// 接続の成否は kind のプロキシーでの account の試行結果としてメトリクスに記録する。hook がエラーを返した場合は接続を試行していないため記録しない。
+func dial(ctx context.Context, hook PreDialFunc, timeout time.Duration, kind, account, host, newHost string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	if hook != nil {
+		var err error
+		if newHost, err = hook(account, host, newHost, d); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := d.DialContext(ctx, "tcp", newHost)
+	recordDial(kind, account, err)
+	return conn, err
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPreDial(t *testing.T) {
+	echo := listenEcho(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+
+	a := newTestAccounts(t,
+		`master/192.0.2.1:7/0.echo=^echo\.test(:\d+)?$`,
+		`master/192.0.2.2:80/0.web=^web\.test(:\d+)?$`,
+		`master/192.0.2.3:7/0.denied=^denied\.test(:\d+)?$`,
+	)
+
+	// hook はルーティング情報による接続先(到達できないアドレス)を実際に待ち受けているアドレスに差し替え、
+	// 呼び出された際の引数を calls に送る。
+	type call struct{ account, host, newHost string }
+	calls := make(chan call, 4)
+	hook := func(account, host, newHost string, d *net.Dialer) (string, error) {
+		calls <- call{account, host, newHost}
+		switch newHost {
+		case "192.0.2.1:7":
+			return echo, nil
+		case "192.0.2.2:80":
+			return backend.Listener.Addr().String(), nil
+		}
+		return "", errors.New("denied by hook")
+	}
+
+	tests := []struct {
+		name string
+		// run は接続先へ接続し、中継に成功したかを返す。
+		run  func(t *testing.T) bool
+		want call
+		ok   bool
+	}{
+		{
+			name: "connect",
+			run: func(t *testing.T) bool {
+				s := NewHTTP(a)
+				s.AccountName = "master"
+				s.PreDial = hook
+				c, res := sendProxy(t, serveHTTP(t, s), "CONNECT echo.test:443 HTTP/1.1\r\nHost: echo.test:443\r\n\r\n")
+				if res.StatusCode != http.StatusOK {
+					return false
+				}
+				c.Write([]byte("ping"))
+				b := make([]byte, 4)
+				_, err := io.ReadFull(c, b)
+				return err == nil && string(b) == "ping"
+			},
+			want: call{"master", "echo.test:443", "192.0.2.1:7"},
+			ok:   true,
+		},
+		{
+			name: "http",
+			run: func(t *testing.T) bool {
+				s := NewHTTP(a)
+				s.AccountName = "master"
+				s.PreDial = hook
+				_, res := sendProxy(t, serveHTTP(t, s), "GET http://web.test/ HTTP/1.1\r\nHost: web.test\r\n\r\n")
+				defer res.Body.Close()
+				b, _ := io.ReadAll(res.Body)
+				return res.StatusCode == http.StatusOK && string(b) == "backend"
+			},
+			want: call{"master", "web.test", "192.0.2.2:80"},
+			ok:   true,
+		},
+		{
+			name: "socks",
+			run: func(t *testing.T) bool {
+				s := NewSOCKS(a)
+				s.AccountName = "master"
+				s.PreDial = hook
+				ln := listenLocal(t)
+				go s.Serve(ln)
+				c, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+				return socksConnect(t, c, "", "", "echo.test", 443, socksCmdConnect) == socksReplySucceeded
+			},
+			want: call{"master", "echo.test:443", "192.0.2.1:7"},
+			ok:   true,
+		},
+		{
+			name: "hook error",
+			run: func(t *testing.T) bool {
+				s := NewHTTP(a)
+				s.AccountName = "master"
+				s.PreDial = hook
+				_, res := sendProxy(t, serveHTTP(t, s), "CONNECT denied.test:443 HTTP/1.1\r\nHost: denied.test:443\r\n\r\n")
+				return res.StatusCode == http.StatusOK
+			},
+			want: call{"master", "denied.test:443", "192.0.2.3:7"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok := tt.run(t); ok != tt.ok {
+				t.Errorf("relayed = %v, want %v", ok, tt.ok)
+			}
+			select {
+			case got := <-calls:
+				if got != tt.want {
+					t.Errorf("hook called with %+v, want %+v", got, tt.want)
+				}
+			default:
+				t.Error("hook not called")
+			}
+		})
+	}
+}
+
+func TestDialStats(t *testing.T) {
+	echo := listenEcho(t)
+	// 接続を拒否されるよう、一度 Listen したポートを閉じておく。
+	ln := listenLocal(t)
+	refused := ln.Addr().String()
+	ln.Close()
+
+	// カウンターは全体で共有されるため、他のテストと重ならないアカウント名を使用する。
+	s := NewHTTP(newTestAccounts(t,
+		`dialstats-ok/`+echo+`/0.echo=^echo\.test$`,
+		`dialstats-ok/_password=secret`,
+		`dialstats-ng/`+refused+`/0.echo=^echo\.test$`,
+		`dialstats-ng/_password=secret`,
+	))
+	s.AdminToken = "secret"
+	addr := serveHTTP(t, s)
+
+	// stats は /debug/accounts からアカウントごとの接続の成功・失敗回数を取得する。
+	stats := func() map[string]DialStats {
+		req := httptest.NewRequest("GET", "/debug/accounts", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		var all []DialStats
+		if err := json.Unmarshal(rec.Body.Bytes(), &all); err != nil {
+			t.Fatal(err)
+		}
+		ret := make(map[string]DialStats)
+		for _, st := range all {
+			ret[st.Account] = st
+		}
+		return ret
+	}
+
+	tests := []struct {
+		account             string
+		successes, failures uint64
+		ratio               float64
+	}{
+		{account: "dialstats-ok", successes: 1, ratio: 1},
+		{account: "dialstats-ng", failures: 1, ratio: 0},
+		{account: "dialstats-ok", successes: 2, ratio: 1},
+		{account: "dialstats-ng", failures: 2, ratio: 0},
+	}
+	if st := stats()["dialstats-ok"]; st.Successes != 0 || st.Failures != 0 || st.SuccessRatio != nil {
+		t.Fatalf("stats before any dial = %+v", st)
+	}
+	for i, tt := range tests {
+		_, res := sendProxy(t, addr, "CONNECT echo.test:443 HTTP/1.1\r\nHost: echo.test:443\r\nProxy-Authorization: "+basicAuth(tt.account, "secret")+"\r\n\r\n")
+		res.Body.Close()
+
+		st := stats()[tt.account]
+		if st.Successes != tt.successes || st.Failures != tt.failures {
+			t.Errorf("%d: %s: successes, failures = %d, %d, want %d, %d", i, tt.account, st.Successes, st.Failures, tt.successes, tt.failures)
+		}
+		if st.SuccessRatio == nil || *st.SuccessRatio != tt.ratio {
+			t.Errorf("%d: %s: successRatio = %v, want %v", i, tt.account, st.SuccessRatio, tt.ratio)
+		}
+	}
+}
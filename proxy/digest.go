@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mimoto-xxxxxx/dockerns/accounts"
+)
+
+// HTTP プロキシーの認証方式。
+const (
+	// AuthBasic は Basic 認証(RFC 7617)。
+	AuthBasic = "basic"
+	// AuthDigest は Digest 認証(RFC 7616)。アルゴリズムは MD5、qop は auth もしくは省略のみに対応する。
+	AuthDigest = "digest"
+)
+
+// nonceLifetime は Digest 認証で発行した nonce の有効期間。
+// 期限が切れた nonce で認証された場合は stale=true を付けて新しい nonce で認証をやり直させる。
+const nonceLifetime = 5 * time.Minute
+
+// errStaleNonce は Digest 認証の nonce の有効期間が切れていることを表す。
+var errStaleNonce = errors.New("stale nonce")
+
+// newNonceKey は nonce の署名に使用する鍵を生成する。
+func newNonceKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// newNonce は現在時刻を nonceKey で署名した nonce を発行する。
+// nonce は発行した時刻を含むため、サーバー側で発行済みの nonce を保持せずに有効期間を確認できる。
+func (s *HTTP) newNonce(now time.Time) string {
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(now.UnixNano()))
+	return hex.EncodeToString(ts[:]) + hex.EncodeToString(s.signNonce(ts[:]))
+}
+
+// signNonce は発行した時刻 ts の署名を返す。
+func (s *HTTP) signNonce(ts []byte) []byte {
+	mac := hmac.New(sha256.New, s.nonceKey)
+	mac.Write(ts)
+	return mac.Sum(nil)[:16]
+}
+
+// checkNonce は nonce が newNonce で発行したものであり、有効期間内であることを確認する。
+// 期限が切れている場合は errStaleNonce を返す。
+func (s *HTTP) checkNonce(nonce string, now time.Time) error {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 8+16 {
+		return fmt.Errorf("invalid nonce: %q", nonce)
+	}
+	if !hmac.Equal(b[8:], s.signNonce(b[:8])) {
+		return fmt.Errorf("invalid nonce: %q", nonce)
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(b[:8])))
+	if now.Sub(issued) > nonceLifetime {
+		return errStaleNonce
+	}
+	return nil
+}
+
+// authorizeDigest は "Proxy-Authorization: Digest" ヘッダーの値 credentials を検証し、
+// 成功した場合に該当するアカウント情報を返す。realm には認証を要求した際に通知したレルムを渡す。
+// パスワードはアカウントに設定されたものを優先し、無ければ s.Password を使用する。
+func (s *HTTP) authorizeDigest(credentials string, r *http.Request, realm string) (*accounts.Account, error) {
+	p := parseDigestParams(credentials)
+	for _, key := range []string{"username", "realm", "nonce", "uri", "response"} {
+		if _, ok := p[key]; !ok {
+			return nil, fmt.Errorf("digest parameter missing: %s", key)
+		}
+	}
+	if p["realm"] != realm {
+		return nil, fmt.Errorf("digest realm mismatch: %q", p["realm"])
+	}
+	if alg := p["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+		return nil, fmt.Errorf("unsupported digest algorithm: %q", alg)
+	}
+	if r.RequestURI != "" && p["uri"] != r.RequestURI {
+		return nil, fmt.Errorf("digest uri mismatch: %q", p["uri"])
+	}
+
+	a := s.accounts.Get(p["username"])
+	if a == nil {
+		return nil, fmt.Errorf("account not found")
+	}
+	// 有効期限の切れた nonce は、パスワードが正しい場合のみ stale として扱う。
+	nonceErr := s.checkNonce(p["nonce"], time.Now())
+	if nonceErr != nil && nonceErr != errStaleNonce {
+		return nil, nonceErr
+	}
+
+	// パスワードが設定されていない場合は Basic 認証と同様に確認しない。
+	if password := a.EffectivePassword(s.Password); password != "" {
+		ha1 := md5Hex(p["username"] + ":" + realm + ":" + password)
+		ha2 := md5Hex(r.Method + ":" + p["uri"])
+		var want string
+		switch p["qop"] {
+		case "auth":
+			want = md5Hex(ha1 + ":" + p["nonce"] + ":" + p["nc"] + ":" + p["cnonce"] + ":auth:" + ha2)
+		case "":
+			want = md5Hex(ha1 + ":" + p["nonce"] + ":" + ha2)
+		default:
+			return nil, fmt.Errorf("unsupported digest qop: %q", p["qop"])
+		}
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(p["response"])), []byte(want)) != 1 {
+			return nil, fmt.Errorf("password incorrect")
+		}
+	}
+	if nonceErr != nil {
+		return nil, nonceErr
+	}
+	return a, nil
+}
+
+// md5Hex は s の MD5 ハッシュを 16 進数の文字列で返す。
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseDigestParams は Digest 認証のヘッダーの `key=value, key="quoted value"` 形式のパラメーターを解釈する。
+// キーは小文字に揃える。
+func parseDigestParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			return params
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i = 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i < len(s) {
+				i++
+			}
+			value, s = b.String(), s[i:]
+		} else {
+			if i = strings.IndexByte(s, ','); i < 0 {
+				i = len(s)
+			}
+			value, s = strings.TrimSpace(s[:i]), s[i:]
+		}
+		params[key] = value
+	}
+}
+
+// digestUnauthorized は Digest 認証を要求する 407 のレスポンスを返す。
+// stale が true の場合は、nonce の有効期限が切れただけであることをクライアントに通知する。
+func (s *HTTP) digestUnauthorized(req *http.Request, realm string, stale bool) *http.Response {
+	challenge := "Digest realm=" + strconv.Quote(realm) +
+		`, qop="auth", algorithm=MD5, nonce="` + s.newNonce(time.Now()) + `"`
+	if stale {
+		challenge += ", stale=true"
+	}
+	msg := []byte("407 Proxy Authentication Required")
+	return &http.Response{
+		StatusCode: http.StatusProxyAuthRequired,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header: http.Header{
+			"Proxy-Authenticate": []string{challenge},
+			"Proxy-Connection":   []string{"close"},
+		},
+		Body:          io.NopCloser(bytes.NewReader(msg)),
+		ContentLength: int64(len(msg)),
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+)
+
+// headerLimits は user のアカウントに適用するヘッダーの合計サイズと個数の上限を返す。
+// アカウントに設定がない場合は HTTP.MaxHeaderBytes と HTTP.MaxHeaders を使用する。
+func (s *HTTP) headerLimits(user string) (maxBytes, maxCount int) {
+	maxBytes, maxCount = s.MaxHeaderBytes, s.MaxHeaders
+	if a := s.accounts.Get(user); a != nil {
+		if a.MaxHeaderBytes > 0 {
+			maxBytes = a.MaxHeaderBytes
+		}
+		if a.MaxHeaders > 0 {
+			maxCount = a.MaxHeaders
+		}
+	}
+	return
+}
+
+// setTLVHeaders は TLVHeaders に従って PROXY プロトコル v2 の TLV の値をリクエストヘッダーに設定する。
+func (s *HTTP) setTLVHeaders(r *http.Request) {
+	if len(s.TLVHeaders) == 0 {
+		return
+	}
+	h := proxyHeaderFrom(r.Context())
+	for name, header := range s.TLVHeaders {
+		r.Header.Del(header)
+		if v, ok := h.Value(name); ok {
+			r.Header.Set(header, v)
+		}
+	}
+}
+
+// exceedsHeaderLimit は h の合計サイズか個数が上限を超えている場合に true を返す。
+// 上限が 0 の場合は制限しない。
+func exceedsHeaderLimit(h http.Header, maxBytes, maxCount int) bool {
+	var size, count int
+	for k, vs := range h {
+		for _, v := range vs {
+			// "Key: Value\r\n" の形で送受信されるものとして数える。
+			size += len(k) + len(v) + 4
+			count++
+		}
+	}
+	return (maxBytes > 0 && size > maxBytes) || (maxCount > 0 && count > maxCount)
+}
+
+// checkResponseHeader は接続先からのレスポンスヘッダーが上限を超えていないか検証し、
+// 超えていた場合はレスポンスを破棄して 502 Bad Gateway を返す。
+func (s *HTTP) checkResponseHeader(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	user, ok := ctx.UserData.(string)
+	if r == nil || !ok {
+		return r
+	}
+	maxBytes, maxCount := s.headerLimits(user)
+	if !exceedsHeaderLimit(r.Header, maxBytes, maxCount) {
+		return r
+	}
+
+	s.Logger.Println("proxyHTTP: response header too large", "user:", user, "host:", ctx.Req.URL.Host)
+	r.Body.Close()
+	return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, "Bad Gateway")
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// basicAuth は Proxy-Authorization ヘッダーの Basic 認証の値を返す。
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestHeaderLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("large") != "" {
+			w.Header().Set("X-Large", strings.Repeat("x", 300))
+		}
+	}))
+	defer backend.Close()
+	target := backend.Listener.Addr().String()
+
+	s := NewHTTP(newTestAccounts(t,
+		`limited/`+target+`/0.www=^www\.test$`,
+		`limited/_password=secret`,
+		`limited/_max_header_bytes=256`,
+		`limited/_max_headers=8`,
+		`unlimited/`+target+`/0.www=^www\.test$`,
+		`unlimited/_password=secret`,
+	))
+	addr := serveHTTP(t, s)
+
+	tests := []struct {
+		name    string
+		account string
+		connect bool
+		headers string
+		path    string
+		want    int
+	}{
+		{name: "small request", account: "limited", path: "/", want: http.StatusOK},
+		{name: "large request", account: "limited", headers: "X-Large: " + strings.Repeat("x", 300) + "\r\n", path: "/", want: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "many headers", account: "limited", headers: strings.Repeat("X-Many: 1\r\n", 10), path: "/", want: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "large CONNECT", account: "limited", connect: true, headers: "X-Large: " + strings.Repeat("x", 300) + "\r\n", want: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "large response", account: "limited", path: "/?large=1", want: http.StatusBadGateway},
+		// 上限はアカウントごとに適用される。
+		{name: "other account large request", account: "unlimited", headers: "X-Large: " + strings.Repeat("x", 300) + "\r\n", path: "/", want: http.StatusOK},
+		{name: "other account large response", account: "unlimited", path: "/?large=1", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := "GET http://www.test" + tt.path + " HTTP/1.1\r\nHost: www.test\r\n"
+			if tt.connect {
+				req = "CONNECT www.test:443 HTTP/1.1\r\nHost: www.test:443\r\n"
+			}
+			req += "Proxy-Authorization: " + basicAuth(tt.account, "secret") + "\r\n" + tt.headers + "\r\n"
+			_, res := sendProxy(t, addr, req)
+			res.Body.Close()
+			if res.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+
+	"github.com/mimoto-xxxxxx/dockerns/accounts"
+)
+
+// errTooManyConns は接続先への同時接続数が上限に達しているため接続しなかったことを表す。
+var errTooManyConns = errors.New("too many connections to target")
+
+// connLimiter は接続先ごとの同時接続数を数える。
+type connLimiter struct {
+	m sync.Mutex
+	n map[string]int
+}
+
+// targetConns はプロキシー全体(全てのアカウント)での接続先ごとの同時接続数。
+var targetConns = &connLimiter{n: make(map[string]int)}
+
+// acquire は key への同時接続数が max 未満であれば 1 増やして true を返す。
+func (l *connLimiter) acquire(key string, max int) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.n[key] >= max {
+		return false
+	}
+	l.n[key]++
+	return true
+}
+
+// release は key への同時接続数を 1 減らす。
+func (l *connLimiter) release(key string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.n[key]--; l.n[key] <= 0 {
+		delete(l.n, key)
+	}
+}
+
+// acquireTarget は route に同時接続数の上限が設定されていれば、差し替えた後の接続先 target への接続枠を確保する。
+// 上限に達している場合は false を返す。確保できた場合は接続の終了時に返された関数を呼び出すこと。
+func acquireTarget(route *accounts.Route, target string) (func(), bool) {
+	if route == nil || route.MaxConns <= 0 {
+		return func() {}, true
+	}
+	if !targetConns.acquire(target, route.MaxConns) {
+		return nil, false
+	}
+	var once sync.Once
+	return func() { once.Do(func() { targetConns.release(target) }) }, true
+}
+
+// releaseConn は Close された時に release を呼び出す net.Conn。
+type releaseConn struct {
+	net.Conn
+	release func()
+}
+
+// Close は net.Conn の実装。
+func (c *releaseConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+// checkConnLimit は HTTP リクエストの転送で接続先への同時接続数が上限に達していたために接続できなかった場合、
+// 503 Service Unavailable を返す。それ以外の場合は r をそのまま返す。
+func (s *HTTP) checkConnLimit(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if r != nil || !errors.Is(ctx.Error, errTooManyConns) {
+		return r
+	}
+	s.Logger.Println("proxyHTTP: too many connections to target", "user:", ctx.UserData, "host:", ctx.Req.URL.Host)
+	res := goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusServiceUnavailable, "Service Unavailable")
+	res.Header.Set("Retry-After", "1")
+	return res
+}
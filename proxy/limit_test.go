@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMaxConns(t *testing.T) {
+	// Upgrade のリクエストには 101 を返して接続を保持し、/block へのリクエストは unblock が閉じられるまで応答しない。
+	unblock := make(chan struct{})
+	defer close(unblock)
+	entered := make(chan struct{}, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isUpgrade(r.Header) {
+			c, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+			io.Copy(io.Discard, c)
+			c.Close()
+			return
+		}
+		if r.URL.Path == "/block" {
+			entered <- struct{}{}
+			<-unblock
+		}
+	})
+	limited := httptest.NewServer(handler)
+	defer limited.Close()
+	other := httptest.NewServer(handler)
+	defer other.Close()
+
+	requests := map[string]func(host string) string{
+		"connect": func(host string) string {
+			return "CONNECT " + host + ":443 HTTP/1.1\r\nHost: " + host + ":443\r\n\r\n"
+		},
+		"upgrade": func(host string) string {
+			return "GET http://" + host + "/ HTTP/1.1\r\nHost: " + host + "\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n"
+		},
+		"http": func(host string) string {
+			return "GET http://" + host + "/block HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+		},
+	}
+	want := map[string]int{"connect": http.StatusOK, "upgrade": http.StatusSwitchingProtocols, "http": http.StatusOK}
+
+	for _, kind := range []string{"connect", "upgrade", "http"} {
+		t.Run(kind, func(t *testing.T) {
+			s := NewHTTP(newTestAccounts(t,
+				fmt.Sprintf(`master/%s/0.limited=^limited\.test(:\d+)?$`, limited.Listener.Addr()),
+				fmt.Sprintf(`master/%s/_max_conns=1`, limited.Listener.Addr()),
+				fmt.Sprintf(`master/%s/0.other=^other\.test(:\d+)?$`, other.Listener.Addr()),
+			))
+			s.AccountName = "master"
+			// 後続のテストに影響しないよう、接続が全て閉じられて接続枠が解放されるのを待つ。
+			t.Cleanup(func() {
+				s.proxy.Tr.CloseIdleConnections()
+				for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+					targetConns.m.Lock()
+					n := targetConns.n[limited.Listener.Addr().String()]
+					targetConns.m.Unlock()
+					if n == 0 {
+						return
+					}
+				}
+				t.Error("connection slots were not released")
+			})
+			addr := serveHTTP(t, s)
+
+			// 1 本目は上限内なので接続できる。HTTP の場合は応答を返さずに接続を使用中のままにする。
+			first, done := make(chan *http.Response, 1), make(chan struct{})
+			var c1 net.Conn
+			go func() {
+				defer close(done)
+				var res *http.Response
+				c1, res = sendProxy(t, addr, requests[kind]("limited.test"))
+				first <- res
+			}()
+			if kind == "http" {
+				<-entered
+			} else if res := <-first; res.StatusCode != want[kind] {
+				t.Fatalf("first: status = %d, want %d", res.StatusCode, want[kind])
+			}
+
+			// 2 本目は上限に達しているため拒否される。
+			if _, res := sendProxy(t, addr, requests[kind]("limited.test")); res.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("second: status = %d, want %d", res.StatusCode, http.StatusServiceUnavailable)
+			}
+
+			// 上限の無い接続先には影響しない。
+			if kind == "http" {
+				if _, res := sendProxy(t, addr, "GET http://other.test/ HTTP/1.1\r\nHost: other.test\r\n\r\n"); res.StatusCode != http.StatusOK {
+					t.Errorf("other: status = %d, want %d", res.StatusCode, http.StatusOK)
+				}
+				unblock <- struct{}{}
+				<-first
+			} else if _, res := sendProxy(t, addr, requests[kind]("other.test")); res.StatusCode != want[kind] {
+				t.Errorf("other: status = %d, want %d", res.StatusCode, want[kind])
+			}
+
+			// 1 本目を閉じると再び接続できる。
+			<-done
+			c1.Close()
+			s.proxy.Tr.CloseIdleConnections()
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				req := requests[kind]("limited.test")
+				if kind == "http" {
+					req = "GET http://limited.test/ HTTP/1.1\r\nHost: limited.test\r\n\r\n"
+				}
+				_, res := sendProxy(t, addr, req)
+				if res.StatusCode == want[kind] {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("after close: status = %d, want %d", res.StatusCode, want[kind])
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
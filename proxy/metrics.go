@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"github.com/mimoto-xxxxxx/dockerns/metrics"
+)
+
+// requests はプロキシーの種類とアカウント、ルーティング情報に一致したかどうかごとの受け付けた要求の数。
+// 種類は HTTP プロキシーでの通常のリクエストの転送は "http"、CONNECT トンネルは "connect"、WebSocket などの中継は "upgrade" になる。
+// route は一致した場合は "matched"、一致せずに本来の接続先へそのまま中継した場合は "passthrough" になる。
+var requests = metrics.Default.Counter(
+	"dockerns_proxy_requests_total",
+	"Number of proxied requests by kind, account and whether a route matched.",
+	"kind", "account", "route",
+)
+
+// authFailures はプロキシーの種類ごとの認証に失敗した要求の数。
+// 存在しないアカウント名で大量のラベルが作られないよう、アカウントごとには数えない。
+var authFailures = metrics.Default.Counter(
+	"dockerns_proxy_auth_failures_total",
+	"Number of proxy requests rejected by authentication by kind.",
+	"kind",
+)
+
+// requestDuration は HTTP プロキシーでリクエストを受け付けてからレスポンスを返し終えるまでの時間。
+var requestDuration = metrics.Default.Histogram(
+	"dockerns_proxy_http_request_duration_seconds",
+	"Time taken to proxy plain HTTP requests in seconds.",
+	nil,
+)
+
+// countRequest は kind のプロキシーで account が受け付けた要求を、ルーティング情報に一致したかどうかと共に数える。
+func countRequest(kind, account string, matched bool) {
+	route := "passthrough"
+	if matched {
+		route = "matched"
+	}
+	requests.Inc(kind, account, route)
+}
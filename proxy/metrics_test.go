@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mimoto-xxxxxx/dockerns/metrics"
+)
+
+func TestRequestKind(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	target := backend.Listener.Addr().String()
+
+	// カウンターは全体で共有されるため、他のテストと重ならないアカウント名を使用する。
+	lines := make(lineWriter, 4)
+	s := NewHTTP(newTestAccounts(t, `requestkind/`+target+`/0.www=^www\.test$`))
+	s.AccountName = "requestkind"
+	s.AccessLog = lines
+	addr := serveHTTP(t, s)
+
+	tests := []struct {
+		name  string
+		req   string
+		kind  string
+		route string
+	}{
+		{name: "http", req: "GET http://www.test/ HTTP/1.1\r\nHost: www.test\r\n\r\n", kind: "http", route: "matched"},
+		{name: "connect", req: "CONNECT www.test:443 HTTP/1.1\r\nHost: www.test:443\r\n\r\n", kind: "connect", route: "matched"},
+		{name: "http passthrough", req: "GET http://" + target + "/ HTTP/1.1\r\nHost: " + target + "\r\n\r\n", kind: "http", route: "passthrough"},
+		{name: "connect passthrough", req: "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n", kind: "connect", route: "passthrough"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := map[string]uint64{}
+			for _, kind := range []string{"http", "connect"} {
+				before[kind] = requests.Get(kind, "requestkind", tt.route)
+			}
+
+			c, res := sendProxy(t, addr, tt.req)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", res.StatusCode)
+			}
+			// CONNECT のアクセスログはトンネルが閉じられた時点で出力される。
+			c.Close()
+
+			var e accessLogEntry
+			select {
+			case line := <-lines:
+				if err := json.Unmarshal([]byte(line), &e); err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no access log")
+			}
+			if e.Kind != tt.kind {
+				t.Errorf("access log kind = %q, want %q", e.Kind, tt.kind)
+			}
+			for _, kind := range []string{"http", "connect"} {
+				want := uint64(0)
+				if kind == tt.kind {
+					want = 1
+				}
+				if got := requests.Get(kind, "requestkind", tt.route) - before[kind]; got != want {
+					t.Errorf("%s/%s requests increased by %d, want %d", kind, tt.route, got, want)
+				}
+			}
+		})
+	}
+}
+
+// captureBackend は通知されたカウンターの増分とヒストグラムの観測回数を "名前{ラベル}" ごとに合計する metrics.Backend。
+type captureBackend struct {
+	m      sync.Mutex
+	counts map[string]uint64
+}
+
+// add は name のメトリクスの labels の系列に n を加える。
+func (c *captureBackend) add(name string, labels map[string]string, n uint64) {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	c.m.Lock()
+	c.counts[name+"{"+strings.Join(pairs, ",")+"}"] += n
+	c.m.Unlock()
+}
+
+// get は key の系列の合計を返す。
+func (c *captureBackend) get(key string) uint64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.counts[key]
+}
+
+// AddCounter は metrics.Backend の実装。
+func (c *captureBackend) AddCounter(name string, labels map[string]string, n uint64) {
+	c.add(name, labels, n)
+}
+
+// SetGauge は metrics.Backend の実装。
+func (c *captureBackend) SetGauge(name string, labels map[string]string, v int64) {}
+
+// Observe は metrics.Backend の実装。
+func (c *captureBackend) Observe(name string, labels map[string]string, v float64) {
+	c.add(name, labels, 1)
+}
+
+func TestMetricsBackend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	target := backend.Listener.Addr().String()
+
+	c := &captureBackend{counts: make(map[string]uint64)}
+	metrics.Default.SetBackend(c)
+	t.Cleanup(func() { metrics.Default.SetBackend(nil) })
+
+	s := NewHTTP(newTestAccounts(t, `backend/`+target+`/0.www=^www\.test$`))
+	s.AccountName = "backend"
+	addr := serveHTTP(t, s)
+
+	tests := []struct {
+		name string
+		req  string
+		// want は通知される系列ごとの合計。
+		want map[string]uint64
+	}{
+		{
+			name: "http",
+			req:  "GET http://www.test/ HTTP/1.1\r\nHost: www.test\r\n\r\n",
+			want: map[string]uint64{
+				"dockerns_proxy_requests_total{account=backend,kind=http,route=matched}":    1,
+				"dockerns_proxy_dials_total{account=backend,kind=http,outcome=success}":     1,
+				"dockerns_proxy_http_request_duration_seconds{}":                            1,
+				"dockerns_proxy_requests_total{account=backend,kind=connect,route=matched}": 0,
+			},
+		},
+		{
+			name: "connect",
+			req:  "CONNECT www.test:443 HTTP/1.1\r\nHost: www.test:443\r\n\r\n",
+			want: map[string]uint64{
+				"dockerns_proxy_requests_total{account=backend,kind=http,route=matched}":    1,
+				"dockerns_proxy_requests_total{account=backend,kind=connect,route=matched}": 1,
+				"dockerns_proxy_dials_total{account=backend,kind=connect,outcome=success}":  1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, res := sendProxy(t, addr, tt.req)
+			res.Body.Close()
+			conn.Close()
+			// レスポンスを返し終えてから記録されるメトリクスもあるため、揃うまで待つ。
+			deadline := time.Now().Add(time.Second)
+			for key, want := range tt.want {
+				for c.get(key) != want && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				if got := c.get(key); got != want {
+					t.Errorf("%s = %d, want %d", key, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Decision は Policy による判定結果を表す。
+type Decision string
+
+const (
+	// Allow はルーティング情報に従った接続を許可する。
+	Allow Decision = "allow"
+	// Deny は接続を拒否する。
+	Deny Decision = "deny"
+	// Rewrite は接続先を PolicyResult.Host に差し替えた上で接続を許可する。
+	Rewrite Decision = "rewrite"
+)
+
+// PolicyRequest は Policy に問い合わせる接続の情報。
+// Host は本来の接続先、NewHost はルーティング情報によって差し替えられた後の接続先。
+type PolicyRequest struct {
+	Account string `json:"account"`
+	Client  string `json:"client"`
+	Host    string `json:"host"`
+	NewHost string `json:"newHost"`
+}
+
+// PolicyResult は Policy による判定結果。
+// Decision が Rewrite の場合のみ Host が使用される。
+type PolicyResult struct {
+	Decision Decision `json:"decision"`
+	Host     string   `json:"host,omitempty"`
+}
+
+// Policy はプロキシーの接続を許可するかどうかを外部で判定するためのインターフェース。
+// Check がエラーを返した場合は接続を拒否する。
+type Policy interface {
+	Check(req *PolicyRequest) (*PolicyResult, error)
+}
+
+// HTTPPolicy は URL に PolicyRequest を JSON として POST し、
+// 返された JSON を PolicyResult として解釈する Policy。
+// FailOpen が true の場合はポリシーサーバーに到達できなかった時に接続を許可する。
+// 到達できたものの 200 以外の応答や解釈できない応答が返った場合は、FailOpen に関わらず接続を拒否する。
+type HTTPPolicy struct {
+	URL      string
+	FailOpen bool
+	Client   *http.Client
+}
+
+// NewHTTPPolicy は url に問い合わせる HTTPPolicy を新規作成する。
+func NewHTTPPolicy(url string) *HTTPPolicy {
+	return &HTTPPolicy{
+		URL:    url,
+		Client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// policyUnreachableError はポリシーサーバーとの通信自体に失敗したことを表す。
+type policyUnreachableError struct {
+	err error
+}
+
+func (e *policyUnreachableError) Error() string {
+	return "policy server unreachable: " + e.err.Error()
+}
+
+// Check は Policy の実装。
+func (p *HTTPPolicy) Check(req *PolicyRequest) (*PolicyResult, error) {
+	r, err := p.check(req)
+	if _, ok := err.(*policyUnreachableError); ok && p.FailOpen {
+		return &PolicyResult{Decision: Allow}, nil
+	}
+	return r, err
+}
+
+// check は URL に req を問い合わせる。通信自体に失敗した場合は *policyUnreachableError を返す。
+func (p *HTTPPolicy) check(req *PolicyRequest) (*PolicyResult, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.Client.Post(p.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, &policyUnreachableError{err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("policy server returned %s", res.Status)
+	}
+
+	var r PolicyResult
+	if err = json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// checkPolicy は p に問い合わせを行い、接続が許可された場合は最終的な接続先を返す。
+// p が nil の場合は newHost をそのまま返す。
+func checkPolicy(p Policy, account, client, host, newHost string) (string, error) {
+	if p == nil {
+		return newHost, nil
+	}
+
+	r, err := p.Check(&PolicyRequest{
+		Account: account,
+		Client:  client,
+		Host:    host,
+		NewHost: newHost,
+	})
+	if err != nil {
+		return "", fmt.Errorf("policy check failed: %v", err)
+	}
+
+	switch r.Decision {
+	case Allow:
+		return newHost, nil
+	case Rewrite:
+		if r.Host == "" {
+			return "", fmt.Errorf("policy returned rewrite without host")
+		}
+		return r.Host, nil
+	case Deny:
+		return "", fmt.Errorf("denied by policy")
+	}
+	return "", fmt.Errorf("unknown policy decision: %q", r.Decision)
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPPolicy(t *testing.T) {
+	backend := func(body string) *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+	routed, rewritten := backend("routed"), backend("rewritten")
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name     string
+		status   int
+		raw      string
+		result   PolicyResult
+		url      string
+		failOpen bool
+		want     int
+		body     string
+	}{
+		{name: "allow", result: PolicyResult{Decision: Allow}, want: http.StatusOK, body: "routed"},
+		{name: "deny", result: PolicyResult{Decision: Deny}, want: http.StatusForbidden},
+		{name: "rewrite", result: PolicyResult{Decision: Rewrite, Host: rewritten.Listener.Addr().String()}, want: http.StatusOK, body: "rewritten"},
+		{name: "rewrite without host", result: PolicyResult{Decision: Rewrite}, want: http.StatusForbidden},
+		{name: "unknown decision", result: PolicyResult{Decision: "maybe"}, want: http.StatusForbidden},
+		{name: "server error", status: http.StatusInternalServerError, want: http.StatusForbidden},
+		// 到達できたポリシーサーバーの異常な応答では FailOpen でも許可しない。
+		{name: "server error fail open", status: http.StatusInternalServerError, failOpen: true, want: http.StatusForbidden},
+		{name: "malformed fail open", raw: "not json", failOpen: true, want: http.StatusForbidden},
+		{name: "unknown decision fail open", result: PolicyResult{Decision: "maybe"}, failOpen: true, want: http.StatusForbidden},
+		{name: "unreachable", url: closed.URL, want: http.StatusForbidden},
+		{name: "unreachable fail open", url: closed.URL, failOpen: true, want: http.StatusOK, body: "routed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan PolicyRequest, 1)
+			endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req PolicyRequest
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					t.Error(err)
+				}
+				requests <- req
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+					return
+				}
+				if tt.raw != "" {
+					io.WriteString(w, tt.raw)
+					return
+				}
+				json.NewEncoder(w).Encode(tt.result)
+			}))
+			defer endpoint.Close()
+
+			policy := NewHTTPPolicy(endpoint.URL)
+			if tt.url != "" {
+				policy.URL = tt.url
+			}
+			policy.FailOpen = tt.failOpen
+
+			s := NewHTTP(newTestAccounts(t, `master/`+routed.Listener.Addr().String()+`/0.www=^www\.test$`))
+			s.AccountName = "master"
+			s.Policy = policy
+			_, res := sendProxy(t, serveHTTP(t, s), "GET http://www.test/ HTTP/1.1\r\nHost: www.test\r\n\r\n")
+			defer res.Body.Close()
+			b, _ := io.ReadAll(res.Body)
+			if res.StatusCode != tt.want || (tt.body != "" && string(b) != tt.body) {
+				t.Errorf("status, body = %d, %q, want %d, %q", res.StatusCode, b, tt.want, tt.body)
+			}
+
+			if tt.url != "" {
+				return
+			}
+			req := <-requests
+			want := PolicyRequest{Account: "master", Host: "www.test", NewHost: routed.Listener.Addr().String()}
+			req.Client = ""
+			if req != want {
+				t.Errorf("policy request = %+v, want %+v", req, want)
+			}
+		})
+	}
+}
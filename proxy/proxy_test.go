@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mimoto-xxxxxx/dockerns/accounts"
+)
+
+// newTestAccounts は routes を静的なルーティング情報(accounts.StaticRouteEnvPrefix を参照)として読み込んだ Accounts を返す。
+func newTestAccounts(t *testing.T, routes ...string) *accounts.Accounts {
+	t.Helper()
+	a := accounts.New("", "", "/proxy")
+	a.StaticRoutes = routes
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// listenEcho は受け取ったデータをそのまま送り返すサーバーを起動し、そのアドレスを返す。
+func listenEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// listenLocal は 127.0.0.1 の空いているポートで Listen する。
+func listenLocal(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+// serveHTTP は s を 127.0.0.1 の空いているポートで起動し、そのアドレスを返す。
+// ProxyProtocol が true の場合は ListenAndServe と同様に PROXY プロトコルのヘッダーを受け取る。
+func serveHTTP(t *testing.T, s *HTTP) string {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(s)
+	if s.ProxyProtocol {
+		ts.Listener = &proxyListener{Listener: ts.Listener}
+	}
+	ts.Config.ConnContext = withConn
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts.Listener.Addr().String()
+}
+
+// sendProxy は addr のプロキシーに接続して req をそのまま送信し、接続とレスポンスを返す。
+// 接続はテストの終了時に閉じられる。
+func sendProxy(t *testing.T, addr, req string) (net.Conn, *http.Response) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, err := io.WriteString(c, req); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, res
+}
+
+// policyFunc は関数を Policy として使用する。
+type policyFunc func(req *PolicyRequest) (*PolicyResult, error)
+
+// Check は Policy の実装。
+func (f policyFunc) Check(req *PolicyRequest) (*PolicyResult, error) {
+	return f(req)
+}
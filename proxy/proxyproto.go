@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolTimeout は PROXY プロトコルのヘッダーを読み込む際のタイムアウト。
+const proxyProtocolTimeout = 10 * time.Second
+
+// proxyV2Signature は PROXY プロトコル v2 のヘッダーの先頭 12 バイト。
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY プロトコル v2 の TLV の種類。
+const (
+	pp2TypeALPN                = 0x01
+	pp2TypeAuthority           = 0x02
+	pp2TypeUniqueID            = 0x05
+	pp2TypeAWS                 = 0xea
+	pp2SubtypeAWSVPCEndpointID = 0x01
+)
+
+// ProxyTLVNames は HTTP.TLVHeaders で指定できる TLV の名前の一覧。
+var ProxyTLVNames = []string{"alpn", "authority", "unique_id", "aws_vpce_id"}
+
+// proxyHeader は PROXY プロトコルのヘッダーから得られた情報。
+// Source はロードバランサーが受け付けた本来のクライアントのアドレスで、LOCAL コマンドの場合は nil。
+type proxyHeader struct {
+	Source net.Addr
+	TLVs   map[byte][]byte
+}
+
+// Value は name に対応する TLV の値を返す。
+// name には ProxyTLVNames のいずれかを指定する。
+func (h *proxyHeader) Value(name string) (string, bool) {
+	if h == nil {
+		return "", false
+	}
+	var v []byte
+	var ok bool
+	switch name {
+	case "alpn":
+		v, ok = h.TLVs[pp2TypeALPN]
+	case "authority":
+		v, ok = h.TLVs[pp2TypeAuthority]
+	case "unique_id":
+		v, ok = h.TLVs[pp2TypeUniqueID]
+	case "aws_vpce_id":
+		v, ok = h.TLVs[pp2TypeAWS]
+		if !ok || len(v) == 0 || v[0] != pp2SubtypeAWSVPCEndpointID {
+			return "", false
+		}
+		v = v[1:]
+	}
+	return string(v), ok
+}
+
+// proxyListener は Accept した接続の先頭から PROXY プロトコル(v1 / v2)のヘッダーを読み取る net.Listener。
+type proxyListener struct {
+	net.Listener
+}
+
+// Accept は net.Listener の実装。
+// ヘッダーの読み込みは Accept を止めないよう、最初に Read か RemoteAddr が呼ばれた時点で行う。
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn は PROXY プロトコルのヘッダーを取り除き、RemoteAddr として本来のクライアントのアドレスを返す net.Conn。
+// deadline は呼び出し側が設定した読み込みの期限で、ヘッダーを読み込んだ後に元に戻すために保存しておく。
+type proxyConn struct {
+	net.Conn
+	r        *bufio.Reader
+	once     sync.Once
+	header   *proxyHeader
+	err      error
+	m        sync.Mutex
+	deadline time.Time
+}
+
+// init はヘッダーを読み込む。
+// 読み込みの期限は proxyProtocolTimeout とするが、呼び出し側がそれより早い期限を設定している場合はそちらを使用する。
+// 読み込んだ後は呼び出し側が設定した期限に戻すため、http.Server の ReadTimeout などはヘッダーの読み込みを含めて適用される。
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.m.Lock()
+		deadline := time.Now().Add(proxyProtocolTimeout)
+		if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+			deadline = c.deadline
+		}
+		c.Conn.SetReadDeadline(deadline)
+		c.m.Unlock()
+
+		c.header, c.err = readProxyHeader(c.r)
+
+		c.m.Lock()
+		c.Conn.SetReadDeadline(c.deadline)
+		c.m.Unlock()
+		if c.err != nil {
+			c.err = fmt.Errorf("proxy protocol: %v", c.err)
+		}
+	})
+}
+
+// SetDeadline は net.Conn の実装。
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline は net.Conn の実装。
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Read は net.Conn の実装。
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr は net.Conn の実装。
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader は r から PROXY プロトコル v1 もしくは v2 のヘッダーを読み込む。
+func readProxyHeader(r *bufio.Reader) (*proxyHeader, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if len(sig) >= 6 && string(sig[:6]) == "PROXY " {
+		return readProxyHeaderV1(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("header not found")
+}
+
+// readProxyHeaderV1 はテキスト形式の v1 ヘッダーを読み込む。
+func readProxyHeaderV1(r *bufio.Reader) (*proxyHeader, error) {
+	// v1 のヘッダーは CRLF を含めて最大 107 バイト。
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s := strings.TrimSuffix(string(line), "\r\n")
+	if len(s) == len(line) {
+		return nil, fmt.Errorf("v1 header too long")
+	}
+
+	f := strings.Split(s, " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return &proxyHeader{}, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header: %q", s)
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid v1 header: %q", s)
+	}
+	return &proxyHeader{Source: &net.TCPAddr{IP: ip, Port: int(port)}}, nil
+}
+
+// readProxyHeaderV2 はバイナリ形式の v2 ヘッダーを読み込む。
+func readProxyHeaderV2(r *bufio.Reader) (*proxyHeader, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version: %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &proxyHeader{}
+	var addrLen int
+	switch hdr[13] >> 4 {
+	case 0x1: // AF_INET
+		addrLen = 12
+		if len(body) < addrLen {
+			return nil, fmt.Errorf("v2 address too short")
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+	case 0x2: // AF_INET6
+		addrLen = 36
+		if len(body) < addrLen {
+			return nil, fmt.Errorf("v2 address too short")
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+	case 0x3: // AF_UNIX
+		addrLen = 216
+	}
+	if addrLen > len(body) {
+		return nil, fmt.Errorf("v2 address too short")
+	}
+
+	// LOCAL コマンドはロードバランサー自身からの接続(ヘルスチェックなど)なので元のアドレスを使用する。
+	if hdr[12]&0x0f == 0x0 {
+		h.Source = nil
+	}
+
+	tlvs := body[addrLen:]
+	for len(tlvs) >= 3 {
+		l := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+l {
+			return nil, fmt.Errorf("v2 TLV too short")
+		}
+		if h.TLVs == nil {
+			h.TLVs = make(map[byte][]byte)
+		}
+		h.TLVs[tlvs[0]] = tlvs[3 : 3+l]
+		tlvs = tlvs[3+l:]
+	}
+	return h, nil
+}
+
+// connContextKey は http.Server.ConnContext で接続を保存する際のキー。
+type connContextKey struct{}
+
+// withConn は http.Server.ConnContext の実装で、ctx に c を保存する。
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// proxyHeaderFrom は ctx に保存された接続が PROXY プロトコルで受け付けたものであれば、そのヘッダーの情報を返す。
+// TLS で受け付けた接続の場合はその下の接続を調べる。
+func proxyHeaderFrom(ctx context.Context) *proxyHeader {
+	conn, _ := ctx.Value(connContextKey{}).(net.Conn)
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	c, ok := conn.(*proxyConn)
+	if !ok {
+		return nil
+	}
+	c.init()
+	return c.header
+}
@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// proxyV2Header は src からの接続を表す PROXY プロトコル v2 のヘッダーを作成する。
+// src が nil の場合は LOCAL コマンドのヘッダーを作成する。
+func proxyV2Header(src *net.TCPAddr, tlvs map[byte]string) []byte {
+	var body bytes.Buffer
+	cmd, family := byte(0x20), byte(0x00)
+	if src != nil {
+		cmd, family = 0x21, 0x11
+		body.Write(src.IP.To4())
+		body.Write([]byte{127, 0, 0, 1})
+		binary.Write(&body, binary.BigEndian, uint16(src.Port))
+		binary.Write(&body, binary.BigEndian, uint16(80))
+	}
+	for typ, v := range tlvs {
+		body.WriteByte(typ)
+		binary.Write(&body, binary.BigEndian, uint16(len(v)))
+		body.WriteString(v)
+	}
+
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	b.Write([]byte{cmd, family})
+	binary.Write(&b, binary.BigEndian, uint16(body.Len()))
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 4321}
+	tests := []struct {
+		name    string
+		in      []byte
+		source  string
+		values  map[string]string
+		wantErr bool
+	}{
+		{name: "v1", in: []byte("PROXY TCP4 203.0.113.5 127.0.0.1 4321 80\r\n"), source: "203.0.113.5:4321"},
+		{name: "v1 unknown", in: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 invalid", in: []byte("PROXY TCP4 nonsense\r\n"), wantErr: true},
+		{
+			name: "v2 with TLVs",
+			in: proxyV2Header(src, map[byte]string{
+				pp2TypeAuthority: "www.example.com",
+				pp2TypeAWS:       "\x01vpce-0123456789abcdef0",
+				pp2TypeUniqueID:  "abc",
+			}),
+			source: "203.0.113.5:4321",
+			values: map[string]string{
+				"authority":   "www.example.com",
+				"aws_vpce_id": "vpce-0123456789abcdef0",
+				"unique_id":   "abc",
+			},
+		},
+		{name: "v2 local", in: proxyV2Header(nil, map[byte]string{pp2TypeALPN: "h2"}), values: map[string]string{"alpn": "h2"}},
+		{name: "no header", in: []byte("GET / HTTP/1.1\r\n\r\n"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := readProxyHeader(bufio.NewReader(bytes.NewReader(tt.in)))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var source string
+			if h.Source != nil {
+				source = h.Source.String()
+			}
+			if source != tt.source {
+				t.Errorf("Source = %q, want %q", source, tt.source)
+			}
+			for _, name := range ProxyTLVNames {
+				want, wantOK := tt.values[name]
+				if got, ok := h.Value(name); got != want || ok != wantOK {
+					t.Errorf("Value(%q) = %q, %v, want %q, %v", name, got, ok, want, wantOK)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyConnDeadline(t *testing.T) {
+	header := []byte("PROXY TCP4 203.0.113.5 127.0.0.1 4321 80\r\n")
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		header   bool
+		data     time.Duration
+		timeout  bool
+	}{
+		// ヘッダーを読み込んだ後も呼び出し側が設定した期限が有効であること。
+		{name: "caller deadline is restored", deadline: 100 * time.Millisecond, header: true, timeout: true},
+		// 呼び出し側の期限がヘッダーの読み込みにも適用されること。
+		{name: "caller deadline applies to the header", deadline: 100 * time.Millisecond, timeout: true},
+		// 呼び出し側が期限を設定していない場合は、ヘッダーの読み込み後に期限が残らないこと。
+		{name: "no deadline", header: true, data: 200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			c := &proxyConn{Conn: server, r: bufio.NewReader(server)}
+			defer c.Close()
+			if tt.deadline > 0 {
+				c.SetReadDeadline(time.Now().Add(tt.deadline))
+			}
+
+			go func() {
+				if tt.header {
+					client.Write(header)
+				}
+				if tt.data > 0 {
+					time.Sleep(tt.data)
+					client.Write([]byte("x"))
+				}
+			}()
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := c.Read(make([]byte, 1))
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if (err != nil) != tt.timeout {
+					t.Fatalf("Read = %v, want timeout %v", err, tt.timeout)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Read did not return")
+			}
+		})
+	}
+}
+
+func TestProxyProtocolTLVHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Vpce-Id")+" "+r.Header.Get("X-Authority"))
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	s := NewHTTP(newTestAccounts(t, `master/127.0.0.1/0.backend=^backend\.test$`))
+	s.AccountName = "master"
+	s.ProxyProtocol = true
+	s.TLVHeaders = map[string]string{"aws_vpce_id": "X-Vpce-Id", "authority": "X-Authority"}
+	addr := serveHTTP(t, s)
+
+	tests := []struct {
+		name   string
+		tlvs   map[byte]string
+		header string
+		want   string
+	}{
+		{
+			name: "TLVs",
+			tlvs: map[byte]string{pp2TypeAWS: "\x01vpce-1", pp2TypeAuthority: "www.example.com"},
+			want: "vpce-1 www.example.com",
+		},
+		{name: "no TLVs", want: " "},
+		{name: "spoofed header", header: "X-Vpce-Id: spoofed\r\n", want: " "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.Write(proxyV2Header(&net.TCPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 4321}, tt.tlvs))
+			io.WriteString(c, "GET http://backend.test:"+port+"/ HTTP/1.1\r\nHost: backend.test:"+port+"\r\n"+tt.header+"Connection: close\r\n\r\n")
+
+			res, err := http.ReadResponse(bufio.NewReader(c), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			b, _ := io.ReadAll(res.Body)
+			if string(b) != tt.want {
+				t.Errorf("body = %q, want %q", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	lines := make(lineWriter, 4)
+	s := NewHTTP(newTestAccounts(t, `master/127.0.0.1/0.backend=^backend\.test$`))
+	s.AccountName = "master"
+	s.ProxyProtocol = true
+	s.AccessLog = lines
+	addr := serveHTTP(t, s)
+
+	tests := []struct {
+		name string
+		tlvs map[byte]string
+		want map[string]string
+	}{
+		{
+			name: "TLVs",
+			tlvs: map[byte]string{pp2TypeAWS: "\x01vpce-1", pp2TypeUniqueID: "conn-1"},
+			want: map[string]string{"aws_vpce_id": "vpce-1", "unique_id": "conn-1"},
+		},
+		{
+			name: "other AWS subtype",
+			tlvs: map[byte]string{pp2TypeAWS: "\x02other"},
+		},
+		{name: "no TLVs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.Write(proxyV2Header(&net.TCPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 4321}, tt.tlvs))
+			io.WriteString(c, "GET http://backend.test:"+port+"/ HTTP/1.1\r\nHost: backend.test:"+port+"\r\nConnection: close\r\n\r\n")
+			res, err := http.ReadResponse(bufio.NewReader(c), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			var e accessLogEntry
+			select {
+			case line := <-lines:
+				if err := json.Unmarshal([]byte(line), &e); err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no access log")
+			}
+			if e.Client != "203.0.113.5:4321" {
+				t.Errorf("client = %q, want %q", e.Client, "203.0.113.5:4321")
+			}
+			if !reflect.DeepEqual(e.TLVs, tt.want) {
+				t.Errorf("tlvs = %v, want %v", e.TLVs, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+
+	"github.com/mimoto-xxxxxx/dockerns/metrics"
+)
+
+// RateLimit はアカウントごとのリクエスト数の上限で、トークンバケットで制限する。
+// Rate は 1 秒あたりに補充されるリクエスト数で、0 の場合は制限しない。
+// Burst は連続して受け付けられるリクエスト数の上限で、0 の場合は Rate を切り上げた値(最低 1)を使用する。
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// capacity はバケットに貯められるトークンの上限を返す。
+func (l RateLimit) capacity() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// rateLimitSweepInterval は一杯になったバケットを削除する間隔。
+// 一杯になったバケットは新しく作ったものと区別が付かないため、削除しても制限の結果は変わらない。
+const rateLimitSweepInterval = time.Minute
+
+// rateLimited はプロキシーの種類とアカウントごとの、リクエスト数の上限を超えたために拒否した要求の数。
+var rateLimited = metrics.Default.Counter(
+	"dockerns_proxy_rate_limited_total",
+	"Number of proxy requests rejected by the per-account rate limit by kind and account.",
+	"kind", "account",
+)
+
+// rateLimitTokens はアカウントごとの、最後に要求を受け付けた時点でバケットに残っているトークンの数(切り捨て)。
+var rateLimitTokens = metrics.Default.Gauge(
+	"dockerns_proxy_rate_limit_tokens",
+	"Number of requests an account can still make without waiting, as of its last request.",
+	"account",
+)
+
+// rateLimitBuckets は保持しているバケットの数。
+var rateLimitBuckets = metrics.Default.Gauge(
+	"dockerns_proxy_rate_limit_buckets",
+	"Number of per-account rate limit buckets currently held.",
+)
+
+// tokenBucket はアカウント一つ分のトークンバケット。
+// limit は最後に使用した上限で、削除できるかどうかの判断に使用する。
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+// refill は last から now までの経過時間に応じてトークンを補充する。
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.limit.capacity(), b.tokens+elapsed*b.limit.Rate)
+	}
+	b.last = now
+}
+
+// rateLimiter はアカウント名ごとのトークンバケットの集合。
+type rateLimiter struct {
+	m       sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// newRateLimiter は rateLimiter を新規作成する。
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// allow は account のバケットからトークンを一つ取り出せれば true を返す。
+// 取り出せない場合は次のトークンが補充されるまでの時間を返す。limit.Rate が 0 以下の場合は常に true を返す。
+func (l *rateLimiter) allow(account string, limit RateLimit) (bool, time.Duration) {
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[account]
+	if !ok {
+		b = &tokenBucket{tokens: limit.capacity(), last: now, limit: limit}
+		l.buckets[account] = b
+		rateLimitBuckets.Set(int64(len(l.buckets)))
+	}
+	b.limit = limit
+	b.refill(now)
+
+	if b.tokens < 1 {
+		rateLimitTokens.Set(0, account)
+		return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	rateLimitTokens.Set(int64(b.tokens), account)
+	return true, 0
+}
+
+// sweep は前回から rateLimitSweepInterval 以上経過していれば、一杯になったバケットを削除する。
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < rateLimitSweepInterval {
+		return
+	}
+	l.swept = now
+	for account, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= b.limit.capacity() {
+			delete(l.buckets, account)
+			rateLimitTokens.Set(int64(b.tokens), account)
+		}
+	}
+	rateLimitBuckets.Set(int64(len(l.buckets)))
+}
+
+// rateLimit は user に適用するリクエスト数の上限を返す。
+// アカウントに個別の上限が設定されている場合はそちらを優先する。
+func (s *HTTP) rateLimit(user string) RateLimit {
+	limit := s.RateLimit
+	if a := s.accounts.Get(user); a != nil {
+		if a.RateLimit > 0 {
+			limit.Rate = a.RateLimit
+		}
+		if a.RateBurst > 0 {
+			limit.Burst = a.RateBurst
+		}
+	}
+	return limit
+}
+
+// checkRateLimit は kind の要求について user のリクエスト数の上限を確認し、超えている場合は 429 のレスポンスを返す。
+func (s *HTTP) checkRateLimit(r *http.Request, kind, user string) *http.Response {
+	ok, wait := s.limiter.allow(user, s.rateLimit(user))
+	if ok {
+		return nil
+	}
+	rateLimited.Inc(kind, user)
+	if s.accounts.VerboseFor(user) {
+		s.Logger.Println("kind:", kind, "user:", user, "host:", r.URL.Host, "rate limit exceeded")
+	}
+	res := goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusTooManyRequests, "Too Many Requests")
+	res.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return res
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection は中継中の接続の情報。
+// Kind は "connect" (HTTP の CONNECT トンネル)、"upgrade" (CONNECT を使わない WebSocket などの中継)、"socks"、"tls" (TLSPassthrough による中継) のいずれか。
+// Host はクライアントが要求した接続先、Target は実際の接続先。
+// BytesIn はクライアントから接続先へ、BytesOut は接続先からクライアントへ転送したバイト数。
+type Connection struct {
+	ID       uint64    `json:"id"`
+	Kind     string    `json:"kind"`
+	Account  string    `json:"account"`
+	Client   string    `json:"client"`
+	Host     string    `json:"host"`
+	Target   string    `json:"target"`
+	Start    time.Time `json:"start"`
+	BytesIn  int64     `json:"bytesIn"`
+	BytesOut int64     `json:"bytesOut"`
+}
+
+// activeConn は registry に登録された接続。
+type activeConn struct {
+	info     Connection
+	bytesIn  int64
+	bytesOut int64
+}
+
+// registry は中継中の接続の一覧。
+type registry struct {
+	m      sync.Mutex
+	lastID uint64
+	conns  map[uint64]*activeConn
+}
+
+// activeConns は HTTP と SOCKS の両方で共有される中継中の接続の一覧。
+var activeConns = &registry{conns: make(map[uint64]*activeConn)}
+
+// add は info を中継中の接続として登録する。
+func (r *registry) add(info Connection) *activeConn {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.lastID++
+	info.ID = r.lastID
+	info.Start = time.Now()
+	c := &activeConn{info: info}
+	r.conns[info.ID] = c
+	return c
+}
+
+// remove は c の登録を解除する。
+func (r *registry) remove(c *activeConn) {
+	r.m.Lock()
+	delete(r.conns, c.info.ID)
+	r.m.Unlock()
+}
+
+// list は中継中の接続の一覧を開始時刻の順に返す。
+func (r *registry) list() []Connection {
+	r.m.Lock()
+	ret := make([]Connection, 0, len(r.conns))
+	for _, c := range r.conns {
+		info := c.info
+		info.BytesIn = atomic.LoadInt64(&c.bytesIn)
+		info.BytesOut = atomic.LoadInt64(&c.bytesOut)
+		ret = append(ret, info)
+	}
+	r.m.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// countConn は Read したバイト数を n に加算する net.Conn。
+type countConn struct {
+	net.Conn
+	n *int64
+}
+
+// Read は net.Conn の実装。
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// relayActive は info を中継中の接続として登録した上で client と upstream の間を中継し、
+// 中継を終えた時点での BytesIn と BytesOut を返す。
+func relayActive(info Connection, client, upstream net.Conn) (in, out int64) {
+	c := activeConns.add(info)
+	defer activeConns.remove(c)
+	relay(&countConn{Conn: client, n: &c.bytesIn}, &countConn{Conn: upstream, n: &c.bytesOut})
+	return atomic.LoadInt64(&c.bytesIn), atomic.LoadInt64(&c.bytesOut)
+}
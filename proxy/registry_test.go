@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestActiveConnections(t *testing.T) {
+	echo := listenEcho(t)
+	_, p, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(p)
+
+	a := newTestAccounts(t, `master/`+echo+`/0.echo=^(connect|socks)\.test$`)
+	api := NewHTTP(a)
+	api.AdminToken = "secret"
+
+	// connections は /debug/connections から host への接続を探す。
+	connections := func(t *testing.T, host string) []Connection {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/debug/connections", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d", rec.Code)
+		}
+		var all, ret []Connection
+		if err := json.Unmarshal(rec.Body.Bytes(), &all); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range all {
+			if c.Host == host {
+				ret = append(ret, c)
+			}
+		}
+		return ret
+	}
+
+	tests := []struct {
+		kind string
+		host string
+		dial func(t *testing.T) net.Conn
+	}{
+		{
+			kind: "connect",
+			host: "connect.test:443",
+			dial: func(t *testing.T) net.Conn {
+				s := NewHTTP(a)
+				s.AccountName = "master"
+				c, res := sendProxy(t, serveHTTP(t, s), "CONNECT connect.test:443 HTTP/1.1\r\nHost: connect.test:443\r\n\r\n")
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("status = %d", res.StatusCode)
+				}
+				return c
+			},
+		},
+		{
+			kind: "socks",
+			host: "socks.test:" + p,
+			dial: func(t *testing.T) net.Conn {
+				s := NewSOCKS(a)
+				s.AccountName = "master"
+				ln := listenLocal(t)
+				go s.Serve(ln)
+				c, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { c.Close() })
+				if rep := socksConnect(t, c, "", "", "socks.test", port, socksCmdConnect); rep != socksReplySucceeded {
+					t.Fatalf("REP = %#x", rep)
+				}
+				return c
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			c := tt.dial(t)
+			if _, err := io.WriteString(c, "hello"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+				t.Fatal(err)
+			}
+
+			conns := connections(t, tt.host)
+			if len(conns) != 1 {
+				t.Fatalf("connections = %+v, want one to %s", conns, tt.host)
+			}
+			got := conns[0]
+			if got.Kind != tt.kind || got.Account != "master" || got.Target != echo || got.BytesIn != 5 || got.BytesOut != 5 {
+				t.Errorf("connection = %+v, want kind %s to %s with 5 bytes each way", got, tt.kind, echo)
+			}
+
+			// 接続を閉じると一覧から消える。
+			c.Close()
+			for deadline := time.Now().Add(5 * time.Second); len(connections(t, tt.host)) > 0; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("connection is still listed after it was closed")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"io"
+	"net"
+)
+
+// relay は a と b の間でデータを双方向に中継する。
+// 一方の方向で EOF を受け取った場合はハーフクローズ(CloseWrite)として相手側へ伝え、もう一方の方向の転送は続ける。
+// 両方向の転送が終了した時点、もしくはエラーなどでハーフクローズを伝えられなかった時点で両方の接続を閉じ、
+// もう一方の転送の終了を待ってから戻る。
+func relay(a, b net.Conn) {
+	done := make(chan bool, 2)
+	cp := func(dst, src net.Conn) {
+		_, err := io.Copy(dst, src)
+		done <- err == nil && closeWrite(dst)
+	}
+	go cp(a, b)
+	go cp(b, a)
+
+	halfClosed := <-done
+	if halfClosed {
+		<-done
+	}
+	a.Close()
+	b.Close()
+	if !halfClosed {
+		<-done
+	}
+}
+
+// closeWrite は c の送信方向のみを閉じる。c が対応していない場合は false を返す。
+// このパッケージで接続を包んでいる型は取り除いた上で元の接続に対して呼び出す。
+func closeWrite(c net.Conn) bool {
+	for {
+		switch v := c.(type) {
+		case interface{ CloseWrite() error }:
+			return v.CloseWrite() == nil
+		case *countConn:
+			c = v.Conn
+		case *releaseConn:
+			c = v.Conn
+		case *trackConn:
+			c = v.Conn
+		case *proxyConn:
+			c = v.Conn
+		case *peekedConn:
+			c = v.Conn
+		default:
+			return false
+		}
+	}
+}
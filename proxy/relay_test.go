@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRelayHalfClose(t *testing.T) {
+	// received には接続先が EOF までに受け取ったデータを送る。
+	received := make(chan string, 1)
+	tests := []struct {
+		name string
+		// server は接続先での処理。
+		server func(c *net.TCPConn)
+		// client は中継された接続 c での処理で、r から受け取ったデータを返す。
+		client func(t *testing.T, r io.Reader, c *net.TCPConn) string
+		// want はクライアントと接続先がそれぞれ受け取るデータ。
+		wantClient string
+		wantServer string
+	}{
+		{
+			// クライアントが送信を終えた後も、接続先からの応答を受け取れる。
+			name: "client half-close",
+			server: func(c *net.TCPConn) {
+				b, _ := io.ReadAll(c)
+				received <- string(b)
+				io.WriteString(c, "got "+strconv.Itoa(len(b))+" bytes")
+			},
+			client: func(t *testing.T, r io.Reader, c *net.TCPConn) string {
+				io.WriteString(c, "request")
+				if err := c.CloseWrite(); err != nil {
+					t.Fatal(err)
+				}
+				b, _ := io.ReadAll(r)
+				return string(b)
+			},
+			wantClient: "got 7 bytes",
+			wantServer: "request",
+		},
+		{
+			// 接続先が送信を終えた後も、クライアントからのデータを届けられる。
+			name: "server half-close",
+			server: func(c *net.TCPConn) {
+				io.WriteString(c, "greeting")
+				c.CloseWrite()
+				b, _ := io.ReadAll(c)
+				received <- string(b)
+			},
+			client: func(t *testing.T, r io.Reader, c *net.TCPConn) string {
+				b, _ := io.ReadAll(r)
+				io.WriteString(c, "reply after EOF")
+				c.CloseWrite()
+				return string(b)
+			},
+			wantClient: "greeting",
+			wantServer: "reply after EOF",
+		},
+	}
+
+	for _, kind := range []string{"socks", "connect"} {
+		for _, tt := range tests {
+			t.Run(kind+"/"+tt.name, func(t *testing.T) {
+				backend := listenLocal(t)
+				go func() {
+					c, err := backend.Accept()
+					if err != nil {
+						return
+					}
+					defer c.Close()
+					tt.server(c.(*net.TCPConn))
+				}()
+				_, p, _ := net.SplitHostPort(backend.Addr().String())
+				port, _ := strconv.Atoi(p)
+
+				a := newTestAccounts(t, `master/127.0.0.1/0.backend=^backend\.test(:\d+)?$`)
+				var c net.Conn
+				var r io.Reader
+				if kind == "socks" {
+					s := NewSOCKS(a)
+					s.AccountName = "master"
+					ln := listenLocal(t)
+					go s.Serve(ln)
+					var err error
+					if c, err = net.Dial("tcp", ln.Addr().String()); err != nil {
+						t.Fatal(err)
+					}
+					defer c.Close()
+					if rep := socksConnect(t, c, "", "", "backend.test", port, socksCmdConnect); rep != socksReplySucceeded {
+						t.Fatalf("reply = %#x", rep)
+					}
+					r = c
+				} else {
+					s := NewHTTP(a)
+					s.AccountName = "master"
+					var err error
+					if c, err = net.Dial("tcp", serveHTTP(t, s)); err != nil {
+						t.Fatal(err)
+					}
+					defer c.Close()
+					io.WriteString(c, "CONNECT backend.test:"+p+" HTTP/1.1\r\nHost: backend.test:"+p+"\r\n\r\n")
+					// 応答と共に読み込まれた接続先からのデータも受け取れるよう、以降も同じ bufio.Reader から読む。
+					br := bufio.NewReader(c)
+					res, err := http.ReadResponse(br, nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if res.StatusCode != http.StatusOK {
+						t.Fatalf("status = %d", res.StatusCode)
+					}
+					r = br
+				}
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+
+				if got := tt.client(t, r, c.(*net.TCPConn)); got != tt.wantClient {
+					t.Errorf("client received %q, want %q", got, tt.wantClient)
+				}
+				select {
+				case got := <-received:
+					if got != tt.wantServer {
+						t.Errorf("server received %q, want %q", got, tt.wantServer)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("server did not receive EOF")
+				}
+			})
+		}
+	}
+}
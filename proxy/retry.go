@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// retryTransport は接続先への接続に失敗した場合に RevHTTP.Retries の回数だけ再試行する http.RoundTripper。
+// 副作用が重複しないよう、GET / HEAD 以外のリクエストは再試行しない。
+type retryTransport struct {
+	r *RevHTTP
+}
+
+// RoundTrip は http.RoundTripper の実装。
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.roundTrip(req)
+	if err == nil || !isRetryable(req) {
+		return res, err
+	}
+
+	backoff := t.r.RetryBackoff
+	for i := 0; i < t.r.Retries && err != nil && isDialError(err); i++ {
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+
+		// コンテナの再起動などでアドレスが変わっている可能性があるため、接続先を求め直す。
+		retry := req.Clone(req.Context())
+		if target, ok := req.Context().Value(revTargetKey{}).(revTarget); ok {
+			_, newHost := t.r.match(target.account, target.host)
+			t.r.setHost(retry, target.host, newHost)
+			accessLogFrom(req.Context()).route(target.account, newHost)
+		}
+		t.r.Logger.Println("RevHTTP: retrying", req.Method, retry.URL.Host, "after:", err)
+		res, err = t.roundTrip(retry)
+	}
+	return res, err
+}
+
+// roundTrip は req を一度だけ転送し、接続先へ接続できたかどうかをメトリクスに記録する。
+// 接続の確立以外の理由で失敗した場合は記録しない。
+func (t *retryTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil || isDialError(err) {
+		target, _ := req.Context().Value(revTargetKey{}).(revTarget)
+		recordDial("reverse", target.account, err)
+	}
+	return res, err
+}
+
+// isRetryable は req が再試行しても副作用が重複しないリクエストであれば true を返す。
+func isRetryable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// isDialError は err が接続先への接続の確立に失敗したことを表す場合に true を返す。
+func isDialError(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
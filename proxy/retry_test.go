@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRevHTTPRetry(t *testing.T) {
+	tests := []struct {
+		method  string
+		body    string
+		want    int
+		reached bool
+	}{
+		{method: "GET", want: http.StatusOK, reached: true},
+		{method: "HEAD", want: http.StatusOK, reached: true},
+		{method: "POST", body: "data", want: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			// 接続先のポートを確保してから閉じ、最初の接続に失敗した後で待ち受けを始める。
+			ln := listenLocal(t)
+			target := ln.Addr().String()
+			ln.Close()
+
+			account := "retry-" + strings.ToLower(tt.method)
+			r := NewRevHTTP(newTestAccounts(t, account+`/`+target+`/0.www=^www\.test$`), account)
+			r.Retries = 3
+			r.RetryBackoff = 200 * time.Millisecond
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+
+			failures := dials.Get("reverse", account, dialFailure)
+			type result struct {
+				status int
+				err    error
+			}
+			done := make(chan result, 1)
+			go func() {
+				req, _ := http.NewRequest(tt.method, ts.URL+"/", strings.NewReader(tt.body))
+				if tt.body == "" {
+					req.Body = http.NoBody
+				}
+				req.Host = "www.test"
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					done <- result{err: err}
+					return
+				}
+				res.Body.Close()
+				done <- result{status: res.StatusCode}
+			}()
+
+			for dials.Get("reverse", account, dialFailure) == failures {
+				time.Sleep(10 * time.Millisecond)
+			}
+			ln, err := net.Listen("tcp", target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			received := make(chan string, 1)
+			backend := &httptest.Server{
+				Listener: ln,
+				Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					received <- r.Method
+				})},
+			}
+			backend.Start()
+			defer backend.Close()
+
+			res := <-done
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			if res.status != tt.want {
+				t.Errorf("status = %d, want %d", res.status, tt.want)
+			}
+			select {
+			case m := <-received:
+				if !tt.reached {
+					t.Errorf("%s reached the backend", m)
+				}
+			default:
+				if tt.reached {
+					t.Error("backend not reached")
+				}
+			}
+			if got := dials.Get("reverse", account, dialFailure) - failures; got != 1 {
+				t.Errorf("failed dials = %d, want 1", got)
+			}
+		})
+	}
+}
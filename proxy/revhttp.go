@@ -1,44 +1,251 @@
 package proxy
 
 import (
+	"context"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/mimoto-xxxxxx/dockerns/accounts"
 )
 
 // RevHTTP は HTTP リバースプロキシ。
+// ShutdownTimeout は Shutdown 時に処理中のリクエストの完了を待つ最大時間で、0 の場合は無制限に待つ。
+// ReadTimeout, WriteTimeout, IdleTimeout は http.Server の同名のフィールドに設定する時間で、0 の場合は http.Server と同じ扱いになる。
+// AccessLog を指定した場合は HTTP.AccessLog と同様にリクエストごとのアクセスログを出力する。
+// Scheme は接続先へ転送する際のスキームで、"http" (既定値) か "https" を指定する。
+// RewriteHost が true の場合は転送するリクエストの Host ヘッダーを差し替えた後の接続先に書き換え、
+// 元の Host ヘッダーを X-Forwarded-Host に設定する。false の場合はクライアントが送った Host ヘッダーをそのまま転送する。
+// X-Forwarded-For には httputil.ReverseProxy によってクライアントのアドレスが追加される。
+// AccountHosts はリクエストのホスト名から使用するアカウント名を引く対応表で、キーにはホスト名か、
+// サブドメインに一致させる場合は "*.example.com" の形式を指定する。
+// AccountFromLabel が true の場合は AccountHosts に一致しなかったホスト名の最初のラベル(tenant1.example.com の tenant1)を
+// アカウント名として使用する。どちらにも該当しない場合や、そのアカウントが存在しない場合は NewRevHTTP に渡したアカウントを使用する。
+// Retries は GET / HEAD リクエストで接続先への接続に失敗した場合に再試行する回数で、
+// 再試行の度にルーティング情報から接続先を求め直し、RetryBackoff から倍々に増える時間だけ待機する。
 type RevHTTP struct {
-	Logger *log.Logger
-	rp     *httputil.ReverseProxy
+	ShutdownTimeout  time.Duration
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	IdleTimeout      time.Duration
+	Retries          int
+	RetryBackoff     time.Duration
+	AccessLog        io.Writer
+	Scheme           string
+	RewriteHost      bool
+	AccountHosts     map[string]string
+	AccountFromLabel bool
+	Logger           *log.Logger
+	accounts         *accounts.Accounts
+	accountName      string
+	rp               *httputil.ReverseProxy
+	server           *http.Server
+	conns            *tracker
 }
 
 // NewRevHTTP は新しい HTTP リバースプロキシを作成する。
 func NewRevHTTP(accounts *accounts.Accounts, accountName string) *RevHTTP {
-	return &RevHTTP{
-		Logger: log.New(os.Stderr, "", log.LstdFlags),
-		rp: &httputil.ReverseProxy{
-			Director: func(req *http.Request) {
-				a := accounts.Get(accountName)
-				if a == nil {
-					req.URL.Host = "0.0.0.0"
-					return
-				}
-				req.URL.Host = a.Routes.ReplaceHost(req.URL.Host)
-				req.Header.Add("X-Real-IP", req.RemoteAddr)
-			},
+	r := &RevHTTP{
+		ShutdownTimeout: 10 * time.Second,
+		IdleTimeout:     defaultIdleTimeout,
+		RetryBackoff:    100 * time.Millisecond,
+		Scheme:          "http",
+		Logger:          log.New(os.Stderr, "", log.LstdFlags),
+		accounts:        accounts,
+		accountName:     accountName,
+		conns:           newTracker(),
+	}
+	r.rp = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			t := req.Context().Value(revTargetKey{}).(revTarget)
+			rewritePath(req.URL, t.route.StripPrefix, t.route.AddPrefix)
+			req.URL.Scheme = r.Scheme
+			r.setHost(req, t.host, t.newHost)
+			accessLogFrom(req.Context()).route(t.account, t.newHost)
+			req.Header.Add("X-Real-IP", req.RemoteAddr)
 		},
+		Transport: &retryTransport{r: r},
+	}
+	r.server = &http.Server{Handler: r}
+	return r
+}
+
+// account はリクエストのホスト名 host に対して使用するアカウント名を返す。
+func (r *RevHTTP) account(host string) string {
+	if name, ok := lookupHost(r.AccountHosts, host); ok {
+		return name
+	}
+	if r.AccountFromLabel {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		label := strings.ToLower(host)
+		if i := strings.Index(label, "."); i >= 0 {
+			label = label[:i]
+		}
+		if label != "" && r.accounts.Get(label) != nil {
+			return label
+		}
+	}
+	return r.accountName
+}
+
+// match は account のルーティング情報から host に一致するものと、それに従って差し替えた後のホストを返す。
+// アカウントが見つからない場合は空文字列を返すため、その接続先への転送は失敗する。
+// 通常は ServeHTTP でアカウントの有無を確認してから呼び出される。
+func (r *RevHTTP) match(account, host string) (*accounts.Route, string) {
+	a := r.accounts.Get(account)
+	if a == nil {
+		return nil, ""
+	}
+	return a.Match(host)
+}
+
+// setHost は転送するリクエスト req の接続先を newHost にし、RewriteHost が true の場合は Host ヘッダーも書き換える。
+// host はクライアントが要求した、差し替える前のホスト。
+func (r *RevHTTP) setHost(req *http.Request, host, newHost string) {
+	req.URL.Host = newHost
+	if r.RewriteHost {
+		req.Host = newHost
+		req.Header.Set("X-Forwarded-Host", host)
 	}
 }
 
+// revTargetKey は ServeHTTP で求めた接続先を Director に渡すために context に保存する際のキー。
+type revTargetKey struct{}
+
+// revTarget は ServeHTTP で求めたアカウントと接続先。
+// host はクライアントが要求した差し替える前のホストで、再試行時に接続先を求め直す際にも使用する。
+type revTarget struct {
+	account string
+	route   *accounts.Route
+	host    string
+	newHost string
+}
+
 // ServeHTTP は http.Handler の実装。
+// アカウントや使用できる接続先が見つからない場合は 503 を、ルーティング情報に一致しない場合は 502 を転送せずに返す。
+// 一致しない場合に要求されたホストへそのまま転送すると、自分自身へ転送し続けることになるため。
 func (r *RevHTTP) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// 通常のリクエストでは req.URL.Host は空のため Host ヘッダーで照合する。
+	host := req.Host
+	if req.URL.Host != "" {
+		host = req.URL.Host
+	}
+	account := r.account(host)
+
+	rw, req, done := beginAccessLog(r.AccessLog, rw, req, "reverse", account)
+	defer done()
+
+	if r.accounts.Get(account) == nil {
+		if r.accounts.Verbose {
+			r.Logger.Println("RevHTTP: account not found:", account, "host:", host)
+		}
+		http.Error(rw, "Service Unavailable: no routes are available for this proxy", http.StatusServiceUnavailable)
+		return
+	}
+
+	route, newHost := r.match(account, host)
+	if route == nil {
+		r.accounts.RecordNoMatch(account, "reverse", host)
+		http.Error(rw, "Bad Gateway: no route for "+host, http.StatusBadGateway)
+		return
+	}
+	if newHost == "" || newHost == host {
+		// 全ての接続先がヘルスチェックに失敗しているか、重みが 0 の場合。
+		http.Error(rw, "Service Unavailable: no available backend for "+host, http.StatusServiceUnavailable)
+		return
+	}
+	req = req.WithContext(context.WithValue(req.Context(), revTargetKey{}, revTarget{account, route, host, newHost}))
 	r.rp.ServeHTTP(rw, req)
 }
 
 // ListenAndServe は addr で Listen して通信の待受状態に入る。
+// Shutdown によって停止された場合は nil を返す。
 func (r *RevHTTP) ListenAndServe(addr string) error {
-	return http.ListenAndServe(addr, r.rp)
+	r.server.ReadTimeout = r.ReadTimeout
+	r.server.WriteTimeout = r.WriteTimeout
+	r.server.IdleTimeout = r.IdleTimeout
+	ln, err := r.conns.listen(addr)
+	if err != nil {
+		return err
+	}
+	if err = r.server.Serve(ln); err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown は新規接続の受付を停止し、処理中のリクエストが終了するまで待機する。
+// ShutdownTimeout を過ぎても終了しない接続は強制的に切断される。
+func (r *RevHTTP) Shutdown(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, r.ShutdownTimeout)
+	defer cancel()
+
+	err := r.server.Shutdown(ctx)
+	if err2 := r.conns.shutdown(ctx); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// rewritePath は u のパスから strip を取り除き、add を付け加える。
+// strip はパスの区切りに一致する場合のみ取り除かれ、エスケープされたパス(RawPath)も同様に書き換えられる。
+func rewritePath(u *url.URL, strip, add string) {
+	if strip != "" && strip != "/" {
+		p, ok := trimPathPrefix(u.Path, strip)
+		if !ok {
+			return
+		}
+		u.Path = p
+		if u.RawPath != "" {
+			if rp, ok := trimPathPrefix(u.RawPath, (&url.URL{Path: strip}).EscapedPath()); ok {
+				u.RawPath = rp
+			} else {
+				u.RawPath = ""
+			}
+		}
+	}
+
+	if add != "" && add != "/" {
+		u.Path = joinPath(add, u.Path)
+		if u.RawPath != "" {
+			u.RawPath = joinPath((&url.URL{Path: add}).EscapedPath(), u.RawPath)
+		}
+	}
+}
+
+// trimPathPrefix は path が prefix で始まり、その直後がパスの区切りになっている場合に prefix を取り除いて返す。
+// 取り除いた結果が空の場合は "/" を返す。
+func trimPathPrefix(path, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(path, prefix) {
+		return path, false
+	}
+	rest := path[len(prefix):]
+	if rest == "" {
+		return "/", true
+	}
+	if rest[0] != '/' {
+		return path, false
+	}
+	return rest, true
+}
+
+// joinPath は prefix と path を "/" が重複しないように連結する。path の末尾の "/" は維持される。
+func joinPath(prefix, path string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if path == "" || path == "/" {
+		return prefix + "/"
+	}
+	if path[0] != '/' {
+		return prefix + "/" + path
+	}
+	return prefix + path
 }
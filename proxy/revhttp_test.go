@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordBackend は受け取ったリクエストを received に送る転送先を起動する。
+func recordBackend(t *testing.T) (*httptest.Server, chan *http.Request) {
+	t.Helper()
+	received := make(chan *http.Request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	}))
+	t.Cleanup(ts.Close)
+	return ts, received
+}
+
+func TestRevHTTPRewritePath(t *testing.T) {
+	backend, received := recordBackend(t)
+	target := backend.Listener.Addr().String()
+
+	tests := []struct {
+		name        string
+		options     []string
+		rewriteHost bool
+		path        string
+		want        string
+	}{
+		{name: "none", path: "/api/users?id=1", want: "/api/users?id=1"},
+		{name: "strip", options: []string{"_strip_prefix=/api"}, path: "/api/users?id=1", want: "/users?id=1"},
+		{name: "strip to root", options: []string{"_strip_prefix=/api/"}, path: "/api", want: "/"},
+		// パスの区切りに一致しない場合は取り除かない。
+		{name: "strip partial segment", options: []string{"_strip_prefix=/api"}, path: "/apiv2/users", want: "/apiv2/users"},
+		{name: "add", options: []string{"_add_prefix=/v1"}, path: "/users", want: "/v1/users"},
+		{name: "strip and add", options: []string{"_strip_prefix=/api", "_add_prefix=/internal/v1"}, path: "/api/users/", want: "/internal/v1/users/"},
+		{name: "strip and rewrite host", options: []string{"_strip_prefix=/api"}, rewriteHost: true, path: "/api/users", want: "/users"},
+		{name: "escaped", options: []string{"_strip_prefix=/api", "_add_prefix=/v1"}, path: "/api/a%2Fb", want: "/v1/a%2Fb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes := []string{`master/` + target + `/0.www=^www\.test$`}
+			for _, o := range tt.options {
+				routes = append(routes, `master/`+target+`/`+o)
+			}
+			r := NewRevHTTP(newTestAccounts(t, routes...), "master")
+			r.RewriteHost = tt.rewriteHost
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+
+			req, _ := http.NewRequest("GET", ts.URL+tt.path, nil)
+			req.Host = "www.test"
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", res.StatusCode)
+			}
+			got := <-received
+			host := "www.test"
+			if tt.rewriteHost {
+				host = target
+			}
+			if got.RequestURI != tt.want || got.Host != host {
+				t.Errorf("backend received %q for %q, want %q for %q", got.RequestURI, got.Host, tt.want, host)
+			}
+		})
+	}
+}
+
+func TestRevHTTPUnavailable(t *testing.T) {
+	backend, received := recordBackend(t)
+	a := newTestAccounts(t, `master/`+backend.Listener.Addr().String()+`/0.www=^www\.test$`)
+
+	tests := []struct {
+		name    string
+		account string
+		host    string
+		status  int
+		body    string
+	}{
+		{name: "ok", account: "master", host: "www.test", status: http.StatusOK},
+		// アカウントが存在しない場合は 0.0.0.0 などへ接続しようとせずに 503 を返す。
+		{name: "missing account", account: "missing", host: "www.test", status: http.StatusServiceUnavailable, body: "no routes are available"},
+		{name: "no route", account: "master", host: "other.test", status: http.StatusBadGateway, body: "no route for other.test"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRevHTTP(a, tt.account)
+			r.Logger.SetOutput(io.Discard)
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+
+			req, _ := http.NewRequest("GET", ts.URL+"/", nil)
+			req.Host = tt.host
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != tt.status || !strings.Contains(string(b), tt.body) {
+				t.Errorf("response = %d %q, want %d containing %q", res.StatusCode, b, tt.status, tt.body)
+			}
+			forwarded := len(received) > 0
+			if forwarded {
+				<-received
+			}
+			if want := tt.status == http.StatusOK; forwarded != want {
+				t.Errorf("forwarded = %v, want %v", forwarded, want)
+			}
+		})
+	}
+}
+
+func TestRevHTTPScheme(t *testing.T) {
+	// 接続先は最初に受け取ったバイトが TLS のハンドシェイクのレコード(0x16)かどうかで、使用されたスキームを判定する。
+	ln := listenLocal(t)
+	schemes := make(chan string, 1)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b := make([]byte, 1)
+			if _, err := io.ReadFull(c, b); err == nil {
+				if b[0] == 0x16 {
+					schemes <- "https"
+				} else {
+					schemes <- "http"
+				}
+			}
+			c.Close()
+		}
+	}()
+	a := newTestAccounts(t, `master/`+ln.Addr().String()+`/0.www=^www\.test$`)
+
+	tests := []struct {
+		name   string
+		scheme string
+		want   string
+	}{
+		{name: "default", want: "http"},
+		{name: "http", scheme: "http", want: "http"},
+		{name: "https", scheme: "https", want: "https"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRevHTTP(a, "master")
+			r.Logger.SetOutput(io.Discard)
+			r.rp.ErrorLog = log.New(io.Discard, "", 0)
+			if tt.scheme != "" {
+				r.Scheme = tt.scheme
+			}
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+
+			req, _ := http.NewRequest("GET", ts.URL+"/", nil)
+			req.Host = "www.test"
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			select {
+			case got := <-schemes:
+				if got != tt.want {
+					t.Errorf("scheme = %s, want %s", got, tt.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("backend was not dialed")
+			}
+		})
+	}
+}
+
+func TestRevHTTPHeaders(t *testing.T) {
+	backend, received := recordBackend(t)
+	target := backend.Listener.Addr().String()
+	a := newTestAccounts(t, `master/`+target+`/0.www=^www\.test$`)
+
+	tests := []struct {
+		name              string
+		rewriteHost       bool
+		forwardedFor      string
+		wantHost          string
+		wantForwardedFor  string
+		wantForwardedHost string
+	}{
+		{name: "preserve host", wantHost: "www.test", wantForwardedFor: "127.0.0.1"},
+		{name: "rewrite host", rewriteHost: true, wantHost: target, wantForwardedFor: "127.0.0.1", wantForwardedHost: "www.test"},
+		// 既存の X-Forwarded-For には置き換えずに追加する。
+		{name: "append forwarded for", forwardedFor: "203.0.113.9", wantHost: "www.test", wantForwardedFor: "203.0.113.9, 127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRevHTTP(a, "master")
+			r.RewriteHost = tt.rewriteHost
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+
+			req, _ := http.NewRequest("GET", ts.URL+"/", nil)
+			req.Host = "www.test"
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", res.StatusCode)
+			}
+			got := <-received
+			if got.Host != tt.wantHost {
+				t.Errorf("Host = %q, want %q", got.Host, tt.wantHost)
+			}
+			if v := got.Header.Get("X-Forwarded-Host"); v != tt.wantForwardedHost {
+				t.Errorf("X-Forwarded-Host = %q, want %q", v, tt.wantForwardedHost)
+			}
+			if v := got.Header.Get("X-Forwarded-For"); v != tt.wantForwardedFor {
+				t.Errorf("X-Forwarded-For = %q, want %q", v, tt.wantForwardedFor)
+			}
+		})
+	}
+}
@@ -1,110 +1,407 @@
 package proxy
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
-
-	"github.com/elazarl/goproxy"
-	"github.com/oov/socks5"
+	"strconv"
+	"time"
 
 	"github.com/mimoto-xxxxxx/dockerns/accounts"
 )
 
+// SOCKS v5 プロトコル(RFC 1928, RFC 1929)で使用する定数。
+const (
+	socksVersion = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodNoAcceptable = 0xff
+
+	socksUserPassVersion = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyGeneralFailure      = 0x01
+	socksReplyNotAllowed          = 0x02
+	socksReplyHostUnreachable     = 0x04
+	socksReplyConnectionRefused   = 0x05
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddrNotSupported    = 0x08
+)
+
+// errAuthenticationFailed は SOCKS の認証に失敗したことを表す。
+var errAuthenticationFailed = errors.New("authentication failed")
+
 // SOCKS は SOCKS5 プロトコルによるプロキシサーバ。
 // AccountName を指定した場合は認証は行わずに接続できる。
+// AllowSOCKS4 が true の場合は SOCKS4 / SOCKS4a の接続も受け付ける。SOCKS4 には認証が無いため、AccountName を指定した場合のみ使用できる。
+// ShutdownTimeout は Shutdown 時に中継中の接続の完了を待つ最大時間で、0 の場合は無制限に待つ。
+// HandshakeTimeout は接続してから認証と要求の受信を終えるまでの最大時間で、0 の場合は無制限に待つ。
+// Policy を指定した場合は接続の前に問い合わせを行い、許可された場合のみ接続する。
+// PreDial を指定した場合は接続先へ接続する直前に呼び出し、接続先や接続に使用するパラメーターを変更できるようにする。
+// Audit を指定した場合はルーティング情報によって接続先が差し替えられた記録を出力する。
+// ProxyProtocol が true の場合は接続の先頭で PROXY プロトコル(v1 / v2)のヘッダーを受け取り、本来のクライアントのアドレスを使用する。
+// AdvertiseAddr を指定した場合は応答の BND.ADDR として接続先への接続に使用したアドレスの代わりにそのアドレスを通知する。
+// NAT の内側や複数のアドレスを持つホストで、クライアントから到達できるアドレスを通知するために使用する。
+// Port が 0 の場合は BND.PORT には接続に使用したポート番号を通知する。
 type SOCKS struct {
-	AccountName string
-	Password    string
-	Logger      *log.Logger
-	accounts    *accounts.Accounts
-	proxy       *goproxy.ProxyHttpServer
-	socks       *socks5.Server
+	AccountName      string
+	Password         string
+	ShutdownTimeout  time.Duration
+	DialTimeout      time.Duration
+	HandshakeTimeout time.Duration
+	Policy           Policy
+	PreDial          PreDialFunc
+	Audit            *Audit
+	ProxyProtocol    bool
+	AdvertiseAddr    *net.TCPAddr
+	AllowSOCKS4      bool
+	Logger           *log.Logger
+	accounts         *accounts.Accounts
+	conns            *tracker
 }
 
 // authorize は username と password 正当なものであることを検証し、
 // 成功した場合に該当するアカウント情報を返す。
+// パスワードはアカウントに設定されたものを優先し、無ければ Password と比較する。
 func (s *SOCKS) authorize(username, password string) (*accounts.Account, error) {
-	if s.Password != "" && password != s.Password {
-		return nil, fmt.Errorf("password incorrect")
-	}
 	a := s.accounts.Get(username)
 	if a == nil {
-		return nil, fmt.Errorf("account not found")
+		return nil, fmt.Errorf("account not found: %s", username)
+	}
+	if !a.CheckPassword(password, s.Password) {
+		return nil, fmt.Errorf("password incorrect")
 	}
 	return a, nil
 }
 
-// noauthorizeSOCKS は認証なし接続が行えるかテストする。
-func (s *SOCKS) noauthorizeSOCKS(c *socks5.Conn) error {
+// noauthorize は認証なし接続が行えるかテストし、可能であれば使用するアカウント情報を返す。
+func (s *SOCKS) noauthorize() (*accounts.Account, error) {
 	if s.AccountName == "" {
-		return socks5.ErrAuthenticationFailed
+		return nil, errAuthenticationFailed
 	}
 
 	a := s.accounts.Get(s.AccountName)
 	if a == nil {
-		if s.accounts.Verbose {
-			log.Println("account not found:", s.AccountName)
+		return nil, fmt.Errorf("account not found: %s", s.AccountName)
+	}
+	return a, nil
+}
+
+// NewSOCKS は SOCKS プロクシサーバーを新規作成する。
+func NewSOCKS(accounts *accounts.Accounts) *SOCKS {
+	return &SOCKS{
+		ShutdownTimeout:  30 * time.Second,
+		DialTimeout:      30 * time.Second,
+		HandshakeTimeout: 10 * time.Second,
+		Logger:           log.New(os.Stderr, "", log.LstdFlags),
+		accounts:         accounts,
+		conns:            newTracker(),
+	}
+}
+
+// ListenAndServe はサーバの Listen を開始する。
+// Shutdown によって停止された場合は nil を返す。
+func (s *SOCKS) ListenAndServe(addr string) error {
+	ln, err := s.conns.listen(addr)
+	if err == nil {
+		if s.ProxyProtocol {
+			ln = &proxyListener{Listener: ln}
+		}
+		err = s.Serve(ln)
+		if s.conns.isClosed() {
+			return nil
+		}
+	}
+	s.Logger.Println("proxy.ListenAndServe(SOCKS):", err)
+	return err
+}
+
+// Serve は ln で接続を受け付け、それぞれの接続を SOCKS v5 プロトコル(AllowSOCKS4 が true の場合は SOCKS4 / SOCKS4a も)として処理する。
+func (s *SOCKS) Serve(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
 		}
-		return socks5.ErrAuthenticationFailed
+		go s.serve(c)
 	}
+}
 
-	c.Data = a
-	return nil
+// Shutdown は新規接続の受付を停止し、中継中の接続が終了するまで待機する。
+// ShutdownTimeout を過ぎても終了しない接続は強制的に切断される。
+func (s *SOCKS) Shutdown(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, s.ShutdownTimeout)
+	defer cancel()
+	return s.conns.shutdown(ctx)
 }
 
-// authorizeSOCKS は接続してきたユーザーが正しいユーザー名とパスワードを所持しているかテストする。
-func (s *SOCKS) authorizeSOCKS(c *socks5.Conn, username, password []byte) error {
-	if s.Password != "" && string(password) != s.Password {
+// serve はクライアントとのネゴシエーションを行い、成功すれば接続先との中継を開始する。
+// 要求を受け取るまでは HandshakeTimeout を期限とし、何も送らずに接続を保持し続けるクライアントを切断する。
+func (s *SOCKS) serve(c net.Conn) {
+	defer c.Close()
+
+	if s.HandshakeTimeout > 0 {
+		c.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+
+	// 先頭の 1 バイトでプロトコルのバージョンを判別する。
+	var ver [1]byte
+	if _, err := io.ReadFull(c, ver[:]); err != nil {
+		return
+	}
+	if ver[0] == socks4Version {
+		s.serve4(c)
+		return
+	}
+
+	account, err := s.negotiate(c, ver[0])
+	if err != nil {
 		if s.accounts.Verbose {
-			log.Println("password incorrect")
+			s.Logger.Println("SOCKS:", c.RemoteAddr(), err)
+		}
+		return
+	}
+
+	host, err := s.readRequest(c)
+	if err != nil {
+		if s.accounts.VerboseFor(account.Name) {
+			s.Logger.Println("SOCKS:", c.RemoteAddr(), err)
 		}
-		return socks5.ErrAuthenticationFailed
+		return
 	}
+	// 接続先への接続には DialTimeout を、中継には期限を設けないため、ここで解除する。
+	c.SetDeadline(time.Time{})
 
-	a := s.accounts.Get(string(username))
-	if a == nil {
-		if s.accounts.Verbose {
-			log.Println("account not found:", string(username))
+	upstream, err := s.connect(c, account, host, writeSOCKSReply)
+	if err != nil {
+		if s.accounts.VerboseFor(account.Name) {
+			s.Logger.Println("SOCKS:", c.RemoteAddr(), err)
 		}
-		return socks5.ErrAuthenticationFailed
+		return
 	}
 
-	c.Data = a
-	return nil
+	relayActive(Connection{
+		Kind:    "socks",
+		Account: account.Name,
+		Client:  c.RemoteAddr().String(),
+		Host:    host,
+		Target:  upstream.RemoteAddr().String(),
+	}, c, upstream)
 }
 
-// NewSOCKS は SOCKS プロクシサーバーを新規作成する。
-func NewSOCKS(accounts *accounts.Accounts) *SOCKS {
-	s := &SOCKS{
-		Logger:   log.New(os.Stderr, "", log.LstdFlags),
-		accounts: accounts,
-		socks:    socks5.New(),
+// negotiate は認証方式の選択と認証を行い、使用するアカウント情報を返す。
+// version には読み取り済みの先頭の 1 バイトを渡す。
+func (s *SOCKS) negotiate(c net.Conn, version byte) (*accounts.Account, error) {
+	if version != socksVersion {
+		return nil, fmt.Errorf("unsupported version: %d", version)
+	}
+	var n [1]byte
+	if _, err := io.ReadFull(c, n[:]); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, n[0])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return nil, err
+	}
+
+	var noAuth, userPass bool
+	for _, m := range methods {
+		switch m {
+		case socksMethodNoAuth:
+			noAuth = true
+		case socksMethodUserPass:
+			userPass = true
+		}
 	}
 
-	s.socks.AuthNoAuthenticationRequiredCallback = s.noauthorizeSOCKS
-	s.socks.AuthUsernamePasswordCallback = s.authorizeSOCKS
-	s.socks.HandleConnectFunc(s.proxySOCKSConnect)
-	return s
+	if noAuth {
+		if a, err := s.noauthorize(); err == nil {
+			_, err = c.Write([]byte{socksVersion, socksMethodNoAuth})
+			return a, err
+		} else if err != errAuthenticationFailed && s.accounts.Verbose {
+			s.Logger.Println("SOCKS:", err)
+		}
+	}
+
+	if !userPass {
+		c.Write([]byte{socksVersion, socksMethodNoAcceptable})
+		return nil, errAuthenticationFailed
+	}
+	if _, err := c.Write([]byte{socksVersion, socksMethodUserPass}); err != nil {
+		return nil, err
+	}
+	return s.authorizeUserPass(c)
 }
 
-// ListenAndServe はサーバの Listen を開始する。
-func (s *SOCKS) ListenAndServe(addr string) error {
-	err := s.socks.ListenAndServe(addr)
+// authorizeUserPass は RFC 1929 のユーザー名/パスワード認証を行う。
+func (s *SOCKS) authorizeUserPass(c net.Conn) (*accounts.Account, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != socksUserPassVersion {
+		return nil, fmt.Errorf("unsupported auth version: %d", hdr[0])
+	}
+	username := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, username); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(c, hdr[:1]); err != nil {
+		return nil, err
+	}
+	password := make([]byte, hdr[0])
+	if _, err := io.ReadFull(c, password); err != nil {
+		return nil, err
+	}
+
+	a, err := s.authorize(string(username), string(password))
 	if err != nil {
-		s.Logger.Println("proxy.ListenAndServe(SOCKS):", err)
+		c.Write([]byte{socksUserPassVersion, 0x01})
+		return nil, err
 	}
-	return err
+	if _, err = c.Write([]byte{socksUserPassVersion, 0x00}); err != nil {
+		return nil, err
+	}
+	return a, nil
 }
 
-// proxySOCKSConnect は SOCKS5 プロクシの実装。
-func (s *SOCKS) proxySOCKSConnect(c *socks5.Conn, host string) (newHost string, err error) {
-	if account, ok := c.Data.(*accounts.Account); ok {
-		newHost = account.Routes.ReplaceHost(host)
-		if s.accounts.Verbose {
-			s.Logger.Println("user:", account.Name, "host:", host, "newHost:", newHost)
+// readRequest はクライアントからの要求を読み取り、"host:port" 形式の接続先を返す。
+// CONNECT 以外の要求には対応していない。
+func (s *SOCKS) readRequest(c net.Conn) (string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("unsupported version: %d", hdr[0])
+	}
+
+	var host string
+	switch hdr[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if hdr[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
 		}
-		return
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeSOCKSReply(c, socksReplyAddrNotSupported, nil)
+		return "", fmt.Errorf("unsupported address type: %d", hdr[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return "", err
 	}
-	return host, nil
+
+	if hdr[1] != socksCmdConnect {
+		writeSOCKSReply(c, socksReplyCommandNotSupported, nil)
+		return "", fmt.Errorf("unsupported command: %d", hdr[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// connect は host をルーティング情報に従って差し替えた上で接続し、結果を reply でクライアントに返す。
+// reply には SOCKS v5 の応答コードを渡すため、SOCKS4 の場合は対応する応答に変換して返す。
+func (s *SOCKS) connect(c net.Conn, account *accounts.Account, host string, reply func(io.Writer, byte, net.Addr) error) (net.Conn, error) {
+	route, newHost := account.Match(host)
+	if route == nil {
+		s.accounts.RecordNoMatch(account.Name, "socks", host)
+	}
+	if s.accounts.VerboseFor(account.Name) {
+		s.Logger.Println("kind: socks", "user:", account.Name, "host:", host, "newHost:", newHost)
+	}
+
+	newHost, err := checkPolicy(s.Policy, account.Name, c.RemoteAddr().String(), host, newHost)
+	if err != nil {
+		reply(c, socksReplyNotAllowed, nil)
+		return nil, err
+	}
+	s.Audit.record("socks", account.Name, c.RemoteAddr().String(), host, newHost)
+
+	release, ok := acquireTarget(route, newHost)
+	if !ok {
+		reply(c, socksReplyGeneralFailure, nil)
+		return nil, fmt.Errorf("too many connections to target: %s", newHost)
+	}
+
+	upstream, err := dial(context.Background(), s.PreDial, s.DialTimeout, "socks", account.Name, host, newHost)
+	if err != nil {
+		code := byte(socksReplyHostUnreachable)
+		if oe, ok := err.(*net.OpError); ok && oe.Op == "dial" && !oe.Timeout() {
+			code = socksReplyConnectionRefused
+		}
+		reply(c, code, nil)
+		release()
+		return nil, err
+	}
+	upstream = &releaseConn{Conn: upstream, release: release}
+
+	if err = reply(c, socksReplySucceeded, s.bindAddr(upstream.LocalAddr())); err != nil {
+		upstream.Close()
+		return nil, err
+	}
+	return upstream, nil
+}
+
+// bindAddr は実際に使用したアドレス local の代わりに、応答でクライアントに通知するアドレスを返す。
+func (s *SOCKS) bindAddr(local net.Addr) net.Addr {
+	if s.AdvertiseAddr == nil {
+		return local
+	}
+	addr := *s.AdvertiseAddr
+	if a, ok := local.(*net.TCPAddr); ok && addr.Port == 0 {
+		addr.Port = a.Port
+	}
+	return &addr
+}
+
+// writeSOCKSReply はクライアントに応答を返す。
+// addr が *net.TCPAddr の場合はそのアドレスを BND.ADDR / BND.PORT として通知する。
+func writeSOCKSReply(w io.Writer, code byte, addr net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if a, ok := addr.(*net.TCPAddr); ok {
+		ip, port = a.IP, a.Port
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+	}
+
+	b := []byte{socksVersion, code, 0x00, socksAddrIPv4}
+	if len(ip) == net.IPv6len {
+		b[3] = socksAddrIPv6
+	}
+	b = append(b, ip...)
+	b = append(b, byte(port>>8), byte(port))
+	_, err := w.Write(b)
+	return err
 }
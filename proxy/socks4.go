@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS4 / SOCKS4a プロトコルで使用する定数。
+const (
+	socks4Version = 0x04
+
+	socks4ReplyVersion  = 0x00
+	socks4ReplyGranted  = 0x5a
+	socks4ReplyRejected = 0x5b
+
+	// socks4MaxField は USERID やホスト名として受け付ける最大の長さ。
+	socks4MaxField = 255
+)
+
+// serve4 は SOCKS4 / SOCKS4a の要求を処理し、成功すれば接続先との中継を開始する。
+// 先頭のバージョンの 1 バイトは読み取り済みであること。
+// SOCKS4 には認証が無いため、AllowSOCKS4 が false の場合や AccountName が指定されていない場合は拒否する。
+func (s *SOCKS) serve4(c net.Conn) {
+	if !s.AllowSOCKS4 {
+		writeSOCKS4Reply(c, socksReplyNotAllowed, nil)
+		if s.accounts.Verbose {
+			s.Logger.Println("SOCKS4:", c.RemoteAddr(), "SOCKS4 is disabled")
+		}
+		return
+	}
+
+	account, err := s.noauthorize()
+	if err != nil {
+		writeSOCKS4Reply(c, socksReplyNotAllowed, nil)
+		if s.accounts.Verbose {
+			s.Logger.Println("SOCKS4:", c.RemoteAddr(), err)
+		}
+		return
+	}
+
+	host, err := readSOCKS4Request(c)
+	if err != nil {
+		if s.accounts.VerboseFor(account.Name) {
+			s.Logger.Println("SOCKS4:", c.RemoteAddr(), err)
+		}
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	upstream, err := s.connect(c, account, host, writeSOCKS4Reply)
+	if err != nil {
+		if s.accounts.VerboseFor(account.Name) {
+			s.Logger.Println("SOCKS4:", c.RemoteAddr(), err)
+		}
+		return
+	}
+
+	relayActive(Connection{
+		Kind:    "socks",
+		Account: account.Name,
+		Client:  c.RemoteAddr().String(),
+		Host:    host,
+		Target:  upstream.RemoteAddr().String(),
+	}, c, upstream)
+}
+
+// readSOCKS4Request はバージョンに続く SOCKS4 / SOCKS4a の要求を読み取り、"host:port" 形式の接続先を返す。
+// DSTIP が 0.0.0.x (x は 0 以外)の場合は SOCKS4a として USERID に続くホスト名を接続先とする。
+// CONNECT 以外の要求には対応していない。
+func readSOCKS4Request(c net.Conn) (string, error) {
+	var hdr [7]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return "", err
+	}
+	if _, err := readSOCKS4String(c); err != nil {
+		return "", fmt.Errorf("invalid USERID: %v", err)
+	}
+
+	ip := net.IP(hdr[3:7])
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		name, err := readSOCKS4String(c)
+		if err != nil {
+			return "", fmt.Errorf("invalid host name: %v", err)
+		}
+		host = name
+	}
+
+	if hdr[0] != socksCmdConnect {
+		writeSOCKS4Reply(c, socksReplyCommandNotSupported, nil)
+		return "", fmt.Errorf("unsupported command: %d", hdr[0])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(hdr[1:3])))), nil
+}
+
+// readSOCKS4String は NUL で終端された文字列を socks4MaxField バイトまで読み取る。
+// 要求に続けて送られてくるデータを読み進めてしまわないよう、1 バイトずつ読み取る。
+func readSOCKS4String(r io.Reader) (string, error) {
+	var b []byte
+	var c [1]byte
+	for {
+		if _, err := io.ReadFull(r, c[:]); err != nil {
+			return "", err
+		}
+		if c[0] == 0 {
+			return string(b), nil
+		}
+		if len(b) >= socks4MaxField {
+			return "", fmt.Errorf("too long")
+		}
+		b = append(b, c[0])
+	}
+}
+
+// writeSOCKS4Reply は SOCKS v5 の応答コード code を SOCKS4 の応答に変換してクライアントに返す。
+// addr が IPv4 の *net.TCPAddr の場合はそのアドレスを DSTIP / DSTPORT として通知する。
+func writeSOCKS4Reply(w io.Writer, code byte, addr net.Addr) error {
+	b := []byte{socks4ReplyVersion, socks4ReplyRejected, 0, 0, 0, 0, 0, 0}
+	if code == socksReplySucceeded {
+		b[1] = socks4ReplyGranted
+	}
+	if a, ok := addr.(*net.TCPAddr); ok {
+		if ip4 := a.IP.To4(); ip4 != nil {
+			binary.BigEndian.PutUint16(b[2:4], uint16(a.Port))
+			copy(b[4:], ip4)
+		}
+	}
+	_, err := w.Write(b)
+	return err
+}
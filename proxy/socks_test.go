@@ -0,0 +1,370 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// socksConnect は c で SOCKS v5 のネゴシエーションを行い、host:port への CONNECT を要求する。
+// user が空の場合は認証なしを、それ以外はユーザー名/パスワード認証を要求する。
+// 認証で拒否された場合は 0xff を、それ以外は要求に対する応答の REP を返す。
+func socksConnect(t *testing.T, c net.Conn, user, password, host string, port int, cmd byte) byte {
+	t.Helper()
+	method := byte(socksMethodNoAuth)
+	if user != "" {
+		method = socksMethodUserPass
+	}
+	c.Write([]byte{socksVersion, 1, method})
+	var res [2]byte
+	if _, err := io.ReadFull(c, res[:]); err != nil {
+		t.Fatal(err)
+	}
+	if res[1] != method {
+		return socksMethodNoAcceptable
+	}
+	if user != "" {
+		var b bytes.Buffer
+		b.WriteByte(socksUserPassVersion)
+		b.WriteByte(byte(len(user)))
+		b.WriteString(user)
+		b.WriteByte(byte(len(password)))
+		b.WriteString(password)
+		c.Write(b.Bytes())
+		if _, err := io.ReadFull(c, res[:]); err != nil {
+			t.Fatal(err)
+		}
+		if res[1] != 0x00 {
+			return socksMethodNoAcceptable
+		}
+	}
+
+	var b bytes.Buffer
+	b.Write([]byte{socksVersion, cmd, 0, socksAddrDomain, byte(len(host))})
+	b.WriteString(host)
+	binary.Write(&b, binary.BigEndian, uint16(port))
+	c.Write(b.Bytes())
+
+	rep, _ := readSOCKSReply(t, c)
+	return rep
+}
+
+// readSOCKSReply は c から要求に対する応答を読み取り、REP と BND.ADDR / BND.PORT を返す。
+func readSOCKSReply(t *testing.T, c net.Conn) (byte, *net.TCPAddr) {
+	t.Helper()
+	// VER REP RSV ATYP
+	var head [4]byte
+	if _, err := io.ReadFull(c, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	ip := make(net.IP, net.IPv4len)
+	if head[3] == socksAddrIPv6 {
+		ip = make(net.IP, net.IPv6len)
+	}
+	var port uint16
+	if _, err := io.ReadFull(c, ip); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Read(c, binary.BigEndian, &port); err != nil {
+		t.Fatal(err)
+	}
+	return head[1], &net.TCPAddr{IP: ip, Port: int(port)}
+}
+
+func TestSOCKSHandshake(t *testing.T) {
+	echo := listenEcho(t)
+	_, p, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(p)
+
+	deny := policyFunc(func(req *PolicyRequest) (*PolicyResult, error) {
+		return &PolicyResult{Decision: Deny}, nil
+	})
+
+	tests := []struct {
+		name        string
+		accountName string
+		policy      Policy
+		user        string
+		password    string
+		cmd         byte
+		want        byte
+	}{
+		{name: "no auth", accountName: "master", cmd: socksCmdConnect, want: socksReplySucceeded},
+		{name: "no auth without account", cmd: socksCmdConnect, want: socksMethodNoAcceptable},
+		{name: "password", user: "master", password: "secret", cmd: socksCmdConnect, want: socksReplySucceeded},
+		{name: "wrong password", user: "master", password: "wrong", cmd: socksCmdConnect, want: socksMethodNoAcceptable},
+		{name: "unknown user", user: "nobody", password: "secret", cmd: socksCmdConnect, want: socksMethodNoAcceptable},
+		{name: "policy deny", accountName: "master", policy: deny, cmd: socksCmdConnect, want: socksReplyNotAllowed},
+		{name: "bind", accountName: "master", cmd: 0x02, want: socksReplyCommandNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSOCKS(newTestAccounts(t,
+				`master/_password=secret`,
+				`master/127.0.0.1/0.echo=^echo\.test$`,
+			))
+			s.AccountName = tt.accountName
+			s.Policy = tt.policy
+			ln := listenLocal(t)
+			go s.Serve(ln)
+
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+
+			if got := socksConnect(t, c, tt.user, tt.password, "echo.test", port, tt.cmd); got != tt.want {
+				t.Fatalf("reply = %#x, want %#x", got, tt.want)
+			}
+			if tt.want != socksReplySucceeded {
+				return
+			}
+			c.Write([]byte("hello"))
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+				t.Fatalf("relay = %q, %v", buf, err)
+			}
+		})
+	}
+}
+
+func TestSOCKSHandshakeTimeout(t *testing.T) {
+	echo := listenEcho(t)
+	_, p, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(p)
+
+	tests := []struct {
+		name  string
+		send  []byte
+		relay bool
+	}{
+		{name: "idle", send: nil},
+		{name: "partial greeting", send: []byte{socksVersion, 1}},
+		{name: "partial request", send: []byte{socksVersion, 1, socksMethodNoAuth, socksVersion, socksCmdConnect}},
+		{name: "relay outlives timeout", relay: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSOCKS(newTestAccounts(t, `master/127.0.0.1/0.echo=^echo\.test$`))
+			s.AccountName = "master"
+			s.HandshakeTimeout = 100 * time.Millisecond
+			ln := listenLocal(t)
+			go s.Serve(ln)
+
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+
+			if tt.relay {
+				if got := socksConnect(t, c, "", "", "echo.test", port, socksCmdConnect); got != socksReplySucceeded {
+					t.Fatalf("reply = %#x", got)
+				}
+				time.Sleep(3 * s.HandshakeTimeout)
+				c.Write([]byte("hello"))
+				buf := make([]byte, 5)
+				if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+					t.Fatalf("relay = %q, %v", buf, err)
+				}
+				return
+			}
+
+			c.Write(tt.send)
+			if _, err := io.ReadAll(c); err != nil {
+				t.Fatalf("connection was not closed by the server: %v", err)
+			}
+		})
+	}
+}
+
+func TestSOCKSAdvertiseAddr(t *testing.T) {
+	echo := listenEcho(t)
+	_, p, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(p)
+
+	tests := []struct {
+		name      string
+		advertise *net.TCPAddr
+		// want は応答の BND.ADDR で、Port が 0 の場合は接続先への接続に使用したポート番号であることのみを確認する。
+		want *net.TCPAddr
+	}{
+		{name: "default", want: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}},
+		{name: "address", advertise: &net.TCPAddr{IP: net.ParseIP("203.0.113.10")}, want: &net.TCPAddr{IP: net.ParseIP("203.0.113.10")}},
+		{name: "address and port", advertise: &net.TCPAddr{IP: net.ParseIP("203.0.113.10"), Port: 1080}, want: &net.TCPAddr{IP: net.ParseIP("203.0.113.10"), Port: 1080}},
+		{name: "ipv6", advertise: &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 1080}, want: &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 1080}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSOCKS(newTestAccounts(t, `master/127.0.0.1/0.echo=^echo\.test$`))
+			s.AccountName = "master"
+			s.AdvertiseAddr = tt.advertise
+			ln := listenLocal(t)
+			go s.Serve(ln)
+
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+
+			c.Write([]byte{socksVersion, 1, socksMethodNoAuth})
+			var method [2]byte
+			if _, err := io.ReadFull(c, method[:]); err != nil {
+				t.Fatal(err)
+			}
+			var b bytes.Buffer
+			b.Write([]byte{socksVersion, socksCmdConnect, 0, socksAddrDomain, byte(len("echo.test"))})
+			b.WriteString("echo.test")
+			binary.Write(&b, binary.BigEndian, uint16(port))
+			c.Write(b.Bytes())
+
+			rep, addr := readSOCKSReply(t, c)
+			if rep != socksReplySucceeded {
+				t.Fatalf("reply = %#x", rep)
+			}
+			if !addr.IP.Equal(tt.want.IP) {
+				t.Errorf("BND.ADDR = %v, want %v", addr.IP, tt.want.IP)
+			}
+			if tt.want.Port != 0 && addr.Port != tt.want.Port {
+				t.Errorf("BND.PORT = %d, want %d", addr.Port, tt.want.Port)
+			}
+			if tt.want.Port == 0 && (addr.Port == 0 || addr.Port == port) {
+				t.Errorf("BND.PORT = %d, want the local port of the upstream connection", addr.Port)
+			}
+		})
+	}
+}
+
+func TestSOCKSProtocol(t *testing.T) {
+	echo := listenEcho(t)
+	_, p, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(p)
+	portBytes := []byte{byte(port >> 8), byte(port)}
+	request := func(cmd, atyp byte, addr ...byte) []byte {
+		b := append([]byte{socksVersion, cmd, 0, atyp}, addr...)
+		return append(b, portBytes...)
+	}
+	domain := append([]byte{byte(len("echo.test"))}, "echo.test"...)
+	userPass := func(user, password string) []byte {
+		b := append([]byte{socksUserPassVersion, byte(len(user))}, user...)
+		return append(append(b, byte(len(password))), password...)
+	}
+
+	const closed = -1
+	tests := []struct {
+		name     string
+		greeting []byte
+		// method は選択される認証方式で、closed の場合は応答せずに切断される。
+		method int
+		auth   []byte
+		// status はユーザー名/パスワード認証の結果。
+		status  byte
+		request []byte
+		// rep は要求に対する応答の REP で、closed の場合は応答せずに切断される。
+		rep int
+	}{
+		{name: "ipv4", greeting: []byte{socksVersion, 1, socksMethodNoAuth}, method: socksMethodNoAuth, request: request(socksCmdConnect, socksAddrIPv4, 127, 0, 0, 1), rep: socksReplySucceeded},
+		{name: "domain", greeting: []byte{socksVersion, 1, socksMethodNoAuth}, method: socksMethodNoAuth, request: request(socksCmdConnect, socksAddrDomain, domain...), rep: socksReplySucceeded},
+		// 接続先は 127.0.0.1 でのみ待ち受けているため、IPv6 のアドレスは解釈された上で接続に失敗する。
+		{name: "ipv6", greeting: []byte{socksVersion, 1, socksMethodNoAuth}, method: socksMethodNoAuth, request: request(socksCmdConnect, socksAddrIPv6, net.IPv6loopback...), rep: socksReplyConnectionRefused},
+		{name: "unknown address type", greeting: []byte{socksVersion, 1, socksMethodNoAuth}, method: socksMethodNoAuth, request: []byte{socksVersion, socksCmdConnect, 0, 0x05}, rep: socksReplyAddrNotSupported},
+		{name: "udp associate", greeting: []byte{socksVersion, 1, socksMethodNoAuth}, method: socksMethodNoAuth, request: request(0x03, socksAddrIPv4, 127, 0, 0, 1), rep: socksReplyCommandNotSupported},
+		{name: "unknown version", greeting: []byte{0x06}, method: closed},
+		{name: "no acceptable method", greeting: []byte{socksVersion, 1, 0x01}, method: socksMethodNoAcceptable},
+		{name: "user/pass", greeting: []byte{socksVersion, 2, socksMethodNoAuth, socksMethodUserPass}, method: socksMethodUserPass, auth: userPass("master", "secret"), status: 0x00, request: request(socksCmdConnect, socksAddrDomain, domain...), rep: socksReplySucceeded},
+		{name: "user/pass failure", greeting: []byte{socksVersion, 1, socksMethodUserPass}, method: socksMethodUserPass, auth: userPass("master", "wrong"), status: 0x01, rep: closed},
+		{name: "user/pass bad version", greeting: []byte{socksVersion, 1, socksMethodUserPass}, method: socksMethodUserPass, auth: []byte{0x05, 0}, rep: closed},
+		{name: "bad request version", greeting: []byte{socksVersion, 1, socksMethodNoAuth}, method: socksMethodNoAuth, request: []byte{0x04, socksCmdConnect, 0, socksAddrIPv4}, rep: closed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSOCKS(newTestAccounts(t,
+				`master/_password=secret`,
+				`master/127.0.0.1/0.echo=^echo\.test$`,
+			))
+			// 認証なしの方式が選択されるべき場合のみ AccountName を指定し、それ以外はユーザー名/パスワード認証を要求させる。
+			if tt.method == socksMethodNoAuth {
+				s.AccountName = "master"
+			}
+			s.Logger.SetOutput(io.Discard)
+			ln := listenLocal(t)
+			go s.Serve(ln)
+
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// expectClosed はサーバーが何も返さずに接続を閉じることを確認する。
+			expectClosed := func(step string) {
+				if b, err := io.ReadAll(c); err != nil || len(b) != 0 {
+					t.Fatalf("%s: got %x, %v, want the connection to be closed", step, b, err)
+				}
+			}
+
+			c.Write(tt.greeting)
+			if tt.method == closed {
+				expectClosed("greeting")
+				return
+			}
+			var res [2]byte
+			if _, err := io.ReadFull(c, res[:]); err != nil {
+				t.Fatal(err)
+			}
+			if res != [2]byte{socksVersion, byte(tt.method)} {
+				t.Fatalf("method = %x, want %#x", res, tt.method)
+			}
+			if tt.method == socksMethodNoAcceptable {
+				expectClosed("method")
+				return
+			}
+
+			if tt.auth != nil {
+				c.Write(tt.auth)
+				if tt.auth[0] != socksUserPassVersion {
+					expectClosed("auth")
+					return
+				}
+				if _, err := io.ReadFull(c, res[:]); err != nil {
+					t.Fatal(err)
+				}
+				if res != [2]byte{socksUserPassVersion, tt.status} {
+					t.Fatalf("auth status = %x, want %#x", res, tt.status)
+				}
+				if tt.status != 0x00 {
+					expectClosed("auth")
+					return
+				}
+			}
+
+			c.Write(tt.request)
+			if tt.rep == closed {
+				expectClosed("request")
+				return
+			}
+			if rep, _ := readSOCKSReply(t, c); rep != byte(tt.rep) {
+				t.Fatalf("reply = %#x, want %#x", rep, tt.rep)
+			}
+			if tt.rep != socksReplySucceeded {
+				expectClosed("reply")
+				return
+			}
+			c.Write([]byte("hello"))
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+				t.Fatalf("relay = %q, %v", buf, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mimoto-xxxxxx/dockerns/accounts"
+)
+
+// TLSPassthrough は TLS を終端せずに中継するリバースプロキシ。
+// クライアントが送信する ClientHello の SNI をルーティング情報に従って差し替え、暗号化されたままの通信を接続先へ中継する。
+// 接続先のポート番号にはクライアントが接続してきたポート番号を使用する。
+// ルーティング情報に一致しない SNI や、SNI を含まない接続は中継せずに切断する。
+// HandshakeTimeout は ClientHello の受信を待つ最大時間。
+// LogHandshake が true の場合は、中継を開始した接続ごとに ClientHello の SNI と ALPN、クライアントが対応している最も新しい
+// TLS のバージョン、選択した接続先を Logger に出力する。いずれも暗号化を解かずに得られる情報のみを使用する。
+type TLSPassthrough struct {
+	ShutdownTimeout  time.Duration
+	DialTimeout      time.Duration
+	HandshakeTimeout time.Duration
+	LogHandshake     bool
+	Policy           Policy
+	PreDial          PreDialFunc
+	Audit            *Audit
+	ProxyProtocol    bool
+	Logger           *log.Logger
+	accounts         *accounts.Accounts
+	accountName      string
+	conns            *tracker
+}
+
+// NewTLSPassthrough は accountName のルーティング情報を使用する TLSPassthrough を新規作成する。
+func NewTLSPassthrough(accounts *accounts.Accounts, accountName string) *TLSPassthrough {
+	return &TLSPassthrough{
+		ShutdownTimeout:  30 * time.Second,
+		DialTimeout:      30 * time.Second,
+		HandshakeTimeout: 10 * time.Second,
+		Logger:           log.New(os.Stderr, "", log.LstdFlags),
+		accounts:         accounts,
+		accountName:      accountName,
+		conns:            newTracker(),
+	}
+}
+
+// ListenAndServe は addr で Listen して通信の待受状態に入る。
+// Shutdown によって停止された場合は nil を返す。
+func (t *TLSPassthrough) ListenAndServe(addr string) error {
+	ln, err := t.conns.listen(addr)
+	if err == nil {
+		if t.ProxyProtocol {
+			ln = &proxyListener{Listener: ln}
+		}
+		err = t.Serve(ln)
+		if t.conns.isClosed() {
+			return nil
+		}
+	}
+	t.Logger.Println("proxy.ListenAndServe(TLSPassthrough):", err)
+	return err
+}
+
+// Serve は ln で接続を受け付け、それぞれの接続を SNI に従って中継する。
+func (t *TLSPassthrough) Serve(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go t.serve(c)
+	}
+}
+
+// Shutdown は新規接続の受付を停止し、中継中の接続が終了するまで待機する。
+// ShutdownTimeout を過ぎても終了しない接続は強制的に切断される。
+func (t *TLSPassthrough) Shutdown(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, t.ShutdownTimeout)
+	defer cancel()
+	return t.conns.shutdown(ctx)
+}
+
+// serve は c の ClientHello から SNI を読み取り、差し替えた接続先との中継を開始する。
+func (t *TLSPassthrough) serve(c net.Conn) {
+	defer c.Close()
+
+	hello, pc, err := peekClientHello(c, t.HandshakeTimeout)
+	if err != nil {
+		if t.accounts.VerboseFor(t.accountName) {
+			t.Logger.Println("TLSPassthrough:", c.RemoteAddr(), err)
+		}
+		return
+	}
+
+	upstream, host, err := t.connect(pc, hello.ServerName)
+	if err != nil {
+		if t.accounts.VerboseFor(t.accountName) {
+			t.Logger.Println("TLSPassthrough:", c.RemoteAddr(), err)
+		}
+		return
+	}
+	if t.LogHandshake {
+		t.logHandshake(c, hello, upstream.RemoteAddr().String())
+	}
+
+	relayActive(Connection{
+		Kind:    "tls",
+		Account: t.accountName,
+		Client:  c.RemoteAddr().String(),
+		Host:    host,
+		Target:  upstream.RemoteAddr().String(),
+	}, pc, upstream)
+}
+
+// connect は serverName とクライアントが接続してきたポート番号をルーティング情報に従って差し替えた上で接続する。
+// 戻り値の文字列は差し替える前の接続先。
+func (t *TLSPassthrough) connect(c net.Conn, serverName string) (net.Conn, string, error) {
+	_, port, err := net.SplitHostPort(c.LocalAddr().String())
+	if err != nil {
+		return nil, "", err
+	}
+	host := net.JoinHostPort(serverName, port)
+
+	account := t.accounts.Get(t.accountName)
+	if account == nil {
+		return nil, host, fmt.Errorf("account not found: %q", t.accountName)
+	}
+	route, newHost := account.Match(host)
+	if route == nil {
+		t.accounts.RecordNoMatch(account.Name, "tls", host)
+		return nil, host, fmt.Errorf("no route for server name: %s", serverName)
+	}
+	if t.accounts.VerboseFor(t.accountName) {
+		t.Logger.Println("kind: tls", "user:", account.Name, "host:", host, "newHost:", newHost)
+	}
+
+	newHost, err = checkPolicy(t.Policy, account.Name, c.RemoteAddr().String(), host, newHost)
+	if err != nil {
+		return nil, host, err
+	}
+	t.Audit.record("tls", account.Name, c.RemoteAddr().String(), host, newHost)
+
+	release, ok := acquireTarget(route, newHost)
+	if !ok {
+		return nil, host, fmt.Errorf("too many connections to target: %s", newHost)
+	}
+	upstream, err := dial(context.Background(), t.PreDial, t.DialTimeout, "tls", account.Name, host, newHost)
+	if err != nil {
+		release()
+		return nil, host, err
+	}
+	return &releaseConn{Conn: upstream, release: release}, host, nil
+}
+
+// logHandshake は LogHandshake が true の場合に、中継を開始した接続 c の ClientHello の内容と接続先 target を出力する。
+func (t *TLSPassthrough) logHandshake(c net.Conn, hello clientHello, target string) {
+	t.Logger.Println(
+		"kind=tls",
+		"account="+strconv.Quote(t.accountName),
+		"client="+c.RemoteAddr().String(),
+		"sni="+strconv.Quote(hello.ServerName),
+		"alpn="+strconv.Quote(strings.Join(hello.ALPN, ",")),
+		"version="+strconv.Quote(tlsVersionName(hello.Version)),
+		"target="+target,
+	)
+}
+
+// clientHello は ClientHello から暗号化を解かずに得られる情報。
+// Version はクライアントが対応している最も新しい TLS のバージョンで、実際に使用されるバージョンは接続先との間で決まる。
+type clientHello struct {
+	ServerName string
+	ALPN       []string
+	Version    uint16
+}
+
+// errServerNameFound は peekClientHello で ClientHello を読み取った時点で TLS のハンドシェイクを打ち切るためのエラー。
+var errServerNameFound = errors.New("server name found")
+
+// peekClientHello は c から ClientHello を読み取って SNI などの情報を返す。
+// 読み取ったデータは失われないよう、戻り値の net.Conn から改めて読み出せるようにする。
+// timeout が正の値の場合は ClientHello の受信をその時間だけ待つ。
+func peekClientHello(c net.Conn, timeout time.Duration) (clientHello, net.Conn, error) {
+	if timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+		defer c.SetReadDeadline(time.Time{})
+	}
+
+	rc := &recordConn{Conn: c}
+	var hello clientHello
+	err := tls.Server(rc, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello.ServerName = info.ServerName
+			hello.ALPN = info.SupportedProtos
+			for _, v := range info.SupportedVersions {
+				// GREASE (RFC 8701) の値は除外する。
+				if v&0x0f0f != 0x0a0a && v > hello.Version {
+					hello.Version = v
+				}
+			}
+			return nil, errServerNameFound
+		},
+	}).Handshake()
+	if !errors.Is(err, errServerNameFound) {
+		return hello, nil, fmt.Errorf("failed to read ClientHello: %v", err)
+	}
+	if hello.ServerName == "" {
+		return hello, nil, errors.New("no server name in ClientHello")
+	}
+	return hello, &peekedConn{Conn: c, r: io.MultiReader(&rc.buf, c)}, nil
+}
+
+// tlsVersionName は TLS のバージョン v の名前を返す。
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	case 0:
+		return ""
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// recordConn は読み込んだデータを buf に記録し、書き込みは全て破棄する net.Conn。
+// ClientHello の解析時に、クライアントへ何も送信せずに読み込んだデータを保存するために使用する。
+type recordConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+// Read は net.Conn の実装。
+func (c *recordConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.buf.Write(p[:n])
+	return n, err
+}
+
+// Write は net.Conn の実装。
+func (c *recordConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// peekedConn は先に読み込んでおいたデータを r から返す net.Conn。
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+// Read は net.Conn の実装。
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTLSPassthrough は p を 127.0.0.1 の空いているポートで起動し、そのアドレスを返す。
+func serveTLSPassthrough(t *testing.T, p *TLSPassthrough) string {
+	t.Helper()
+	ln := listenLocal(t)
+	go p.Serve(ln)
+	return ln.Addr().String()
+}
+
+// newTLSBackend は name を応答する HTTPS サーバーを起動する。
+func newTLSBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestTLSPassthrough(t *testing.T) {
+	web, api := newTLSBackend(t, "web"), newTLSBackend(t, "api")
+	a := newTestAccounts(t,
+		`tls/`+web.Listener.Addr().String()+`/0.www=^www\.example\.com$`,
+		`tls/`+api.Listener.Addr().String()+`/0.api=^api\.example\.com$`,
+	)
+	p := NewTLSPassthrough(a, "tls")
+	p.Logger.SetOutput(io.Discard)
+	addr := serveTLSPassthrough(t, p)
+
+	// httptest のサーバー証明書は *.example.com に対して有効なため、接続先のサーバー証明書をそのまま検証できる。
+	roots := x509.NewCertPool()
+	roots.AddCert(web.Certificate())
+
+	tests := []struct {
+		serverName string
+		// want は応答した接続先の名前で、空の場合は中継されずにハンドシェイクが失敗する。
+		want string
+	}{
+		{serverName: "www.example.com", want: "web"},
+		{serverName: "api.example.com", want: "api"},
+		{serverName: "other.example.com"},
+		{serverName: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			config := &tls.Config{ServerName: tt.serverName, RootCAs: roots}
+			if tt.serverName == "" {
+				// SNI を送信しないため、サーバー証明書は検証しない。
+				config.InsecureSkipVerify = true
+			}
+			c, err := tls.Dial("tcp", addr, config)
+			if tt.want == "" {
+				if err == nil {
+					c.Close()
+					t.Fatal("handshake succeeded, want failure")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if _, err := io.WriteString(c, "GET / HTTP/1.1\r\nHost: "+tt.serverName+"\r\nConnection: close\r\n\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			res, err := http.ReadResponse(bufio.NewReader(c), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if string(body) != tt.want {
+				t.Errorf("backend = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSPassthroughLogHandshake(t *testing.T) {
+	web := newTLSBackend(t, "web")
+	target := web.Listener.Addr().String()
+	roots := x509.NewCertPool()
+	roots.AddCert(web.Certificate())
+
+	tests := []struct {
+		name       string
+		log        bool
+		alpn       []string
+		maxVersion uint16
+		// want はログに含まれるべき項目で、空の場合はログを出力しない。
+		want []string
+	}{
+		{
+			name: "sni and alpn",
+			log:  true,
+			alpn: []string{"h2", "http/1.1"},
+			want: []string{`kind=tls`, `account="tls"`, `sni="www.example.com"`, `alpn="h2,http/1.1"`, `version="TLS 1.3"`, `target=` + target},
+		},
+		{
+			name:       "tls 1.2 without alpn",
+			log:        true,
+			maxVersion: tls.VersionTLS12,
+			want:       []string{`sni="www.example.com"`, `alpn=""`, `version="TLS 1.2"`, `target=` + target},
+		},
+		{name: "disabled", alpn: []string{"http/1.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := make(lineWriter, 4)
+			p := NewTLSPassthrough(newTestAccounts(t, `tls/`+target+`/0.www=^www\.example\.com$`), "tls")
+			p.Logger = log.New(lines, "", 0)
+			p.LogHandshake = tt.log
+			addr := serveTLSPassthrough(t, p)
+
+			c, err := tls.Dial("tcp", addr, &tls.Config{
+				ServerName: "www.example.com",
+				RootCAs:    roots,
+				NextProtos: tt.alpn,
+				MaxVersion: tt.maxVersion,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			// ログは中継を開始する前に出力されるため、ハンドシェイクが完了した時点で書き込まれている。
+			if tt.want == nil {
+				if len(lines) > 0 {
+					t.Errorf("unexpected log: %s", <-lines)
+				}
+				return
+			}
+			select {
+			case line := <-lines:
+				if !strings.Contains(line, "client="+c.LocalAddr().String()) {
+					t.Errorf("log %q does not contain the client address %s", line, c.LocalAddr())
+				}
+				for _, field := range tt.want {
+					if !strings.Contains(line, field) {
+						t.Errorf("log %q does not contain %s", line, field)
+					}
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no log")
+			}
+		})
+	}
+}
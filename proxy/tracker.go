@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// tracker は Listen 中のリスナーと Accept した接続を追跡する。
+// http.Server はハイジャックされた接続(CONNECT トンネルなど)の終了を待たないため、
+// 終了時にはこちらで残っている接続の完了を待機する。
+type tracker struct {
+	m         sync.Mutex
+	closed    bool
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+}
+
+// newTracker は tracker を新規作成する。
+func newTracker() *tracker {
+	return &tracker{
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// listen は addr で TCP の待受を開始し、追跡対象のリスナーとして返す。
+func (t *tracker) listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.track(ln), nil
+}
+
+// track は ln を追跡対象のリスナーとしてラップする。
+// 既に shutdown が呼ばれている場合は ln を即座に閉じる。
+func (t *tracker) track(ln net.Listener) net.Listener {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.closed {
+		ln.Close()
+	} else {
+		t.listeners = append(t.listeners, ln)
+	}
+	return &trackListener{Listener: ln, t: t}
+}
+
+// isClosed は shutdown が既に呼ばれているかを返す。
+func (t *tracker) isClosed() bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.closed
+}
+
+// shutdown は全てのリスナーを閉じ、追跡中の接続が全て閉じられるのを ctx が終了するまで待つ。
+// ctx が先に終了した場合は残っている接続を強制的に閉じて ctx.Err() を返す。
+func (t *tracker) shutdown(ctx context.Context) error {
+	t.m.Lock()
+	t.closed = true
+	for _, ln := range t.listeners {
+		ln.Close()
+	}
+	t.listeners = nil
+	t.m.Unlock()
+
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		t.m.Lock()
+		n := len(t.conns)
+		t.m.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			t.m.Lock()
+			conns := make([]net.Conn, 0, len(t.conns))
+			for c := range t.conns {
+				conns = append(conns, c)
+			}
+			t.m.Unlock()
+			for _, c := range conns {
+				c.Close()
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+func (t *tracker) add(c net.Conn) {
+	t.m.Lock()
+	t.conns[c] = struct{}{}
+	t.m.Unlock()
+}
+
+func (t *tracker) remove(c net.Conn) {
+	t.m.Lock()
+	delete(t.conns, c)
+	t.m.Unlock()
+}
+
+// trackListener は Accept した接続を tracker に登録する net.Listener。
+type trackListener struct {
+	net.Listener
+	t *tracker
+}
+
+// Accept は net.Listener の実装。
+func (l *trackListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &trackConn{Conn: c, t: l.t}
+	l.t.add(tc)
+	return tc, nil
+}
+
+// trackConn は Close された時に tracker から登録を解除する net.Conn。
+type trackConn struct {
+	net.Conn
+	t    *tracker
+	once sync.Once
+}
+
+// Close は net.Conn の実装。
+func (c *trackConn) Close() error {
+	c.once.Do(func() { c.t.remove(c) })
+	return c.Conn.Close()
+}
+
+// withTimeout は timeout が正の値の場合に ctx へ期限を設定する。
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
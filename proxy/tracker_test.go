@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shutdowner は Shutdown による終了処理に対応したサーバー。
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	echo := listenEcho(t)
+	_, p, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(p)
+
+	// RevHTTP の転送先は unblock が閉じられるまで応答しない。
+	unblock, entered := make(chan struct{}), make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-unblock
+	}))
+	defer backend.Close()
+	defer close(unblock)
+
+	a := newTestAccounts(t,
+		`master/`+echo+`/0.echo=^echo\.test$`,
+		`master/`+backend.Listener.Addr().String()+`/0.slow=^slow\.test$`,
+	)
+
+	// start はサーバーを起動して処理中の接続を一つ作り、そのサーバーを返す。
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		start   func(t *testing.T) shutdowner
+	}{
+		{
+			name:    "http",
+			timeout: 200 * time.Millisecond,
+			start: func(t *testing.T) shutdowner {
+				s := NewHTTP(a)
+				s.AccountName = "master"
+				s.ShutdownTimeout = 200 * time.Millisecond
+				ln := listenLocal(t)
+				go s.server.Serve(s.conns.track(ln))
+
+				// CONNECT のトンネルは http.Server の Shutdown では待たれないため、tracker が待つ。
+				_, res := sendProxy(t, ln.Addr().String(), "CONNECT echo.test:443 HTTP/1.1\r\nHost: echo.test:443\r\n\r\n")
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("CONNECT: status = %d", res.StatusCode)
+				}
+				return s
+			},
+		},
+		{
+			name:    "reverse",
+			timeout: 500 * time.Millisecond,
+			start: func(t *testing.T) shutdowner {
+				r := NewRevHTTP(a, "master")
+				r.ShutdownTimeout = 500 * time.Millisecond
+				ln := listenLocal(t)
+				go r.server.Serve(r.conns.track(ln))
+
+				go func() {
+					req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+					req.Host = "slow.test"
+					if res, err := http.DefaultClient.Do(req); err == nil {
+						res.Body.Close()
+					}
+				}()
+				<-entered
+				return r
+			},
+		},
+		{
+			name:    "socks",
+			timeout: 800 * time.Millisecond,
+			start: func(t *testing.T) shutdowner {
+				s := NewSOCKS(a)
+				s.AccountName = "master"
+				s.ShutdownTimeout = 800 * time.Millisecond
+				ln := listenLocal(t)
+				go s.Serve(s.conns.track(ln))
+
+				c, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { c.Close() })
+				if rep := socksConnect(t, c, "", "", "echo.test", port, socksCmdConnect); rep != socksReplySucceeded {
+					t.Fatalf("CONNECT: REP = %#x", rep)
+				}
+				return s
+			},
+		},
+	}
+
+	servers := make([]shutdowner, len(tests))
+	for i, tt := range tests {
+		servers[i] = tt.start(t)
+	}
+
+	// 全てのサーバーを同時に停止し、それぞれが自身の ShutdownTimeout だけ待ってから接続を切断することを確認する。
+	elapsed, errs := make([]time.Duration, len(tests)), make([]error, len(tests))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range tests {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = servers[i].Shutdown(context.Background())
+			elapsed[i] = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errs[i] != context.DeadlineExceeded {
+				t.Errorf("Shutdown = %v, want %v", errs[i], context.DeadlineExceeded)
+			}
+			if elapsed[i] < tt.timeout || elapsed[i] > tt.timeout+250*time.Millisecond {
+				t.Errorf("Shutdown took %v, want %v", elapsed[i], tt.timeout)
+			}
+		})
+	}
+}
+
+func TestShutdownDrained(t *testing.T) {
+	echo := listenEcho(t)
+	s := NewHTTP(newTestAccounts(t, `master/`+echo+`/0.echo=^echo\.test$`))
+	s.AccountName = "master"
+	s.ShutdownTimeout = 5 * time.Second
+	ln := listenLocal(t)
+	go s.server.Serve(s.conns.track(ln))
+
+	c, res := sendProxy(t, ln.Addr().String(), "CONNECT echo.test:443 HTTP/1.1\r\nHost: echo.test:443\r\n\r\n")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: status = %d", res.StatusCode)
+	}
+
+	// 接続が閉じられた時点で、ShutdownTimeout を待たずに終了する。
+	time.AfterFunc(200*time.Millisecond, func() { c.Close() })
+	start := time.Now()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Shutdown took %v after the tunnel closed", d)
+	}
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// isUpgrade は h が WebSocket などへのプロトコルの切り替えを要求するヘッダーであれば true を返す。
+func isUpgrade(h http.Header) bool {
+	if h.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range h["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyUpgrade は CONNECT を使わずに送られてきたプロトコル切り替えのリクエスト(ws:// など)を処理する。
+// 接続先へリクエストを転送した後はクライアントとの接続をハイジャックし、101 Switching Protocols 以降の通信を双方向に中継する。
+func (s *HTTP) proxyUpgrade(rw http.ResponseWriter, req *http.Request) {
+	host := req.URL.Host
+	user, route, res := s.rewriteRequest(req, "upgrade")
+	if res != nil {
+		writeResponse(rw, res)
+		return
+	}
+
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "Upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "80"
+		if req.URL.Scheme == "https" || req.URL.Scheme == "wss" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	release, ok := acquireTarget(route, addr)
+	if !ok {
+		s.Logger.Println("proxyUpgrade: too many connections to target", "user:", user, "host:", host, "target:", addr)
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	upstream, err := dial(req.Context(), s.PreDial, s.DialTimeout, "upgrade", user, host, addr)
+	if err != nil {
+		release()
+		s.Logger.Println("proxyUpgrade:", err, "user:", user, "host:", host)
+		http.Error(rw, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	upstream = &releaseConn{Conn: upstream, release: release}
+
+	req.Header.Del("Proxy-Connection")
+	if err = req.Write(upstream); err != nil {
+		s.Logger.Println("proxyUpgrade:", err, "user:", user, "host:", host)
+		upstream.Close()
+		http.Error(rw, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	client, buf, err := hj.Hijack()
+	if err != nil {
+		s.Logger.Println("proxyUpgrade:", err, "user:", user, "host:", host)
+		upstream.Close()
+		return
+	}
+	defer client.Close()
+
+	// ハイジャック前に読み込まれていたクライアントからのデータを先に転送する。
+	if n := buf.Reader.Buffered(); n > 0 {
+		b, _ := buf.Reader.Peek(n)
+		if _, err = upstream.Write(b); err != nil {
+			upstream.Close()
+			return
+		}
+	}
+
+	in, out := relayActive(Connection{
+		Kind:    "upgrade",
+		Account: user,
+		Client:  client.RemoteAddr().String(),
+		Host:    host,
+		Target:  upstream.RemoteAddr().String(),
+	}, client, upstream)
+	// 接続先からのレスポンスはそのまま中継しているため、ステータスコードは記録しない。
+	accessLogFrom(req.Context()).relayed(0, in, out)
+}
+
+// writeResponse は res の内容を rw に書き込む。
+func writeResponse(rw http.ResponseWriter, res *http.Response) {
+	for k, vs := range res.Header {
+		for _, v := range vs {
+			rw.Header().Add(k, v)
+		}
+	}
+	rw.WriteHeader(res.StatusCode)
+	if res.Body != nil {
+		io.Copy(rw, res.Body)
+		res.Body.Close()
+	}
+}
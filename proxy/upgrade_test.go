@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsUpgrade(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{name: "websocket", header: http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}}, want: true},
+		{name: "token list", header: http.Header{"Upgrade": {"websocket"}, "Connection": {"keep-alive, upgrade"}}, want: true},
+		{name: "no upgrade", header: http.Header{"Connection": {"Upgrade"}}},
+		{name: "no connection", header: http.Header{"Upgrade": {"websocket"}}},
+		{name: "keep-alive", header: http.Header{"Upgrade": {"websocket"}, "Connection": {"keep-alive"}}},
+	}
+	for _, tt := range tests {
+		if got := isUpgrade(tt.header); got != tt.want {
+			t.Errorf("%s: isUpgrade = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	// WebSocket のハンドシェイクに 101 を返し、それ以降に受け取ったデータをそのまま送り返す。
+	hosts := make(chan string, 4)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgrade(r.Header) {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		hosts <- r.Host
+		c, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(c, buf)
+	}))
+	defer backend.Close()
+
+	s := NewHTTP(newTestAccounts(t, `master/`+backend.Listener.Addr().String()+`/0.ws=^ws\.test$`))
+	s.AccountName = "master"
+	addr := serveHTTP(t, s)
+
+	tests := []struct {
+		name string
+		// early はハンドシェイクのリクエストと同じ書き込みで送るデータ。
+		early string
+		data  []string
+	}{
+		{name: "after handshake", data: []string{"hello", "world"}},
+		{name: "pipelined", early: "early", data: []string{"late"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+
+			io.WriteString(c, "GET http://ws.test/chat HTTP/1.1\r\n"+
+				"Host: ws.test\r\n"+
+				"Connection: Upgrade\r\n"+
+				"Upgrade: websocket\r\n"+
+				"Sec-WebSocket-Version: 13\r\n"+
+				"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"+tt.early)
+			r := bufio.NewReader(c)
+			res, err := http.ReadResponse(r, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status = %d, want 101", res.StatusCode)
+			}
+			if host := <-hosts; host != "ws.test" {
+				t.Errorf("Host = %q, want %q", host, "ws.test")
+			}
+
+			want := tt.early
+			for _, d := range tt.data {
+				if _, err := io.WriteString(c, d); err != nil {
+					t.Fatal(err)
+				}
+				want += d
+			}
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(r, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("echo = %q, want %q", got, want)
+			}
+		})
+	}
+}